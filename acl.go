@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// User is an ACL user with its credentials and permissions.
+type User struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords map[string]bool // SHA-256 hex digests
+
+	// commands is the set of permitted commands, derived from commandRules.
+	commands     map[string]bool
+	commandRules []string
+
+	allKeys     bool
+	keyPatterns []string
+}
+
+// Users holds every ACL user by name.
+var Users = map[string]*User{"default": newDefaultUser()}
+var UsersMu = sync.RWMutex{}
+
+// newUser creates a user with no access, as ACL SETUSER does for new names.
+func newUser(name string) *User {
+	return &User{
+		name:      name,
+		passwords: map[string]bool{},
+		commands:  map[string]bool{},
+	}
+}
+
+// newDefaultUser creates the unrestricted "default" user.
+func newDefaultUser() *User {
+	u := newUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allcommands"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+// configureRequirePass sets or clears the password of the default user.
+func configureRequirePass(password string) {
+	UsersMu.Lock()
+	defer UsersMu.Unlock()
+
+	u := Users["default"]
+	u.applyRule("resetpass")
+	if password == "" {
+		u.applyRule("nopass")
+	} else {
+		u.applyRule(">" + password)
+	}
+}
+
+// hashPassword returns the digest under which a password is stored.
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// applyRule applies a single ACL SETUSER rule to the user, returning an error message if it is invalid.
+func (u *User) applyRule(rule string) string {
+	lower := strings.ToLower(rule)
+
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = map[string]bool{}
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = map[string]bool{}
+	case strings.HasPrefix(rule, ">"):
+		u.nopass = false
+		u.passwords[hashPassword(rule[1:])] = true
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case lower == "allkeys" || rule == "~*":
+		u.allKeys = true
+		u.keyPatterns = nil
+	case lower == "resetkeys":
+		u.allKeys = false
+		u.keyPatterns = nil
+	case strings.HasPrefix(rule, "~"):
+		if !u.allKeys {
+			u.keyPatterns = append(u.keyPatterns, rule[1:])
+		}
+	case lower == "allcommands":
+		return u.applyRule("+@all")
+	case lower == "nocommands":
+		return u.applyRule("-@all")
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		return u.applyCommandRule(lower)
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "nocommands", "off"} {
+			u.applyRule(r)
+		}
+	default:
+		return "Syntax error"
+	}
+
+	return ""
+}
+
+// applyCommandRule applies a "+cmd", "-cmd", "+@category" or "-@category" rule.
+func (u *User) applyCommandRule(rule string) string {
+	allow := rule[0] == '+'
+	name := rule[1:]
+
+	var commands []string
+	if strings.HasPrefix(name, "@") {
+		category := name[1:]
+		found := category == "all"
+		for command, cmd := range Commands {
+			for _, c := range cmd.categories {
+				if category == "all" || c == category {
+					commands = append(commands, command)
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return "Unknown command or category name in ACL"
+		}
+	} else {
+		command := strings.ToUpper(name)
+		if _, ok := Commands[command]; !ok {
+			return "Unknown command or category name in ACL"
+		}
+		commands = append(commands, command)
+	}
+
+	for _, command := range commands {
+		if allow {
+			u.commands[command] = true
+		} else {
+			delete(u.commands, command)
+		}
+	}
+
+	// Rules that cover everything make the earlier ones irrelevant.
+	if name == "@all" {
+		u.commandRules = nil
+	}
+	u.commandRules = append(u.commandRules, rule)
+
+	return ""
+}
+
+// checkPassword reports whether the user may log in with the given password.
+func (u *User) checkPassword(password string) bool {
+	return u.enabled && (u.nopass || u.passwords[hashPassword(password)])
+}
+
+// flags returns the user's ACL flags as reported by ACL GETUSER.
+func (u *User) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	if u.allKeys {
+		flags = append(flags, "allkeys")
+	}
+	return flags
+}
+
+// keysDescription returns the user's key patterns in rule form.
+func (u *User) keysDescription() string {
+	if u.allKeys {
+		return "~*"
+	}
+	patterns := make([]string, 0, len(u.keyPatterns))
+	for _, pattern := range u.keyPatterns {
+		patterns = append(patterns, "~"+pattern)
+	}
+	return strings.Join(patterns, " ")
+}
+
+// commandsDescription returns the user's command rules.
+func (u *User) commandsDescription() string {
+	if len(u.commandRules) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.commandRules, " ")
+}
+
+// describe returns the user in the format used by ACL LIST.
+func (u *User) describe() string {
+	parts := []string{"user", u.name, u.flags()[0]}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	hashes := make([]string, 0, len(u.passwords))
+	for hash := range u.passwords {
+		hashes = append(hashes, "#"+hash)
+	}
+	sort.Strings(hashes)
+	parts = append(parts, hashes...)
+	if keys := u.keysDescription(); keys != "" {
+		parts = append(parts, keys)
+	}
+	parts = append(parts, u.commandsDescription())
+
+	return strings.Join(parts, " ")
+}
+
+// aclCheck verifies that the client's user may run the command on its keys.
+// It returns nil when the command is permitted.
+func aclCheck(c *Client, command string, cmd Command, args []Value) *Value {
+	if cmd.hasFlag("no_auth") {
+		return nil
+	}
+
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	u := c.user
+	if !u.commands[command] {
+		return &Value{typ: "error", str: "NOPERM User " + u.name + " has no permissions to run the '" + strings.ToLower(command) + "' command"}
+	}
+
+	if u.allKeys {
+		return nil
+	}
+
+	for _, key := range cmd.keys(args) {
+		allowed := false
+		for _, pattern := range u.keyPatterns {
+			if matchGlob(pattern, key) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &Value{typ: "error", str: "NOPERM No permissions to access a key"}
+		}
+	}
+
+	return nil
+}
+
+// handleACL handles the "ACL" command and its subcommands.
+func handleACL(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'acl' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "SETUSER":
+		return handleACLSetUser(args[1:])
+	case "GETUSER":
+		return handleACLGetUser(args[1:])
+	case "DELUSER":
+		return handleACLDelUser(args[1:])
+	case "LIST":
+		return handleACLList()
+	case "WHOAMI":
+		return Value{typ: "bulk", bulk: c.user.name}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+}
+
+// handleACLSetUser handles "ACL SETUSER username [rule ...]".
+func handleACLSetUser(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'acl|setuser' command"}
+	}
+
+	UsersMu.Lock()
+	defer UsersMu.Unlock()
+
+	name := args[0].bulk
+	u, ok := Users[name]
+	if !ok {
+		u = newUser(name)
+	}
+
+	// Validate the rules against a copy so a bad rule leaves the user untouched.
+	updated := *u
+	updated.passwords = map[string]bool{}
+	for hash := range u.passwords {
+		updated.passwords[hash] = true
+	}
+	updated.commands = map[string]bool{}
+	for command := range u.commands {
+		updated.commands[command] = true
+	}
+	updated.commandRules = append([]string{}, u.commandRules...)
+	updated.keyPatterns = append([]string{}, u.keyPatterns...)
+
+	for _, arg := range args[1:] {
+		if msg := updated.applyRule(arg.bulk); msg != "" {
+			return Value{typ: "error", str: "ERR Error in ACL SETUSER modifier '" + arg.bulk + "': " + msg}
+		}
+	}
+
+	// Update in place so connected clients see the new permissions immediately.
+	*u = updated
+	Users[name] = u
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleACLGetUser handles "ACL GETUSER username".
+func handleACLGetUser(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'acl|getuser' command"}
+	}
+
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	u, ok := Users[args[0].bulk]
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	flags := []Value{}
+	for _, flag := range u.flags() {
+		flags = append(flags, Value{typ: "bulk", bulk: flag})
+	}
+	passwords := []Value{}
+	for hash := range u.passwords {
+		passwords = append(passwords, Value{typ: "bulk", bulk: hash})
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "flags"}, {typ: "array", array: flags},
+		{typ: "bulk", bulk: "passwords"}, {typ: "array", array: passwords},
+		{typ: "bulk", bulk: "commands"}, {typ: "bulk", bulk: u.commandsDescription()},
+		{typ: "bulk", bulk: "keys"}, {typ: "bulk", bulk: u.keysDescription()},
+	}}
+}
+
+// handleACLDelUser handles "ACL DELUSER username [username ...]".
+func handleACLDelUser(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'acl|deluser' command"}
+	}
+
+	UsersMu.Lock()
+	defer UsersMu.Unlock()
+
+	deleted := 0
+	for _, arg := range args {
+		if arg.bulk == "default" {
+			return Value{typ: "error", str: "ERR The 'default' user cannot be removed"}
+		}
+		if u, ok := Users[arg.bulk]; ok {
+			// Clients still logged in as this user lose all access.
+			u.applyRule("reset")
+			delete(Users, arg.bulk)
+			deleted++
+		}
+	}
+
+	return Value{typ: "integer", num: deleted}
+}
+
+// handleACLList handles "ACL LIST".
+func handleACLList() Value {
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	names := make([]string, 0, len(Users))
+	for name := range Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := []Value{}
+	for _, name := range names {
+		values = append(values, Value{typ: "bulk", bulk: Users[name].describe()})
+	}
+
+	return Value{typ: "array", array: values}
+}
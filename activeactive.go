@@ -0,0 +1,904 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Active-active settings, experimental. With ActiveActive set to "yes",
+// set at startup only, the server is one of several primaries accepting
+// writes to the same keys, which converge once every write reached every
+// primary. ActiveActiveNodeID names the server among them, and must be
+// unique and stable across restarts: it is host:port when empty.
+// ActiveActivePeers lists the "host:port" of every other primary, each of
+// which the server streams its writes to; a primary must list all the
+// others, as writes aren't forwarded.
+//
+// Keys converge as conflict-free replicated data types rather than by
+// replaying commands: each primary records its writes as changes to the
+// state of the key, stamped with a hybrid logical clock and its node ID,
+// and sends them with CRDT MERGE, which merges them the same way in any
+// order. Strings and hash fields are last-writer-wins registers, INCR adds
+// to a counter with one positive and one negative count per primary, and
+// removing a key, by UNLINK, a flush or expiry, hides what was written to
+// it before. There are no sets to be observed-remove sets. SWAPDB and MOVE,
+// which have no such state, are refused.
+var (
+	ActiveActive       = "no"
+	ActiveActiveNodeID = ""
+	ActiveActivePeers  = ""
+)
+
+// activeActiveMaxPending is how many bytes of writes may wait for a peer
+// before its link is dropped, to resend the whole dataset once it is back.
+const activeActiveMaxPending = 64 * 1024 * 1024
+
+// activeActivePingInterval is how often the link to a peer is pinged, so
+// that both sides notice when it fails.
+const activeActivePingInterval = time.Second
+
+// activeActiveRefused are the write commands refused in active-active mode.
+var activeActiveRefused = map[string]bool{"SWAPDB": true, "MOVE": true}
+
+// crdtStamp orders the writes to a key: by hybrid logical clock time, in
+// Unix milliseconds, then by the node ID of the primary that made them.
+type crdtStamp struct {
+	time int64
+	node string
+}
+
+// less reports whether s comes before o.
+func (s crdtStamp) less(o crdtStamp) bool {
+	return s.time < o.time || (s.time == o.time && s.node < o.node)
+}
+
+// crdtRegister is the last value written to a string or a hash field,
+// deleted when the string was last deleted instead.
+type crdtRegister struct {
+	value   string
+	deleted bool
+	stamp   crdtStamp
+}
+
+// crdtCounter is what one primary added to a key by INCR since base, the
+// stamp of the string value incremented: p increments and n decrements.
+type crdtCounter struct {
+	base crdtStamp
+	p, n int64
+}
+
+// crdtExpire is the last expiry time set on a key, 0 when it was
+// persisted.
+type crdtExpire struct {
+	when  int64
+	stamp crdtStamp
+}
+
+// crdtKey is the active-active state of a key. Everything stamped before
+// removed, when the key was last removed, is hidden, and so is everything
+// stamped before its expiry time once that passed.
+type crdtKey struct {
+	removed  crdtStamp
+	str      *crdtRegister
+	counters map[string]crdtCounter
+	fields   map[string]crdtRegister
+	expire   *crdtExpire
+}
+
+// crdtView is the value of a key as its state makes it: a string, a hash or
+// both. expire is the key's expiry time, 0 for none.
+type crdtView struct {
+	value    string
+	hasValue bool
+	hash     map[string]string
+	expire   int64
+	// base is the stamp INCR counts from: the string's, or when the key was
+	// removed.
+	base crdtStamp
+}
+
+// activeActive holds the clock and the links to the peers, guarded by mu.
+var activeActive = struct {
+	mu sync.Mutex
+	// clock is the time of the last stamp made or seen, in Unix
+	// milliseconds.
+	clock int64
+	peers map[string]*activeActivePeer
+}{peers: map[string]*activeActivePeer{}}
+
+// activeActivePeer is the link to another primary.
+type activeActivePeer struct {
+	addr string
+	stop chan struct{}
+	// wake is signalled when writes were added to pending.
+	wake chan struct{}
+
+	// The fields below are guarded by activeActive.mu.
+	conn net.Conn
+	// status is "connecting" until the link is up, "sync" while the dataset
+	// is sent and "online" once writes are streamed.
+	status string
+	// pending holds the writes to send, encoded, from when the link is up.
+	pending []byte
+	// selected is the database pending last selected, -1 to select one
+	// before the next command.
+	selected int
+}
+
+// setActiveActivePeers sets the peers, which are linked within a second.
+func setActiveActivePeers(value string) error {
+	for _, addr := range strings.Fields(value) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid peer %q, expected host:port", addr)
+		}
+	}
+	ActiveActivePeers = value
+	return nil
+}
+
+// activeActiveWrites reports whether writes are recorded for the peers:
+// on a primary in active-active mode. A replica gets them from its primary.
+func activeActiveWrites() bool {
+	return ActiveActive == "yes" && atomic.LoadInt32(&replicating) == 0
+}
+
+// activeActiveCheck refuses the write commands active-active mode can't
+// merge.
+func activeActiveCheck(command string) *Value {
+	if ActiveActive != "yes" || !activeActiveRefused[command] {
+		return nil
+	}
+	return &Value{typ: "error", str: "ERR " + command + " is not supported in active-active mode"}
+}
+
+// activeActiveStamp returns a stamp for a write of this primary, after
+// every stamp it made or saw.
+func activeActiveStamp() crdtStamp {
+	activeActive.mu.Lock()
+	defer activeActive.mu.Unlock()
+
+	activeActive.clock = max(nowMillis(), activeActive.clock+1)
+	return crdtStamp{activeActive.clock, ActiveActiveNodeID}
+}
+
+// observeStamps moves the clock past the stamps of a peer's write, so that
+// later writes of this primary come after it.
+func observeStamps(k *crdtKey) {
+	latest := k.removed.time
+	if k.str != nil {
+		latest = max(latest, k.str.stamp.time)
+	}
+	for _, r := range k.fields {
+		latest = max(latest, r.stamp.time)
+	}
+	if k.expire != nil {
+		latest = max(latest, k.expire.stamp.time)
+	}
+
+	activeActive.mu.Lock()
+	activeActive.clock = max(activeActive.clock, latest)
+	activeActive.mu.Unlock()
+}
+
+// merge merges the state other into k, reporting whether k changed.
+func (k *crdtKey) merge(other *crdtKey) bool {
+	changed := false
+	if k.removed.less(other.removed) {
+		k.removed = other.removed
+		changed = true
+	}
+	if other.str != nil && (k.str == nil || k.str.stamp.less(other.str.stamp)) {
+		r := *other.str
+		k.str = &r
+		changed = true
+	}
+	for node, c := range other.counters {
+		old, ok := k.counters[node]
+		switch {
+		case !ok || old.base.less(c.base):
+		case old.base == c.base && (c.p > old.p || c.n > old.n):
+			c.p, c.n = max(c.p, old.p), max(c.n, old.n)
+		default:
+			continue
+		}
+		if k.counters == nil {
+			k.counters = map[string]crdtCounter{}
+		}
+		k.counters[node] = c
+		changed = true
+	}
+	for field, r := range other.fields {
+		if old, ok := k.fields[field]; ok && !old.stamp.less(r.stamp) {
+			continue
+		}
+		if k.fields == nil {
+			k.fields = map[string]crdtRegister{}
+		}
+		k.fields[field] = r
+		changed = true
+	}
+	if other.expire != nil && (k.expire == nil || k.expire.stamp.less(other.expire.stamp)) {
+		e := *other.expire
+		k.expire = &e
+		changed = true
+	}
+	return changed
+}
+
+// view returns the value of the key at time now.
+func (k *crdtKey) view(now int64) crdtView {
+	removed, expire := k.removed, k.expire
+	if expire != nil && expire.stamp.less(removed) {
+		expire = nil
+	}
+	// A key expiring is removed at its expiry time, or when the expiry
+	// time was set if that was later.
+	if expire != nil && expire.when != 0 && expire.when <= now {
+		if fired := (crdtStamp{max(expire.when, expire.stamp.time), ""}); removed.less(fired) {
+			removed = fired
+		}
+		expire = nil
+	}
+	visible := func(s crdtStamp) bool { return !s.less(removed) }
+
+	v := crdtView{base: removed}
+	if k.str != nil && visible(k.str.stamp) {
+		v.base = k.str.stamp
+		if !k.str.deleted {
+			v.value, v.hasValue = k.str.value, true
+		}
+	}
+	sum, counted := int64(0), false
+	for _, c := range k.counters {
+		if c.base == v.base {
+			sum += c.p - c.n
+			counted = true
+		}
+	}
+	if counted {
+		n, err := strconv.ParseInt(v.value, 10, 64)
+		if !v.hasValue || err == nil {
+			v.value, v.hasValue = strconv.FormatInt(n+sum, 10), true
+		}
+	}
+	for field, r := range k.fields {
+		if visible(r.stamp) {
+			if v.hash == nil {
+				v.hash = map[string]string{}
+			}
+			v.hash[field] = r.value
+		}
+	}
+	if expire != nil {
+		v.expire = expire.when
+	}
+	return v
+}
+
+// exists reports whether the key holds a value.
+func (v crdtView) exists() bool {
+	return v.hasValue || len(v.hash) > 0
+}
+
+// equal reports whether v and o hold the same value.
+func (v crdtView) equal(o crdtView) bool {
+	if v.exists() != o.exists() || v.hasValue != o.hasValue || v.value != o.value || len(v.hash) != len(o.hash) {
+		return false
+	}
+	for field, value := range v.hash {
+		if other, ok := o.hash[field]; !ok || other != value {
+			return false
+		}
+	}
+	return !v.exists() || v.expire == o.expire
+}
+
+// state returns the state writing v at stamp s.
+func (v crdtView) state(s crdtStamp) *crdtKey {
+	k := &crdtKey{}
+	if v.hasValue {
+		k.str = &crdtRegister{value: v.value, stamp: s}
+	}
+	for field, value := range v.hash {
+		if k.fields == nil {
+			k.fields = map[string]crdtRegister{}
+		}
+		k.fields[field] = crdtRegister{value: value, stamp: s}
+	}
+	if v.expire != 0 {
+		k.expire = &crdtExpire{v.expire, s}
+	}
+	return k
+}
+
+// storedView returns the value of the key in the store, as a view. db.mu
+// must be held.
+func (db *Database) storedView(key string, now int64) crdtView {
+	when, expiring := db.store.ExpireTime(key)
+	if expiring && when <= now {
+		return crdtView{}
+	}
+	v := crdtView{}
+	v.value, v.hasValue = db.store.Get(key)
+	if hash, ok := db.store.GetHash(key); ok && len(hash) > 0 {
+		v.hash = hash
+	}
+	if v.exists() && expiring {
+		v.expire = when
+	}
+	return v
+}
+
+// crdtState returns the state of the key, creating an empty one. db.mu must
+// be held for writing.
+func (db *Database) crdtState(key string) *crdtKey {
+	k, ok := db.crdt[key]
+	if !ok {
+		k = &crdtKey{}
+		db.crdt[key] = k
+	}
+	return k
+}
+
+// recordWrite records the changes a write made to the key, compared to its
+// state, as a state to merge, nil when there are none. A change to the
+// string made by INCR, with counter set, is counted by this primary's
+// counter instead of overwriting the string, so concurrent INCRs add up.
+// db.mu must be held for writing.
+func (db *Database) recordWrite(key string, counter bool, now int64) *crdtKey {
+	k := db.crdtState(key)
+	before, after := k.view(now), db.storedView(key, now)
+	if before.equal(after) {
+		return nil
+	}
+	s := activeActiveStamp()
+
+	// Hash fields are only ever removed with their key, so a key losing
+	// any was removed, and whatever remains was written after.
+	removed := before.exists() && !after.exists()
+	for field := range before.hash {
+		if _, ok := after.hash[field]; !ok {
+			removed = true
+		}
+	}
+	if removed {
+		delta := after.state(s)
+		delta.removed = s
+		k.merge(delta)
+		return delta
+	}
+
+	delta := &crdtKey{}
+	if before.hasValue != after.hasValue || before.value != after.value {
+		from, fromErr := strconv.ParseInt(before.value, 10, 64)
+		to, toErr := strconv.ParseInt(after.value, 10, 64)
+		if counter && after.hasValue && toErr == nil && (!before.hasValue || fromErr == nil) {
+			c, ok := k.counters[ActiveActiveNodeID]
+			if !ok || c.base != before.base {
+				c = crdtCounter{base: before.base}
+			}
+			if to > from {
+				c.p += to - from
+			} else {
+				c.n += from - to
+			}
+			delta.counters = map[string]crdtCounter{ActiveActiveNodeID: c}
+		} else {
+			delta.str = &crdtRegister{value: after.value, deleted: !after.hasValue, stamp: s}
+		}
+	}
+	for field, value := range after.hash {
+		if old, ok := before.hash[field]; !ok || old != value {
+			if delta.fields == nil {
+				delta.fields = map[string]crdtRegister{}
+			}
+			delta.fields[field] = crdtRegister{value: value, stamp: s}
+		}
+	}
+	// The state may hold an expiry time for a key that doesn't exist, which
+	// a key written anew must not inherit.
+	if after.exists() && (after.expire != before.expire || !before.exists()) {
+		delta.expire = &crdtExpire{after.expire, s}
+	}
+	k.merge(delta)
+	return delta
+}
+
+// materialize writes the value of the key to the store. db.mu must be held
+// for writing.
+func (db *Database) materialize(key string, v crdtView) {
+	db.store.Remove(key)
+	if !v.exists() {
+		db.forgetAccess(key)
+		return
+	}
+	if v.hasValue {
+		db.store.Set(key, v.value)
+	}
+	if len(v.hash) > 0 {
+		db.store.SetHash(key, v.hash)
+	}
+	if v.expire != 0 {
+		db.store.Expire(key, v.expire)
+	}
+}
+
+// command returns the CRDT MERGE command merging the state k into the key:
+//
+//	CRDT MERGE <key> [REMOVED <time> <node>] [STRING <time> <node> <value>]
+//	    [DELETED <time> <node>] [COUNTER <node> <base time> <base node> <p> <n>]...
+//	    [FIELD <field> <time> <node> <value>]... [EXPIRE <time> <node> <when>]
+func (k *crdtKey) command(key string) Value {
+	args := []string{"CRDT", "MERGE", key}
+	stamp := func(s crdtStamp) []string {
+		return []string{strconv.FormatInt(s.time, 10), s.node}
+	}
+	if k.removed != (crdtStamp{}) {
+		args = append(append(args, "REMOVED"), stamp(k.removed)...)
+	}
+	if k.str != nil && k.str.deleted {
+		args = append(append(args, "DELETED"), stamp(k.str.stamp)...)
+	} else if k.str != nil {
+		args = append(append(append(args, "STRING"), stamp(k.str.stamp)...), k.str.value)
+	}
+	for node, c := range k.counters {
+		args = append(append(append(args, "COUNTER", node), stamp(c.base)...),
+			strconv.FormatInt(c.p, 10), strconv.FormatInt(c.n, 10))
+	}
+	for field, r := range k.fields {
+		args = append(append(append(args, "FIELD", field), stamp(r.stamp)...), r.value)
+	}
+	if k.expire != nil {
+		args = append(append(append(args, "EXPIRE"), stamp(k.expire.stamp)...), strconv.FormatInt(k.expire.when, 10))
+	}
+
+	value := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+	}
+	return value
+}
+
+// parseCRDTState parses the state following the key of CRDT MERGE.
+func parseCRDTState(args []Value) (*crdtKey, bool) {
+	k := &crdtKey{}
+	stamp := func(i int) (crdtStamp, bool) {
+		t, err := strconv.ParseInt(args[i].bulk, 10, 64)
+		return crdtStamp{t, args[i+1].bulk}, err == nil
+	}
+	for i := 0; i < len(args); {
+		var ok bool
+		switch option, rest := strings.ToUpper(args[i].bulk), len(args)-i-1; {
+		case option == "REMOVED" && rest >= 2:
+			k.removed, ok = stamp(i + 1)
+			i += 3
+		case option == "STRING" && rest >= 3:
+			k.str = &crdtRegister{value: args[i+3].bulk}
+			k.str.stamp, ok = stamp(i + 1)
+			i += 4
+		case option == "DELETED" && rest >= 2:
+			k.str = &crdtRegister{deleted: true}
+			k.str.stamp, ok = stamp(i + 1)
+			i += 3
+		case option == "COUNTER" && rest >= 5:
+			var c crdtCounter
+			var pErr, nErr error
+			c.base, ok = stamp(i + 2)
+			c.p, pErr = strconv.ParseInt(args[i+4].bulk, 10, 64)
+			c.n, nErr = strconv.ParseInt(args[i+5].bulk, 10, 64)
+			ok = ok && pErr == nil && nErr == nil && c.p >= 0 && c.n >= 0
+			if k.counters == nil {
+				k.counters = map[string]crdtCounter{}
+			}
+			k.counters[args[i+1].bulk] = c
+			i += 6
+		case option == "FIELD" && rest >= 4:
+			r := crdtRegister{value: args[i+4].bulk}
+			r.stamp, ok = stamp(i + 2)
+			if k.fields == nil {
+				k.fields = map[string]crdtRegister{}
+			}
+			k.fields[args[i+1].bulk] = r
+			i += 5
+		case option == "EXPIRE" && rest >= 3:
+			k.expire = &crdtExpire{}
+			k.expire.stamp, ok = stamp(i + 1)
+			when, err := strconv.ParseInt(args[i+3].bulk, 10, 64)
+			k.expire.when, ok = when, ok && err == nil && when >= 0
+			i += 4
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return k, true
+}
+
+// handleCRDT handles "CRDT MERGE key state", with which a peer sends its
+// writes to the key, see crdtKey.command. The reply is 1 if the key's state
+// changed and 0 otherwise. A replica gets the merges from its primary, so it
+// accepts them outside of active-active mode too.
+func handleCRDT(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'crdt' command"}
+	}
+	if !strings.EqualFold(args[0].bulk, "MERGE") {
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+	if ActiveActive != "yes" && !c.master && c.conn != nil {
+		return Value{typ: "error", str: "ERR active-active mode is disabled"}
+	}
+	key := args[1].bulk
+	other, ok := parseCRDTState(args[2:])
+	if !ok {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	observeStamps(other)
+
+	db := c.database()
+	now := nowMillis()
+	db.mu.Lock()
+	// Record a write that ran but wasn't recorded yet, before the key is
+	// overwritten. Loading the dataset writes nothing.
+	var local *crdtKey
+	if activeActiveWrites() && c.conn != nil {
+		local = db.recordWrite(key, false, now)
+	}
+	k := db.crdtState(key)
+	changed := k.merge(other)
+	v := k.view(now)
+	if changed {
+		db.materialize(key, v)
+	}
+	db.mu.Unlock()
+
+	if local != nil {
+		shareWrite(c, db.id, local.command(key))
+	}
+	if !changed {
+		return Value{typ: "integer", num: 0}
+	}
+	if v.exists() {
+		notifyKeyEvent(db, "set", key)
+	} else {
+		notifyKeyEvent(db, "del", key)
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// recordWrites records the changes a write command made, persisting them and
+// sending them to the peers as CRDT MERGE commands in place of the command.
+// A command naming no keys, such as FLUSHALL, may have changed any of them.
+func recordWrites(c *Client, command string, cmd Command, args []Value) {
+	dbs, keys := []*Database{c.database()}, cmd.keys(args)
+	if cmd.firstKey == 0 {
+		dbs = Databases
+	}
+
+	now := nowMillis()
+	for _, db := range dbs {
+		deltas := map[string]*crdtKey{}
+		db.mu.Lock()
+		if cmd.firstKey == 0 {
+			keys = make([]string, 0, len(db.crdt))
+			for key := range db.crdt {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if delta := db.recordWrite(key, command == "INCR", now); delta != nil {
+				deltas[key] = delta
+			}
+		}
+		db.mu.Unlock()
+
+		for key, delta := range deltas {
+			shareWrite(c, db.id, delta.command(key))
+		}
+	}
+}
+
+// shareWrite persists a CRDT MERGE command applying to database db and
+// queues it for the peers.
+func shareWrite(c *Client, db int, value Value) {
+	persistIn(c, db, value)
+
+	activeActive.mu.Lock()
+	defer activeActive.mu.Unlock()
+
+	for _, p := range activeActive.peers {
+		if p.status == "connecting" {
+			continue
+		}
+		command, err := encodeCommand(&p.selected, db, value)
+		if err != nil {
+			fmt.Println("Error encoding command for active-active peers:", err)
+			return
+		}
+		if len(p.pending)+len(command) > activeActiveMaxPending {
+			fmt.Println("Active-active peer", p.addr, "fell behind, resyncing it")
+			p.conn.Close()
+			p.status, p.pending = "connecting", nil
+			continue
+		}
+		p.pending = append(p.pending, command...)
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startActiveActive adopts the keys loaded without an active-active state,
+// as written by this primary before any other write, and starts linking
+// the peers.
+func startActiveActive() {
+	if ActiveActive != "yes" {
+		return
+	}
+	if ActiveActiveNodeID == "" {
+		host, _ := os.Hostname()
+		ActiveActiveNodeID = net.JoinHostPort(host, Port)
+	}
+
+	now := nowMillis()
+	for _, db := range Databases {
+		db.mu.Lock()
+		adopt := func(key string) {
+			if _, ok := db.crdt[key]; !ok {
+				db.crdt[key] = db.storedView(key, now).state(crdtStamp{0, ActiveActiveNodeID})
+			}
+		}
+		db.store.IterateStrings(func(key, value string) bool {
+			adopt(key)
+			return true
+		})
+		db.store.IterateHashes(func(key string, hash map[string]string) bool {
+			adopt(key)
+			return true
+		})
+		db.mu.Unlock()
+	}
+
+	fmt.Println("Active-active node", ActiveActiveNodeID)
+	go runActiveActive()
+}
+
+// runActiveActive keeps a link to every peer configured.
+func runActiveActive() {
+	for {
+		configMu.RLock()
+		addrs := strings.Fields(ActiveActivePeers)
+		configMu.RUnlock()
+
+		activeActive.mu.Lock()
+		wanted := map[string]bool{}
+		for _, addr := range addrs {
+			wanted[addr] = true
+			if activeActive.peers[addr] == nil {
+				p := &activeActivePeer{
+					addr:   addr,
+					stop:   make(chan struct{}),
+					wake:   make(chan struct{}, 1),
+					status: "connecting",
+				}
+				activeActive.peers[addr] = p
+				go p.run()
+			}
+		}
+		for addr, p := range activeActive.peers {
+			if !wanted[addr] {
+				close(p.stop)
+				delete(activeActive.peers, addr)
+			}
+		}
+		activeActive.mu.Unlock()
+
+		time.Sleep(replicationRetryInterval)
+	}
+}
+
+// run links the peer, again after the link failed, while the server is a
+// primary, until the peer is removed.
+func (p *activeActivePeer) run() {
+	for {
+		if atomic.LoadInt32(&replicating) == 0 {
+			if err := p.link(); err != nil {
+				fmt.Println("Error linking active-active peer", p.addr+":", err)
+			}
+			activeActive.mu.Lock()
+			p.status, p.pending = "connecting", nil
+			activeActive.mu.Unlock()
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// link connects to the peer, checks that it is another primary in
+// active-active mode, sends it the state of every key and then streams the
+// writes, until the link fails or the peer is removed.
+func (p *activeActivePeer) link() error {
+	conn, err := net.DialTimeout("tcp", p.addr, replicationTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := NewRESP(conn)
+
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	for _, command := range authCommands() {
+		reply, err := roundTrip(conn, reader, command)
+		if err != nil {
+			return err
+		}
+		if reply.typ == "error" {
+			return fmt.Errorf("AUTH failed: %s", reply.str)
+		}
+	}
+	reply, err := roundTrip(conn, reader, []string{"INFO", "activeactive"})
+	if err != nil {
+		return err
+	}
+	info := map[string]string{}
+	for _, line := range strings.Split(reply.bulk, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			info[name] = value
+		}
+	}
+	switch {
+	case reply.typ == "error":
+		return fmt.Errorf("INFO failed: %s", reply.str)
+	case info["active_active"] != "1":
+		return fmt.Errorf("the peer isn't in active-active mode")
+	case info["active_active_node_id"] == ActiveActiveNodeID:
+		return fmt.Errorf("the peer has the same node ID %s", ActiveActiveNodeID)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Writes from now on are queued, so the state sent next may miss none.
+	activeActive.mu.Lock()
+	p.conn, p.status, p.pending, p.selected = conn, "sync", nil, -1
+	activeActive.mu.Unlock()
+
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			configMu.RLock()
+			timeout := time.Duration(ReplTimeout) * time.Second
+			configMu.RUnlock()
+			conn.SetReadDeadline(time.Now().Add(timeout))
+
+			reply, err := reader.ReadReply()
+			if err != nil {
+				failed <- err
+				return
+			}
+			if reply.typ == "error" {
+				fmt.Println("Error from active-active peer", p.addr+":", reply.str)
+			}
+		}
+	}()
+
+	writer := bufio.NewWriter(conn)
+	write := func(command []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		_, err := writer.Write(command)
+		return err
+	}
+	selected := -1
+	for _, db := range Databases {
+		db.mu.RLock()
+		commands := make([]Value, 0, len(db.crdt))
+		for key, k := range db.crdt {
+			commands = append(commands, k.command(key))
+		}
+		db.mu.RUnlock()
+
+		for _, value := range commands {
+			command, err := encodeCommand(&selected, db.id, value)
+			if err != nil {
+				return err
+			}
+			if err := write(command); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	activeActive.mu.Lock()
+	p.status = "online"
+	activeActive.mu.Unlock()
+	fmt.Println("Active-active peer", p.addr, "is in sync")
+
+	ping, _ := Value{typ: "array", array: []Value{{typ: "bulk", bulk: "PING"}}}.Marshal()
+	ticker := time.NewTicker(activeActivePingInterval)
+	defer ticker.Stop()
+	for {
+		var out []byte
+		select {
+		case err := <-failed:
+			return err
+		case <-p.stop:
+			return nil
+		case <-ticker.C:
+			if atomic.LoadInt32(&replicating) == 1 {
+				return fmt.Errorf("the server became a replica")
+			}
+			out = ping
+		case <-p.wake:
+		}
+
+		activeActive.mu.Lock()
+		out, p.pending = append(p.pending, out...), nil
+		activeActive.mu.Unlock()
+		if err := write(out); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// infoActiveActive reports the active-active mode and the link to every
+// peer.
+func infoActiveActive() []string {
+	enabled := 0
+	if ActiveActive == "yes" {
+		enabled = 1
+	}
+
+	activeActive.mu.Lock()
+	defer activeActive.mu.Unlock()
+
+	addrs := make([]string, 0, len(activeActive.peers))
+	for addr := range activeActive.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	lines := []string{
+		fmt.Sprintf("active_active:%d", enabled),
+		"active_active_node_id:" + ActiveActiveNodeID,
+		fmt.Sprintf("active_active_peers:%d", len(addrs)),
+	}
+	for i, addr := range addrs {
+		p := activeActive.peers[addr]
+		lines = append(lines, fmt.Sprintf("peer%d:addr=%s,status=%s,pending=%d", i, addr, p.status, len(p.pending)))
+	}
+	return lines
+}
+
+// loadCRDTState merges into db the state of a key saved in a snapshot, as
+// an encoded CRDT MERGE command.
+func loadCRDTState(db *Database, encoded string) error {
+	value, err := NewRESP(strings.NewReader(encoded)).Read()
+	if err != nil {
+		return err
+	}
+	if value.typ != "array" || len(value.array) < 3 {
+		return fmt.Errorf("invalid active-active state")
+	}
+	client := newReplayClient()
+	client.db = db.id
+	if reply := handleCRDT(client, value.array[1:]); reply.typ == "error" {
+		return fmt.Errorf("loading active-active state: %s", reply.str)
+	}
+	return nil
+}
@@ -2,89 +2,821 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// AppendOnly controls whether writes are persisted to the AOF: "yes" or "no".
+var AppendOnly = "yes"
+
+// AppendDirname is the directory inside Dir holding the AOF's files.
+var AppendDirname = "appendonlydir"
+
+// AppendFilename is the prefix of the names of the AOF's files and manifest.
+var AppendFilename = "database.aof"
+
+// AppendFsync is when the AOF is synced to disk: "always" after every batch
+// of writes, "everysec" once a second, or "no" to leave it to the operating
+// system.
+var AppendFsync = "everysec"
+
+// setAppendFsync changes the AOF fsync policy.
+func setAppendFsync(value string) error {
+	switch value {
+	case "always", "everysec", "no":
+		AppendFsync = value
+		return nil
+	default:
+		return fmt.Errorf("argument must be one of: always, everysec, no")
+	}
+}
+
+// AOFTimestampEnabled is whether commands appended to the AOF are preceded
+// by a "#TS:<unix time>" annotation whenever the second changed: "yes" or
+// "no". The annotations are what AOFReplayUntil goes by.
+var AOFTimestampEnabled = "no"
+
+// AOFReplayUntil is the time to restore the dataset to, set with the
+// -aof-replay-until flag: the AOF is only replayed up to the first
+// timestamp annotation after it, and the commands after it are dropped from
+// the AOF. The zero time replays everything.
+var AOFReplayUntil time.Time
+
+// setAOFReplayUntil sets AOFReplayUntil from a Unix time or an RFC 3339 date.
+func setAOFReplayUntil(value string) error {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		AOFReplayUntil = time.Unix(seconds, 0)
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("expected a Unix time or an RFC 3339 date such as 2024-01-02T15:04:05Z")
+	}
+	AOFReplayUntil = t
+	return nil
+}
+
+// AOFLoadTruncated is whether an AOF whose last command was cut short, as
+// when the server is killed mid-write, loads anyway: "yes" drops the partial
+// command with a warning, "no" refuses to start.
+var AOFLoadTruncated = "yes"
+
+// AutoAOFRewritePercentage is how much the AOF must grow, in percent of its
+// size after the last rewrite, before it is rewritten automatically; 0
+// disables automatic rewrites.
+var AutoAOFRewritePercentage = 100
+
+// AutoAOFRewriteMinSize is the size in bytes below which the AOF isn't
+// rewritten automatically, however much it grew.
+var AutoAOFRewriteMinSize = 64 * 1024 * 1024
+
+// aof is the open append-only file, nil when AppendOnly is "no".
+var aof *AOF
+
 // AOF (Append-Only File) handles the append-only file for data persistence.
+// It is made of a base file, written by the last rewrite, and incremental
+// files appended to since, listed by a manifest. Writes go to the last
+// incremental file.
 type AOF struct {
-	file *os.File
-	rd   *bufio.Reader
-	mu   sync.Mutex
+	dir      string
+	name     string
+	manifest aofManifest
+	file     *os.File
+	mu       sync.Mutex
+
+	// selected is the database the last appended command applied to, or -1
+	// when unknown, e.g. after reopening an existing file.
+	selected int
+
+	// size is the size of the files, and baseSize their size when opened or
+	// after the last rewrite, which automatic rewrites compare it to.
+	size     int
+	baseSize int
+
+	// rewriting is set while BGREWRITEAOF writes a new base file.
+	rewriting bool
+
+	// corrupt counts the damaged commands dropped while loading, see
+	// dropFrom.
+	corrupt int
+
+	// timestamp is the Unix time of the last timestamp annotation in the
+	// current file, see AOFTimestampEnabled.
+	timestamp int64
+
+	// buf holds the commands appended since the last flush. Flush writes
+	// them with a single write, synced under the "always" policy, for a whole
+	// batch of commands, shared by every client waiting on it.
+	buf []byte
+
+	// appended and flushed count the commands appended and those written to
+	// the file. flushing is set while a flush writes without holding aof.mu,
+	// and flushDone is signaled once it is done.
+	appended  int64
+	flushed   int64
+	flushing  bool
+	flushDone *sync.Cond
+
+	// Outcome of the last write, fsync and rewrite, reported by INFO persistence.
+	lastWriteErr   error
+	lastFsyncErr   error
+	lastRewriteErr error
+
+	closed bool
+	done   chan struct{}
 }
 
-// NewAOF initializes a new AOF file at the specified path.
-func NewAOF(path string) (*AOF, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
+// NewAOF opens the AOF in directory dir, whose files and manifest are named
+// after name, creating it if needed. A single-file AOF named name, from
+// before the AOF had several files, becomes the base file.
+func NewAOF(dir, name string) (*AOF, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
 	aof := &AOF{
-		file: f,
-		rd:   bufio.NewReader(f),
+		dir:      dir,
+		name:     name,
+		selected: -1,
+		done:     make(chan struct{}),
 	}
+	aof.flushDone = sync.NewCond(&aof.mu)
 
-	// Start a goroutine to periodically sync the AOF file to disk.
+	manifest, err := loadManifest(aof.manifestPath())
+	if err != nil {
+		return nil, err
+	}
+	aof.manifest = manifest
+
+	if manifest.base == nil && len(manifest.incrs) == 0 {
+		if _, err := os.Stat(name); err == nil {
+			base := manifest.nextBase(name)
+			if err := os.Rename(name, aof.filePath(base)); err != nil {
+				return nil, err
+			}
+			aof.manifest.base = &base
+			fmt.Println("Moved the AOF", name, "into", dir, "as its base file")
+		}
+	}
+
+	// Append to the last incremental file, starting one if there is none.
+	if len(aof.manifest.incrs) == 0 {
+		aof.manifest.incrs = append(aof.manifest.incrs, aof.manifest.nextIncr(name))
+		if err := aof.manifest.save(aof.manifestPath()); err != nil {
+			return nil, err
+		}
+	}
+	incr := aof.manifest.incrs[len(aof.manifest.incrs)-1]
+	aof.file, err = os.OpenFile(aof.filePath(incr), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	aof.size, err = aof.filesSize()
+	if err != nil {
+		aof.file.Close()
+		return nil, err
+	}
+	aof.baseSize = aof.size
+
+	// Start a goroutine flushing commands no client waits on, syncing the
+	// AOF file to disk every second while the fsync policy is "everysec", and
+	// rewriting it once it grew enough.
 	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
 		for {
-			time.Sleep(time.Second)
-			aof.mu.Lock()
-			aof.file.Sync()
-			aof.mu.Unlock()
+			select {
+			case <-ticker.C:
+				if err := aof.Flush(); err != nil {
+					fmt.Println("Error writing to AOF:", err)
+				}
+
+				configMu.RLock()
+				everysec := AppendFsync == "everysec"
+				configMu.RUnlock()
+				// A failed fsync is retried whatever the policy, so that
+				// writes are accepted again once the disk recovers.
+				aof.mu.Lock()
+				if everysec || aof.lastFsyncErr != nil {
+					aof.sync()
+				}
+				aof.mu.Unlock()
+
+				aof.autoRewrite()
+			case <-aof.done:
+				return
+			}
 		}
 	}()
 
 	return aof, nil
 }
 
-// Close safely closes the AOF file.
+// Close writes and syncs pending writes to disk and closes the AOF file.
+// Calling it again is a no-op.
 func (aof *AOF) Close() error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
+	if aof.closed {
+		return nil
+	}
+	aof.closed = true
+	close(aof.done)
+
+	if err := aof.drain(); err != nil {
+		aof.file.Close()
+		return err
+	}
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return err
+	}
 	return aof.file.Close()
 }
 
-// Write appends a serialized Value to the AOF file.
-func (aof *AOF) Write(value Value) error {
+// Write appends a serialized Value to the AOF, preceded by a SELECT whenever
+// it targets a different database than the previous command. The command is
+// only buffered: it reaches the file with the next Flush.
+func (aof *AOF) Write(db int, value Value) error {
+	configMu.RLock()
+	timestamps := AOFTimestampEnabled == "yes"
+	configMu.RUnlock()
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	_, err := aof.file.Write(value.Marshal())
+	bytes, err := encodeCommand(&aof.selected, db, value)
 	if err != nil {
 		return err
 	}
 
+	if now := time.Now().Unix(); timestamps && now != aof.timestamp {
+		annotation := timestampAnnotation(now)
+		aof.buf = append(aof.buf, annotation...)
+		aof.size += len(annotation)
+		aof.timestamp = now
+	}
+
+	aof.buf = append(aof.buf, bytes...)
+	aof.size += len(bytes)
+	aof.appended++
 	return nil
 }
 
-// Read replays the commands stored in the AOF file.
-func (aof *AOF) Read(fn func(value Value)) error {
+// Flush writes the commands appended so far to the file, and syncs it when
+// the fsync policy is "always". Concurrent calls are batched: while one
+// writes, the others wait and the next one writes everything appended
+// meanwhile at once.
+func (aof *AOF) Flush() error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	// Reset the file pointer to the beginning.
-	_, err := aof.file.Seek(0, io.SeekStart)
+	target := aof.appended
+	for aof.flushed < target {
+		if aof.flushing {
+			aof.flushDone.Wait()
+			continue
+		}
+		if err := aof.flushBatch(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushBatch writes and syncs the buffered commands, releasing aof.mu
+// meanwhile so more can be appended. Commands that failed to be written are
+// kept for the next attempt. aof.mu must be held, and no flush be in progress.
+func (aof *AOF) flushBatch() error {
+	buf, upto, file := aof.buf, aof.appended, aof.file
+	aof.buf = nil
+	aof.flushing = true
+	aof.mu.Unlock()
+
+	configMu.RLock()
+	always := AppendFsync == "always"
+	configMu.RUnlock()
+
+	n, err := file.Write(buf)
+	var fsyncErr error
+	if err == nil && always {
+		start := time.Now()
+		fsyncErr = file.Sync()
+		latencyAddSample("aof-fsync", time.Since(start))
+	}
+
+	aof.mu.Lock()
+	aof.flushing = false
+	aof.flushDone.Broadcast()
+
+	aof.lastWriteErr = err
 	if err != nil {
+		aof.buf = append(buf[n:], aof.buf...)
 		return err
 	}
+	aof.flushed = upto
+	if always {
+		aof.lastFsyncErr = fsyncErr
+		if fsyncErr != nil {
+			fmt.Println("Error syncing AOF:", fsyncErr)
+			return fsyncErr
+		}
+	}
+	return nil
+}
+
+// drain writes the buffered commands to the current file, after any flush in
+// progress, before the file is switched or closed. aof.mu must be held.
+func (aof *AOF) drain() error {
+	for aof.flushing {
+		aof.flushDone.Wait()
+	}
+
+	n, err := aof.file.Write(aof.buf)
+	aof.lastWriteErr = err
+	aof.buf = aof.buf[n:]
+	if err != nil {
+		return err
+	}
+	aof.flushed = aof.appended
+	return nil
+}
+
+// timestampAnnotation returns the annotation recording that the commands
+// after it ran at Unix time t.
+func timestampAnnotation(t int64) string {
+	return "#TS:" + strconv.FormatInt(t, 10) + "\r\n"
+}
+
+// writeMu is held from applying a write up to persisting it, so that writes
+// reach the AOF and replicas in the order they were applied; commands running
+// at the same time under executionMu.RLock would otherwise persist in
+// whichever order they return. It is taken after executionMu and before any
+// db.mu, and never held while blocking, see writeUnlocked.
+var writeMu = sync.Mutex{}
+
+// writeUnlocked runs fn, which waits on the network, without holding writeMu,
+// which the write command calling it holds, so that other writes and expiry
+// go on meanwhile. The command must apply its write after fn returned.
+func writeUnlocked(fn func()) {
+	writeMu.Unlock()
+	defer writeMu.Lock()
+
+	fn()
+}
+
+// persist appends a write command the client ran to the AOF, if enabled,
+// and streams it to replicas. writeMu must be held since the write was
+// applied, or executionMu for writing.
+func persist(c *Client, value Value) {
+	persistIn(c, c.db, value)
+}
+
+// persistIn is persist for a command applying to database db rather than
+// the client's. Inside a transaction or script, the first write is preceded
+// by the MULTI opening its block, see persistBlock.
+func persistIn(c *Client, db int, value Value) {
+	openPersistBlock(c, db)
+	writePersisted(c, db, value)
+}
+
+// writePersisted streams a command to replicas and appends it to the AOF.
+func writePersisted(c *Client, db int, value Value) {
+	replicate(db, value)
+	if aof == nil {
+		return
+	}
+	if err := aof.Write(db, value); err != nil {
+		fmt.Println("Error writing to AOF:", err)
+		return
+	}
+	c.aofPending = true
+}
+
+// encodeCommand serializes a command applying to database db, preceded by a
+// SELECT when db isn't the selected one, and updates selected.
+func encodeCommand(selected *int, db int, value Value) ([]byte, error) {
+	bytes, err := value.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if db != *selected {
+		selectCmd, _ := Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "SELECT"},
+			{typ: "bulk", bulk: strconv.Itoa(db)},
+		}}.Marshal()
+		bytes = append(selectCmd, bytes...)
+		*selected = db
+	}
+
+	return bytes, nil
+}
+
+// sync flushes the AOF file to disk, recording the outcome. aof.mu must be held.
+func (aof *AOF) sync() error {
+	start := time.Now()
+	err := aof.file.Sync()
+	latencyAddSample("aof-fsync", time.Since(start))
+
+	aof.lastFsyncErr = err
+	if err != nil {
+		fmt.Println("Error syncing AOF:", err)
+	}
+	return err
+}
+
+// StopWritesOnPersistenceError makes write commands fail with a MISCONF
+// error while the AOF can't be written or synced, rather than acknowledge
+// writes that may never reach the disk: "yes" or "no".
+var StopWritesOnPersistenceError = "yes"
+
+// persistenceError returns why the AOF can't be written or synced, if its
+// last write or sync failed.
+func (aof *AOF) persistenceError() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.lastWriteErr != nil {
+		return aof.lastWriteErr
+	}
+	return aof.lastFsyncErr
+}
+
+// stopWrites reports whether write commands are refused when persisting
+// fails.
+func stopWrites() bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return StopWritesOnPersistenceError == "yes"
+}
+
+// persistenceCheck returns the MISCONF error write commands fail with while
+// the AOF can't be written or synced, if stop-writes-on-persistence-error is
+// set. The ticker of the AOF retries in the background, and writes are
+// accepted again once it succeeds.
+func persistenceCheck() *Value {
+	if aof == nil || !stopWrites() {
+		return nil
+	}
+	if err := aof.persistenceError(); err != nil {
+		return &Value{typ: "error", str: "MISCONF Errors writing to the AOF file: " + err.Error()}
+	}
+	return nil
+}
+
+// infoPersistence reports the state of snapshots and of the AOF for INFO.
+func infoPersistence() []string {
+	lines := append(append(infoSnapshots(), infoRemoteBackups()...), infoDiskSpace()...)
+	if aof == nil {
+		return append(lines, "aof_enabled:0")
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	rewriting := 0
+	if aof.rewriting {
+		rewriting = 1
+	}
+	refusing := 0
+	if (aof.lastWriteErr != nil || aof.lastFsyncErr != nil) && stopWrites() {
+		refusing = 1
+	}
+
+	return append(lines, []string{
+		"aof_enabled:1",
+		fmt.Sprintf("aof_current_size:%d", aof.size),
+		fmt.Sprintf("aof_base_size:%d", aof.baseSize),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		"aof_last_bgrewrite_status:" + statusString(aof.lastRewriteErr),
+		"aof_last_write_status:" + statusString(aof.lastWriteErr),
+		"aof_last_fsync_status:" + statusString(aof.lastFsyncErr),
+		fmt.Sprintf("aof_refusing_writes:%d", refusing),
+	}...)
+}
+
+// statusString reports the outcome of an operation as "ok" or "err".
+func statusString(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
 
-	reader := NewRESP(aof.file)
+// Read replays the commands stored in the AOF's files, in manifest order,
+// up to AOFReplayUntil. fn is also passed the number of bytes of the files
+// read so far, out of aof.size, to report progress with.
+func (aof *AOF) Read(fn func(value Value, read int)) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	files := aof.manifest.files()
+	done := 0
+	for i, file := range files {
+		cut, n, err := aof.readFile(file, i == len(files)-1, func(value Value, read int) {
+			fn(value, done+read)
+		})
+		if err != nil {
+			return err
+		}
+		done += n
+		if cut >= 0 {
+			return aof.cut(i, cut)
+		}
+	}
+
+	if !AOFReplayUntil.IsZero() {
+		fmt.Println("Replayed the whole AOF, no commands were annotated as later than", AOFReplayUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// readFile replays the commands stored in one of the AOF's files. When the
+// file is the last one, the one being appended to, a command cut short at
+// its end is truncated if AOFLoadTruncated allows. The commands of a
+// transaction or script are stored in a MULTI block, replayed once its EXEC
+// was read, and a block left unterminated is truncated likewise. It stops
+// at a timestamp annotation after AOFReplayUntil, returning its offset, or
+// returns -1 once the whole file was replayed. It also returns the bytes of
+// the file read, which fn is passed as it goes. aof.mu must be held.
+func (aof *AOF) readFile(file aofFile, last bool, fn func(value Value, read int)) (int, int, error) {
+	path := aof.filePath(file)
+	f, err := os.Open(path)
+	if err != nil {
+		return -1, 0, err
+	}
+	defer f.Close()
+
+	// Rewritten base files may be compressed, see PersistenceCompression.
+	// Offsets count decompressed bytes, progress the bytes of the file.
+	raw := &countingReader{r: f}
+	dr, err := decompressReader(bufio.NewReaderSize(raw, aofReadBufferSize))
+	if err != nil {
+		return -1, 0, err
+	}
+	defer dr.Close()
+
+	counter := &countingReader{r: dr}
+	reader := NewRESPSize(counter, aofReadBufferSize)
+
+	// The commands of the MULTI block being read, which starts at offset
+	// blockStart, or -1 outside of one. Damage within a block drops it whole.
+	var block []Value
+	blockStart := -1
+	start := func(offset int) int {
+		if blockStart >= 0 {
+			return blockStart
+		}
+		return offset
+	}
 
 	for {
+		offset := counter.n - reader.Buffered()
+		annotation, ok, err := readAnnotation(reader)
+		if err == io.ErrUnexpectedEOF {
+			return -1, raw.n, aof.truncate(file, last, start(offset))
+		}
+		if err != nil {
+			return -1, raw.n, err
+		}
+		if ok {
+			t, isTimestamp := parseTimestampAnnotation(annotation)
+			if isTimestamp && !AOFReplayUntil.IsZero() && t > AOFReplayUntil.Unix() {
+				if file.typ == "b" {
+					return -1, raw.n, fmt.Errorf("%s was rewritten at %s, after %s, so the dataset can't be restored to that time", file.name, time.Unix(t, 0).Format(time.RFC3339), AOFReplayUntil.Format(time.RFC3339))
+				}
+				return start(offset), raw.n, nil
+			}
+			continue
+		}
+
 		value, err := reader.Read()
+		if err == io.EOF && counter.n-reader.Buffered() == offset {
+			if blockStart >= 0 {
+				return -1, raw.n, aof.truncate(file, last, blockStart)
+			}
+			break
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return -1, raw.n, aof.truncate(file, last, start(offset))
+		}
+		if err == nil && (value.typ != "array" || len(value.array) == 0 || value.array[0].typ != "bulk") {
+			err = fmt.Errorf("not a command")
+		}
+		if err == nil && blockStart >= 0 && strings.EqualFold(value.array[0].bulk, "MULTI") {
+			err = fmt.Errorf("MULTI inside a MULTI block")
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
+			return -1, raw.n, aof.repair(file, start(offset), err)
+		}
+
+		switch command := value.array[0].bulk; {
+		case strings.EqualFold(command, "MULTI"):
+			block, blockStart = nil, offset
+		case blockStart < 0:
+			fn(value, raw.n)
+		case strings.EqualFold(command, "EXEC"):
+			for _, value := range block {
+				fn(value, raw.n)
 			}
+			block, blockStart = nil, -1
+		default:
+			block = append(block, value)
+		}
+	}
+
+	return -1, raw.n, nil
+}
+
+// readAnnotation reads the annotation line, such as "#TS:1700000000", that
+// comes next if any, returning it without its leading '#' and its CRLF.
+func readAnnotation(r *RESP) (string, bool, error) {
+	b, err := r.reader.Peek(1)
+	if err != nil || b[0] != '#' {
+		return "", false, nil
+	}
+
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF {
+		return "", false, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSuffix(line[1:], "\r\n"), true, nil
+}
+
+// parseTimestampAnnotation returns the Unix time of a "TS:<unix time>"
+// annotation, and false for other annotations.
+func parseTimestampAnnotation(annotation string) (int64, bool) {
+	value, ok := strings.CutPrefix(annotation, "TS:")
+	if !ok {
+		return 0, false
+	}
+	t, err := strconv.ParseInt(value, 10, 64)
+	return t, err == nil
+}
+
+// cut drops everything after offset in the i-th of the AOF's files and the
+// files after it, which hold the commands after AOFReplayUntil, and appends
+// to that file from now on. aof.mu must be held.
+func (aof *AOF) cut(i int, offset int) error {
+	files := aof.manifest.files()
+	file := files[i]
+	path := aof.filePath(file)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dropped := int(info.Size()) - offset
+	for _, later := range files[i+1:] {
+		if info, err := os.Stat(aof.filePath(later)); err == nil {
+			dropped += int(info.Size())
+		}
+	}
+	fmt.Printf("Replayed the AOF up to %s, dropping the %d bytes of commands after it\n", AOFReplayUntil.Format(time.RFC3339), dropped)
+
+	if err := os.Truncate(path, int64(offset)); err != nil {
+		return err
+	}
+
+	if i < len(files)-1 {
+		manifest := aofManifest{base: aof.manifest.base}
+		for _, incr := range aof.manifest.incrs {
+			if incr.seq <= file.seq {
+				manifest.incrs = append(manifest.incrs, incr)
+			}
+		}
+		if err := manifest.save(aof.manifestPath()); err != nil {
 			return err
 		}
+		aof.manifest = manifest
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		aof.file.Close()
+		aof.file = f
+
+		for _, later := range files[i+1:] {
+			if err := os.Remove(aof.filePath(later)); err != nil {
+				fmt.Println("Error removing AOF file:", err)
+			}
+		}
+	}
+
+	aof.size, err = aof.filesSize()
+	if err != nil {
+		return err
+	}
+	aof.baseSize = aof.size
+	return nil
+}
+
+// truncate drops the partial command or MULTI block at offset at the end
+// of one of the AOF's files, if it is the last file and AOFLoadTruncated allows, or any
+// file with -repair. aof.mu must be held.
+func (aof *AOF) truncate(file aofFile, last bool, offset int) error {
+	if !Repair && (!last || AOFLoadTruncated != "yes") {
+		return fmt.Errorf("%s ends in a truncated command or MULTI block at offset %d", file.name, offset)
+	}
+
+	dropped, err := aof.dropFrom(file, offset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Warning: %s ends in a truncated command or MULTI block, dropped the last %d bytes\n", file.name, dropped)
+	return nil
+}
 
-		fn(value)
+// repair drops the damaged command at offset in one of the AOF's files and
+// everything after it in that file, with -repair. The commands of the files
+// after it still load. aof.mu must be held.
+func (aof *AOF) repair(file aofFile, offset int, cause error) error {
+	if !Repair {
+		return fmt.Errorf("%s: bad command at offset %d: %w", file.name, offset, cause)
 	}
 
+	dropped, err := aof.dropFrom(file, offset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Repaired %s: bad command at offset %d: %v, dropped the last %d bytes\n", file.name, offset, cause, dropped)
 	return nil
 }
+
+// dropFrom truncates one of the AOF's files at offset, counting the dropped
+// data as a corrupt record, and returns the number of bytes dropped.
+// aof.mu must be held.
+func (aof *AOF) dropFrom(file aofFile, offset int) (int, error) {
+	// Offsets within compressed files count decompressed bytes.
+	path := aof.filePath(file)
+	compressed, err := isCompressedFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if compressed {
+		return 0, fmt.Errorf("%s is damaged at offset %d, but is compressed and can't be repaired", file.name, offset)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Truncate(path, int64(offset)); err != nil {
+		return 0, err
+	}
+	aof.corrupt++
+
+	dropped := int(info.Size()) - offset
+	aof.size -= dropped
+	aof.baseSize = aof.size
+	return dropped, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// manifestPath returns the path of the AOF's manifest.
+func (aof *AOF) manifestPath() string {
+	return filepath.Join(aof.dir, aof.name+".manifest")
+}
+
+// filePath returns the path of one of the AOF's files.
+func (aof *AOF) filePath(file aofFile) string {
+	return filepath.Join(aof.dir, file.name)
+}
+
+// filesSize returns the total size of the AOF's files.
+func (aof *AOF) filesSize() (int, error) {
+	size := 0
+	for _, file := range aof.manifest.files() {
+		info, err := os.Stat(aof.filePath(file))
+		if err != nil {
+			return 0, err
+		}
+		size += int(info.Size())
+	}
+	return size, nil
+}
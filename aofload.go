@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Repair is set by the -repair flag: a damaged AOF or snapshot loads up to
+// the damage rather than the server refusing to start. The damaged command
+// of an AOF file and everything after it in that file is dropped, and a
+// snapshot keeps the keys read before the damage.
+var Repair bool
+
+// aofReadBufferSize is the size of the buffers the AOF's files are read and
+// parsed through, large enough to keep reads few on multi-GB files.
+const aofReadBufferSize = 4 * 1024 * 1024
+
+// aofLoadProgressInterval is how often loading the AOF reports its progress.
+const aofLoadProgressInterval = 5 * time.Second
+
+// aofLoader loads the AOF into the databases on startup. The commands
+// rewritten base files consist of, and most appended ones, are loaded into
+// the stores directly: nothing else runs yet, so the handlers' locking and
+// notifications can be skipped. Other commands run through their handlers
+// as the replay client. SELECT entries switch the replay client's database
+// like they would for a live client.
+type aofLoader struct {
+	client *Client
+	// total is the size of the AOF's files, which progress is reported against.
+	total      int
+	commands   int
+	started    time.Time
+	lastReport time.Time
+}
+
+// newAOFLoader creates a loader for an AOF of total bytes.
+func newAOFLoader(total int) *aofLoader {
+	now := time.Now()
+	return &aofLoader{client: newReplayClient(), total: total, started: now, lastReport: now}
+}
+
+// load loads one command of the AOF, read bytes into it.
+func (l *aofLoader) load(value Value, read int) {
+	command := strings.ToUpper(value.array[0].bulk)
+	args := value.array[1:]
+	l.commands++
+
+	if !l.loadDirect(command, args) {
+		handler, ok := Handlers[command]
+		if !ok {
+			fmt.Println("Invalid command during AOF replay:", command)
+			return
+		}
+
+		// Execute the handler to restore state.
+		handler(l.client, args)
+	}
+
+	if l.commands%1024 != 0 {
+		return
+	}
+	if now := time.Now(); now.Sub(l.lastReport) >= aofLoadProgressInterval {
+		l.lastReport = now
+		fmt.Printf("Loading AOF: %d of %d bytes (%.1f%%), %d commands\n", read, l.total, percent(read, l.total), l.commands)
+	}
+}
+
+// loadDirect loads a SELECT, SET, HSET, PEXPIREAT or DEL straight into the
+// store, reporting false for other commands and malformed ones, which are
+// left to their handlers.
+func (l *aofLoader) loadDirect(command string, args []Value) bool {
+	if command == "SELECT" {
+		if len(args) != 1 {
+			return false
+		}
+		index, errValue := parseDBIndex(args[0])
+		if errValue != nil {
+			return false
+		}
+		l.client.db = index
+		return true
+	}
+
+	store := Databases[l.client.db].store
+	switch {
+	case command == "SET" && len(args) == 2:
+		store.Set(args[0].bulk, args[1].bulk)
+		store.Persist(args[0].bulk)
+	case command == "HSET" && len(args) == 3:
+		store.SetField(args[0].bulk, args[1].bulk, args[2].bulk)
+	case command == "PEXPIREAT" && len(args) == 2:
+		when, err := strconv.ParseInt(args[1].bulk, 10, 64)
+		if err != nil {
+			return false
+		}
+		// Like the handler for the replay client, keys that have expired
+		// since are left for expiry to remove.
+		if Databases[l.client.db].exists(args[0].bulk) {
+			store.Expire(args[0].bulk, when)
+		}
+	case command == "DEL" && len(args) > 0:
+		for _, arg := range args {
+			store.Delete(arg.bulk)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// done logs a summary of loading: the commands replayed, the keys loaded
+// and the damaged commands dropped.
+func (l *aofLoader) done(corrupt int) {
+	elapsed := time.Since(l.started)
+	fmt.Printf("Loaded the AOF in %.3f seconds: %d commands replayed, %d keys loaded, %d corrupt records dropped\n", elapsed.Seconds(), l.commands, datasetKeys(), corrupt)
+}
+
+// percent returns n as a percentage of total.
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// aofFile is one of the files making up the AOF: the base file, written by
+// the last rewrite, or an incremental file, appended to since.
+type aofFile struct {
+	name string
+	seq  int
+	// typ is "b" for the base file and "i" for incremental files.
+	typ string
+}
+
+// aofManifest lists the files making up the AOF. They are replayed in
+// order: the base file, if any, then the incremental files.
+type aofManifest struct {
+	base  *aofFile
+	incrs []aofFile
+}
+
+// files returns the manifest's files in replay order.
+func (m aofManifest) files() []aofFile {
+	files := []aofFile{}
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// nextBase returns the base file a rewrite replaces the current one with.
+func (m aofManifest) nextBase(name string) aofFile {
+	seq := 1
+	if m.base != nil {
+		seq = m.base.seq + 1
+	}
+	return aofFile{name: fmt.Sprintf("%s.%d.base.aof", name, seq), seq: seq, typ: "b"}
+}
+
+// nextIncr returns the incremental file opened after the current ones.
+func (m aofManifest) nextIncr(name string) aofFile {
+	seq := 1
+	if len(m.incrs) > 0 {
+		seq = m.incrs[len(m.incrs)-1].seq + 1
+	}
+	return aofFile{name: fmt.Sprintf("%s.%d.incr.aof", name, seq), seq: seq, typ: "i"}
+}
+
+// loadManifest reads the manifest at path, made of lines of the form
+// "file <name> seq <seq> type <b|i>". A missing manifest is empty.
+func loadManifest(path string) (aofManifest, error) {
+	m := aofManifest{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 6 || fields[0] != "file" || fields[2] != "seq" || fields[4] != "type" {
+			return m, fmt.Errorf("invalid AOF manifest line %d", line)
+		}
+		seq, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return m, fmt.Errorf("invalid AOF manifest line %d: bad seq", line)
+		}
+
+		file := aofFile{name: fields[1], seq: seq, typ: fields[5]}
+		switch file.typ {
+		case "b":
+			if m.base != nil {
+				return m, fmt.Errorf("invalid AOF manifest line %d: more than one base file", line)
+			}
+			m.base = &file
+		case "i":
+			m.incrs = append(m.incrs, file)
+		default:
+			return m, fmt.Errorf("invalid AOF manifest line %d: unknown type %q", line, file.typ)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// save replaces the manifest at path with m.
+func (m aofManifest) save(path string) error {
+	var b strings.Builder
+	for _, file := range m.files() {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", file.name, file.seq, file.typ)
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
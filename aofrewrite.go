@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// aofEntry is a command written to the AOF, and the database it applies to.
+type aofEntry struct {
+	db    int
+	value Value
+}
+
+// datasetSnapshot is a copy of the dataset taken for an AOF rewrite.
+type datasetSnapshot struct {
+	dbs []dbSnapshot
+	// libraries holds the code of the function libraries.
+	libraries []string
+	// taken is when the copy was taken.
+	taken time.Time
+	// stream describes the stream sent to a replica after the copy, on a
+	// replica forwarding its primary's stream.
+	stream replicationStream
+}
+
+// dbSnapshot is a copy of one database's keys.
+type dbSnapshot struct {
+	id      int
+	sets    map[string]string
+	hsets   map[string]map[string]string
+	expires map[string]int64
+	// crdt holds the CRDT MERGE commands recreating the active-active state
+	// of the keys.
+	crdt []Value
+}
+
+// snapshotDataset copies the dataset. executionMu must be held for writing,
+// so that no command is halfway through between the AOF and the dataset.
+func snapshotDataset() datasetSnapshot {
+	snapshot := datasetSnapshot{taken: time.Now()}
+
+	for _, db := range Databases {
+		db.mu.RLock()
+		strs, hashes, expires := db.store.Counts()
+		s := dbSnapshot{
+			id:      db.id,
+			sets:    make(map[string]string, strs),
+			hsets:   make(map[string]map[string]string, hashes),
+			expires: make(map[string]int64, expires),
+		}
+		db.store.IterateStrings(func(key, value string) bool {
+			s.sets[key] = value
+			return true
+		})
+		db.store.IterateHashes(func(key string, hash map[string]string) bool {
+			fields := make(map[string]string, len(hash))
+			for field, value := range hash {
+				fields[field] = value
+			}
+			s.hsets[key] = fields
+			return true
+		})
+		db.store.IterateExpires(func(key string, when int64) bool {
+			s.expires[key] = when
+			return true
+		})
+		for key, k := range db.crdt {
+			s.crdt = append(s.crdt, k.command(key))
+		}
+		db.mu.RUnlock()
+
+		snapshot.dbs = append(snapshot.dbs, s)
+	}
+
+	functionsMu.RLock()
+	for _, lib := range libraries {
+		snapshot.libraries = append(snapshot.libraries, lib.code)
+	}
+	functionsMu.RUnlock()
+	sort.Strings(snapshot.libraries)
+
+	return snapshot
+}
+
+// commands returns the commands recreating the snapshot, in order: function
+// libraries, then each database's strings, hashes, expiry times and
+// active-active state. Keys that have expired are left out.
+func (s datasetSnapshot) commands() []aofEntry {
+	entries := []aofEntry{}
+	command := func(db int, args ...string) {
+		value := Value{typ: "array", array: make([]Value, 0, len(args))}
+		for _, arg := range args {
+			value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+		}
+		entries = append(entries, aofEntry{db, value})
+	}
+
+	for _, code := range s.libraries {
+		command(0, "FUNCTION", "LOAD", code)
+	}
+
+	now := nowMillis()
+	for _, db := range s.dbs {
+		expired := func(key string) bool {
+			when, ok := db.expires[key]
+			return ok && when <= now
+		}
+
+		for key, value := range db.sets {
+			if !expired(key) {
+				command(db.id, "SET", key, value)
+			}
+		}
+		for key, hash := range db.hsets {
+			if expired(key) {
+				continue
+			}
+			for field, value := range hash {
+				command(db.id, "HSET", key, field, value)
+			}
+		}
+		for key, when := range db.expires {
+			if !expired(key) {
+				command(db.id, "PEXPIREAT", key, strconv.FormatInt(when, 10))
+			}
+		}
+		for _, value := range db.crdt {
+			entries = append(entries, aofEntry{db.id, value})
+		}
+	}
+
+	return entries
+}
+
+// handleBgRewriteAOF handles the "BGREWRITEAOF" command, compacting the AOF
+// in the background into the shortest command stream recreating the
+// dataset. executionMu must be held for writing, for the snapshot.
+func handleBgRewriteAOF(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bgrewriteaof' command"}
+	}
+	if aof == nil {
+		return Value{typ: "error", str: "ERR Background append only file rewriting needs appendonly yes"}
+	}
+
+	if err := aof.startRewrite(); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	return Value{typ: "string", str: "Background append only file rewriting started"}
+}
+
+// autoRewrite starts a rewrite once the AOF grew by AutoAOFRewritePercentage
+// over its base size and is at least AutoAOFRewriteMinSize.
+func (aof *AOF) autoRewrite() {
+	configMu.RLock()
+	percentage, minSize := AutoAOFRewritePercentage, AutoAOFRewriteMinSize
+	configMu.RUnlock()
+	if percentage == 0 {
+		return
+	}
+
+	aof.mu.Lock()
+	size, base, rewriting := aof.size, aof.baseSize, aof.rewriting
+	aof.mu.Unlock()
+	if rewriting || size < minSize {
+		return
+	}
+	if base == 0 {
+		base = 1
+	}
+	growth := (size - base) * 100 / base
+	if growth < percentage {
+		return
+	}
+
+	executionMu.Lock()
+	defer executionMu.Unlock()
+
+	if err := aof.startRewrite(); err != nil {
+		return
+	}
+	fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+}
+
+// startRewrite snapshots the dataset and rewrites the AOF from it in the
+// background. Writes go to a new incremental file meanwhile, which the
+// rewritten AOF keeps. executionMu must be held for writing, so that the
+// snapshot holds exactly the writes in the files the rewrite replaces.
+func (aof *AOF) startRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.closed {
+		return fmt.Errorf("AOF is closed")
+	}
+	if aof.rewriting {
+		return fmt.Errorf("Background append only file rewriting already in progress")
+	}
+
+	// Commands buffered so far belong to the current file.
+	if err := aof.drain(); err != nil {
+		return err
+	}
+
+	incr := aof.manifest.nextIncr(aof.name)
+	f, err := os.OpenFile(aof.filePath(incr), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	manifest := aof.manifest
+	manifest.incrs = append(manifest.incrs[:len(manifest.incrs):len(manifest.incrs)], incr)
+	if err := manifest.save(aof.manifestPath()); err != nil {
+		f.Close()
+		os.Remove(aof.filePath(incr))
+		return err
+	}
+
+	aof.sync()
+	aof.file.Close()
+	aof.file = f
+	aof.selected = -1
+	aof.timestamp = 0
+	aof.manifest = manifest
+	aof.rewriting = true
+
+	go aof.rewrite(snapshotDataset(), incr.seq)
+	return nil
+}
+
+// rewrite writes the snapshot to a new base file and replaces the base file
+// and the incremental files before the one numbered from with it.
+func (aof *AOF) rewrite(snapshot datasetSnapshot, from int) {
+	err := aof.rewriteFrom(snapshot, from)
+
+	aof.mu.Lock()
+	aof.rewriting = false
+	aof.lastRewriteErr = err
+	aof.mu.Unlock()
+
+	if err != nil {
+		fmt.Println("Error rewriting AOF:", err)
+		return
+	}
+	fmt.Println("Background AOF rewrite finished successfully")
+}
+
+// rewriteFrom does the work of rewrite, returning its error.
+func (aof *AOF) rewriteFrom(snapshot datasetSnapshot, from int) error {
+	tempPath := filepath.Join(aof.dir, fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	configMu.RLock()
+	timestamps := AOFTimestampEnabled == "yes"
+	configMu.RUnlock()
+
+	cw, err := compressWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	selected := -1
+	w := bufio.NewWriter(cw)
+	if timestamps {
+		w.WriteString(timestampAnnotation(snapshot.taken.Unix()))
+	}
+	for _, entry := range snapshot.commands() {
+		bytes, err := encodeCommand(&selected, entry.db, entry.value)
+		if err == nil {
+			_, err = w.Write(bytes)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.closed {
+		return fmt.Errorf("AOF closed during rewrite")
+	}
+
+	old := aof.manifest
+	manifest := aofManifest{}
+	base := old.nextBase(aof.name)
+	manifest.base = &base
+	for _, incr := range old.incrs {
+		if incr.seq >= from {
+			manifest.incrs = append(manifest.incrs, incr)
+		}
+	}
+
+	if err := os.Rename(tempPath, aof.filePath(base)); err != nil {
+		return err
+	}
+	if err := manifest.save(aof.manifestPath()); err != nil {
+		os.Remove(aof.filePath(base))
+		return err
+	}
+	aof.manifest = manifest
+
+	// The replaced files are no longer in the manifest, so they can go.
+	for _, file := range old.files() {
+		if file.typ == "b" || file.seq < from {
+			if err := os.Remove(aof.filePath(file)); err != nil {
+				fmt.Println("Error removing replaced AOF file:", err)
+			}
+		}
+	}
+
+	// Commands not written yet count too, once a flush in progress is done.
+	for aof.flushing {
+		aof.flushDone.Wait()
+	}
+	aof.size, err = aof.filesSize()
+	if err != nil {
+		return err
+	}
+	aof.size += len(aof.buf)
+	aof.baseSize = aof.size
+	return nil
+}
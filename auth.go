@@ -0,0 +1,52 @@
+package main
+
+// RequirePass is the password of the default user; empty lets clients in without AUTH.
+var RequirePass = ""
+
+// isAuthenticated reports whether the client may run commands other than AUTH.
+func isAuthenticated(c *Client) bool {
+	return c.user != nil
+}
+
+// autoAuthUser returns the user new connections are logged in as, or nil if
+// they must AUTH first.
+func autoAuthUser() *User {
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	u := Users["default"]
+	if u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+// handleAuth handles the "AUTH [username] password" command.
+func handleAuth(c *Client, args []Value) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'auth' command"}
+	}
+
+	username, password := "default", args[0].bulk
+	if len(args) == 2 {
+		username, password = args[0].bulk, args[1].bulk
+	}
+
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	u, ok := Users[username]
+	if len(args) == 1 && ok && u.nopass {
+		return Value{typ: "error", str: "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+	}
+
+	if !ok || !u.checkPassword(password) {
+		return Value{typ: "error", str: "WRONGPASS invalid username-password pair or user is disabled."}
+	}
+
+	c.metaMu.Lock()
+	c.user = u
+	c.metaMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// State of backups, guarded by saveMu.
+var (
+	// lastBackupErr is the outcome of the last BGSAVE TO.
+	lastBackupErr error
+	// backupInProgress is set while BGSAVE TO writes a snapshot.
+	backupInProgress bool
+)
+
+// handleBgSaveTo handles "BGSAVE TO path", writing a snapshot of the dataset
+// as it is now to path in the background, without changing what counts as
+// saved: DBFilename, LASTSAVE and the unsaved changes are left alone.
+// executionMu must be held for writing, for the snapshot.
+func handleBgSaveTo(c *Client, args []Value) Value {
+	if len(args) != 2 || !strings.EqualFold(args[0].bulk, "TO") {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	path := args[1].bulk
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	if backupInProgress {
+		return Value{typ: "error", str: "ERR Background backup already in progress"}
+	}
+	backupInProgress = true
+
+	bgsaves.Add(1)
+	go backup(path, snapshotDataset())
+	return Value{typ: "string", str: "Background backup started"}
+}
+
+// backup writes a snapshot taken by BGSAVE TO to path.
+func backup(path string, snapshot datasetSnapshot) {
+	defer bgsaves.Done()
+	start := time.Now()
+	err := writeSnapshot(path, snapshot)
+
+	saveMu.Lock()
+	backupInProgress = false
+	lastBackupErr = err
+	saveMu.Unlock()
+
+	if err != nil {
+		fmt.Println("Error in background backup:", err)
+		return
+	}
+	fmt.Printf("Backup to %s finished in %v\n", path, time.Since(start).Round(time.Millisecond))
+}
+
+// handleBackup handles the "BACKUP" command, replying with a snapshot of the
+// dataset as it is now in the RDB format, for the client to store. Only
+// copying the dataset holds up other commands; encoding the copy doesn't,
+// except inside a transaction. executionMu must be held for writing.
+func handleBackup(c *Client, args []Value) Value {
+	snapshot := snapshotDataset()
+
+	if !c.exclusive {
+		executionMu.Unlock()
+		defer executionMu.Lock()
+	}
+
+	var buf bytes.Buffer
+	if err := encodeSnapshotFile(&buf, snapshot); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	return Value{typ: "bulk", bulk: buf.String()}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+)
+
+// bigKeysBatch is how many keys BIGKEYS measures per hold of the database
+// lock, a page of SCAN. Writers get a chance to run between batches.
+const bigKeysBatch = 100
+
+// bigKeysType accumulates the sizes of the keys of one type.
+type bigKeysType struct {
+	name    string
+	unit    string
+	keys    int
+	total   int
+	biggest string
+	max     int
+}
+
+// handleBigKeys handles "BIGKEYS", reporting the largest key of every type in
+// the current database along with per-type totals. Strings are measured in
+// bytes and hashes in fields. The keyspace is walked a SCAN page at a time,
+// so the database stays available to other clients during a long scan; as
+// with SCAN, keys present throughout are measured once, keys created
+// meanwhile may be missed and deleted ones are skipped.
+func handleBigKeys(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bigkeys' command"}
+	}
+
+	db := c.database()
+	types := map[string]*bigKeysType{
+		"string": {name: "string", unit: "bytes"},
+		"hash":   {name: "hash", unit: "fields"},
+	}
+
+	scanned := 0
+	for cursor := uint64(0); ; {
+		db.mu.RLock()
+		page, next := db.scan(cursor, bigKeysBatch)
+		for _, key := range page {
+			var t *bigKeysType
+			var size int
+			if value, ok := db.store.Get(key); ok {
+				t, size = types["string"], len(value)
+			} else if fields, ok := db.store.HashLen(key); ok {
+				t, size = types["hash"], fields
+			} else {
+				continue
+			}
+
+			scanned++
+			t.keys++
+			t.total += size
+			if t.biggest == "" || size > t.max {
+				t.biggest, t.max = key, size
+			}
+		}
+		db.mu.RUnlock()
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+		runtime.Gosched()
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	found := []Value{}
+	for _, name := range names {
+		t := types[name]
+		if t.keys == 0 {
+			continue
+		}
+		entry := Value{typ: "map", array: []Value{
+			{typ: "bulk", bulk: "type"}, {typ: "bulk", bulk: t.name},
+			{typ: "bulk", bulk: "biggest-key"}, {typ: "bulk", bulk: t.biggest},
+			{typ: "bulk", bulk: "biggest-size"}, {typ: "integer", num: t.max},
+			{typ: "bulk", bulk: "unit"}, {typ: "bulk", bulk: t.unit},
+			{typ: "bulk", bulk: "keys"}, {typ: "integer", num: t.keys},
+			{typ: "bulk", bulk: "total-size"}, {typ: "integer", num: t.total},
+			{typ: "bulk", bulk: "avg-size"}, {typ: "double", double: float64(t.total) / float64(t.keys)},
+		}}
+		found = append(found, entry)
+	}
+
+	reply := Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "scanned"}, {typ: "integer", num: scanned},
+		{typ: "bulk", bulk: "types"}, {typ: "array", array: found},
+	}}
+	if c.proto != 3 {
+		reply = resp2Compatible(reply)
+	}
+	return reply
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change-data-capture settings. While CDCEnabled is "yes", every write
+// command that succeeds is appended to the system stream CDCStreamKey, which
+// clients tail with XREAD. The stream lives in memory beside the databases,
+// is readable from all of them and keeps its newest CDCMaxLen entries.
+var (
+	CDCEnabled   = "no"
+	CDCStreamKey = "__cdc__"
+	CDCMaxLen    = 10000
+)
+
+// streamID identifies a stream entry: the Unix milliseconds it was added at
+// and a sequence number telling apart entries added in the same millisecond.
+type streamID struct {
+	ms  int64
+	seq int64
+}
+
+// maxStreamID is the greatest possible stream ID.
+var maxStreamID = streamID{math.MaxInt64, math.MaxInt64}
+
+// String formats the ID as "ms-seq".
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+// less reports whether id comes before other.
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// next returns the smallest ID after id.
+func (id streamID) next() streamID {
+	if id.seq == math.MaxInt64 {
+		return streamID{id.ms + 1, 0}
+	}
+	return streamID{id.ms, id.seq + 1}
+}
+
+// parseStreamID parses "ms-seq" or "ms". A missing sequence is missingSeq,
+// so the same ID can stand for the first or the last entry of a millisecond.
+func parseStreamID(s string, missingSeq int64) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil || ms < 0 {
+		return streamID{}, false
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, true
+	}
+	seq, err := strconv.ParseInt(seqPart, 10, 64)
+	if err != nil || seq < 0 {
+		return streamID{}, false
+	}
+	return streamID{ms, seq}, true
+}
+
+// streamEntry is one entry of a stream: its ID and field/value pairs.
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+// cdcStream is the change-data-capture stream. added is closed and replaced
+// whenever entries are added, waking readers blocked in XREAD.
+var cdcStream = struct {
+	mu      sync.Mutex
+	entries []streamEntry
+	lastID  streamID
+	added   chan struct{}
+}{added: make(chan struct{})}
+
+// cdcAppend records a write command that changed database db, as the
+// effect persisted and streamed to replicas, see commandEffect. Its
+// relative expiry times are already absolute, so consumers applying the
+// entries later get the same result.
+func cdcAppend(db int, command Value) {
+	configMu.RLock()
+	enabled, maxLen := CDCEnabled == "yes", CDCMaxLen
+	configMu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	args := command.array
+	fields := make([]string, 0, 4+2*len(args))
+	fields = append(fields, "db", strconv.Itoa(db), "command", strings.ToLower(args[0].bulk))
+	for i, arg := range args[1:] {
+		fields = append(fields, "arg"+strconv.Itoa(i+1), arg.bulk)
+	}
+
+	cdcStream.mu.Lock()
+	defer cdcStream.mu.Unlock()
+
+	// IDs never go backwards, even if the clock does.
+	id := streamID{ms: nowMillis()}
+	if !cdcStream.lastID.less(id) {
+		id = cdcStream.lastID.next()
+	}
+	cdcStream.lastID = id
+
+	cdcStream.entries = append(cdcStream.entries, streamEntry{id: id, fields: fields})
+	if excess := len(cdcStream.entries) - maxLen; excess > 0 {
+		cdcStream.entries = cdcStream.entries[excess:]
+	}
+
+	close(cdcStream.added)
+	cdcStream.added = make(chan struct{})
+}
+
+// isCDCStream reports whether the key names the change-data-capture stream.
+func isCDCStream(key string) bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return key == CDCStreamKey
+}
+
+// streamEntriesValue formats stream entries as [id, [field, value, ...]] pairs.
+func streamEntriesValue(entries []streamEntry) Value {
+	values := make([]Value, 0, len(entries))
+	for _, entry := range entries {
+		fields := make([]Value, 0, len(entry.fields))
+		for _, field := range entry.fields {
+			fields = append(fields, Value{typ: "bulk", bulk: field})
+		}
+		values = append(values, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: entry.id.String()},
+			{typ: "array", array: fields},
+		}})
+	}
+	return Value{typ: "array", array: values}
+}
+
+// cdcRange returns up to count entries with IDs from start to end, both
+// inclusive; a count of 0 means no limit. cdcStream.mu must be held.
+func cdcRange(start, end streamID, count int) []streamEntry {
+	entries := []streamEntry{}
+	for _, entry := range cdcStream.entries {
+		if entry.id.less(start) {
+			continue
+		}
+		if end.less(entry.id) || (count > 0 && len(entries) == count) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// handleXLen handles "XLEN key".
+func handleXLen(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xlen' command"}
+	}
+	if !isCDCStream(args[0].bulk) {
+		return Value{typ: "integer", num: 0}
+	}
+
+	cdcStream.mu.Lock()
+	defer cdcStream.mu.Unlock()
+
+	return Value{typ: "integer", num: len(cdcStream.entries)}
+}
+
+// handleXRange handles "XRANGE key start end [COUNT count]". The special IDs
+// "-" and "+" stand for the first and the last entry, and a "(" prefix makes
+// a bound exclusive.
+func handleXRange(c *Client, args []Value) Value {
+	if len(args) != 3 && len(args) != 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xrange' command"}
+	}
+
+	count := 0
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].bulk) != "COUNT" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		n, err := strconv.Atoi(args[4].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		if n == 0 {
+			return Value{typ: "array", array: []Value{}}
+		}
+		count = n
+	}
+
+	start, ok := parseRangeBound(args[1].bulk, 0, streamID{})
+	if !ok {
+		return Value{typ: "error", str: "ERR Invalid stream ID specified as stream command argument"}
+	}
+	end, ok := parseRangeBound(args[2].bulk, math.MaxInt64, maxStreamID)
+	if !ok {
+		return Value{typ: "error", str: "ERR Invalid stream ID specified as stream command argument"}
+	}
+
+	if !isCDCStream(args[0].bulk) {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	cdcStream.mu.Lock()
+	defer cdcStream.mu.Unlock()
+
+	return streamEntriesValue(cdcRange(start, end, count))
+}
+
+// parseRangeBound parses an XRANGE bound. missingSeq completes IDs given as
+// bare milliseconds and special is the ID that "-" or "+" stands for.
+func parseRangeBound(s string, missingSeq int64, special streamID) (streamID, bool) {
+	if s == "-" || s == "+" {
+		return special, true
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	id, ok := parseStreamID(strings.TrimPrefix(s, "("), missingSeq)
+	if !ok || !exclusive {
+		return id, ok
+	}
+
+	// Exclusive bounds move one entry inwards: up for a start, down for an end.
+	if missingSeq == 0 {
+		return id.next(), true
+	}
+	if id.seq == 0 {
+		return streamID{id.ms - 1, math.MaxInt64}, id.ms > 0
+	}
+	return streamID{id.ms, id.seq - 1}, true
+}
+
+// xreadKeys returns the stream keys of "XREAD ... STREAMS key [key ...] id [id ...]".
+func xreadKeys(args []Value) []string {
+	for i, arg := range args {
+		if strings.ToUpper(arg.bulk) == "STREAMS" {
+			streams := args[i+1:]
+			keys := []string{}
+			for _, key := range streams[:len(streams)/2] {
+				keys = append(keys, key.bulk)
+			}
+			return keys
+		}
+	}
+	return []string{}
+}
+
+// handleXRead handles "XREAD [COUNT count] [BLOCK milliseconds] STREAMS key
+// [key ...] id [id ...]", returning the entries after the given IDs. With
+// BLOCK it waits until such entries arrive or the timeout, 0 meaning
+// forever, passes. The ID "$" stands for the last entry in the stream.
+func handleXRead(c *Client, args []Value) Value {
+	count, block := 0, time.Duration(-1)
+
+	i := 0
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		if option == "STREAMS" {
+			break
+		}
+		if i+1 == len(args) {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+		switch option {
+		case "COUNT":
+			if err != nil || n < 0 {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			count = int(n)
+		case "BLOCK":
+			if err != nil || n < 0 {
+				return Value{typ: "error", str: "ERR timeout is not an integer or out of range"}
+			}
+			block = time.Duration(n) * time.Millisecond
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		i++
+	}
+
+	streams := args[i+1:]
+	if i == len(args) || len(streams) == 0 || len(streams)%2 != 0 {
+		return Value{typ: "error", str: "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."}
+	}
+	keys, ids := streams[:len(streams)/2], streams[len(streams)/2:]
+
+	cdcStream.mu.Lock()
+	after := make([]streamID, len(ids))
+	for j, id := range ids {
+		if id.bulk == "$" {
+			after[j] = cdcStream.lastID
+			continue
+		}
+		parsed, ok := parseStreamID(id.bulk, 0)
+		if !ok {
+			cdcStream.mu.Unlock()
+			return Value{typ: "error", str: "ERR Invalid stream ID specified as stream command argument"}
+		}
+		after[j] = parsed
+	}
+	cdcStream.mu.Unlock()
+
+	// Inside a transaction or a script, waiting would stall every other client.
+	if c.exclusive && block >= 0 {
+		block = -1
+	}
+
+	var deadline <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		cdcStream.mu.Lock()
+		results := []Value{}
+		for j, key := range keys {
+			if !isCDCStream(key.bulk) {
+				continue
+			}
+			entries := cdcRange(after[j].next(), maxStreamID, count)
+			if len(entries) > 0 {
+				results = append(results, Value{typ: "bulk", bulk: key.bulk}, streamEntriesValue(entries))
+			}
+		}
+		added := cdcStream.added
+		cdcStream.mu.Unlock()
+
+		if len(results) > 0 {
+			if c.proto == 3 {
+				return Value{typ: "map", array: results}
+			}
+			pairs := []Value{}
+			for j := 0; j < len(results); j += 2 {
+				pairs = append(pairs, Value{typ: "array", array: results[j : j+2]})
+			}
+			return Value{typ: "array", array: pairs}
+		}
+		if block < 0 {
+			return Value{typ: "null"}
+		}
+
+		timedOut := false
+		blockUnlocked(func() {
+			select {
+			case <-added:
+			case <-deadline:
+				timedOut = true
+			case <-shuttingDown:
+				timedOut = true
+			}
+		})
+		if timedOut {
+			return Value{typ: "null"}
+		}
+	}
+}
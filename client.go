@@ -0,0 +1,575 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeout closes connections idle for this many seconds; 0 disables it.
+var Timeout = 0
+
+// nextClientID hands out unique, increasing connection ids.
+var nextClientID int64
+
+// Client holds the state of a single client connection.
+type Client struct {
+	id     int64
+	conn   net.Conn
+	writer *RESPWriter
+	mu     sync.Mutex // guards writer, which is also used by other goroutines for pushes
+	output *outputBuffer
+	// streaming is set while a large reply is streamed, which releases mu
+	// while the client reads it; pushes arriving meanwhile are queued in
+	// deferredPushes, to follow the reply, and their size counted against
+	// the output limits in deferredSize. All are guarded by mu.
+	streaming      bool
+	deferredPushes []Value
+	deferredSize   int
+
+	// proto is the RESP version negotiated with HELLO.
+	proto int
+
+	// Connection metadata reported by CLIENT LIST and CLIENT INFO. Fields
+	// below metaMu are written under it because other clients read them.
+	created         time.Time
+	metaMu          sync.Mutex
+	name            string
+	lastCommand     string
+	lastInteraction time.Time
+
+	// db is the index of the selected database.
+	db int
+
+	// user is the ACL user the client is logged in as, nil until it authenticates.
+	user *User
+
+	// Client-side caching state, see tracking.go, guarded by trackingMu.
+	// tracked are the keys read in default mode, not invalidated yet.
+	tracking bool
+	bcast    bool
+	noloop   bool
+	prefixes []string
+	tracked  map[string]struct{}
+
+	// Pub/sub channels, patterns and shard channels the client is subscribed
+	// to, guarded by pubsubMu.
+	channels      map[string]bool
+	patterns      map[string]bool
+	shardChannels map[string]bool
+
+	// Transaction state, see multi.go. Only the client's own goroutine uses it.
+	multi      bool
+	multiDirty bool
+	queued     []queuedCommand
+
+	// aofPending is set once the client appended to the AOF, until its
+	// replies are sent. Only the client's own goroutine uses it.
+	aofPending bool
+
+	// exclusive is set while the client's commands run under the exclusive
+	// execution lock, in EXEC or in a script, where they must not block.
+	exclusive bool
+
+	// Keys watched for the next transaction, guarded by watchMu.
+	watched    map[watchedKey]bool
+	watchDirty bool
+
+	// replica is set, atomically, once the connection attached as a replica
+	// with SYNC or PSYNC, see replication.go. replicaPort is the port it
+	// listens on, from REPLCONF listening-port, and replicaEOF is set once
+	// it announced with REPLCONF capa eof that it loads datasets streamed
+	// without a file.
+	replica     int32
+	replicaPort string
+	replicaEOF  bool
+
+	// master is set on the client applying the command stream of the
+	// primary, on a replica.
+	master bool
+
+	// asking is set by ASKING for the next command, in cluster mode.
+	asking bool
+
+	// oom is set while a write runs that found the dataset above maxmemory
+	// and nothing to evict. Only the client's own goroutine uses it.
+	oom bool
+}
+
+// Clients is the registry of connected clients by id.
+var Clients = map[int64]*Client{}
+var ClientsMu = sync.RWMutex{}
+
+// newReplayClient creates a connectionless client used to apply commands
+// loaded from persistence. It is not registered and has full permissions.
+func newReplayClient() *Client {
+	return &Client{proto: 2, user: Users["default"], created: time.Now()}
+}
+
+// NewClient creates the state for a newly accepted connection and registers it.
+func NewClient(conn net.Conn) *Client {
+	now := time.Now()
+	c := &Client{
+		id:              atomic.AddInt64(&nextClientID, 1),
+		conn:            conn,
+		proto:           2,
+		created:         now,
+		lastInteraction: now,
+		user:            autoAuthUser(),
+	}
+	c.output = newOutputBuffer(conn, c.outputClass)
+	c.writer = NewRESPWriter(c.output)
+
+	// WebSocket clients get JSON frames, and RESP3 semantics so that they
+	// can publish while subscribed.
+	if _, ok := conn.(*wsConn); ok {
+		c.writer.marshal = marshalWebSocket
+		c.proto = 3
+	}
+
+	ClientsMu.Lock()
+	Clients[c.id] = c
+	ClientsMu.Unlock()
+
+	return c
+}
+
+// Write buffers a reply for the client. It returns the error if the reply
+// can't be marshaled or the output buffer was dropped, as the client went
+// over its limits, and the connection must then be closed, since the client
+// would miss a reply. Large replies are streamed to the client as it reads
+// them, except those to writes, which must wait for the AOF. Only the
+// client's own goroutine may call it.
+func (c *Client) Write(v Value) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.aofPending && v.large() {
+		c.streaming = true
+		err := c.writer.Stream(v, func() error {
+			c.mu.Unlock()
+			defer c.mu.Lock()
+			return c.output.waitBelow(replyChunkSize)
+		})
+		c.streaming = false
+
+		pushes := c.deferredPushes
+		c.output.release(c.deferredSize)
+		c.deferredPushes, c.deferredSize = nil, 0
+		for _, push := range pushes {
+			if err == nil {
+				err = c.writer.Write(push)
+			}
+		}
+		if err == nil && len(pushes) > 0 {
+			err = c.writer.Flush()
+		}
+		return err
+	}
+	return c.writer.Write(v)
+}
+
+// Flush sends all buffered replies to the client.
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.writer.Flush()
+}
+
+// flushReplies sends the buffered replies, once the writes the client made
+// since they were last sent reached the AOF. If they can't be written and
+// stop-writes-on-persistence-error is set, the replies are dropped instead
+// and the error returned, for the connection to be closed, so that the
+// writes aren't acknowledged. Only the client's own goroutine may call it.
+func (c *Client) flushReplies() error {
+	if c.aofPending {
+		c.aofPending = false
+		if err := aof.Flush(); err != nil {
+			fmt.Println("Error writing to AOF:", err)
+			if stopWrites() {
+				c.mu.Lock()
+				c.writer.Discard()
+				c.mu.Unlock()
+				return err
+			}
+		}
+	}
+	return c.Flush()
+}
+
+// Push writes an out-of-band RESP3 push message and flushes it immediately,
+// or once the large reply being streamed to the client was, without waiting
+// for the client to read it.
+func (c *Client) Push(v Value) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.streaming {
+		bytes, err := v.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := c.output.hold(len(bytes)); err != nil {
+			return err
+		}
+		c.deferredPushes = append(c.deferredPushes, v)
+		c.deferredSize += len(bytes)
+		return nil
+	}
+	if err := c.writer.Write(v); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// refreshIdleDeadline pushes back the point at which an idle client is disconnected.
+func (c *Client) refreshIdleDeadline() {
+	configMu.RLock()
+	timeout := Timeout
+	configMu.RUnlock()
+
+	// Subscribers and replicas legitimately stay silent while waiting for
+	// messages or commands.
+	if timeout <= 0 || c.subscriptionCount() > 0 || atomic.LoadInt32(&c.replica) == 1 {
+		c.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+}
+
+// database returns the client's selected database.
+func (c *Client) database() *Database {
+	return Databases[c.db]
+}
+
+// outputClass returns the class whose output buffer limits apply to the client.
+func (c *Client) outputClass() string {
+	if atomic.LoadInt32(&c.replica) == 1 {
+		return "replica"
+	}
+	if c.subscriptionCount() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// Close releases the server-side state held for the client, giving queued
+// replies a moment to reach the connection.
+func (c *Client) Close() {
+	ClientsMu.Lock()
+	delete(Clients, c.id)
+	ClientsMu.Unlock()
+
+	disableTracking(c)
+	unsubscribeAll(c)
+	unwatchAll(c)
+	removeReplica(c)
+
+	c.flushReplies()
+	c.output.Close(time.Second)
+}
+
+// touch records the command the client is about to run.
+func (c *Client) touch(command string) {
+	c.metaMu.Lock()
+	c.lastCommand = strings.ToLower(command)
+	c.lastInteraction = time.Now()
+	c.metaMu.Unlock()
+}
+
+// info describes the client in the format used by CLIENT LIST and CLIENT INFO.
+func (c *Client) info() string {
+	pubsubMu.RLock()
+	channels, patterns, shardChannels := len(c.channels), len(c.patterns), len(c.shardChannels)
+	pubsubMu.RUnlock()
+
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+
+	user := ""
+	if c.user != nil {
+		user = c.user.name
+	}
+	now := time.Now()
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=%d sub=%d psub=%d ssub=%d omem=%d cmd=%s user=%s resp=%d",
+		c.id, c.conn.RemoteAddr(), c.conn.LocalAddr(), c.name,
+		int(now.Sub(c.created).Seconds()), int(now.Sub(c.lastInteraction).Seconds()),
+		c.db, channels, patterns, shardChannels, c.output.Size(), c.lastCommand, user, c.proto)
+}
+
+// handleHello handles "HELLO [protover [AUTH username password] [SETNAME
+// clientname]]", switching the protocol version, authenticating and naming
+// the client, and describing the server.
+func handleHello(c *Client, args []Value) Value {
+	proto := 0
+	if len(args) > 0 {
+		var err error
+		proto, err = strconv.Atoi(args[0].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if proto != 2 && proto != 3 {
+			return Value{typ: "error", str: "NOPROTO unsupported protocol version"}
+		}
+	}
+
+	var auth []Value
+	var name *string
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].bulk); {
+		case option == "AUTH" && i+2 < len(args):
+			auth = args[i+1 : i+3]
+			i += 2
+		case option == "SETNAME" && i+1 < len(args):
+			if !validClientName(args[i+1].bulk) {
+				return Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."}
+			}
+			name = &args[i+1].bulk
+			i++
+		default:
+			return Value{typ: "error", str: "ERR Syntax error in HELLO option '" + args[i].bulk + "'"}
+		}
+	}
+
+	if auth != nil {
+		if reply := handleAuth(c, auth); reply.typ == "error" {
+			return reply
+		}
+	}
+	if !isAuthenticated(c) {
+		return Value{typ: "error", str: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	c.metaMu.Lock()
+	if proto != 0 {
+		c.proto = proto
+	}
+	if name != nil {
+		c.name = *name
+	}
+	c.metaMu.Unlock()
+
+	mode := "standalone"
+	if clusterMode() {
+		mode = "cluster"
+	}
+	role := "master"
+	if atomic.LoadInt32(&replicating) == 1 {
+		role = "replica"
+	}
+	info := []Value{
+		{typ: "bulk", bulk: "server"}, {typ: "bulk", bulk: "stormydb"},
+		{typ: "bulk", bulk: "proto"}, {typ: "integer", num: c.proto},
+		{typ: "bulk", bulk: "id"}, {typ: "integer", num: int(c.id)},
+		{typ: "bulk", bulk: "mode"}, {typ: "bulk", bulk: mode},
+		{typ: "bulk", bulk: "role"}, {typ: "bulk", bulk: role},
+	}
+
+	if c.proto == 3 {
+		return Value{typ: "map", array: info}
+	}
+	return Value{typ: "array", array: info}
+}
+
+// handleReset handles the "RESET" command, returning the connection to the
+// state of a freshly accepted one.
+func handleReset(c *Client, args []Value) Value {
+	disableTracking(c)
+	unsubscribeAll(c)
+	c.discardTransaction()
+
+	c.metaMu.Lock()
+	c.db = 0
+	c.proto = 2
+	c.user = autoAuthUser()
+	c.metaMu.Unlock()
+
+	return Value{typ: "string", str: "RESET"}
+}
+
+// handleClientCommand handles the "CLIENT" command and its subcommands.
+func handleClientCommand(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "TRACKING":
+		return handleClientTracking(c, args[1:])
+	case "ID":
+		return Value{typ: "integer", num: int(c.id)}
+	case "INFO":
+		return Value{typ: "bulk", bulk: c.info() + "\n"}
+	case "LIST":
+		return handleClientList(args[1:])
+	case "SETNAME":
+		return handleClientSetName(c, args[1:])
+	case "GETNAME":
+		c.metaMu.Lock()
+		name := c.name
+		c.metaMu.Unlock()
+		if name == "" {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: name}
+	case "KILL":
+		return handleClientKill(c, args[1:])
+	case "PAUSE":
+		return handleClientPause(args[1:])
+	case "UNPAUSE":
+		return handleClientUnpause(args[1:])
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+}
+
+// handleClientList handles "CLIENT LIST [ID id ...]".
+func handleClientList(args []Value) Value {
+	ids := map[int64]bool{}
+	if len(args) > 0 {
+		if strings.ToUpper(args[0].bulk) != "ID" || len(args) == 1 {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(arg.bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "ERR Invalid client ID"}
+			}
+			ids[id] = true
+		}
+	}
+
+	ClientsMu.RLock()
+	clients := make([]*Client, 0, len(Clients))
+	for id, client := range Clients {
+		if len(ids) == 0 || ids[id] {
+			clients = append(clients, client)
+		}
+	}
+	ClientsMu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	var list strings.Builder
+	for _, client := range clients {
+		list.WriteString(client.info())
+		list.WriteString("\n")
+	}
+
+	return Value{typ: "bulk", bulk: list.String()}
+}
+
+// handleClientSetName handles "CLIENT SETNAME name".
+func handleClientSetName(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|setname' command"}
+	}
+
+	name := args[0].bulk
+	if !validClientName(name) {
+		return Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."}
+	}
+
+	c.metaMu.Lock()
+	c.name = name
+	c.metaMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// validClientName reports whether name, set with CLIENT SETNAME or HELLO,
+// is made of printable characters other than spaces only.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// handleClientKill handles "CLIENT KILL addr" and "CLIENT KILL [ID id] [ADDR addr] [USER name] [SKIPME yes|no]".
+func handleClientKill(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|kill' command"}
+	}
+
+	// The old single-argument form kills by address and fails if nobody matched.
+	legacy := len(args) == 1
+	var id int64
+	addr, user := "", ""
+	skipMe := true
+
+	if legacy {
+		addr = args[0].bulk
+	} else {
+		if len(args)%2 != 0 {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		for i := 0; i < len(args); i += 2 {
+			option, arg := strings.ToUpper(args[i].bulk), args[i+1].bulk
+			switch option {
+			case "ID":
+				parsed, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					return Value{typ: "error", str: "ERR client-id should be greater than 0"}
+				}
+				id = parsed
+			case "ADDR":
+				addr = arg
+			case "USER":
+				user = arg
+			case "SKIPME":
+				switch strings.ToLower(arg) {
+				case "yes":
+					skipMe = true
+				case "no":
+					skipMe = false
+				default:
+					return Value{typ: "error", str: "ERR syntax error"}
+				}
+			default:
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+		}
+	}
+
+	ClientsMu.RLock()
+	victims := []*Client{}
+	for _, client := range Clients {
+		if id != 0 && client.id != id {
+			continue
+		}
+		if addr != "" && client.conn.RemoteAddr().String() != addr {
+			continue
+		}
+		if user != "" && (client.user == nil || client.user.name != user) {
+			continue
+		}
+		if client == c && skipMe && !legacy {
+			continue
+		}
+		victims = append(victims, client)
+	}
+	ClientsMu.RUnlock()
+
+	// Closing the connection makes the client's own goroutine exit and clean up.
+	for _, client := range victims {
+		client.conn.Close()
+	}
+
+	if legacy {
+		if len(victims) == 0 {
+			return Value{typ: "error", str: "ERR No such client"}
+		}
+		return Value{typ: "string", str: "OK"}
+	}
+	return Value{typ: "integer", num: len(victims)}
+}
@@ -0,0 +1,940 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Handlers["CLUSTER"] = handleCluster
+	Handlers["ASKING"] = handleAsking
+}
+
+// Cluster configuration.
+var (
+	// ClusterEnabled is "yes" to run as a node of a cluster, serving the
+	// keys of the hash slots assigned to it.
+	ClusterEnabled = "no"
+	// ClusterConfigFile is the file the node keeps its view of the cluster
+	// in: its ID, the other nodes and the slots each serves.
+	ClusterConfigFile = "nodes.conf"
+	// ClusterNodeTimeout is how many milliseconds a node may not answer
+	// before it is suspected to have failed.
+	ClusterNodeTimeout = 15000
+	// ClusterRequireFullCoverage is "yes" to refuse keys while any slot
+	// isn't served, "no" to keep serving the others.
+	ClusterRequireFullCoverage = "yes"
+)
+
+// clusterSlots is the number of hash slots keys are spread over.
+const clusterSlots = 16384
+
+// clusterNode is a node of the cluster.
+type clusterNode struct {
+	id string
+	// host and port are the address clients reach the node at, and
+	// busPort the port of its cluster bus.
+	host    string
+	port    int
+	busPort int
+	// configEpoch orders the claims of nodes on slots: the highest wins.
+	configEpoch int64
+
+	// handshake is set for a node met but not answered yet, under an ID
+	// of its own until it tells its real one.
+	handshake bool
+	created   time.Time
+	// pfail is set while the node hasn't answered for ClusterNodeTimeout,
+	// and fail once a majority of the nodes serving slots agreed it failed.
+	pfail, fail bool
+	// pingSent is when the ping the node didn't answer yet was sent, and
+	// seen when it last sent a message, in Unix milliseconds.
+	pingSent, seen int64
+	// failureReports maps the nodes that reported the node failing to
+	// when they last did, in Unix milliseconds.
+	failureReports map[string]int64
+
+	// link is the node's link from this one, nil until started.
+	link *clusterLink
+}
+
+// addr returns the address clients reach the node at.
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+// cluster is the node's view of the cluster, guarded by mu.
+var cluster = struct {
+	mu     sync.RWMutex
+	myself *clusterNode
+	nodes  map[string]*clusterNode
+	// slots maps every slot to the node serving it, nil while unassigned.
+	slots [clusterSlots]*clusterNode
+	// migrating maps the slots the node serves that move to another node
+	// to that node, and importing the slots that move to this node to the
+	// node serving them, see CLUSTER SETSLOT.
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+	// currentEpoch is the highest epoch seen in the cluster.
+	currentEpoch int64
+	// state is "ok" while the node serves keys, "fail" while it refuses
+	// them, see updateClusterState.
+	state string
+	// forgotten maps the nodes removed with CLUSTER FORGET to when they may
+	// be learned about again.
+	forgotten map[string]time.Time
+}{
+	nodes: map[string]*clusterNode{}, migrating: map[int]*clusterNode{}, importing: map[int]*clusterNode{},
+	state: "fail", forgotten: map[string]time.Time{},
+}
+
+// clusterMode reports whether the server runs as a node of a cluster.
+func clusterMode() bool {
+	return ClusterEnabled == "yes"
+}
+
+// keyHashSlot returns the slot of a key: the CRC16 of the key modulo the
+// number of slots. A key holding a hash tag, a non-empty part between the
+// first "{" and the first "}" after it, like user in {user}:1, is hashed by
+// the tag alone, so keys sharing a tag are in the same slot and can be used
+// together.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+// crc16Table holds the CRC16-CCITT (XModem) of every byte, as Redis hashes
+// keys with.
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 returns the CRC16-CCITT (XModem) of s.
+func crc16(s string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// startCluster loads the cluster's configuration, creating it with the
+// node alone, under a new ID, the first time, and starts the cluster bus and
+// the proxy.
+func startCluster() error {
+	if !clusterMode() {
+		return nil
+	}
+
+	if err := loadClusterConfig(); err != nil {
+		return err
+	}
+	listeners, err := listenAll(strconv.Itoa(cluster.myself.busPort), listenTCP)
+	if err != nil {
+		return fmt.Errorf("cluster bus: %w", err)
+	}
+	for _, listener := range listeners {
+		fmt.Println("Cluster bus listening on", listener.Addr())
+		go acceptClusterBus(listener)
+	}
+	go runCluster()
+
+	if ClusterProxyPort != "" {
+		listeners, err := listenAll(ClusterProxyPort, listenTCP)
+		if err != nil {
+			return fmt.Errorf("cluster proxy: %w", err)
+		}
+		for _, listener := range listeners {
+			fmt.Println("Cluster proxy listening on", listener.Addr())
+			go acceptClusterProxy(listener)
+		}
+	}
+	return nil
+}
+
+// loadClusterConfig loads the cluster's configuration, or creates it.
+func loadClusterConfig() error {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	data, err := os.ReadFile(ClusterConfigFile)
+	if os.IsNotExist(err) {
+		cluster.myself = newClusterNode(newReplicationID(), "", 0, 0)
+		cluster.nodes[cluster.myself.id] = cluster.myself
+	} else if err != nil {
+		return err
+	} else if err := parseClusterConfig(string(data)); err != nil {
+		return fmt.Errorf("%s: %w", ClusterConfigFile, err)
+	}
+
+	configMu.RLock()
+	cluster.myself.port, _ = strconv.Atoi(Port)
+	configMu.RUnlock()
+	cluster.myself.busPort = cluster.myself.port + 10000
+	updateClusterState()
+
+	fmt.Println("Cluster node", cluster.myself.id)
+	return saveClusterConfig()
+}
+
+// newClusterNode returns a node just learned about.
+func newClusterNode(id, host string, port, busPort int) *clusterNode {
+	return &clusterNode{
+		id: id, host: host, port: port, busPort: busPort,
+		created: time.Now(), seen: nowMillis(), failureReports: map[string]int64{},
+	}
+}
+
+// parseClusterConfig reads the nodes and slots of a configuration written by
+// saveClusterConfig, in the format of Redis's nodes.conf: a line per node,
+// "<id> <host>:<port>@<bus port> <flags> <primary> <ping sent> <pong
+// received> <config epoch> <link state> <slot> ...", where the node's own
+// line is flagged "myself" and slots are numbers or ranges like 0-5460,
+// with "[<slot>->-<id>]" for a slot migrating to another node and
+// "[<slot>-<-<id>]" for one importing from it, and a last line "vars
+// currentEpoch <epoch> lastVoteEpoch <epoch>". cluster.mu must be held for
+// writing.
+func parseClusterConfig(data string) error {
+	type pending struct {
+		slot      int
+		id        string
+		migrating bool
+	}
+	var moves []pending
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					cluster.currentEpoch, _ = strconv.ParseInt(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("invalid line %q", line)
+		}
+
+		addr, _, _ := strings.Cut(fields[1], ",")
+		addr, bus, _ := strings.Cut(addr, "@")
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", fields[1])
+		}
+		n := newClusterNode(fields[0], host, 0, 0)
+		n.port, _ = strconv.Atoi(port)
+		n.busPort, _ = strconv.Atoi(bus)
+		n.configEpoch, _ = strconv.ParseInt(fields[6], 10, 64)
+		cluster.nodes[n.id] = n
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch flag {
+			case "myself":
+				cluster.myself = n
+			case "fail":
+				n.fail = true
+			}
+		}
+
+		for _, slots := range fields[8:] {
+			if strings.HasPrefix(slots, "[") {
+				slot, id, migrating := strings.TrimSuffix(slots[1:], "]"), "", false
+				if s, to, ok := strings.Cut(slot, "->-"); ok {
+					slot, id, migrating = s, to, true
+				} else if s, from, ok := strings.Cut(slot, "-<-"); ok {
+					slot, id = s, from
+				}
+				n, err := strconv.Atoi(slot)
+				if err != nil || n < 0 || n >= clusterSlots || id == "" {
+					return fmt.Errorf("invalid slot %q", slots)
+				}
+				moves = append(moves, pending{n, id, migrating})
+				continue
+			}
+			first, last, err := parseSlotRange(slots)
+			if err != nil {
+				return err
+			}
+			for slot := first; slot <= last; slot++ {
+				cluster.slots[slot] = n
+			}
+		}
+	}
+	if cluster.myself == nil {
+		return fmt.Errorf("no node is flagged myself")
+	}
+
+	for _, move := range moves {
+		n, ok := cluster.nodes[move.id]
+		if !ok {
+			return fmt.Errorf("unknown node %s", move.id)
+		}
+		if move.migrating {
+			cluster.migrating[move.slot] = n
+		} else {
+			cluster.importing[move.slot] = n
+		}
+	}
+	return nil
+}
+
+// parseSlotRange parses a slot or a range of slots, like 0-5460.
+func parseSlotRange(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	a, errA := strconv.Atoi(first)
+	b, errB := strconv.Atoi(last)
+	if errA != nil || errB != nil || a < 0 || b >= clusterSlots || a > b {
+		return 0, 0, fmt.Errorf("invalid slot range %q", s)
+	}
+	return a, b, nil
+}
+
+// saveClusterConfig writes the node's view of the cluster to
+// ClusterConfigFile, replacing it at once. cluster.mu must be held.
+func saveClusterConfig() error {
+	var b strings.Builder
+	for _, n := range sortedNodes() {
+		if !n.handshake {
+			b.WriteString(clusterNodeLine(n))
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "vars currentEpoch %d lastVoteEpoch 0\n", cluster.currentEpoch)
+
+	temp := ClusterConfigFile + ".tmp"
+	if err := os.WriteFile(temp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp, ClusterConfigFile)
+}
+
+// sortedNodes returns the nodes of the cluster by ID. cluster.mu must be
+// held.
+func sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cluster.nodes))
+	for _, n := range cluster.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// clusterNodeLine describes a node as a line of the configuration, with the
+// slots moving from or to it. cluster.mu must be held.
+func clusterNodeLine(n *clusterNode) string {
+	fields := []string{
+		n.id, fmt.Sprintf("%s@%d", n.addr(), n.busPort), strings.Join(n.flags(), ","), "-",
+		strconv.FormatInt(n.pingSent, 10), strconv.FormatInt(n.seen, 10), strconv.FormatInt(n.configEpoch, 10),
+	}
+	if n == cluster.myself || n.link != nil && n.link.connected {
+		fields = append(fields, "connected")
+	} else {
+		fields = append(fields, "disconnected")
+	}
+	for _, r := range nodeSlotRanges(n) {
+		if r[0] == r[1] {
+			fields = append(fields, strconv.Itoa(r[0]))
+		} else {
+			fields = append(fields, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	if n == cluster.myself {
+		fields = append(fields, slotMoves(cluster.migrating, "->-")...)
+		fields = append(fields, slotMoves(cluster.importing, "-<-")...)
+	}
+	return strings.Join(fields, " ")
+}
+
+// flags returns the flags of the node, as CLUSTER NODES lists them.
+// cluster.mu must be held.
+func (n *clusterNode) flags() []string {
+	var flags []string
+	if n == cluster.myself {
+		flags = append(flags, "myself")
+	}
+	if n.handshake {
+		return append(flags, "handshake")
+	}
+	flags = append(flags, "master")
+	switch {
+	case n.fail:
+		flags = append(flags, "fail")
+	case n.pfail:
+		flags = append(flags, "fail?")
+	}
+	return flags
+}
+
+// slotMoves describes the slots moving to or from other nodes, in slot
+// order.
+func slotMoves(moves map[int]*clusterNode, arrow string) []string {
+	slots := make([]int, 0, len(moves))
+	for slot := range moves {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	fields := make([]string, 0, len(slots))
+	for _, slot := range slots {
+		fields = append(fields, fmt.Sprintf("[%d%s%s]", slot, arrow, moves[slot].id))
+	}
+	return fields
+}
+
+// nodeSlotRanges returns the ranges of slots the node serves, as first and
+// last slot. cluster.mu must be held.
+func nodeSlotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cluster.slots[slot] != n {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == slot-1 {
+			ranges[len(ranges)-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// clusterRefused are the commands refused in cluster mode, which only has
+// database 0.
+var clusterRefused = map[string]bool{
+	"MOVE":   true,
+	"SWAPDB": true,
+}
+
+// shardChannelCommands are the commands naming shard channels, which are
+// routed to the node serving their slot like keys.
+var shardChannelCommands = map[string]bool{
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+	"SPUBLISH":     true,
+}
+
+// clusterCheck returns the error sending a client to another node when this
+// one doesn't serve the keys of the command, or nil to run it here. Keys
+// must all hash to the same slot, also across a transaction, else the
+// command is refused with CROSSSLOT. A key of a slot another node serves
+// gets MOVED to it. A slot migrating to another node is still served,
+// except for keys that are missing, having moved already, which get ASK to
+// go there once; a slot importing from another node is only served to
+// clients that sent ASKING just before. The primary's stream is always
+// applied.
+func clusterCheck(c *Client, command string, cmd Command, args []Value) *Value {
+	asking := c.asking || cmd.hasFlag("asking")
+	c.asking = false
+	if !clusterMode() || c.master {
+		return nil
+	}
+
+	if clusterRefused[command] || command == "SELECT" && len(args) == 1 && args[0].bulk != "0" {
+		return &Value{typ: "error", str: "ERR " + command + " is not allowed in cluster mode"}
+	}
+
+	keys := cmd.keys(args)
+	if shardChannelCommands[command] {
+		keys = make([]string, 0, len(args))
+		for i, arg := range args {
+			if command != "SPUBLISH" || i == 0 {
+				keys = append(keys, arg.bulk)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return &Value{typ: "error", str: "CROSSSLOT Keys in request don't hash to the same slot"}
+		}
+	}
+	if c.multi {
+		for _, q := range c.queued {
+			if queued := q.cmd.keys(q.value.array[1:]); len(queued) > 0 && keyHashSlot(queued[0]) != slot {
+				return &Value{typ: "error", str: "CROSSSLOT Keys in request don't hash to the same slot"}
+			}
+		}
+	}
+
+	cluster.mu.RLock()
+	state := cluster.state
+	owner, migrating, importing := cluster.slots[slot], cluster.migrating[slot], cluster.importing[slot]
+	myself := cluster.myself
+	var ownerAddr, migratingAddr string
+	if owner != nil {
+		ownerAddr = owner.addr()
+	}
+	if migrating != nil {
+		migratingAddr = migrating.addr()
+	}
+	cluster.mu.RUnlock()
+
+	if state != "ok" {
+		return &Value{typ: "error", str: "CLUSTERDOWN The cluster is down"}
+	}
+	if migrating == nil && importing == nil {
+		switch owner {
+		case nil:
+			return &Value{typ: "error", str: "CLUSTERDOWN Hash slot not served"}
+		case myself:
+			return nil
+		default:
+			return movedError("MOVED", slot, ownerAddr)
+		}
+	}
+
+	if migrating == nil && !(importing != nil && asking) {
+		if owner == nil {
+			return &Value{typ: "error", str: "CLUSTERDOWN Hash slot not served"}
+		}
+		return movedError("MOVED", slot, ownerAddr)
+	}
+
+	// Keys of a moving slot are where they were last written: missing keys
+	// moved already, or are created on the node they move to.
+	missing := 0
+	db := Databases[0]
+	now := nowMillis()
+	db.mu.RLock()
+	for _, key := range keys {
+		if !db.exists(key) || db.isExpired(key, now) {
+			missing++
+		}
+	}
+	db.mu.RUnlock()
+	switch {
+	case missing > 0 && len(keys) > 1 && !shardChannelCommands[command]:
+		return &Value{typ: "error", str: "TRYAGAIN Multiple keys request during rehashing of slot"}
+	case missing > 0 && migrating != nil && !shardChannelCommands[command]:
+		return movedError("ASK", slot, migratingAddr)
+	}
+	return nil
+}
+
+// movedError returns a MOVED or ASK redirection to the node at addr for the
+// slot.
+func movedError(kind string, slot int, addr string) *Value {
+	return &Value{typ: "error", str: fmt.Sprintf("%s %d %s", kind, slot, addr)}
+}
+
+// handleAsking handles "ASKING", letting the client's next command reach a
+// slot the node imports, after an ASK redirection.
+func handleAsking(c *Client, args []Value) Value {
+	if !clusterMode() {
+		return Value{typ: "error", str: "ERR This instance has cluster support disabled"}
+	}
+	c.asking = true
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleCluster handles the "CLUSTER" command and its subcommands.
+func handleCluster(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster' command"}
+	}
+	if !clusterMode() {
+		return Value{typ: "error", str: "ERR This instance has cluster support disabled"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|keyslot' command"}
+		}
+		return Value{typ: "integer", num: keyHashSlot(args[1].bulk)}
+	case "ADDSLOTS", "DELSLOTS":
+		return handleClusterSlots(args, false)
+	case "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		return handleClusterSlots(args, true)
+	case "SETSLOT":
+		return handleClusterSetSlot(args[1:])
+	case "COUNTKEYSINSLOT":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|countkeysinslot' command"}
+		}
+		slot, err := strconv.Atoi(args[1].bulk)
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			return Value{typ: "error", str: "ERR Invalid slot"}
+		}
+		return Value{typ: "integer", num: countKeysInSlot(slot)}
+	case "GETKEYSINSLOT":
+		if len(args) != 3 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|getkeysinslot' command"}
+		}
+		slot, err := strconv.Atoi(args[1].bulk)
+		count, errCount := strconv.Atoi(args[2].bulk)
+		if err != nil || errCount != nil || slot < 0 || slot >= clusterSlots || count < 0 {
+			return Value{typ: "error", str: "ERR Invalid slot or number of keys"}
+		}
+		keys := keysInSlot(slot, count)
+		reply := make([]Value, 0, len(keys))
+		for _, key := range keys {
+			reply = append(reply, Value{typ: "bulk", bulk: key})
+		}
+		return Value{typ: "array", array: reply}
+	case "MEET":
+		return handleClusterMeet(args[1:])
+	case "FORGET":
+		return handleClusterForget(args[1:])
+	case "COUNT-FAILURE-REPORTS":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|count-failure-reports' command"}
+		}
+		cluster.mu.RLock()
+		defer cluster.mu.RUnlock()
+		n, ok := cluster.nodes[args[1].bulk]
+		if !ok {
+			return Value{typ: "error", str: "ERR Unknown node " + args[1].bulk}
+		}
+		return Value{typ: "integer", num: len(n.failureReports)}
+	case "INFO", "NODES", "SLOTS", "SHARDS", "MYID":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|" + strings.ToLower(args[0].bulk) + "' command"}
+		}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "INFO":
+		return Value{typ: "bulk", bulk: strings.Join(clusterInfo(), "\r\n") + "\r\n"}
+	case "NODES":
+		var b strings.Builder
+		for _, n := range sortedNodes() {
+			b.WriteString(clusterNodeLine(n))
+			b.WriteString("\n")
+		}
+		return Value{typ: "bulk", bulk: b.String()}
+	case "SLOTS", "SHARDS":
+		reply := clusterSlotsReply(c)
+		if strings.ToUpper(args[0].bulk) == "SHARDS" {
+			reply = clusterShardsReply(c)
+		}
+		if c.proto != 3 {
+			reply = resp2Compatible(reply)
+		}
+		return reply
+	case "MYID":
+		return Value{typ: "bulk", bulk: cluster.myself.id}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+}
+
+// handleClusterSlots handles "CLUSTER ADDSLOTS slot ...", "CLUSTER
+// DELSLOTS slot ..." and, with ranges, "CLUSTER ADDSLOTSRANGE first last
+// ..." and "CLUSTER DELSLOTSRANGE first last ...", which assign unassigned
+// slots to the node, or unassign slots, whatever node serves them.
+func handleClusterSlots(args []Value, ranges bool) Value {
+	subcommand := strings.ToLower(args[0].bulk)
+	add := strings.HasPrefix(subcommand, "add")
+	if len(args) < 2 || ranges && len(args)%2 != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|" + subcommand + "' command"}
+	}
+
+	var slots []int
+	seen := map[int]bool{}
+	for i := 1; i < len(args); i++ {
+		first, err := strconv.Atoi(args[i].bulk)
+		last := first
+		if ranges {
+			i++
+			last, err = strconv.Atoi(args[i].bulk)
+			if err == nil && first > last {
+				return Value{typ: "error", str: fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", first, last)}
+			}
+		}
+		if err != nil || first < 0 || last >= clusterSlots {
+			return Value{typ: "error", str: "ERR Invalid or out of range slot"}
+		}
+		for slot := first; slot <= last; slot++ {
+			if seen[slot] {
+				return Value{typ: "error", str: fmt.Sprintf("ERR Slot %d specified multiple times", slot)}
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	for _, slot := range slots {
+		switch {
+		case add && cluster.slots[slot] != nil:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Slot %d is already busy", slot)}
+		case !add && cluster.slots[slot] == nil:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Slot %d is already unassigned", slot)}
+		}
+	}
+	for _, slot := range slots {
+		if add {
+			cluster.slots[slot] = cluster.myself
+			delete(cluster.importing, slot)
+		} else {
+			cluster.slots[slot] = nil
+			delete(cluster.migrating, slot)
+		}
+	}
+	return clusterSaved()
+}
+
+// handleClusterSetSlot handles "CLUSTER SETSLOT slot MIGRATING node",
+// "CLUSTER SETSLOT slot IMPORTING node", "CLUSTER SETSLOT slot STABLE" and
+// "CLUSTER SETSLOT slot NODE node", which mark a slot as moving to or from
+// another node, end its move, or assign it to a node. A slot can't be
+// assigned away while the node still holds keys of it.
+func handleClusterSetSlot(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|setslot' command"}
+	}
+	slot, err := strconv.Atoi(args[0].bulk)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return Value{typ: "error", str: "ERR Invalid or out of range slot"}
+	}
+	action := strings.ToUpper(args[1].bulk)
+	if action == "STABLE" && len(args) != 2 || action != "STABLE" && len(args) != 3 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	var n *clusterNode
+	if action != "STABLE" {
+		var ok bool
+		if n, ok = cluster.nodes[args[2].bulk]; !ok {
+			return Value{typ: "error", str: "ERR I don't know about node " + args[2].bulk}
+		}
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cluster.slots[slot] != cluster.myself {
+			return Value{typ: "error", str: fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot)}
+		}
+		if n == cluster.myself {
+			return Value{typ: "error", str: "ERR I can't migrate a slot to myself"}
+		}
+		cluster.migrating[slot] = n
+	case "IMPORTING":
+		if cluster.slots[slot] == cluster.myself {
+			return Value{typ: "error", str: fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot)}
+		}
+		if n == cluster.myself {
+			return Value{typ: "error", str: "ERR I can't import a slot from myself"}
+		}
+		cluster.importing[slot] = n
+	case "STABLE":
+		delete(cluster.migrating, slot)
+		delete(cluster.importing, slot)
+	case "NODE":
+		if cluster.slots[slot] == cluster.myself && n != cluster.myself && countKeysInSlot(slot) > 0 {
+			return Value{typ: "error", str: fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)}
+		}
+		// Taking over a slot imported from another node claims it with a
+		// new epoch, for the other nodes to prefer this claim to the
+		// former owner's.
+		if n == cluster.myself && cluster.importing[slot] != nil {
+			bumpConfigEpoch()
+		}
+		cluster.slots[slot] = n
+		delete(cluster.migrating, slot)
+		if n == cluster.myself {
+			delete(cluster.importing, slot)
+		}
+	default:
+		return Value{typ: "error", str: "ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"}
+	}
+	return clusterSaved()
+}
+
+// countKeysInSlot returns the number of keys of the slot, going over all
+// the keys.
+func countKeysInSlot(slot int) int {
+	return len(keysInSlot(slot, -1))
+}
+
+// keysInSlot returns up to count keys of the slot, all with a negative
+// count, going over all the keys.
+func keysInSlot(slot, count int) []string {
+	db := Databases[0]
+	now := nowMillis()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	keys := []string{}
+	db.store.IterateKeys(func(key string) bool {
+		if count >= 0 && len(keys) >= count {
+			return false
+		}
+		if keyHashSlot(key) == slot && !db.isExpired(key, now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// clusterSaved saves the configuration after a change, replying with OK or
+// the error. cluster.mu must be held for writing.
+func clusterSaved() Value {
+	updateClusterState()
+	if err := saveClusterConfig(); err != nil {
+		return Value{typ: "error", str: "ERR saving the cluster configuration: " + err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// infoCluster reports whether cluster mode is enabled.
+func infoCluster() []string {
+	enabled := 0
+	if clusterMode() {
+		enabled = 1
+	}
+	return []string{fmt.Sprintf("cluster_enabled:%d", enabled)}
+}
+
+// clusterInfo returns the lines of CLUSTER INFO: whether every slot is
+// served, and how many slots and nodes there are. cluster.mu must be held.
+func clusterInfo() []string {
+	assigned, pfail, fail := 0, 0, 0
+	for _, n := range cluster.slots {
+		switch {
+		case n == nil:
+			continue
+		case n.fail:
+			fail++
+		case n.pfail:
+			pfail++
+		}
+		assigned++
+	}
+	return []string{
+		"cluster_state:" + cluster.state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(cluster.nodes)),
+		fmt.Sprintf("cluster_size:%d", len(servingNodes())),
+		fmt.Sprintf("cluster_current_epoch:%d", cluster.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", cluster.myself.configEpoch),
+	}
+}
+
+// slotRange is a run of consecutive slots served by the same node.
+type slotRange struct {
+	first, last int
+	node        *clusterNode
+}
+
+// assignedSlotRanges returns the runs of assigned slots, in slot order.
+// cluster.mu must be held.
+func assignedSlotRanges() []slotRange {
+	var ranges []slotRange
+	for slot, n := range cluster.slots {
+		switch {
+		case n == nil:
+		case len(ranges) > 0 && ranges[len(ranges)-1].node == n && ranges[len(ranges)-1].last == slot-1:
+			ranges[len(ranges)-1].last = slot
+		default:
+			ranges = append(ranges, slotRange{slot, slot, n})
+		}
+	}
+	return ranges
+}
+
+// nodeHost returns the host clients reach the node at. A node that doesn't
+// know its own address yet, as it was never met by another, is reached at
+// the address the client connected to.
+func nodeHost(c *Client, n *clusterNode) string {
+	if n.host != "" || c.conn == nil {
+		return n.host
+	}
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	return host
+}
+
+// clusterSlotsReply replies to CLUSTER SLOTS with every run of assigned
+// slots, as its first and last slot and the node serving it: its host,
+// port and ID. cluster.mu must be held.
+func clusterSlotsReply(c *Client) Value {
+	ranges := assignedSlotRanges()
+	reply := make([]Value, 0, len(ranges))
+	for _, r := range ranges {
+		reply = append(reply, Value{typ: "array", array: []Value{
+			{typ: "integer", num: r.first},
+			{typ: "integer", num: r.last},
+			{typ: "array", array: []Value{
+				{typ: "bulk", bulk: nodeHost(c, r.node)},
+				{typ: "integer", num: r.node.port},
+				{typ: "bulk", bulk: r.node.id},
+				{typ: "map"},
+			}},
+		}})
+	}
+	return Value{typ: "array", array: reply}
+}
+
+// clusterShardsReply replies to CLUSTER SHARDS with a shard per node: the
+// slot ranges it serves, as first and last slots, and its description.
+// cluster.mu must be held.
+func clusterShardsReply(c *Client) Value {
+	nodes := sortedNodes()
+	reply := make([]Value, 0, len(nodes))
+	for _, n := range nodes {
+		var slots []Value
+		for _, r := range nodeSlotRanges(n) {
+			slots = append(slots, Value{typ: "integer", num: r[0]}, Value{typ: "integer", num: r[1]})
+		}
+		host := nodeHost(c, n)
+		node := Value{typ: "map", array: []Value{
+			{typ: "bulk", bulk: "id"}, {typ: "bulk", bulk: n.id},
+			{typ: "bulk", bulk: "port"}, {typ: "integer", num: n.port},
+			{typ: "bulk", bulk: "ip"}, {typ: "bulk", bulk: host},
+			{typ: "bulk", bulk: "endpoint"}, {typ: "bulk", bulk: host},
+			{typ: "bulk", bulk: "role"}, {typ: "bulk", bulk: "master"},
+			{typ: "bulk", bulk: "replication-offset"}, {typ: "integer", num: 0},
+			{typ: "bulk", bulk: "health"}, {typ: "bulk", bulk: "online"},
+		}}
+		reply = append(reply, Value{typ: "map", array: []Value{
+			{typ: "bulk", bulk: "slots"}, {typ: "array", array: slots},
+			{typ: "bulk", bulk: "nodes"}, {typ: "array", array: []Value{node}},
+		}})
+	}
+	return Value{typ: "array", array: reply}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// clusterPingInterval is how often a node pings every other over the
+// cluster bus.
+const clusterPingInterval = time.Second
+
+// clusterForgetTime is how long a node removed with CLUSTER FORGET isn't
+// learned about again from the gossip of the others.
+const clusterForgetTime = time.Minute
+
+// The cluster bus links every node to every other, on the port 10000 above
+// the node's. Each node pings the others every clusterPingInterval with
+// RESP arrays of bulk strings:
+//
+//	PING|MEET <id> <port> <bus port> <config epoch> <current epoch> <slots>
+//	    [<id> <host> <port> <bus port> <flags>] ...
+//
+// where slots is a bitmap of the slots the sender serves, and the groups
+// after it gossip about the other nodes the sender knows, flagged "pfail",
+// "fail" or "-". Nodes answer with the same message, as PONG. MEET, sent to
+// a node met with CLUSTER MEET or learned about from gossip, makes the
+// receiver learn about the sender, which a PING doesn't. Once a majority of
+// the nodes agree a node failed, the first to notice sends
+//
+//	FAIL <id> <failed id>
+//
+// to the others, which reply OK.
+
+// clusterLink is the link from this node to another over the cluster bus.
+type clusterLink struct {
+	node *clusterNode
+	stop chan struct{}
+	// wake is signalled when messages were added to pending.
+	wake chan struct{}
+
+	// The fields below are guarded by cluster.mu.
+	connected bool
+	// pending holds the messages to send before the next ping.
+	pending [][]string
+}
+
+// clusterNodeTimeout returns ClusterNodeTimeout in milliseconds.
+func clusterNodeTimeout() int64 {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return int64(ClusterNodeTimeout)
+}
+
+// runCluster links every known node, suspects the nodes that stopped
+// answering to have failed and updates the state of the cluster, ten times
+// a second.
+func runCluster() {
+	for {
+		time.Sleep(100 * time.Millisecond)
+		timeout := clusterNodeTimeout()
+
+		cluster.mu.Lock()
+		now := nowMillis()
+		changed := false
+		for _, n := range cluster.nodes {
+			if n == cluster.myself {
+				continue
+			}
+			if n.link == nil {
+				n.link = &clusterLink{node: n, stop: make(chan struct{}), wake: make(chan struct{}, 1)}
+				go n.link.run()
+			}
+			if n.handshake && time.Since(n.created) > max(time.Duration(timeout)*time.Millisecond, time.Second) {
+				fmt.Println("Handshake with node", n.addr(), "timed out")
+				removeClusterNode(n)
+				continue
+			}
+			for id, when := range n.failureReports {
+				if now-when > 2*timeout {
+					delete(n.failureReports, id)
+				}
+			}
+			if !n.handshake && !n.pfail && !n.fail && now-n.seen > timeout {
+				fmt.Println("Node", n.id, "possibly failing")
+				n.pfail = true
+			}
+			if markFailedIfAgreed(n) {
+				changed = true
+			}
+		}
+		for id, until := range cluster.forgotten {
+			if time.Now().After(until) {
+				delete(cluster.forgotten, id)
+			}
+		}
+		updateClusterState()
+		if changed {
+			if err := saveClusterConfig(); err != nil {
+				fmt.Println("Error saving the cluster configuration:", err)
+			}
+		}
+		cluster.mu.Unlock()
+	}
+}
+
+// updateClusterState sets cluster.state to "ok" while the node serves keys:
+// it reaches a majority of the nodes serving slots and, unless
+// ClusterRequireFullCoverage is "no", every slot is served by a node not
+// failing. cluster.mu must be held for writing.
+func updateClusterState() {
+	configMu.RLock()
+	fullCoverage := ClusterRequireFullCoverage == "yes"
+	configMu.RUnlock()
+
+	state := "ok"
+	if fullCoverage {
+		for _, n := range cluster.slots {
+			if n == nil || n.fail {
+				state = "fail"
+				break
+			}
+		}
+	}
+	// A node cut off from most of the nodes serving slots refuses keys
+	// until it rejoins them.
+	serving := servingNodes()
+	reachable := 0
+	for n := range serving {
+		if n == cluster.myself || !n.pfail && !n.fail {
+			reachable++
+		}
+	}
+	if reachable < len(serving)/2+1 {
+		state = "fail"
+	}
+
+	if state != cluster.state {
+		fmt.Println("Cluster state changed:", state)
+		cluster.state = state
+	}
+}
+
+// servingNodes returns the nodes serving slots. cluster.mu must be held.
+func servingNodes() map[*clusterNode]bool {
+	serving := map[*clusterNode]bool{}
+	for _, n := range cluster.slots {
+		if n != nil {
+			serving[n] = true
+		}
+	}
+	return serving
+}
+
+// markFailedIfAgreed marks a node suspected to have failed as failed once
+// a majority of the nodes serving slots reported it failing, counting this
+// one, and tells the other nodes. cluster.mu must be held for writing.
+func markFailedIfAgreed(n *clusterNode) bool {
+	if !n.pfail {
+		return false
+	}
+	reports := len(n.failureReports) + 1
+	if reports < len(servingNodes())/2+1 {
+		return false
+	}
+
+	fmt.Println("Marking node", n.id, "as failed, a majority agreed")
+	n.pfail, n.fail = false, true
+	for _, other := range cluster.nodes {
+		if other != cluster.myself && other != n && !other.handshake && other.link != nil {
+			other.link.pending = append(other.link.pending, []string{"FAIL", cluster.myself.id, n.id})
+			select {
+			case other.link.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return true
+}
+
+// removeClusterNode removes a node, unassigning the slots it serves.
+// cluster.mu must be held for writing.
+func removeClusterNode(n *clusterNode) {
+	delete(cluster.nodes, n.id)
+	if n.link != nil {
+		close(n.link.stop)
+	}
+	for slot, owner := range cluster.slots {
+		if owner == n {
+			cluster.slots[slot] = nil
+		}
+	}
+	for slot, other := range cluster.migrating {
+		if other == n {
+			delete(cluster.migrating, slot)
+		}
+	}
+	for slot, other := range cluster.importing {
+		if other == n {
+			delete(cluster.importing, slot)
+		}
+	}
+	for _, other := range cluster.nodes {
+		delete(other.failureReports, n.id)
+	}
+}
+
+// startHandshake starts meeting the node at the address, unless a node is
+// known at it already. cluster.mu must be held for writing.
+func startHandshake(host string, port, busPort int) {
+	for _, n := range cluster.nodes {
+		if n.host == host && n.port == port {
+			return
+		}
+	}
+	n := newClusterNode(newReplicationID(), host, port, busPort)
+	n.handshake = true
+	cluster.nodes[n.id] = n
+}
+
+// bumpConfigEpoch gives the node a config epoch higher than any other.
+// cluster.mu must be held for writing.
+func bumpConfigEpoch() {
+	cluster.currentEpoch++
+	cluster.myself.configEpoch = cluster.currentEpoch
+	fmt.Println("New config epoch", cluster.myself.configEpoch)
+}
+
+// clusterMessage returns a PING, MEET or PONG message describing this node
+// and gossiping about the others. cluster.mu must be held.
+func clusterMessage(kind string) []string {
+	myself := cluster.myself
+	slots := make([]byte, clusterSlots/8)
+	for slot, n := range cluster.slots {
+		if n == myself {
+			slots[slot/8] |= 1 << (slot % 8)
+		}
+	}
+	message := []string{
+		kind, myself.id, strconv.Itoa(myself.port), strconv.Itoa(myself.busPort),
+		strconv.FormatInt(myself.configEpoch, 10), strconv.FormatInt(cluster.currentEpoch, 10), string(slots),
+	}
+	for _, n := range cluster.nodes {
+		if n == myself || n.handshake || n.host == "" {
+			continue
+		}
+		flags := "-"
+		switch {
+		case n.fail:
+			flags = "fail"
+		case n.pfail:
+			flags = "pfail"
+		}
+		message = append(message, n.id, n.host, strconv.Itoa(n.port), strconv.Itoa(n.busPort), flags)
+	}
+	return message
+}
+
+// clusterMessageFields returns the bulk strings of a message, if it has
+// the fields of a PING, MEET or PONG.
+func clusterMessageFields(v Value) ([]string, bool) {
+	fields := make([]string, 0, len(v.array))
+	for _, arg := range v.array {
+		fields = append(fields, arg.bulk)
+	}
+	if v.typ != "array" || len(fields) < 7 || (len(fields)-7)%5 != 0 || len(fields[6]) != clusterSlots/8 {
+		return nil, false
+	}
+	return fields, true
+}
+
+// processClusterMessage updates what the node knows from a PING, MEET or
+// PONG sender sent: its address, epochs and slots, and its gossip about the
+// other nodes. cluster.mu must be held for writing.
+func processClusterMessage(sender *clusterNode, fields []string) {
+	changed := false
+	sender.seen = nowMillis()
+	if port, err := strconv.Atoi(fields[2]); err == nil && port != sender.port {
+		sender.port, changed = port, true
+	}
+	if busPort, err := strconv.Atoi(fields[3]); err == nil && busPort != sender.busPort {
+		sender.busPort, changed = busPort, true
+	}
+	sender.pfail = false
+	if sender.fail {
+		fmt.Println("Clearing the failed state of node", sender.id, "as it is reachable again")
+		sender.fail, changed = false, true
+	}
+
+	configEpoch, _ := strconv.ParseInt(fields[4], 10, 64)
+	currentEpoch, _ := strconv.ParseInt(fields[5], 10, 64)
+	if currentEpoch > cluster.currentEpoch {
+		cluster.currentEpoch, changed = currentEpoch, true
+	}
+	if configEpoch > sender.configEpoch {
+		sender.configEpoch, changed = configEpoch, true
+	}
+	if updateSlots(sender, fields[6]) {
+		changed = true
+	}
+
+	// Two nodes with the same config epoch can't tell whose claim on a
+	// slot wins, so the one with the lower ID takes a new epoch.
+	if sender.configEpoch == cluster.myself.configEpoch && cluster.myself.id < sender.id {
+		bumpConfigEpoch()
+		changed = true
+	}
+
+	for i := 7; i+5 <= len(fields); i += 5 {
+		id, host, flags := fields[i], fields[i+1], fields[i+4]
+		port, _ := strconv.Atoi(fields[i+2])
+		busPort, _ := strconv.Atoi(fields[i+3])
+		if id == cluster.myself.id {
+			continue
+		}
+		if n, ok := cluster.nodes[id]; ok {
+			if n.handshake {
+				continue
+			}
+			if flags == "pfail" || flags == "fail" {
+				n.failureReports[sender.id] = nowMillis()
+				if markFailedIfAgreed(n) {
+					changed = true
+				}
+			} else {
+				delete(n.failureReports, sender.id)
+			}
+			continue
+		}
+		if _, forgotten := cluster.forgotten[id]; !forgotten && host != "" && port > 0 {
+			startHandshake(host, port, busPort)
+		}
+	}
+
+	if changed {
+		updateClusterState()
+		if err := saveClusterConfig(); err != nil {
+			fmt.Println("Error saving the cluster configuration:", err)
+		}
+	}
+}
+
+// updateSlots assigns the slots the sender claims in its bitmap to it, when
+// unassigned or claimed by a node with a lower config epoch, except for
+// slots this node imports. cluster.mu must be held for writing.
+func updateSlots(sender *clusterNode, bitmap string) bool {
+	changed := false
+	for slot := 0; slot < clusterSlots; slot++ {
+		if bitmap[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := cluster.slots[slot]
+		if owner == sender || cluster.importing[slot] != nil {
+			continue
+		}
+		if owner == nil || owner.configEpoch < sender.configEpoch {
+			if owner == cluster.myself {
+				fmt.Printf("Slot %d is now served by node %s\n", slot, sender.id)
+				delete(cluster.migrating, slot)
+			}
+			cluster.slots[slot] = sender
+			changed = true
+		}
+	}
+	return changed
+}
+
+// run keeps the link up, connecting again after it failed, until the node
+// is removed.
+func (l *clusterLink) run() {
+	for {
+		err := l.ping()
+
+		cluster.mu.Lock()
+		if l.connected && err != nil {
+			fmt.Println("Cluster bus link to node", l.node.id, "lost:", err)
+		}
+		l.connected = false
+		cluster.mu.Unlock()
+
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(clusterPingInterval):
+		}
+	}
+}
+
+// ping connects to the node and pings it every clusterPingInterval, sending
+// the messages queued for it first, until the link fails or the node is
+// removed.
+func (l *clusterLink) ping() error {
+	n := l.node
+	timeout := time.Duration(clusterNodeTimeout()) * time.Millisecond
+	cluster.mu.RLock()
+	addr := net.JoinHostPort(n.host, strconv.Itoa(n.busPort))
+	cluster.mu.RUnlock()
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := NewRESP(conn)
+
+	ticker := time.NewTicker(clusterPingInterval)
+	defer ticker.Stop()
+	for {
+		cluster.mu.Lock()
+		pending := l.pending
+		l.pending = nil
+		kind := "PING"
+		if n.handshake {
+			kind = "MEET"
+		}
+		message := clusterMessage(kind)
+		if n.pingSent == 0 {
+			n.pingSent = nowMillis()
+		}
+		cluster.mu.Unlock()
+
+		conn.SetDeadline(time.Now().Add(timeout))
+		for _, command := range pending {
+			if _, err := roundTrip(conn, reader, command); err != nil {
+				return err
+			}
+		}
+		reply, err := roundTrip(conn, reader, message)
+		if err != nil {
+			return err
+		}
+
+		cluster.mu.Lock()
+		err = processPong(n, reply)
+		l.connected = err == nil
+		cluster.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-l.stop:
+			return nil
+		case <-ticker.C:
+		case <-l.wake:
+		}
+	}
+}
+
+// processPong handles the node's answer to a ping. A node met answers
+// with its ID, which replaces the one it was known under, unless the
+// node is known already under it. cluster.mu must be held for writing.
+func processPong(n *clusterNode, reply Value) error {
+	fields, ok := clusterMessageFields(reply)
+	if !ok || fields[0] != "PONG" {
+		return fmt.Errorf("invalid reply %q", reply.str)
+	}
+	id := fields[1]
+
+	if n.handshake {
+		_, known := cluster.nodes[id]
+		_, forgotten := cluster.forgotten[id]
+		if known || forgotten || id == cluster.myself.id {
+			removeClusterNode(n)
+			return nil
+		}
+		delete(cluster.nodes, n.id)
+		n.id, n.handshake = id, false
+		cluster.nodes[id] = n
+		fmt.Println("Met node", id, "at", n.addr())
+	} else if id != n.id {
+		return fmt.Errorf("node answered as %s", id)
+	}
+
+	n.pingSent = 0
+	processClusterMessage(n, fields)
+	return nil
+}
+
+// acceptClusterBus serves the connections of the other nodes on the
+// cluster bus.
+func acceptClusterBus(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting cluster bus connection:", err)
+			return
+		}
+		go serveClusterBus(conn)
+	}
+}
+
+// serveClusterBus answers the messages of another node.
+func serveClusterBus(conn net.Conn) {
+	defer conn.Close()
+	reader := NewRESP(conn)
+	writer := NewRESPWriter(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	local, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	for {
+		// Nodes ping every clusterPingInterval, so a silent connection is
+		// from a node that failed.
+		conn.SetReadDeadline(time.Now().Add(2 * time.Duration(clusterNodeTimeout()) * time.Millisecond))
+		v, err := reader.Read()
+		if err != nil {
+			return
+		}
+		cluster.mu.Lock()
+		reply := handleClusterMessage(v, host, local)
+		cluster.mu.Unlock()
+		if err := writer.Write(reply); err != nil {
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleClusterMessage handles a message from the node at host, received
+// at the local address, returning the reply. A node learns its own address
+// from the first message. cluster.mu must be held for writing.
+func handleClusterMessage(v Value, host, local string) Value {
+	if len(v.array) == 3 && v.array[0].bulk == "FAIL" {
+		_, known := cluster.nodes[v.array[1].bulk]
+		failed, ok := cluster.nodes[v.array[2].bulk]
+		if known && ok && failed != cluster.myself && !failed.fail {
+			fmt.Println("Node", failed.id, "failed, as reported by node", v.array[1].bulk)
+			failed.pfail, failed.fail = false, true
+			updateClusterState()
+			if err := saveClusterConfig(); err != nil {
+				fmt.Println("Error saving the cluster configuration:", err)
+			}
+		}
+		return Value{typ: "string", str: "OK"}
+	}
+
+	fields, ok := clusterMessageFields(v)
+	if !ok || fields[0] != "PING" && fields[0] != "MEET" {
+		return Value{typ: "error", str: "ERR invalid cluster bus message"}
+	}
+	id := fields[1]
+	if cluster.myself.host == "" {
+		cluster.myself.host = local
+	}
+
+	sender, known := cluster.nodes[id]
+	_, forgotten := cluster.forgotten[id]
+	if !known && fields[0] == "MEET" && !forgotten && id != cluster.myself.id {
+		sender = newClusterNode(id, host, 0, 0)
+		cluster.nodes[id] = sender
+		fmt.Println("Met node", id, "at", host)
+		known = true
+	}
+	if known && !sender.handshake && sender != cluster.myself {
+		sender.host = host
+		processClusterMessage(sender, fields)
+	}
+	return clusterMessageValue(clusterMessage("PONG"))
+}
+
+// clusterMessageValue returns a message as a RESP array of bulk strings.
+func clusterMessageValue(message []string) Value {
+	args := make([]Value, 0, len(message))
+	for _, arg := range message {
+		args = append(args, Value{typ: "bulk", bulk: arg})
+	}
+	return Value{typ: "array", array: args}
+}
+
+// handleClusterMeet handles "CLUSTER MEET host port [bus-port]", starting
+// to link the node at the address, which joins it to the cluster of this
+// node. The other nodes of both clusters learn about each other through
+// gossip.
+func handleClusterMeet(args []Value) Value {
+	if len(args) != 2 && len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|meet' command"}
+	}
+	host := args[0].bulk
+	port, err := strconv.Atoi(args[1].bulk)
+	busPort := port + 10000
+	if err == nil && len(args) == 3 {
+		busPort, err = strconv.Atoi(args[2].bulk)
+	}
+	if err != nil || net.ParseIP(host) == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return Value{typ: "error", str: "ERR Invalid node address specified: " + net.JoinHostPort(host, args[1].bulk)}
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	startHandshake(host, port, busPort)
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleClusterForget handles "CLUSTER FORGET id", removing the node, which
+// isn't learned about again from the others' gossip for a minute, the time
+// to forget it on every node.
+func handleClusterForget(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'cluster|forget' command"}
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	n, ok := cluster.nodes[args[0].bulk]
+	switch {
+	case !ok:
+		return Value{typ: "error", str: "ERR Unknown node " + args[0].bulk}
+	case n == cluster.myself:
+		return Value{typ: "error", str: "ERR I tried hard but I can't forget myself..."}
+	}
+	removeClusterNode(n)
+	cluster.forgotten[n.id] = time.Now().Add(clusterForgetTime)
+	return clusterSaved()
+}
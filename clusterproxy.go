@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClusterProxyPort is the port a cluster node accepts clients that don't
+// know about the cluster on, routing their commands to the nodes serving
+// their keys. The proxy is disabled when empty.
+var ClusterProxyPort = ""
+
+// proxyRedirects bounds the MOVED and ASK redirections the proxy follows for
+// a command.
+const proxyRedirects = 5
+
+// proxyRefused are the commands the proxy can't route, as they keep state
+// about keys on a connection of their own or stream replies without being
+// asked.
+var proxyRefused = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+	"MONITOR":      true,
+	"WATCH":        true,
+	"UNWATCH":      true,
+	"SYNC":         true,
+	"PSYNC":        true,
+	"REPLCONF":     true,
+}
+
+// proxySummed are the commands whose keys the proxy splits by slot, adding
+// up the replies of the nodes.
+var proxySummed = map[string]bool{
+	"DEL":    true,
+	"UNLINK": true,
+	"EXISTS": true,
+}
+
+// proxyBroadcast are the keyless commands the proxy sends to every node
+// serving slots, combining their replies: DBSIZE adds them up, and the
+// others reply with the first error or OK.
+var proxyBroadcast = map[string]bool{
+	"DBSIZE":   true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+}
+
+// proxyClient is a client of the proxy, with a connection of its own to
+// each node it used, so the nodes see its credentials.
+type proxyClient struct {
+	conn  net.Conn
+	nodes map[string]*proxyBackend
+	// auth is the last AUTH that succeeded, sent to the nodes connected to
+	// next.
+	auth Value
+	// multi is set inside MULTI, while queued holds the commands to send
+	// the node serving their keys at EXEC.
+	multi  bool
+	queued []Value
+}
+
+// proxyBackend is a connection of a proxy client to a node.
+type proxyBackend struct {
+	conn   net.Conn
+	reader *RESP
+	writer *RESPWriter
+}
+
+// acceptClusterProxy serves the clients of the proxy.
+func acceptClusterProxy(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting cluster proxy connection:", err)
+			return
+		}
+		go serveClusterProxy(conn)
+	}
+}
+
+// serveClusterProxy routes the commands of a client until it disconnects.
+func serveClusterProxy(conn net.Conn) {
+	defer conn.Close()
+	writer := NewRESPWriter(conn)
+	if protectedModeBlocks(conn) {
+		writer.Write(Value{typ: "error", str: protectedModeError})
+		writer.Flush()
+		return
+	}
+
+	p := &proxyClient{conn: conn, nodes: map[string]*proxyBackend{}}
+	defer p.close()
+	reader := NewRESP(conn)
+	for {
+		value, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if value.typ != "array" || len(value.array) == 0 {
+			continue
+		}
+		reply := p.route(value)
+		if err := writer.Write(reply); err != nil {
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			return
+		}
+		if strings.EqualFold(value.array[0].bulk, "QUIT") {
+			return
+		}
+	}
+}
+
+// close closes the client's connections to the nodes.
+func (p *proxyClient) close() {
+	for _, b := range p.nodes {
+		b.conn.Close()
+	}
+}
+
+// route runs a command on the nodes serving its keys, replying as a single
+// server would. Keyless commands run on this node, except those in
+// proxyBroadcast.
+func (p *proxyClient) route(value Value) Value {
+	name := strings.ToUpper(value.array[0].bulk)
+	command, ok := resolveCommand(name)
+	if !ok {
+		command = name
+	}
+	args := value.array[1:]
+
+	switch {
+	case proxyRefused[command]:
+		return Value{typ: "error", str: "ERR " + name + " is not supported through the cluster proxy"}
+	case command == "HELLO" && len(args) > 0 && args[0].bulk != "2":
+		// Replies are relayed as RESP2, which is all the proxy reads.
+		return Value{typ: "error", str: "NOPROTO unsupported protocol version"}
+	case command == "MULTI":
+		if p.multi {
+			return Value{typ: "error", str: "ERR MULTI calls can not be nested"}
+		}
+		p.multi, p.queued = true, nil
+		return Value{typ: "string", str: "OK"}
+	case command == "DISCARD":
+		if !p.multi {
+			return Value{typ: "error", str: "ERR DISCARD without MULTI"}
+		}
+		p.multi, p.queued = false, nil
+		return Value{typ: "string", str: "OK"}
+	case command == "EXEC":
+		if !p.multi {
+			return Value{typ: "error", str: "ERR EXEC without MULTI"}
+		}
+		queued := p.queued
+		p.multi, p.queued = false, nil
+		return p.exec(queued)
+	case p.multi:
+		p.queued = append(p.queued, value)
+		return Value{typ: "string", str: "QUEUED"}
+	case command == "AUTH":
+		reply := p.local(value)
+		if reply.typ != "error" {
+			p.auth = value
+			for addr := range p.nodes {
+				p.send(addr, []Value{value})
+			}
+		}
+		return reply
+	case proxyBroadcast[command]:
+		return p.broadcast(command, value)
+	}
+
+	cmd, ok := Commands[command]
+	if !ok {
+		return p.local(value)
+	}
+	keys := cmd.keys(args)
+	if len(keys) == 0 {
+		return p.local(value)
+	}
+	if proxySummed[command] {
+		return p.sum(value, keys)
+	}
+	return p.forward(keyHashSlot(keys[0]), []Value{value})
+}
+
+// local runs a command on this node.
+func (p *proxyClient) local(value Value) Value {
+	cluster.mu.RLock()
+	addr := cluster.myself.addr()
+	cluster.mu.RUnlock()
+	return p.send(addr, []Value{value})[0]
+}
+
+// forward runs commands on the node serving the slot, following MOVED and
+// ASK redirections, and returns the reply of the last one.
+func (p *proxyClient) forward(slot int, commands []Value) Value {
+	cluster.mu.RLock()
+	owner := cluster.slots[slot]
+	addr := ""
+	if owner != nil {
+		addr = owner.addr()
+	}
+	cluster.mu.RUnlock()
+	if owner == nil {
+		return Value{typ: "error", str: "CLUSTERDOWN Hash slot not served"}
+	}
+
+	asking := false
+	for redirects := 0; ; redirects++ {
+		sent := commands
+		if asking {
+			sent = append([]Value{{typ: "array", array: []Value{{typ: "bulk", bulk: "ASKING"}}}}, commands...)
+		}
+		replies := p.send(addr, sent)
+		reply := replies[len(replies)-1]
+		if redirects == proxyRedirects {
+			return reply
+		}
+
+		// A transaction is redirected as a whole, by the first command
+		// that was.
+		var redirect []string
+		for _, r := range replies {
+			if r.typ == "error" && (strings.HasPrefix(r.str, "MOVED ") || strings.HasPrefix(r.str, "ASK ")) {
+				redirect = strings.Fields(r.str)
+				break
+			}
+		}
+		switch {
+		case len(redirect) == 3:
+			addr, asking = redirect[2], redirect[0] == "ASK"
+		case reply.typ == "error" && strings.HasPrefix(reply.str, "TRYAGAIN"):
+			time.Sleep(50 * time.Millisecond)
+		default:
+			return reply
+		}
+	}
+}
+
+// exec runs a transaction on the node serving the keys of its commands,
+// which must all be in the same slot, as on a single node.
+func (p *proxyClient) exec(queued []Value) Value {
+	commands := make([]Value, 0, len(queued)+2)
+	commands = append(commands, Value{typ: "array", array: []Value{{typ: "bulk", bulk: "MULTI"}}})
+	commands = append(commands, queued...)
+	commands = append(commands, Value{typ: "array", array: []Value{{typ: "bulk", bulk: "EXEC"}}})
+
+	for _, value := range queued {
+		command, _ := resolveCommand(strings.ToUpper(value.array[0].bulk))
+		if cmd, ok := Commands[command]; ok {
+			if keys := cmd.keys(value.array[1:]); len(keys) > 0 {
+				return p.forward(keyHashSlot(keys[0]), commands)
+			}
+		}
+	}
+	cluster.mu.RLock()
+	addr := cluster.myself.addr()
+	cluster.mu.RUnlock()
+	replies := p.send(addr, commands)
+	return replies[len(replies)-1]
+}
+
+// sum runs a command on each slot of its keys, with the keys of the slot,
+// and adds up the replies.
+func (p *proxyClient) sum(value Value, keys []string) Value {
+	var slots []int
+	bySlot := map[int][]Value{}
+	for _, key := range keys {
+		slot := keyHashSlot(key)
+		if bySlot[slot] == nil {
+			slots = append(slots, slot)
+		}
+		bySlot[slot] = append(bySlot[slot], Value{typ: "bulk", bulk: key})
+	}
+
+	total := 0
+	for _, slot := range slots {
+		command := Value{typ: "array", array: append([]Value{value.array[0]}, bySlot[slot]...)}
+		reply := p.forward(slot, []Value{command})
+		if reply.typ == "error" {
+			return reply
+		}
+		total += reply.num
+	}
+	return Value{typ: "integer", num: total}
+}
+
+// broadcast runs a command in proxyBroadcast on every node serving slots.
+func (p *proxyClient) broadcast(command string, value Value) Value {
+	cluster.mu.RLock()
+	var addrs []string
+	for n := range servingNodes() {
+		addrs = append(addrs, n.addr())
+	}
+	cluster.mu.RUnlock()
+	if len(addrs) == 0 {
+		return p.local(value)
+	}
+
+	combined := Value{typ: "string", str: "OK"}
+	if command == "DBSIZE" {
+		combined = Value{typ: "integer"}
+	}
+	for _, addr := range addrs {
+		reply := p.send(addr, []Value{value})[0]
+		if reply.typ == "error" {
+			return reply
+		}
+		combined.num += reply.num
+	}
+	return combined
+}
+
+// send pipelines commands to the node at addr, connecting first, and
+// returns their replies, or errors for all if the connection failed.
+func (p *proxyClient) send(addr string, commands []Value) []Value {
+	replies := make([]Value, 0, len(commands))
+	b, err := p.backend(addr)
+	for _, command := range commands {
+		if err == nil {
+			err = b.writer.Write(command)
+		}
+	}
+	if err == nil {
+		err = b.writer.Flush()
+	}
+	for range commands {
+		if err != nil {
+			break
+		}
+		var reply Value
+		if reply, err = b.reader.ReadReply(); err == nil {
+			replies = append(replies, reply)
+		}
+	}
+	if err != nil {
+		if b != nil {
+			b.conn.Close()
+			delete(p.nodes, addr)
+		}
+		for len(replies) < len(commands) {
+			replies = append(replies, Value{typ: "error", str: fmt.Sprintf("ERR error reaching node %s: %v", addr, err)})
+		}
+	}
+	return replies
+}
+
+// backend returns the client's connection to the node at addr, connecting
+// and authenticating first if needed.
+func (p *proxyClient) backend(addr string) (*proxyBackend, error) {
+	if b, ok := p.nodes[addr]; ok {
+		return b, nil
+	}
+	conn, err := net.DialTimeout("tcp", addr, replicationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	b := &proxyBackend{conn: conn, reader: NewRESP(conn), writer: NewRESPWriter(conn)}
+	if p.auth.typ == "array" {
+		b.writer.Write(p.auth)
+		err = b.writer.Flush()
+		if err == nil {
+			_, err = b.reader.ReadReply()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	p.nodes[addr] = b
+	return b, nil
+}
@@ -0,0 +1,395 @@
+// Command stormy-check-aof validates a StormyDB append-only file and can
+// repair a damaged one.
+//
+// It takes either one AOF file or the manifest of a multi-part AOF, in which
+// case it checks every file the manifest lists. For each file it reports
+// whether it is valid and, if not, the offset of the first damaged command.
+// With -fix, a damaged file is truncated at that offset, dropping everything
+// after it; only the last file of a multi-part AOF can be truncated, as the
+// files after it depend on it. With -skip, only the damaged ranges are
+// dropped and the valid commands after them are kept. A MULTI block, holding
+// the writes of a transaction or script, is damaged as a whole when any of
+// it is or when it isn't terminated by EXEC, so that it is dropped whole.
+// Annotation lines, such
+// as the timestamps written with aof-timestamp-enabled, are valid, and base
+// files compressed with persistence-compression are checked decompressed,
+// but can't be repaired.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// errTruncated is returned when a command is cut short by the end of the file.
+var errTruncated = errors.New("unexpected end of file")
+
+// errUnterminated is reported for a MULTI block cut short by the end of the
+// file, and errNested for a MULTI within a MULTI block.
+var (
+	errUnterminated = errors.New("MULTI without EXEC")
+	errNested       = errors.New("MULTI inside a MULTI block")
+)
+
+// damage is a range of bytes of a file holding no valid command.
+type damage struct {
+	start, end int
+	err        error
+}
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate a damaged file at its first damaged command")
+	skip := flag.Bool("skip", false, "drop the damaged ranges of a file, keeping the valid commands after them")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-fix | -skip] <file.aof | file.manifest>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || (*fix && *skip) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	files := []string{flag.Arg(0)}
+	if strings.HasSuffix(flag.Arg(0), ".manifest") {
+		var err error
+		files, err = manifestFiles(flag.Arg(0))
+		if err != nil {
+			fmt.Println("Error reading manifest:", err)
+			os.Exit(1)
+		}
+	}
+
+	status := 0
+	for i, path := range files {
+		ok, err := checkFile(path, *fix, *skip, i == len(files)-1)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		if !ok {
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// manifestFiles returns the paths of the files listed by a manifest, base
+// file first.
+func manifestFiles(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	base, incrs := []string{}, []string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 6 || fields[0] != "file" || fields[2] != "seq" || fields[4] != "type" {
+			return nil, fmt.Errorf("invalid line %d", i+1)
+		}
+		switch fields[5] {
+		case "b":
+			base = append(base, filepath.Join(dir, fields[1]))
+		case "i":
+			incrs = append(incrs, filepath.Join(dir, fields[1]))
+		default:
+			return nil, fmt.Errorf("invalid line %d: unknown type %q", i+1, fields[5])
+		}
+	}
+	if len(base) > 1 {
+		return nil, fmt.Errorf("more than one base file")
+	}
+	return append(base, incrs...), nil
+}
+
+// checkFile checks one AOF file, repairing it if fix or skip is set, and
+// reports whether it is valid, or was repaired.
+func checkFile(path string, fix, skip, last bool) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	data, compressed, err := decompress(data)
+	if err != nil {
+		fmt.Printf("%s: can't decompress: %v\n", path, err)
+		return false, nil
+	}
+
+	damages, commands := scan(data)
+	if len(damages) == 0 {
+		fmt.Printf("%s: OK, %d commands in %d bytes\n", path, commands, len(data))
+		return true, nil
+	}
+
+	first := damages[0]
+	fmt.Printf("%s: bad command at offset %d: %v\n", path, first.start, first.err)
+	fmt.Printf("%s: size=%d, ok_up_to=%d, diff=%d\n", path, len(data), first.start, len(data)-first.start)
+
+	switch {
+	case (fix || skip) && compressed:
+		fmt.Printf("%s: compressed files can't be repaired\n", path)
+		return false, nil
+	case fix:
+		if !last {
+			fmt.Printf("%s: only the last file of a multi-part AOF can be truncated, try -skip\n", path)
+			return false, nil
+		}
+		if err := os.Truncate(path, int64(first.start)); err != nil {
+			return false, err
+		}
+		fmt.Printf("%s: truncated to %d bytes\n", path, first.start)
+		return true, nil
+	case skip:
+		kept := []byte{}
+		start := 0
+		for _, d := range damages {
+			kept = append(kept, data[start:d.start]...)
+			fmt.Printf("%s: dropping bytes %d to %d\n", path, d.start, d.end)
+			start = d.end
+		}
+		kept = append(kept, data[start:]...)
+		if err := writeFileAtomic(path, kept); err != nil {
+			return false, err
+		}
+		fmt.Printf("%s: kept %d of %d bytes\n", path, len(kept), len(data))
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// decompress returns the content of a base file compressed with zstd or
+// LZ4, as persistence-compression does, and whether it was compressed.
+func decompress(data []byte) ([]byte, bool, error) {
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(data, []byte{0x28, 0xB5, 0x2F, 0xFD}):
+		d, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, true, err
+		}
+		defer d.Close()
+		r = d
+	case bytes.HasPrefix(data, []byte{0x04, 0x22, 0x4D, 0x18}):
+		r = lz4.NewReader(bytes.NewReader(data))
+	default:
+		return data, false, nil
+	}
+
+	data, err := io.ReadAll(r)
+	return data, true, err
+}
+
+// scan parses the commands of a file, returning the damaged ranges and the
+// number of valid commands. A damaged range ends where the next valid
+// command starts, or at the end of the file.
+func scan(data []byte) ([]damage, int) {
+	damages := []damage{}
+	commands := 0
+	// The offset of the MULTI starting the block being scanned, or -1. A
+	// damaged range within a block spans the whole block.
+	block := -1
+
+	for off := 0; off < len(data); {
+		next, err := parseAnnotation(data, off)
+		if err == nil && next == off {
+			next, err = parseCommand(data, off)
+			if err == nil {
+				switch commandName(data, off) {
+				case "MULTI":
+					if block >= 0 {
+						err = errNested
+					} else {
+						block = off
+					}
+				case "EXEC":
+					block = -1
+				}
+			}
+			if err == nil {
+				commands++
+			}
+		}
+		if err == nil {
+			off = next
+			continue
+		}
+
+		start, end := off, resync(data, off+1)
+		switch {
+		case err == errNested:
+			start, end = block, off
+		case block >= 0:
+			start, end = block, blockEnd(data, end)
+		}
+		block = -1
+		damages = append(damages, damage{start: start, end: end, err: err})
+		off = end
+	}
+	if block >= 0 {
+		damages = append(damages, damage{start: block, end: len(data), err: errUnterminated})
+	}
+	return damages, commands
+}
+
+// blockEnd returns the offset following the EXEC that ends the MULTI block
+// holding off, or that of the next MULTI or the end of data if none does.
+func blockEnd(data []byte, off int) int {
+	for off < len(data) {
+		next, err := parseAnnotation(data, off)
+		if err == nil && next == off {
+			next, err = parseCommand(data, off)
+			if err == nil {
+				switch commandName(data, off) {
+				case "MULTI":
+					return off
+				case "EXEC":
+					return next
+				}
+			}
+		}
+		if err != nil {
+			next = resync(data, off+1)
+		}
+		off = next
+	}
+	return len(data)
+}
+
+// commandName returns the upper-cased name of the valid command at off.
+func commandName(data []byte, off int) string {
+	_, off, _ = parseLength(data, off, '*')
+	size, off, _ := parseLength(data, off, '$')
+	return strings.ToUpper(string(data[off : off+size]))
+}
+
+// resync returns the offset of the first valid command at or after off that
+// starts a line, or the end of data if there is none.
+func resync(data []byte, off int) int {
+	for off < len(data) {
+		i := bytes.IndexByte(data[off:], '*')
+		if i < 0 {
+			break
+		}
+		off += i
+		if off > 0 && data[off-1] == '\n' {
+			if _, err := parseCommand(data, off); err == nil {
+				return off
+			}
+		}
+		off++
+	}
+	return len(data)
+}
+
+// parseAnnotation skips the annotation line starting at off, such as the
+// "#TS:<unix time>" timestamps, and returns the offset following it, or off
+// if no annotation starts there.
+func parseAnnotation(data []byte, off int) (int, error) {
+	if data[off] != '#' {
+		return off, nil
+	}
+	end := bytes.Index(data[off:], []byte("\r\n"))
+	if end < 0 {
+		return 0, errTruncated
+	}
+	return off + end + 2, nil
+}
+
+// parseCommand parses the command starting at off, an array of bulk
+// strings, and returns the offset following it.
+func parseCommand(data []byte, off int) (int, error) {
+	n, off, err := parseLength(data, off, '*')
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("invalid command length %d", n)
+	}
+
+	for i := 0; i < n; i++ {
+		size, next, err := parseLength(data, off, '$')
+		if err != nil {
+			return 0, err
+		}
+		if size < 0 {
+			return 0, fmt.Errorf("invalid bulk length %d", size)
+		}
+		if next+size+2 > len(data) {
+			return 0, errTruncated
+		}
+		if data[next+size] != '\r' || data[next+size+1] != '\n' {
+			return 0, fmt.Errorf("bulk string not terminated by CRLF")
+		}
+		off = next + size + 2
+	}
+	return off, nil
+}
+
+// parseLength parses a "<prefix><n>\r\n" line starting at off, returning n
+// and the offset following the line.
+func parseLength(data []byte, off int, prefix byte) (int, int, error) {
+	if off >= len(data) {
+		return 0, 0, errTruncated
+	}
+	if data[off] != prefix {
+		return 0, 0, fmt.Errorf("expected '%c', got '%c'", prefix, data[off])
+	}
+	end := bytes.Index(data[off:], []byte("\r\n"))
+	if end < 0 {
+		return 0, 0, errTruncated
+	}
+	n, err := strconv.Atoi(string(data[off+1 : off+end]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid length %q", data[off+1:off+end])
+	}
+	return n, off + end + 2, nil
+}
+
+// writeFileAtomic replaces path with data by writing and syncing a temporary
+// file in the same directory and renaming it over the original, keeping its
+// permissions.
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
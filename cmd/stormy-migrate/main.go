@@ -0,0 +1,131 @@
+// Command stormy-migrate copies the keys of a running StormyDB server to
+// another one while both keep serving clients, e.g. to move a dataset to a
+// new machine or into a cluster.
+//
+// It iterates over the source's keys with SCAN and copies each with DUMP
+// and RESTORE, keeping its TTL, on -workers pairs of connections at once,
+// with the commands for a page of keys pipelined. Keys that already exist
+// on the target are left alone, or replaced with -replace, and keys that
+// are deleted or expire on the source before they are copied are skipped.
+// Progress is reported every -progress. A key written on the source after
+// it was copied isn't copied again, so writes are best stopped during the
+// copy; replication keeps a copy up to date instead, see REPLICAOF.
+//
+// With -verify, a second pass compares every key of the source with the
+// target's: its string, its hash and its TTL, which may differ by the time
+// the copy took. The command exits with status 1 if a key failed to copy
+// or differs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// timeout bounds connecting and every round trip.
+	timeout time.Duration
+	// replace makes RESTORE replace the keys that exist on the target.
+	replace bool
+)
+
+func main() {
+	var source, target server
+	flag.StringVar(&source.addr, "source", "", "host:port of the server to copy from")
+	flag.StringVar(&source.user, "source-user", "", "user to authenticate to the source as")
+	flag.StringVar(&source.pass, "source-pass", "", "password to authenticate to the source with")
+	flag.StringVar(&target.addr, "target", "", "host:port of the server to copy to")
+	flag.StringVar(&target.user, "target-user", "", "user to authenticate to the target as")
+	flag.StringVar(&target.pass, "target-pass", "", "password to authenticate to the target with")
+	dbList := flag.String("db", "", "comma-separated databases to copy, all those holding keys when empty")
+	match := flag.String("match", "*", "glob pattern of the keys to copy")
+	count := flag.Int("count", 1000, "keys to ask SCAN for at once")
+	workers := flag.Int("workers", 8, "pages of keys to copy at once")
+	progress := flag.Duration("progress", 5*time.Second, "interval between progress reports")
+	verify := flag.Bool("verify", false, "compare every key with the target's once copied")
+	flag.BoolVar(&replace, "replace", false, "replace the keys that exist on the target")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "timeout of connecting and of every round trip")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -source <host:port> -target <host:port> [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if source.addr == "" || target.addr == "" || flag.NArg() != 0 || *count <= 0 || *workers <= 0 || *progress <= 0 || timeout <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dbs, total, err := databases(source, *dbList)
+	if err != nil {
+		fmt.Println("Error reading the source's databases:", err)
+		os.Exit(1)
+	}
+
+	m := &migration{
+		source: source, target: target,
+		dbs: dbs, match: *match, count: *count, workers: *workers, progress: *progress,
+		total: total,
+	}
+	ok := m.run("Copying", copyKeys)
+	if *verify {
+		ok = m.run("Verifying", verifyKeys) && ok
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// databases returns the source's databases to copy, from list or else
+// those INFO keyspace reports keys in, and how many keys they hold.
+func databases(source server, list string) ([]int, int64, error) {
+	c, err := source.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.Close()
+
+	info, err := c.do("INFO", "keyspace")
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := map[int]int64{}
+	for _, line := range strings.Split(info.str, "\r\n") {
+		name, stats, ok := strings.Cut(line, ":")
+		db, err := strconv.Atoi(strings.TrimPrefix(name, "db"))
+		if !ok || !strings.HasPrefix(name, "db") || err != nil {
+			continue
+		}
+		for _, stat := range strings.Split(stats, ",") {
+			if n, ok := strings.CutPrefix(stat, "keys="); ok {
+				keys[db], _ = strconv.ParseInt(n, 10, 64)
+			}
+		}
+	}
+
+	var dbs []int
+	if list == "" {
+		for db := range keys {
+			dbs = append(dbs, db)
+		}
+	} else {
+		for _, field := range strings.Split(list, ",") {
+			db, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || db < 0 {
+				return nil, 0, fmt.Errorf("invalid database %q", field)
+			}
+			dbs = append(dbs, db)
+		}
+	}
+	sort.Ints(dbs)
+
+	total := int64(0)
+	for _, db := range dbs {
+		total += keys[db]
+	}
+	return dbs, total, nil
+}
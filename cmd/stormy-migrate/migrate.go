@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ttlTolerance is how much the TTLs of a key may differ between the source
+// and the target for -verify, as the copy took some time in flight.
+const ttlTolerance = time.Second
+
+// migration is a run of the tool: passes over the source's keys.
+type migration struct {
+	source, target server
+	dbs            []int
+	match          string
+	count, workers int
+	progress       time.Duration
+	// total is the number of keys the source held at the start, for the
+	// progress reports.
+	total int64
+}
+
+// page is a page of keys of one database, as SCAN returned it.
+type page struct {
+	db   int
+	keys []string
+}
+
+// worker holds a connection to each server.
+type worker struct {
+	source, target *conn
+}
+
+// stats counts the keys a pass went over, by outcome.
+type stats struct {
+	scanned int64
+	// done counts the keys copied, or found equal when verifying.
+	done int64
+	// existing counts the keys left alone as they exist on the target.
+	existing int64
+	// gone counts the keys deleted from the source or expired before the
+	// pass reached them.
+	gone int64
+	// failed counts the keys that couldn't be copied, or differ when
+	// verifying.
+	failed int64
+}
+
+// pageFunc handles a page of keys, the connections having the page's
+// database selected, returning errors for the connections only.
+type pageFunc func(w *worker, p page, s *stats) error
+
+// run makes a pass over the keys of the databases, handling the pages SCAN
+// returns with fn on the workers, and reports whether every key went well.
+func (m *migration) run(name string, fn pageFunc) bool {
+	s := &stats{}
+	start := time.Now()
+	fmt.Printf("%s %d keys of databases %v from %s to %s\n", name, m.total, m.dbs, m.source.addr, m.target.addr)
+
+	pages := make(chan page, m.workers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var errMu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.work(pages, stop, fn, s); err != nil {
+				fail(err)
+			}
+		}()
+	}
+	go func() {
+		if err := m.scan(pages, stop, s); err != nil {
+			fail(err)
+		}
+		close(pages)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(m.progress)
+	defer ticker.Stop()
+	for finished := false; !finished; {
+		select {
+		case <-ticker.C:
+			m.report(s, start)
+		case <-done:
+			finished = true
+		}
+	}
+
+	if firstErr != nil {
+		fmt.Printf("%s failed: %v\n", name, firstErr)
+		return false
+	}
+	m.report(s, start)
+	return atomic.LoadInt64(&s.failed) == 0
+}
+
+// report prints the progress of a pass.
+func (m *migration) report(s *stats, start time.Time) {
+	scanned := atomic.LoadInt64(&s.scanned)
+	percent := 100.0
+	if m.total > 0 && scanned < m.total {
+		percent = float64(scanned) * 100 / float64(m.total)
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("%d keys (%.1f%%) in %s, %.0f keys/s: %d done, %d existing, %d gone, %d failed\n",
+		scanned, percent, elapsed.Round(time.Second), float64(scanned)/elapsed.Seconds(),
+		atomic.LoadInt64(&s.done), atomic.LoadInt64(&s.existing), atomic.LoadInt64(&s.gone), atomic.LoadInt64(&s.failed))
+}
+
+// scan sends the pages of keys of every database until done or stopped.
+func (m *migration) scan(pages chan<- page, stop <-chan struct{}, s *stats) error {
+	c, err := m.source.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, db := range m.dbs {
+		if err := c.selectDB(db); err != nil {
+			return err
+		}
+		cursor := "0"
+		for {
+			v, err := c.do("SCAN", cursor, "MATCH", m.match, "COUNT", strconv.Itoa(m.count))
+			if err != nil {
+				return fmt.Errorf("SCAN: %w", err)
+			}
+			if len(v.array) != 2 {
+				return fmt.Errorf("SCAN: unexpected reply")
+			}
+			p := page{db: db}
+			for _, key := range v.array[1].array {
+				p.keys = append(p.keys, key.str)
+			}
+			if len(p.keys) > 0 {
+				atomic.AddInt64(&s.scanned, int64(len(p.keys)))
+				select {
+				case pages <- p:
+				case <-stop:
+					return nil
+				}
+			}
+			cursor = v.array[0].str
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// work handles pages with fn until there are no more or the pass stopped.
+func (m *migration) work(pages <-chan page, stop <-chan struct{}, fn pageFunc, s *stats) error {
+	source, err := m.source.dial()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := m.target.dial()
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	w := &worker{source: source, target: target}
+
+	for {
+		select {
+		case p, ok := <-pages:
+			if !ok {
+				return nil
+			}
+			if err := source.selectDB(p.db); err != nil {
+				return err
+			}
+			if err := target.selectDB(p.db); err != nil {
+				return err
+			}
+			if err := fn(w, p, s); err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// copyKeys copies a page of keys with their TTL.
+func copyKeys(w *worker, p page, s *stats) error {
+	commands := make([][]string, 0, 2*len(p.keys))
+	for _, key := range p.keys {
+		commands = append(commands, []string{"PTTL", key}, []string{"DUMP", key})
+	}
+	replies, err := w.source.pipeline(commands)
+	if err != nil {
+		return err
+	}
+
+	restores := make([][]string, 0, len(p.keys))
+	keys := make([]string, 0, len(p.keys))
+	for i, key := range p.keys {
+		ttl, dump := replies[2*i], replies[2*i+1]
+		switch {
+		case ttl.kind == '-' || dump.kind == '-':
+			fmt.Printf("Error reading key %q of db %d: %s%s\n", key, p.db, ttl.str, dump.str)
+			atomic.AddInt64(&s.failed, 1)
+			continue
+		case ttl.num == -2 || dump.null:
+			atomic.AddInt64(&s.gone, 1)
+			continue
+		}
+		restore := []string{"RESTORE", key, strconv.FormatInt(max(ttl.num, 0), 10), dump.str}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		restores = append(restores, restore)
+		keys = append(keys, key)
+	}
+	if len(restores) == 0 {
+		return nil
+	}
+
+	replies, err = w.target.pipeline(restores)
+	if err != nil {
+		return err
+	}
+	for i, v := range replies {
+		switch {
+		case v.kind != '-':
+			atomic.AddInt64(&s.done, 1)
+		case len(v.str) >= 7 && v.str[:7] == "BUSYKEY":
+			atomic.AddInt64(&s.existing, 1)
+		default:
+			fmt.Printf("Error copying key %q of db %d: %s\n", keys[i], p.db, v.str)
+			atomic.AddInt64(&s.failed, 1)
+		}
+	}
+	return nil
+}
+
+// verifyKeys compares a page of keys with the target's: their string, hash
+// and TTL.
+func verifyKeys(w *worker, p page, s *stats) error {
+	commands := make([][]string, 0, 3*len(p.keys))
+	for _, key := range p.keys {
+		commands = append(commands, []string{"PTTL", key}, []string{"GET", key}, []string{"HGETALL", key})
+	}
+	sources, err := w.source.pipeline(commands)
+	if err != nil {
+		return err
+	}
+	targets, err := w.target.pipeline(commands)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range p.keys {
+		src, dst := sources[3*i:3*i+3], targets[3*i:3*i+3]
+		if src[0].kind == ':' && src[0].num == -2 {
+			atomic.AddInt64(&s.gone, 1)
+			continue
+		}
+		if problem := compareKey(src, dst); problem != "" {
+			fmt.Printf("Key %q of db %d differs: %s\n", key, p.db, problem)
+			atomic.AddInt64(&s.failed, 1)
+			continue
+		}
+		atomic.AddInt64(&s.done, 1)
+	}
+	return nil
+}
+
+// compareKey compares the replies to PTTL, GET and HGETALL for a key on the
+// source and on the target, describing how they differ.
+func compareKey(src, dst []reply) string {
+	switch ttl, other := src[0].num, dst[0].num; {
+	case other == -2:
+		return "missing on the target"
+	case (ttl == -1) != (other == -1):
+		return fmt.Sprintf("TTL %d ms on the source, %d ms on the target", ttl, other)
+	case ttl != -1 && abs(ttl-other) > ttlTolerance.Milliseconds():
+		return fmt.Sprintf("TTL %d ms on the source, %d ms on the target", ttl, other)
+	}
+
+	if src[1].kind != dst[1].kind || src[1].null != dst[1].null || src[1].str != dst[1].str {
+		return "string values differ"
+	}
+	if src[2].kind != dst[2].kind || src[2].str != dst[2].str || !sameHash(src[2].array, dst[2].array) {
+		return "hashes differ"
+	}
+	return ""
+}
+
+// sameHash reports whether two HGETALL replies hold the same fields and
+// values, in whatever order.
+func sameHash(a, b []reply) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	fields := make(map[string]string, len(a)/2)
+	for i := 0; i+1 < len(a); i += 2 {
+		fields[a[i].str] = a[i+1].str
+	}
+	for i := 0; i+1 < len(b); i += 2 {
+		if value, ok := fields[b[i].str]; !ok || value != b[i+1].str {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
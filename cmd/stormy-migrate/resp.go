@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// reply is a RESP value: a simple string (+), an error (-), an integer (:),
+// a bulk string ($), which is null when null is set, or an array (*).
+type reply struct {
+	kind  byte
+	str   string
+	num   int64
+	array []reply
+	null  bool
+}
+
+// errProtocol is returned for input that isn't valid RESP.
+var errProtocol = errors.New("protocol error")
+
+// readReply reads one RESP value.
+func readReply(r *bufio.Reader) (reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return reply{}, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return reply{}, errProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+', '-':
+		return reply{kind: kind, str: body}, nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return reply{}, errProtocol
+		}
+		return reply{kind: kind, num: n}, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > 512*1024*1024 {
+			return reply{}, errProtocol
+		}
+		if n < 0 {
+			return reply{kind: kind, null: true}, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return reply{}, err
+		}
+		return reply{kind: kind, str: string(data[:n])}, nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > 1024*1024 {
+			return reply{}, errProtocol
+		}
+		if n < 0 {
+			return reply{kind: kind, null: true}, nil
+		}
+		v := reply{kind: kind}
+		for i := 0; i < n; i++ {
+			element, err := readReply(r)
+			if err != nil {
+				return reply{}, err
+			}
+			v.array = append(v.array, element)
+		}
+		return v, nil
+	default:
+		return reply{}, errProtocol
+	}
+}
+
+// appendCommand appends a command as an array of bulk strings.
+func appendCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// server is the address of a server and the credentials to authenticate
+// to it with, when the password is set.
+type server struct {
+	addr, user, pass string
+}
+
+// conn is a connection to a server, which commands are pipelined on.
+type conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// db is the database selected.
+	db int
+}
+
+// dial connects to the server and authenticates.
+func (s server) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", s.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{conn: nc, reader: bufio.NewReader(nc)}
+	if s.pass != "" {
+		args := []string{"AUTH", s.pass}
+		if s.user != "" {
+			args = []string{"AUTH", s.user, s.pass}
+		}
+		if _, err := c.do(args...); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("AUTH failed: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// pipeline sends the commands at once and reads their replies, within
+// timeout. Error replies are returned as replies, not errors.
+func (c *conn) pipeline(commands [][]string) ([]reply, error) {
+	var buf []byte
+	for _, args := range commands {
+		buf = appendCommand(buf, args...)
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([]reply, 0, len(commands))
+	for range commands {
+		v, err := readReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, v)
+	}
+	return replies, nil
+}
+
+// do sends a command and reads its reply, returning error replies as
+// errors.
+func (c *conn) do(args ...string) (reply, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return reply{}, err
+	}
+	if replies[0].kind == '-' {
+		return reply{}, errors.New(replies[0].str)
+	}
+	return replies[0], nil
+}
+
+// selectDB selects the database, unless it is already selected.
+func (c *conn) selectDB(db int) error {
+	if c.db == db {
+		return nil
+	}
+	if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+		return err
+	}
+	c.db = db
+	return nil
+}
+
+func (c *conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backend is an instance keys are sharded across.
+type backend struct {
+	addr string
+	// up is set while the backend answers health checks, which puts it on
+	// the ring. Guarded by state.mu.
+	up bool
+	// check is the connection health checks are sent on, used by a single
+	// goroutine.
+	check *conn
+}
+
+// state holds the backends and the ring of those that are up.
+var state = struct {
+	mu       sync.RWMutex
+	backends []*backend
+	ring     *ring
+}{ring: &ring{}}
+
+// change is a backend joining or leaving the ring, and the backends on the
+// ring after it.
+type change struct {
+	event, addr string
+	ring        []string
+}
+
+// changes queues the changes to run -on-change for and rebalance after, in
+// order, so health checks don't wait for them.
+var changes = make(chan change, 1024)
+
+// lookup returns the address of the backend a key belongs to, or "" if no
+// backend is up.
+func lookup(key string) string {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return state.ring.lookup(key)
+}
+
+// upBackends returns the addresses of the backends that are up.
+func upBackends() []string {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	var addrs []string
+	for _, b := range state.backends {
+		if b.up {
+			addrs = append(addrs, b.addr)
+		}
+	}
+	return addrs
+}
+
+// authCommands returns the AUTH to send backends with -auth-user and
+// -auth-pass, if any.
+func authCommands() [][]string {
+	switch {
+	case authPass == "":
+		return nil
+	case authUser == "":
+		return [][]string{{"AUTH", authPass}}
+	default:
+		return [][]string{{"AUTH", authUser, authPass}}
+	}
+}
+
+// ping checks that the backend replies to PING, connecting first if needed.
+func (b *backend) ping() error {
+	if b.check == nil {
+		c, err := dial(b.addr, timeout, authCommands())
+		if err != nil {
+			return err
+		}
+		b.check = c
+	}
+	if _, err := b.check.do("PING"); err != nil {
+		b.check.Close()
+		b.check = nil
+		return err
+	}
+	return nil
+}
+
+// monitor health-checks the backend every -check-interval. It joins the
+// ring as soon as it replies, and leaves it once it didn't for -down-after.
+func (b *backend) monitor() {
+	lastOK := time.Now()
+	for {
+		time.Sleep(checkInterval)
+		err := b.ping()
+		state.mu.RLock()
+		up := b.up
+		state.mu.RUnlock()
+		switch {
+		case err == nil:
+			lastOK = time.Now()
+			if !up {
+				setUp(b, true)
+			}
+		case up && time.Since(lastOK) >= downAfter:
+			fmt.Printf("Backend %s failed health checks: %v\n", b.addr, err)
+			setUp(b, false)
+		}
+	}
+}
+
+// setUp puts the backend on the ring or takes it off, and queues the
+// change.
+func setUp(b *backend, up bool) {
+	state.mu.Lock()
+	b.up = up
+	var addrs []string
+	for _, b := range state.backends {
+		if b.up {
+			addrs = append(addrs, b.addr)
+		}
+	}
+	state.ring = newRing(addrs, vnodes)
+	state.mu.Unlock()
+
+	event := "down"
+	if up {
+		event = "up"
+	}
+	fmt.Println(time.Now().Format("2006-01-02 15:04:05.000"), "backend", b.addr, event, "ring", addrs)
+	changes <- change{event: event, addr: b.addr, ring: addrs}
+}
+
+// handleChanges runs -on-change for every change and, with -rebalance,
+// moves the keys that belong to another backend since. Changes that came in
+// during a rebalance are followed by a single one.
+func handleChanges() {
+	for ch := range changes {
+		runHook(ch)
+		if !rebalance {
+			continue
+		}
+		for pending := true; pending; {
+			select {
+			case ch := <-changes:
+				runHook(ch)
+			default:
+				pending = false
+			}
+		}
+		rebalanceKeys()
+	}
+}
+
+// runHook runs -on-change with the event, "up" or "down", the backend's
+// address and the addresses of the backends on the ring.
+func runHook(ch change) {
+	if onChange == "" {
+		return
+	}
+	cmd := exec.Command(onChange, append([]string{ch.event, ch.addr}, ch.ring...)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Error running %s for %s %s: %v\n", onChange, ch.addr, ch.event, err)
+	}
+}
+
+// rebalanceKeys moves the keys of every backend that is up which belong to
+// another one on the ring with MIGRATE, replacing the target's: they were
+// written while their backend was down, so they are the latest.
+func rebalanceKeys() {
+	start := time.Now()
+	moved := 0
+	for _, addr := range upBackends() {
+		n, err := rebalanceBackend(addr)
+		moved += n
+		if err != nil {
+			fmt.Printf("Error rebalancing %s: %v\n", addr, err)
+		}
+	}
+	fmt.Printf("Rebalanced %d keys in %s\n", moved, time.Since(start).Round(time.Millisecond))
+}
+
+// rebalanceBackend moves the keys of the backend at addr that belong to
+// another backend, going over the databases INFO keyspace reports keys in,
+// and returns how many it moved.
+func rebalanceBackend(addr string) (int, error) {
+	// A MIGRATE connects to its target and makes a round trip to it, each
+	// within -timeout.
+	c, err := dial(addr, 3*timeout, authCommands())
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	info, err := c.do("INFO", "keyspace")
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, line := range strings.Split(info.str, "\r\n") {
+		name, _, ok := strings.Cut(line, ":")
+		db, err := strconv.Atoi(strings.TrimPrefix(name, "db"))
+		if !ok || !strings.HasPrefix(name, "db") || err != nil {
+			continue
+		}
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			return moved, err
+		}
+
+		cursor := "0"
+		for {
+			v, err := c.do("SCAN", cursor, "COUNT", "1000")
+			if err != nil {
+				return moved, fmt.Errorf("SCAN: %w", err)
+			}
+			if len(v.array) != 2 {
+				return moved, fmt.Errorf("SCAN: unexpected reply")
+			}
+			cursor = v.array[0].str
+
+			byTarget := map[string][]string{}
+			for _, key := range v.array[1].strings() {
+				if target := lookup(key); target != "" && target != addr {
+					byTarget[target] = append(byTarget[target], key)
+				}
+			}
+			for target, keys := range byTarget {
+				if err := migrateKeys(c, target, db, keys); err != nil {
+					return moved, err
+				}
+				moved += len(keys)
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return moved, nil
+}
+
+// migrateKeys moves keys of database db to the backend at target.
+func migrateKeys(c *conn, target string, db int, keys []string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	args := []string{"MIGRATE", host, port, "", strconv.Itoa(db), strconv.FormatInt(timeout.Milliseconds(), 10), "REPLACE"}
+	for _, auth := range authCommands() {
+		if len(auth) == 3 {
+			args = append(args, "AUTH2", auth[1], auth[2])
+		} else {
+			args = append(args, "AUTH", auth[1])
+		}
+	}
+	args = append(args, "KEYS")
+	if _, err := c.do(append(args, keys...)...); err != nil {
+		return fmt.Errorf("MIGRATE to %s: %w", target, err)
+	}
+	return nil
+}
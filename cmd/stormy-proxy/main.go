@@ -0,0 +1,118 @@
+// Command stormy-proxy shards keys across independent StormyDB servers, for
+// scaling out without cluster mode: clients connect to the proxy as to a
+// single server, and each command runs on the backend its keys belong to.
+//
+// The -backends are placed on a consistent hash ring at -vnodes points
+// each, so a backend joining or leaving it only moves the keys between it
+// and its neighbours. Keys holding a {hash tag} are placed by the tag alone,
+// so commands and transactions using several keys can keep them on the same
+// backend; those whose keys are on different backends fail with CROSSSLOT,
+// except DEL, UNLINK and EXISTS, which are split by backend. DBSIZE, FLUSHDB
+// and FLUSHALL run on every backend, and AUTH and SELECT too, for the
+// client's connections to them. Commands without keys, such as SCAN or
+// SUBSCRIBE, can't be routed. PROXY BACKENDS lists the backends and whether
+// they are up, and PROXY LOOKUP <key> names the backend of a key.
+//
+// Every backend is sent PING every -check-interval. One that didn't reply
+// for -down-after leaves the ring, and its keys are unavailable while the
+// others keep serving theirs, with the keys written to it meanwhile going
+// to its neighbour; it joins again as soon as it replies. On either change,
+// -on-change is run with "up" or "down", the backend's address and the
+// addresses of the backends left on the ring, e.g. to page someone or
+// resync a replica. With -rebalance, the proxy then moves the keys that
+// belong to another backend since with MIGRATE, replacing that backend's:
+// the keys written to a neighbour while a backend was down go back to it,
+// but keys deleted meanwhile come back. Keys read before they are moved are
+// missing.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// vnodes is the number of points of each backend on the ring.
+	vnodes int
+	// authUser and authPass authenticate the health checks and rebalancing
+	// to the backends.
+	authUser, authPass string
+	checkInterval      time.Duration
+	downAfter          time.Duration
+	// timeout bounds connecting and the round trips of health checks and
+	// rebalancing.
+	timeout time.Duration
+	// onChange is the command run when a backend joins or leaves the ring.
+	onChange string
+	// rebalance makes the proxy move keys to the backends they belong to
+	// once the ring changed.
+	rebalance bool
+)
+
+func main() {
+	backendList := flag.String("backends", "", "comma-separated host:port of the servers to shard keys across")
+	listenPort := flag.Int("port", 7379, "port to listen on")
+	flag.IntVar(&vnodes, "vnodes", 160, "points of each backend on the hash ring")
+	flag.StringVar(&authUser, "auth-user", "", "user to authenticate health checks and rebalancing as")
+	flag.StringVar(&authPass, "auth-pass", "", "password to authenticate health checks and rebalancing with")
+	flag.DurationVar(&checkInterval, "check-interval", time.Second, "interval between health checks of a backend")
+	flag.DurationVar(&downAfter, "down-after", 5*time.Second, "time without a reply after which a backend leaves the ring")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "timeout of connecting and of health check and rebalancing round trips")
+	flag.StringVar(&onChange, "on-change", "", `command run as "<command> up|down <host:port> [<host:port> ...]" when a backend joins or leaves the ring`)
+	flag.BoolVar(&rebalance, "rebalance", false, "move keys to the backend they belong to when the ring changes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -backends <host:port>,<host:port>... [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *backendList == "" || flag.NArg() != 0 || vnodes <= 0 || checkInterval <= 0 || downAfter <= 0 || timeout <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, addr := range strings.Split(*backendList, ",") {
+		addr = strings.TrimSpace(addr)
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			fmt.Printf("Error in -backends: invalid address %q\n", addr)
+			os.Exit(1)
+		}
+		for _, b := range state.backends {
+			if b.addr == addr {
+				fmt.Printf("Error in -backends: %s is listed twice\n", addr)
+				os.Exit(1)
+			}
+		}
+		state.backends = append(state.backends, &backend{addr: addr})
+	}
+
+	// The backends that reply to a first check are on the ring from the
+	// start, so keys aren't moved when the proxy restarts.
+	var up []string
+	for _, b := range state.backends {
+		if err := b.ping(); err != nil {
+			fmt.Printf("Backend %s is down: %v\n", b.addr, err)
+			continue
+		}
+		b.up = true
+		up = append(up, b.addr)
+	}
+	state.ring = newRing(up, vnodes)
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(*listenPort))
+	if err != nil {
+		fmt.Println("Error listening:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Proxy listening on port %d, sharding across %v\n", *listenPort, up)
+
+	go handleChanges()
+	for _, b := range state.backends {
+		go b.monitor()
+	}
+	serve(listener)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// keyed are the commands routed to the backend of their key, the first
+// argument, or of all their arguments for those set, which are split by
+// backend and whose replies are added up.
+var keyed = map[string]bool{
+	"GET": false, "SET": false, "CAS": false, "INCR": false,
+	"HSET": false, "HGET": false, "HGETALL": false,
+	"EXPIRE": false, "PEXPIRE": false, "EXPIREAT": false, "PEXPIREAT": false,
+	"TTL": false, "PTTL": false, "PERSIST": false,
+	"DUMP": false, "RESTORE": false, "MOVE": false,
+	"XRANGE": false, "XLEN": false,
+	"DEL": true, "UNLINK": true, "EXISTS": true,
+}
+
+// client is a connection to the proxy, with a connection of its own to
+// each backend it used, so the backends see its credentials and database.
+type client struct {
+	conn     net.Conn
+	backends map[string]*conn
+	// auth and selected are the last AUTH and SELECT that succeeded, sent
+	// to the backends connected to next.
+	auth, selected []string
+	// multi is set inside MULTI, while queued holds the commands to send
+	// the backend of their keys at EXEC, and dirty is set once one was
+	// refused.
+	multi  bool
+	dirty  bool
+	queued [][]string
+}
+
+// serve accepts clients.
+func serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		go handleConnection(conn)
+	}
+}
+
+// handleConnection routes the commands of a client until it disconnects.
+func handleConnection(nc net.Conn) {
+	c := &client{conn: nc, backends: map[string]*conn{}}
+	defer func() {
+		for _, b := range c.backends {
+			b.Close()
+		}
+		nc.Close()
+	}()
+
+	reader := bufio.NewReader(nc)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := nc.Write(c.route(args)); err != nil {
+			return
+		}
+		if strings.EqualFold(args[0], "QUIT") {
+			return
+		}
+	}
+}
+
+// readCommand reads a command, as an array of bulk strings or an inline
+// command.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := reader.ReadString('\n')
+		return strings.Fields(line), err
+	}
+	v, err := readReply(reader)
+	if err != nil {
+		return nil, err
+	}
+	return v.strings(), nil
+}
+
+// route runs a command on the backends of its keys and returns the reply,
+// as a single server would.
+func (c *client) route(args []string) []byte {
+	name := strings.ToUpper(args[0])
+	switch {
+	case name == "QUIT":
+		return appendSimple(nil, '+', "OK")
+	case name == "MULTI":
+		if c.multi {
+			return appendSimple(nil, '-', "ERR MULTI calls can not be nested")
+		}
+		c.multi, c.dirty, c.queued = true, false, nil
+		return appendSimple(nil, '+', "OK")
+	case name == "DISCARD":
+		if !c.multi {
+			return appendSimple(nil, '-', "ERR DISCARD without MULTI")
+		}
+		c.multi, c.queued = false, nil
+		return appendSimple(nil, '+', "OK")
+	case name == "EXEC":
+		if !c.multi {
+			return appendSimple(nil, '-', "ERR EXEC without MULTI")
+		}
+		queued, dirty := c.queued, c.dirty
+		c.multi, c.queued = false, nil
+		if dirty {
+			return appendSimple(nil, '-', "EXECABORT Transaction discarded because of previous errors.")
+		}
+		return c.exec(queued)
+	case c.multi:
+		if keys := commandKeys(name, args); len(keys) == 0 {
+			c.dirty = true
+			return unsupported(args[0])
+		}
+		c.queued = append(c.queued, args)
+		return appendSimple(nil, '+', "QUEUED")
+	case name == "PING":
+		if len(args) > 1 {
+			return appendBulk(nil, args[1])
+		}
+		return appendSimple(nil, '+', "PONG")
+	case name == "HELLO" && len(args) > 1 && args[1] != "2":
+		// Replies are relayed as RESP2, which is all the proxy reads.
+		return appendSimple(nil, '-', "NOPROTO unsupported protocol version")
+	case name == "PROXY":
+		return proxyCommand(args)
+	case name == "AUTH", name == "SELECT", name == "FLUSHDB", name == "FLUSHALL", name == "DBSIZE":
+		return c.broadcast(name, args)
+	}
+
+	keys := commandKeys(name, args)
+	if len(keys) == 0 {
+		return unsupported(args[0])
+	}
+	if keyed[name] {
+		return c.sum(args, keys)
+	}
+	addr, errReply := ownerOf(keys)
+	if errReply != nil {
+		return errReply
+	}
+	return appendReply(nil, c.send(addr, [][]string{args})[0])
+}
+
+// commandKeys returns the keys of a command, none for the commands the
+// proxy can't route by key.
+func commandKeys(name string, args []string) []string {
+	switch name {
+	case "EVAL", "EVALSHA", "FCALL":
+		if len(args) < 3 {
+			return nil
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 || n > len(args)-3 {
+			return nil
+		}
+		return args[3 : 3+n]
+	case "XREAD":
+		for i, arg := range args {
+			if strings.EqualFold(arg, "STREAMS") {
+				streams := args[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	}
+	all, ok := keyed[name]
+	if !ok || len(args) < 2 {
+		return nil
+	}
+	if all {
+		return args[1:]
+	}
+	return args[1:2]
+}
+
+// unsupported is the error for a command the proxy can't route.
+func unsupported(command string) []byte {
+	return appendSimple(nil, '-', fmt.Sprintf("ERR '%s' can't be routed through the proxy", command))
+}
+
+// ownerOf returns the address of the backend of keys, or the error to reply
+// with if no backend is up or they belong to different backends.
+func ownerOf(keys []string) (string, []byte) {
+	addr := ""
+	for _, key := range keys {
+		owner := lookup(key)
+		if owner == "" {
+			return "", appendSimple(nil, '-', "ERR no backend is up")
+		}
+		if addr != "" && owner != addr {
+			return "", appendSimple(nil, '-', "CROSSSLOT Keys in request don't hash to the same backend")
+		}
+		addr = owner
+	}
+	return addr, nil
+}
+
+// exec runs a transaction on the backend of the keys of its commands, which
+// must all be on the same one, as on a single server.
+func (c *client) exec(queued [][]string) []byte {
+	if len(queued) == 0 {
+		return append([]byte(nil), "*0\r\n"...)
+	}
+	var keys []string
+	for _, args := range queued {
+		keys = append(keys, commandKeys(strings.ToUpper(args[0]), args)...)
+	}
+	addr, errReply := ownerOf(keys)
+	if errReply != nil {
+		return errReply
+	}
+	commands := append([][]string{{"MULTI"}}, queued...)
+	replies := c.send(addr, append(commands, []string{"EXEC"}))
+	return appendReply(nil, replies[len(replies)-1])
+}
+
+// sum runs a command on the backend of each of its keys, with the keys of
+// the backend, and adds up the replies.
+func (c *client) sum(args, keys []string) []byte {
+	var addrs []string
+	byAddr := map[string][]string{}
+	for _, key := range keys {
+		addr := lookup(key)
+		if addr == "" {
+			return appendSimple(nil, '-', "ERR no backend is up")
+		}
+		if byAddr[addr] == nil {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], key)
+	}
+
+	total := int64(0)
+	for _, addr := range addrs {
+		v := c.send(addr, [][]string{append([]string{args[0]}, byAddr[addr]...)})[0]
+		if v.kind == '-' {
+			return appendReply(nil, v)
+		}
+		total += v.num
+	}
+	return appendSimple(nil, ':', strconv.FormatInt(total, 10))
+}
+
+// broadcast runs a keyless command on every backend that is up, replying
+// with the first error, the sum of the replies for DBSIZE, or else the last
+// reply. AUTH and SELECT are kept for the backends connected to next.
+func (c *client) broadcast(name string, args []string) []byte {
+	addrs := upBackends()
+	if len(addrs) == 0 {
+		return appendSimple(nil, '-', "ERR no backend is up")
+	}
+	var last reply
+	total := int64(0)
+	for _, addr := range addrs {
+		last = c.send(addr, [][]string{args})[0]
+		if last.kind == '-' {
+			return appendReply(nil, last)
+		}
+		total += last.num
+	}
+
+	switch name {
+	case "DBSIZE":
+		return appendSimple(nil, ':', strconv.FormatInt(total, 10))
+	case "AUTH":
+		c.auth = args
+	case "SELECT":
+		c.selected = args
+	}
+	return appendReply(nil, last)
+}
+
+// send pipelines commands to the backend at addr, connecting first, and
+// returns their replies, or errors for all if the connection failed.
+func (c *client) send(addr string, commands [][]string) []reply {
+	b, ok := c.backends[addr]
+	var err error
+	if !ok {
+		var setup [][]string
+		for _, command := range [][]string{c.auth, c.selected} {
+			if command != nil {
+				setup = append(setup, command)
+			}
+		}
+		if b, err = dial(addr, 0, setup); err == nil {
+			c.backends[addr] = b
+		}
+	}
+	var replies []reply
+	if err == nil {
+		if replies, err = b.pipeline(commands); err != nil {
+			b.Close()
+			delete(c.backends, addr)
+		}
+	}
+	if err != nil {
+		replies = make([]reply, len(commands))
+		for i := range replies {
+			replies[i] = reply{kind: '-', str: fmt.Sprintf("ERR error reaching backend %s: %v", addr, err)}
+		}
+	}
+	return replies
+}
+
+// proxyCommand handles "PROXY BACKENDS", listing the backends and whether
+// they are up, and "PROXY LOOKUP key", returning the backend of a key.
+func proxyCommand(args []string) []byte {
+	if len(args) < 2 {
+		return appendSimple(nil, '-', "ERR wrong number of arguments for 'proxy' command")
+	}
+	switch strings.ToUpper(args[1]) {
+	case "BACKENDS":
+		state.mu.RLock()
+		defer state.mu.RUnlock()
+		buf := appendSimple(nil, '*', strconv.Itoa(len(state.backends)))
+		for _, b := range state.backends {
+			status := "down"
+			if b.up {
+				status = "up"
+			}
+			buf = appendCommand(buf, b.addr, status)
+		}
+		return buf
+	case "LOOKUP":
+		if len(args) != 3 {
+			return appendSimple(nil, '-', "ERR wrong number of arguments for 'proxy|lookup' command")
+		}
+		addr := lookup(args[2])
+		if addr == "" {
+			return append([]byte(nil), "$-1\r\n"...)
+		}
+		return appendBulk(nil, addr)
+	default:
+		return appendSimple(nil, '-', fmt.Sprintf("ERR unknown subcommand '%s'. Try PROXY BACKENDS or PROXY LOOKUP.", args[1]))
+	}
+}
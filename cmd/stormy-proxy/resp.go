@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// reply is a RESP value: a simple string (+), an error (-), an integer (:),
+// a bulk string ($), which is null when null is set, or an array (*).
+type reply struct {
+	kind  byte
+	str   string
+	num   int64
+	array []reply
+	null  bool
+}
+
+// errProtocol is returned for input that isn't valid RESP.
+var errProtocol = errors.New("protocol error")
+
+// readReply reads one RESP value.
+func readReply(r *bufio.Reader) (reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return reply{}, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return reply{}, errProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+', '-':
+		return reply{kind: kind, str: body}, nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return reply{}, errProtocol
+		}
+		return reply{kind: kind, num: n}, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > 512*1024*1024 {
+			return reply{}, errProtocol
+		}
+		if n < 0 {
+			return reply{kind: kind, null: true}, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return reply{}, err
+		}
+		return reply{kind: kind, str: string(data[:n])}, nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > 1024*1024 {
+			return reply{}, errProtocol
+		}
+		if n < 0 {
+			return reply{kind: kind, null: true}, nil
+		}
+		v := reply{kind: kind}
+		for i := 0; i < n; i++ {
+			element, err := readReply(r)
+			if err != nil {
+				return reply{}, err
+			}
+			v.array = append(v.array, element)
+		}
+		return v, nil
+	default:
+		return reply{}, errProtocol
+	}
+}
+
+// strings returns the elements of an array reply as strings.
+func (v reply) strings() []string {
+	values := make([]string, 0, len(v.array))
+	for _, element := range v.array {
+		if element.kind == ':' {
+			values = append(values, strconv.FormatInt(element.num, 10))
+		} else {
+			values = append(values, element.str)
+		}
+	}
+	return values
+}
+
+// appendReply appends a reply as it was read.
+func appendReply(buf []byte, v reply) []byte {
+	switch v.kind {
+	case '+', '-':
+		return appendSimple(buf, v.kind, v.str)
+	case ':':
+		return appendSimple(buf, ':', strconv.FormatInt(v.num, 10))
+	case '$':
+		if v.null {
+			return append(buf, "$-1\r\n"...)
+		}
+		return appendBulk(buf, v.str)
+	default:
+		if v.null {
+			return append(buf, "*-1\r\n"...)
+		}
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(v.array)), 10)
+		buf = append(buf, '\r', '\n')
+		for _, element := range v.array {
+			buf = appendReply(buf, element)
+		}
+		return buf
+	}
+}
+
+// appendCommand appends a command as an array of bulk strings.
+func appendCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = appendBulk(buf, arg)
+	}
+	return buf
+}
+
+// appendBulk appends a bulk string.
+func appendBulk(buf []byte, s string) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// appendSimple appends a simple string, an error or an integer, by kind.
+func appendSimple(buf []byte, kind byte, s string) []byte {
+	buf = append(buf, kind)
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// conn is a connection to a backend, which commands are pipelined on.
+type conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// timeout bounds every round trip, unless 0 as for the connections of
+	// clients, whose commands may block.
+	timeout time.Duration
+}
+
+// dial connects to addr within -timeout, with round trips bounded by limit,
+// and sends the commands that set up the connection, such as AUTH, failing
+// if any replies with an error.
+func dial(addr string, limit time.Duration, setup [][]string) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{conn: nc, reader: bufio.NewReader(nc), timeout: limit}
+	if len(setup) == 0 {
+		return c, nil
+	}
+	replies, err := c.pipeline(setup)
+	for i, v := range replies {
+		if v.kind == '-' && err == nil {
+			err = fmt.Errorf("%s failed: %s", setup[i][0], v.str)
+		}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pipeline sends the commands at once and reads their replies. Error
+// replies are returned as replies, not errors.
+func (c *conn) pipeline(commands [][]string) ([]reply, error) {
+	var buf []byte
+	for _, args := range commands {
+		buf = appendCommand(buf, args...)
+	}
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([]reply, 0, len(commands))
+	for range commands {
+		v, err := readReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, v)
+	}
+	return replies, nil
+}
+
+// do sends a command and reads its reply, returning error replies as
+// errors.
+func (c *conn) do(args ...string) (reply, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return reply{}, err
+	}
+	if replies[0].kind == '-' {
+		return reply{}, errors.New(replies[0].str)
+	}
+	return replies[0], nil
+}
+
+func (c *conn) Close() error {
+	return c.conn.Close()
+}
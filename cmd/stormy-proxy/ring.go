@@ -0,0 +1,67 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ring is a consistent hash ring of backends: each backend is placed at
+// -vnodes points, and a key belongs to the backend of the first point at or
+// after its hash, wrapping around. Adding or removing a backend only moves
+// the keys between it and its neighbours on the ring.
+type ring struct {
+	points []point
+}
+
+// point is a place of a backend on the ring.
+type point struct {
+	hash uint32
+	addr string
+}
+
+// newRing places the backends at addrs on a ring.
+func newRing(addrs []string, vnodes int) *ring {
+	r := &ring{points: make([]point, 0, len(addrs)*vnodes)}
+	for _, addr := range addrs {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, point{hash: crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(i))), addr: addr})
+		}
+	}
+	// Ties are broken by address, so every proxy with the same backends
+	// builds the same ring.
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].addr < r.points[j].addr
+	})
+	return r
+}
+
+// lookup returns the address of the backend a key belongs to, or "" if the
+// ring is empty.
+func (r *ring) lookup(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := keyHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].addr
+}
+
+// keyHash hashes a key onto the ring. A key holding a {hash tag} is hashed
+// by the tag alone, as in cluster mode, so keys sharing a tag are on the
+// same backend and can be used together.
+func keyHash(key string) uint32 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxDesync is the most a sentinel delays its failovers by at random, so
+// that sentinels seeing a primary fail together don't keep splitting the
+// vote.
+const maxDesync = time.Second
+
+// check marks instances down, asks the other sentinels whether the primary
+// is down and advances the failover, every tickInterval.
+func (m *master) check() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m.checkDown(m.primary)
+	for _, inst := range m.replicas {
+		m.checkDown(inst)
+	}
+	m.checkODown()
+	if m.primary.sdown && time.Since(m.lastAsk) >= askPeriod {
+		m.askPeers()
+	}
+	m.advanceFailover()
+}
+
+// checkDown marks inst subjectively down once it didn't reply to PING for
+// -down-after, and up again once it does. mu must be held.
+func (m *master) checkDown(inst *instance) {
+	down := time.Since(inst.lastOK) > downAfter
+	switch {
+	case down && !inst.sdown:
+		inst.sdown = true
+		event("+sdown", m.describe(inst))
+	case !down && inst.sdown:
+		inst.sdown = false
+		event("-sdown", m.describe(inst))
+		if inst == m.primary {
+			for _, p := range m.peers {
+				p.masterDown = false
+			}
+		}
+	}
+}
+
+// checkODown marks the primary objectively down once it is subjectively
+// down for a quorum of sentinels, counting this one. mu must be held.
+func (m *master) checkODown() {
+	votes := 0
+	if m.primary.sdown {
+		votes = 1
+		for _, p := range m.peers {
+			if p.masterDown && time.Since(p.downReplyTime) < 5*askPeriod {
+				votes++
+			}
+		}
+	}
+
+	odown := votes >= m.quorum
+	switch {
+	case odown && !m.odown:
+		m.odown = true
+		event("+odown", fmt.Sprintf("%s #quorum %d/%d", m.describePrimary(), votes, m.quorum))
+	case !odown && m.odown:
+		m.odown = false
+		event("-odown", m.describePrimary())
+	}
+}
+
+// askPeers asks the other sentinels whether they consider the primary down
+// and, during a failover, for their vote. mu must be held.
+func (m *master) askPeers() {
+	m.lastAsk = time.Now()
+	host, port, _ := net.SplitHostPort(m.primary.addr)
+	candidate := "*"
+	if m.failoverState != "" {
+		candidate = runID
+	}
+	epoch := strconv.FormatInt(currentEpoch, 10)
+
+	for _, p := range m.peers {
+		if p.asking {
+			continue
+		}
+		p.asking = true
+		go func(p *peer) {
+			v, err := p.link.do(commandTimeout, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, epoch, candidate)
+
+			mu.Lock()
+			defer mu.Unlock()
+			p.asking = false
+			if err != nil || v.kind != '*' || len(v.array) != 3 {
+				return
+			}
+			p.masterDown = v.array[0].num == 1
+			p.downReplyTime = time.Now()
+			if leader := v.array[1].str; leader != "*" {
+				p.leader, p.leaderEpoch = leader, v.array[2].num
+			}
+		}(p)
+	}
+}
+
+// vote votes for the sentinel with run ID id as the leader of the failover
+// of epoch, unless this sentinel voted in that epoch already, and returns
+// the sentinel voted for and the epoch of the vote. mu must be held.
+func (m *master) vote(id string, epoch int64) (string, int64) {
+	adoptEpoch(epoch)
+	if m.leaderEpoch < epoch && currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = id, epoch
+		event("+vote-for-leader", fmt.Sprintf("%s %d", id, epoch))
+		// Give the sentinel voted for the time to fail over before trying.
+		if id != runID {
+			m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(maxDesync))))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// electedLeader counts the votes of the sentinels for the failover of epoch,
+// voting for the sentinel ahead or else for this one, and returns the
+// sentinel voted for by a majority of them and at least a quorum, or "".
+// mu must be held.
+func (m *master) electedLeader(epoch int64) string {
+	votes := map[string]int{}
+	for _, p := range m.peers {
+		if p.leader != "" && p.leaderEpoch == epoch {
+			votes[p.leader]++
+		}
+	}
+	winner := mostVoted(votes)
+	if winner == "" {
+		winner = runID
+	}
+	if leader, leaderEpoch := m.vote(winner, epoch); leaderEpoch == epoch {
+		votes[leader]++
+	}
+
+	winner = mostVoted(votes)
+	if votes[winner] < (len(m.peers)+1)/2+1 || votes[winner] < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+// mostVoted returns the sentinel with the most votes, the greatest run ID
+// among ties.
+func mostVoted(votes map[string]int) string {
+	winner := ""
+	for id, n := range votes {
+		if n > votes[winner] || (n == votes[winner] && id > winner) {
+			winner = id
+		}
+	}
+	return winner
+}
+
+// startFailover starts a failover for a new epoch, to be led by the sentinel
+// the others elect unless forced. mu must be held.
+func (m *master) startFailover(forced bool) {
+	currentEpoch++
+	event("+new-epoch", strconv.FormatInt(currentEpoch, 10))
+	m.failoverEpoch = currentEpoch
+	m.forced = forced
+	m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(maxDesync))))
+	m.setState("wait-start")
+	event("+try-failover", m.describePrimary())
+	// Ask for votes right away.
+	m.lastAsk = time.Time{}
+}
+
+// setState moves the failover to state. mu must be held.
+func (m *master) setState(state string) {
+	m.failoverState = state
+	m.stateChange = time.Now()
+	if state != "wait-start" {
+		event("+failover-state-"+state, m.describePrimary())
+	}
+}
+
+// abortFailover gives up the failover in progress. It is retried after
+// twice the failover timeout, unless the primary comes back. mu must be
+// held.
+func (m *master) abortFailover(reason string) {
+	event(reason, m.describePrimary())
+	m.failoverState, m.promoted, m.forced = "", nil, false
+	for _, inst := range m.replicas {
+		inst.reconfSent, inst.reconfDone = false, false
+	}
+}
+
+// advanceFailover starts a failover once the primary is objectively down
+// and moves it along. mu must be held.
+func (m *master) advanceFailover() {
+	switch m.failoverState {
+	case "":
+		if m.odown && time.Since(m.failoverStart) >= 2*failoverTimeout {
+			m.startFailover(false)
+		}
+	case "wait-start":
+		if !m.forced {
+			if leader := m.electedLeader(m.failoverEpoch); leader != runID {
+				if time.Since(m.failoverStart) > min(10*time.Second, failoverTimeout) {
+					m.abortFailover("-failover-abort-not-elected")
+				}
+				return
+			}
+		}
+		event("+elected-leader", m.describePrimary())
+		m.setState("select-slave")
+	case "select-slave":
+		// Compare the offsets the replicas report once INFO is sent every
+		// downInfoPeriod, unless some don't reply.
+		if !m.replicasRefreshed(m.stateChange) && time.Since(m.stateChange) < 5*downInfoPeriod {
+			return
+		}
+		best := m.bestReplica(m.stateChange)
+		if best == nil {
+			m.abortFailover("-failover-abort-no-good-slave")
+			return
+		}
+		m.promoted = best
+		event("+selected-slave", m.describe(best))
+		m.reconfigure(best, "")
+		m.setState("wait-promotion")
+	case "wait-promotion":
+		if time.Since(m.stateChange) > failoverTimeout {
+			m.abortFailover("-failover-abort-slave-timeout")
+		}
+	case "reconf-slaves":
+		done := true
+		for _, inst := range m.replicas {
+			if inst == m.promoted || inst.reconfDone || inst.sdown {
+				continue
+			}
+			done = false
+			if !inst.reconfSent {
+				inst.reconfSent = true
+				m.reconfigure(inst, m.promoted.addr)
+				event("+slave-reconf-sent", m.describe(inst))
+			}
+		}
+		if !done && time.Since(m.stateChange) <= failoverTimeout {
+			return
+		}
+		if done {
+			event("+failover-end", m.describePrimary())
+		} else {
+			event("+failover-end-for-timeout", m.describePrimary())
+		}
+		m.switchMaster(m.promoted.addr)
+	}
+}
+
+// bestReplica returns the replica to promote: one that is up and replied to
+// INFO since the given time, with the highest replication offset, the lowest
+// address among ties. mu must be held.
+func (m *master) bestReplica(since time.Time) *instance {
+	candidates := []*instance{}
+	for _, inst := range m.replicas {
+		if !inst.sdown && inst.role == "slave" && inst.lastInfo.After(since) {
+			candidates = append(candidates, inst)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].offset != candidates[j].offset {
+			return candidates[i].offset > candidates[j].offset
+		}
+		return candidates[i].addr < candidates[j].addr
+	})
+	return candidates[0]
+}
+
+// replicasRefreshed reports whether every replica that is up replied to INFO
+// since the given time. mu must be held.
+func (m *master) replicasRefreshed(since time.Time) bool {
+	for _, inst := range m.replicas {
+		if !inst.sdown && !inst.lastInfo.After(since) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+// Command stormy-sentinel monitors StormyDB primaries and their replicas and
+// fails over automatically when a primary goes down.
+//
+// Each -monitor flag names a primary to watch and the number of sentinels
+// that must agree it is down, its quorum. A sentinel pings the primary and
+// its replicas, which it learns from INFO replication, every second, and
+// considers an instance subjectively down once it didn't reply for
+// -down-after. Sentinels watching the same primary find each other through
+// hello messages they publish to the __sentinel__:hello channel of every
+// instance. Once a quorum of them consider the primary down, it is
+// objectively down: one of them is elected leader by a majority of the
+// sentinels, for a new epoch, and promotes the replica with the highest
+// replication offset with REPLICAOF NO ONE, then makes the other replicas
+// and, once it comes back, the old primary replicate it. The new address is
+// spread to the other sentinels with the epoch of the failover, so the one
+// from the latest failover wins. A failover that doesn't complete within
+// -failover-timeout is aborted, and retried after twice as long.
+//
+// Clients ask any sentinel for the current address of a primary with
+// SENTINEL GET-MASTER-ADDR-BY-NAME <name>, and learn about failovers as they
+// happen by subscribing to the +switch-master channel, whose messages read
+// "<name> <old ip> <old port> <new ip> <new port>". Every event is also
+// logged and published to a channel of its own name, such as +sdown, +odown,
+// +try-failover, +elected-leader and +convert-to-slave.
+//
+// The state isn't saved: a restarted sentinel monitors the primaries its
+// flags name and learns of the failovers since from the other sentinels.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// monitors collects the -monitor flags.
+type monitors []string
+
+func (m *monitors) String() string { return strings.Join(*m, ", ") }
+
+func (m *monitors) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+var (
+	// port is the port the sentinel listens on, announced to the others.
+	port string
+	// announceIP is the address announced to the other sentinels, the one
+	// the sentinel connects to the monitored servers from when empty.
+	announceIP string
+	// authUser and authPass authenticate to the monitored servers.
+	authUser, authPass string
+	downAfter          time.Duration
+	failoverTimeout    time.Duration
+)
+
+func main() {
+	var watched monitors
+	flag.Var(&watched, "monitor", `primary to monitor, as "<name> <host> <port> <quorum>" (repeatable)`)
+	listenPort := flag.Int("port", 26379, "port to listen on")
+	flag.StringVar(&announceIP, "announce-ip", "", "address announced to the other sentinels")
+	flag.StringVar(&authUser, "auth-user", "", "user to authenticate to the monitored servers as")
+	flag.StringVar(&authPass, "auth-pass", "", "password to authenticate to the monitored servers with")
+	flag.DurationVar(&downAfter, "down-after", 30*time.Second, "time without a reply after which an instance is down")
+	flag.DurationVar(&failoverTimeout, "failover-timeout", 3*time.Minute, "time a failover may take before it is aborted")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -monitor \"<name> <host> <port> <quorum>\" [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(watched) == 0 || flag.NArg() != 0 || downAfter <= 0 || failoverTimeout <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	port = strconv.Itoa(*listenPort)
+
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		fmt.Println("Error generating run ID:", err)
+		os.Exit(1)
+	}
+	runID = hex.EncodeToString(id)
+
+	for _, monitor := range watched {
+		m, err := parseMonitor(monitor)
+		if err != nil {
+			fmt.Println("Error in -monitor:", err)
+			os.Exit(1)
+		}
+		masters = append(masters, m)
+	}
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fmt.Println("Error listening:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Sentinel %s listening on port %s\n", runID, port)
+
+	go deliverEvents()
+	for _, m := range masters {
+		m.start()
+	}
+	serve(listener)
+}
+
+// parseMonitor parses a -monitor flag. The host is resolved to an address,
+// as replicas report the address of their primary.
+func parseMonitor(monitor string) (*master, error) {
+	fields := strings.Fields(monitor)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("%q isn't \"<name> <host> <port> <quorum>\"", monitor)
+	}
+	name, host, port := fields[0], fields[1], fields[2]
+	for _, m := range masters {
+		if m.name == name {
+			return nil, fmt.Errorf("%s is monitored twice", name)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	quorum, err := strconv.Atoi(fields[3])
+	if err != nil || quorum <= 0 {
+		return nil, fmt.Errorf("invalid quorum %q", fields[3])
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	return newMaster(name, net.JoinHostPort(addrs[0], port), quorum), nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tickInterval is how often each master checks its instances and
+	// advances a failover.
+	tickInterval = 100 * time.Millisecond
+	// pingPeriod is how often instances are pinged, unless -down-after is
+	// shorter.
+	pingPeriod = time.Second
+	// infoPeriod is how often instances are sent INFO, and downInfoPeriod
+	// how often while their primary is down or failed over.
+	infoPeriod     = 10 * time.Second
+	downInfoPeriod = time.Second
+	// helloPeriod is how often hello messages are published to instances.
+	helloPeriod = 2 * time.Second
+	// askPeriod is how often the other sentinels are asked whether they
+	// consider a down primary down too, and votes count for five times as
+	// long.
+	askPeriod = time.Second
+	// commandTimeout bounds the commands sent to instances and sentinels.
+	commandTimeout = 5 * time.Second
+	// reconfPeriod is how long an instance with the wrong primary is left
+	// alone after being sent REPLICAOF.
+	reconfPeriod = 10 * time.Second
+	// helloChannel is the channel sentinels publish hello messages to.
+	helloChannel = "__sentinel__:hello"
+)
+
+var (
+	// mu guards the state of every master, their instances and peers, and
+	// currentEpoch. It is never held while waiting on the network.
+	mu sync.Mutex
+	// runID identifies the sentinel to the others.
+	runID string
+	// currentEpoch is the latest epoch a failover was started for by any
+	// sentinel known.
+	currentEpoch int64
+	// masters are the primaries monitored, in the order of the flags.
+	masters []*master
+)
+
+// instance is a monitored server, a primary or one of its replicas, with
+// what it last replied to PING and INFO.
+type instance struct {
+	addr string
+	link *link
+
+	// lastOK is when the instance last replied to PING, or when it started
+	// being monitored.
+	lastOK   time.Time
+	lastInfo time.Time
+	sdown    bool
+	// role is "master" or "slave", from INFO. Replicas also report the
+	// address of their primary, whether their link to it is up and their
+	// replication offset.
+	role       string
+	masterAddr string
+	linkUp     bool
+	offset     int64
+
+	// lastReconf is when the instance was last sent REPLICAOF. reconfSent
+	// and reconfDone are set once a replica was sent REPLICAOF during a
+	// failover and once it replicates the promoted replica.
+	lastReconf time.Time
+	reconfSent bool
+	reconfDone bool
+}
+
+// peer is another sentinel monitoring the same primary.
+type peer struct {
+	runID     string
+	addr      string
+	link      *link
+	lastHello time.Time
+	// masterDown is whether the peer considered the primary down when last
+	// asked, at downReplyTime.
+	masterDown    bool
+	downReplyTime time.Time
+	asking        bool
+	// leader is the sentinel the peer voted for in leaderEpoch.
+	leader      string
+	leaderEpoch int64
+}
+
+// master is a monitored primary, with its replicas and the other sentinels
+// monitoring it.
+type master struct {
+	name   string
+	quorum int
+
+	primary  *instance
+	replicas map[string]*instance
+	peers    map[string]*peer
+
+	// configEpoch is the epoch of the failover that made primary the
+	// primary, 0 when it is the one configured.
+	configEpoch int64
+	odown       bool
+	lastAsk     time.Time
+	// leader is the sentinel this one voted for in leaderEpoch.
+	leader      string
+	leaderEpoch int64
+
+	// failoverState is empty without a failover, then "wait-start" until
+	// elected, "select-slave", "wait-promotion" once promoted was sent
+	// REPLICAOF NO ONE and "reconf-slaves" while the other replicas are
+	// made to replicate it. failoverStart is when the last failover started
+	// or this sentinel last voted for another, stateChange when the state
+	// last changed, and forced is set for SENTINEL FAILOVER.
+	failoverState string
+	failoverEpoch int64
+	failoverStart time.Time
+	stateChange   time.Time
+	forced        bool
+	promoted      *instance
+}
+
+// newMaster returns a master whose primary is at addr.
+func newMaster(name, addr string, quorum int) *master {
+	return &master{
+		name:     name,
+		quorum:   quorum,
+		primary:  &instance{addr: addr, link: &link{addr: addr, auth: true}, lastOK: time.Now()},
+		replicas: map[string]*instance{},
+		peers:    map[string]*peer{},
+	}
+}
+
+// start starts monitoring the primary.
+func (m *master) start() {
+	m.watch(m.primary)
+	go func() {
+		for range time.Tick(tickInterval) {
+			m.check()
+		}
+	}()
+}
+
+// addReplica starts monitoring the replica at addr. mu must be held.
+func (m *master) addReplica(addr string) *instance {
+	inst := &instance{addr: addr, link: &link{addr: addr, auth: true}, lastOK: time.Now()}
+	m.replicas[addr] = inst
+	m.watch(inst)
+	return inst
+}
+
+// watch starts pinging inst, sending it INFO and hello messages and reading
+// the hello messages of the other sentinels from it.
+func (m *master) watch(inst *instance) {
+	go m.poll(inst)
+	go m.subscribe(inst)
+}
+
+// poll pings inst and sends it INFO and hello messages, periodically.
+func (m *master) poll(inst *instance) {
+	period := min(pingPeriod, downAfter)
+	var lastInfo, lastHello time.Time
+	for {
+		start := time.Now()
+		if v, err := inst.link.do(commandTimeout, "PING"); err == nil && validPing(v) {
+			mu.Lock()
+			inst.lastOK = time.Now()
+			mu.Unlock()
+		}
+
+		mu.Lock()
+		wait := infoPeriod
+		if m.primary.sdown || m.failoverState != "" || m.promoted != nil {
+			wait = downInfoPeriod
+		}
+		mu.Unlock()
+		if time.Since(lastInfo) >= wait {
+			lastInfo = time.Now()
+			if v, err := inst.link.do(commandTimeout, "INFO", "replication"); err == nil && v.kind == '$' {
+				m.refresh(inst, parseInfo(v.str))
+			}
+		}
+
+		if time.Since(lastHello) >= helloPeriod {
+			lastHello = time.Now()
+			m.sendHello(inst)
+		}
+		time.Sleep(period - time.Since(start))
+	}
+}
+
+// validPing reports whether v is a reply to PING from a working server, which
+// may still be loading its dataset.
+func validPing(v reply) bool {
+	return v.kind == '+' || (v.kind == '-' && (strings.HasPrefix(v.str, "LOADING") || strings.HasPrefix(v.str, "MASTERDOWN")))
+}
+
+// refresh records the INFO replication fields of inst, learns the replicas
+// of the primary, and tells instances replicating the wrong primary to
+// replicate the right one.
+func (m *master) refresh(inst *instance, fields map[string]string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	inst.lastInfo = time.Now()
+	inst.role = fields["role"]
+	if inst.role == "slave" {
+		inst.masterAddr = net.JoinHostPort(fields["master_host"], fields["master_port"])
+		inst.linkUp = fields["master_link_status"] == "up"
+		inst.offset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	} else {
+		inst.masterAddr, inst.linkUp = "", false
+		inst.offset, _ = strconv.ParseInt(fields["master_repl_offset"], 10, 64)
+	}
+
+	if inst == m.primary {
+		for field, value := range fields {
+			if _, err := strconv.Atoi(strings.TrimPrefix(field, "slave")); err != nil || !strings.HasPrefix(field, "slave") {
+				continue
+			}
+			addr := replicaAddr(value)
+			if addr != "" && addr != m.primary.addr && m.replicas[addr] == nil {
+				m.addReplica(addr)
+				event("+slave", m.describe(m.replicas[addr]))
+			}
+		}
+		return
+	}
+
+	settled := m.failoverState == "" && m.promoted == nil && !m.primary.sdown && time.Since(inst.lastReconf) > reconfPeriod
+	switch {
+	case inst == m.promoted && m.failoverState == "wait-promotion" && inst.role == "master":
+		m.configEpoch = m.failoverEpoch
+		event("+promoted-slave", m.describe(inst))
+		m.setState("reconf-slaves")
+	case inst.role == "master" && settled:
+		event("+convert-to-slave", m.describe(inst))
+		m.reconfigure(inst, m.primary.addr)
+	case inst.role == "slave" && inst.masterAddr != m.primary.addr && settled:
+		event("+fix-slave-config", m.describe(inst))
+		m.reconfigure(inst, m.primary.addr)
+	case m.failoverState == "reconf-slaves" && inst.reconfSent && !inst.reconfDone &&
+		inst.role == "slave" && inst.masterAddr == m.promoted.addr && inst.linkUp:
+		inst.reconfDone = true
+		event("+slave-reconf-done", m.describe(inst))
+	}
+}
+
+// replicaAddr returns the address of a replica from its "slaveN" line of
+// INFO replication, as "ip=...,port=...,state=...".
+func replicaAddr(line string) string {
+	var ip, port string
+	for _, field := range strings.Split(line, ",") {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "ip":
+			ip = value
+		case "port":
+			port = value
+		}
+	}
+	if ip == "" || port == "" {
+		return ""
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// reconfigure sends inst REPLICAOF to make it replicate the primary at addr,
+// or REPLICAOF NO ONE when addr is empty. mu must be held.
+func (m *master) reconfigure(inst *instance, addr string) {
+	inst.lastReconf = time.Now()
+	args := []string{"REPLICAOF", "NO", "ONE"}
+	if addr != "" {
+		host, port, _ := net.SplitHostPort(addr)
+		args = []string{"REPLICAOF", host, port}
+	}
+	go func() {
+		v, err := inst.link.do(commandTimeout, args...)
+		if err == nil && v.kind == '-' {
+			err = fmt.Errorf("%s", v.str)
+		}
+		if err != nil {
+			fmt.Printf("Error sending REPLICAOF to %s: %v\n", inst.addr, err)
+		}
+	}()
+}
+
+// sendHello publishes a hello message to inst, announcing the sentinel and
+// the primary it knows with the epoch of that configuration:
+// "<ip>,<port>,<run ID>,<current epoch>,<name>,<primary ip>,<primary
+// port>,<config epoch>".
+func (m *master) sendHello(inst *instance) {
+	ip := announceIP
+	if ip == "" {
+		if ip = inst.link.localIP(); ip == "" {
+			return
+		}
+	}
+
+	mu.Lock()
+	primaryHost, primaryPort, _ := net.SplitHostPort(m.announcedAddr())
+	hello := strings.Join([]string{
+		ip, port, runID, strconv.FormatInt(currentEpoch, 10),
+		m.name, primaryHost, primaryPort, strconv.FormatInt(m.configEpoch, 10),
+	}, ",")
+	mu.Unlock()
+
+	inst.link.do(commandTimeout, "PUBLISH", helloChannel, hello)
+}
+
+// announcedAddr returns the address of the primary announced in hello
+// messages: that of the replica promoted by the failover in progress, which
+// got the epoch of the failover, once it was promoted. mu must be held.
+func (m *master) announcedAddr() string {
+	if m.failoverState == "reconf-slaves" {
+		return m.promoted.addr
+	}
+	return m.primary.addr
+}
+
+// subscribe reads the hello messages published to inst, reconnecting when
+// the connection fails.
+func (m *master) subscribe(inst *instance) {
+	for {
+		m.readHellos(inst)
+		time.Sleep(time.Second)
+	}
+}
+
+// readHellos subscribes to the hello channel of inst and handles the
+// messages until the connection fails. The sentinel's own hello messages
+// arrive every helloPeriod, so a silent connection is a dead one.
+func (m *master) readHellos(inst *instance) error {
+	conn, reader, err := dial(inst.addr, true, commandTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := conn.Write(appendCommand(nil, "SUBSCRIBE", helloChannel)); err != nil {
+		return err
+	}
+	for {
+		v, err := readReply(reader)
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(3 * helloPeriod))
+		if v.kind == '*' && len(v.array) == 3 && v.array[0].str == "message" {
+			m.processHello(v.array[2].str)
+		}
+	}
+}
+
+// processHello learns the sentinel that sent a hello message, and the
+// primary it announces when that configuration is newer.
+func (m *master) processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	ip, port, id, name := fields[0], fields[1], fields[2], fields[4]
+	epoch, err1 := strconv.ParseInt(fields[3], 10, 64)
+	configEpoch, err2 := strconv.ParseInt(fields[7], 10, 64)
+	if err1 != nil || err2 != nil || id == runID || name != m.name {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	adoptEpoch(epoch)
+	addr := net.JoinHostPort(ip, port)
+	p := m.peers[id]
+	if p == nil {
+		// A sentinel restarted at the same address has a new run ID.
+		for other, q := range m.peers {
+			if q.addr == addr {
+				delete(m.peers, other)
+			}
+		}
+		p = &peer{runID: id, addr: addr, link: &link{addr: addr}}
+		m.peers[id] = p
+		event("+sentinel", fmt.Sprintf("sentinel %s %s %s @ %s", id, ip, port, m.describePrimary()))
+	} else if p.addr != addr {
+		p.addr, p.link = addr, &link{addr: addr}
+	}
+	p.lastHello = time.Now()
+
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		primary := net.JoinHostPort(fields[5], fields[6])
+		if primary != m.primary.addr {
+			event("+config-update-from", fmt.Sprintf("sentinel %s %s %s @ %s", id, ip, port, m.describePrimary()))
+			m.switchMaster(primary)
+		}
+	}
+}
+
+// adoptEpoch makes epoch the current epoch if it is newer. mu must be held.
+func adoptEpoch(epoch int64) {
+	if epoch > currentEpoch {
+		currentEpoch = epoch
+		event("+new-epoch", strconv.FormatInt(epoch, 10))
+	}
+}
+
+// switchMaster makes the instance at addr the primary, and the old primary
+// one of its replicas. mu must be held.
+func (m *master) switchMaster(addr string) {
+	old := m.primary
+	primary := m.replicas[addr]
+	if primary == nil {
+		primary = m.addReplica(addr)
+	}
+	delete(m.replicas, addr)
+	if old.addr != addr {
+		m.replicas[old.addr] = old
+	}
+	m.primary = primary
+
+	m.odown = false
+	m.failoverState, m.promoted, m.forced = "", nil, false
+	for _, inst := range m.replicas {
+		inst.reconfSent, inst.reconfDone = false, false
+	}
+	for _, p := range m.peers {
+		p.masterDown = false
+	}
+
+	oldHost, oldPort, _ := net.SplitHostPort(old.addr)
+	newHost, newPort, _ := net.SplitHostPort(addr)
+	event("+switch-master", strings.Join([]string{m.name, oldHost, oldPort, newHost, newPort}, " "))
+}
+
+// describe names inst in events, as "master <name> <ip> <port>" or "slave
+// <addr> <ip> <port> @ <name> <primary ip> <primary port>". mu must be held.
+func (m *master) describe(inst *instance) string {
+	if inst == m.primary {
+		return m.describePrimary()
+	}
+	host, port, _ := net.SplitHostPort(inst.addr)
+	return fmt.Sprintf("slave %s %s %s @ %s", inst.addr, host, port, strings.TrimPrefix(m.describePrimary(), "master "))
+}
+
+// describePrimary names the primary in events. mu must be held.
+func (m *master) describePrimary() string {
+	host, port, _ := net.SplitHostPort(m.primary.addr)
+	return fmt.Sprintf("master %s %s %s", m.name, host, port)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reply is a RESP value: a simple string (+), an error (-), an integer (:),
+// a bulk string ($), which is null when null is set, or an array (*).
+type reply struct {
+	kind  byte
+	str   string
+	num   int64
+	array []reply
+	null  bool
+}
+
+// errProtocol is returned for input that isn't valid RESP.
+var errProtocol = errors.New("protocol error")
+
+// readReply reads one RESP value.
+func readReply(r *bufio.Reader) (reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return reply{}, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return reply{}, errProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+', '-':
+		return reply{kind: kind, str: body}, nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return reply{}, errProtocol
+		}
+		return reply{kind: kind, num: n}, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > 512*1024*1024 {
+			return reply{}, errProtocol
+		}
+		if n < 0 {
+			return reply{kind: kind, null: true}, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return reply{}, err
+		}
+		return reply{kind: kind, str: string(data[:n])}, nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > 1024*1024 {
+			return reply{}, errProtocol
+		}
+		if n < 0 {
+			return reply{kind: kind, null: true}, nil
+		}
+		v := reply{kind: kind}
+		for i := 0; i < n; i++ {
+			element, err := readReply(r)
+			if err != nil {
+				return reply{}, err
+			}
+			v.array = append(v.array, element)
+		}
+		return v, nil
+	default:
+		return reply{}, errProtocol
+	}
+}
+
+// strings returns the elements of an array reply as strings.
+func (v reply) strings() []string {
+	values := make([]string, 0, len(v.array))
+	for _, element := range v.array {
+		if element.kind == ':' {
+			values = append(values, strconv.FormatInt(element.num, 10))
+		} else {
+			values = append(values, element.str)
+		}
+	}
+	return values
+}
+
+// appendCommand appends a command as an array of bulk strings.
+func appendCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = appendBulk(buf, arg)
+	}
+	return buf
+}
+
+// appendBulk appends a bulk string.
+func appendBulk(buf []byte, s string) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// appendSimple appends a simple string, an error or an integer, by kind.
+func appendSimple(buf []byte, kind byte, s string) []byte {
+	buf = append(buf, kind)
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// link is a connection to a server or another sentinel for commands,
+// opened when first needed and again after it failed.
+type link struct {
+	addr string
+	// auth is set for the links to monitored servers, which are sent AUTH
+	// with -auth-user and -auth-pass.
+	auth bool
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command and reads the reply, within timeout. An error reply is
+// returned as a reply, not an error.
+func (l *link) do(timeout time.Duration, args ...string) (reply, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		conn, reader, err := dial(l.addr, l.auth, timeout)
+		if err != nil {
+			return reply{}, err
+		}
+		l.conn, l.reader = conn, reader
+	}
+
+	l.conn.SetDeadline(time.Now().Add(timeout))
+	v, err := roundTrip(l.conn, l.reader, args...)
+	if err != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+	return v, err
+}
+
+// dial connects to addr and, with auth, authenticates with -auth-user and
+// -auth-pass.
+func dial(addr string, auth bool, timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if !auth || authPass == "" {
+		return conn, reader, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	args := []string{"AUTH", authPass}
+	if authUser != "" {
+		args = []string{"AUTH", authUser, authPass}
+	}
+	v, err := roundTrip(conn, reader, args...)
+	if err == nil && v.kind == '-' {
+		err = fmt.Errorf("AUTH failed: %s", v.str)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+// roundTrip writes a command and reads its reply.
+func roundTrip(conn net.Conn, reader *bufio.Reader, args ...string) (reply, error) {
+	if _, err := conn.Write(appendCommand(nil, args...)); err != nil {
+		return reply{}, err
+	}
+	return readReply(reader)
+}
+
+// localIP returns the address the link connects from, which other servers
+// can reach the sentinel at, or "" while it isn't connected.
+func (l *link) localIP() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+	return host
+}
+
+// parseInfo returns the "field:value" lines of an INFO reply.
+func parseInfo(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if field, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[field] = value
+		}
+	}
+	return fields
+}
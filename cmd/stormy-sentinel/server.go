@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client is a connection to the sentinel.
+type client struct {
+	conn net.Conn
+	// writeMu serializes the replies with the messages of subscriptions.
+	writeMu sync.Mutex
+	// channels and patterns are the subscriptions, guarded by
+	// subscribers.mu.
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+// subscribers are the clients subscribed to events.
+var subscribers = struct {
+	mu      sync.Mutex
+	clients map[*client]bool
+}{clients: map[*client]bool{}}
+
+// events queues the events to publish to subscribers, as channel and
+// message pairs, so a slow subscriber doesn't hold up monitoring.
+var events = make(chan [2]string, 1024)
+
+// event logs an event and publishes message to the channel named kind.
+func event(kind, message string) {
+	fmt.Println(time.Now().Format("2006-01-02 15:04:05.000"), kind, message)
+	select {
+	case events <- [2]string{kind, message}:
+	default:
+	}
+}
+
+// deliverEvents publishes the queued events to the subscribed clients.
+func deliverEvents() {
+	for e := range events {
+		channel, message := e[0], e[1]
+		subscribers.mu.Lock()
+		for c := range subscribers.clients {
+			if c.channels[channel] {
+				c.write(appendCommand(nil, "message", channel, message))
+			}
+			for pattern := range c.patterns {
+				if matched, _ := path.Match(pattern, channel); matched {
+					c.write(appendCommand(nil, "pmessage", pattern, channel, message))
+				}
+			}
+		}
+		subscribers.mu.Unlock()
+	}
+}
+
+// write sends out to the client, dropping it if it doesn't keep up.
+func (c *client) write(out []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(commandTimeout))
+	if _, err := c.conn.Write(out); err != nil {
+		c.conn.Close()
+	}
+}
+
+// serve accepts clients and other sentinels.
+func serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		go handleConnection(conn)
+	}
+}
+
+// handleConnection runs the commands of a client until it disconnects.
+func handleConnection(conn net.Conn) {
+	c := &client{conn: conn, channels: map[string]bool{}, patterns: map[string]bool{}}
+	defer func() {
+		subscribers.mu.Lock()
+		delete(subscribers.clients, c)
+		subscribers.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) > 0 {
+			c.write(c.execute(args))
+		}
+	}
+}
+
+// readCommand reads a command, as an array of bulk strings or an inline
+// command.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := reader.ReadString('\n')
+		return strings.Fields(line), err
+	}
+	v, err := readReply(reader)
+	if err != nil {
+		return nil, err
+	}
+	return v.strings(), nil
+}
+
+// execute runs a command and returns its reply.
+func (c *client) execute(args []string) []byte {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return appendSimple(nil, '+', "PONG")
+	case "INFO":
+		return appendBulk(nil, info())
+	case "SENTINEL":
+		if len(args) < 2 {
+			return wrongArity(args[0])
+		}
+		return sentinelCommand(args[1:])
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) < 2 {
+			return wrongArity(args[0])
+		}
+		return c.subscribe(strings.ToLower(args[0]), args[1:])
+	default:
+		return appendSimple(nil, '-', fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// wrongArity is the error for a command with the wrong number of arguments.
+func wrongArity(command string) []byte {
+	return appendSimple(nil, '-', fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// subscribe subscribes the client to channels, or to patterns for
+// PSUBSCRIBE.
+func (c *client) subscribe(kind string, names []string) []byte {
+	subscribers.mu.Lock()
+	defer subscribers.mu.Unlock()
+
+	subscribers.clients[c] = true
+	var out []byte
+	for _, name := range names {
+		if kind == "subscribe" {
+			c.channels[name] = true
+		} else {
+			c.patterns[name] = true
+		}
+		out = append(out, "*3\r\n"...)
+		out = appendBulk(out, kind)
+		out = appendBulk(out, name)
+		out = appendSimple(out, ':', strconv.Itoa(len(c.channels)+len(c.patterns)))
+	}
+	return out
+}
+
+// info reports the sentinel and the primaries it monitors.
+func info() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	lines := []string{
+		"# Server",
+		"run_id:" + runID,
+		"tcp_port:" + port,
+		"",
+		"# Sentinel",
+		fmt.Sprintf("sentinel_masters:%d", len(masters)),
+	}
+	for i, m := range masters {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.primary.sdown {
+			status = "sdown"
+		}
+		lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, m.name, status, m.primary.addr, len(m.replicas), len(m.peers)+1))
+	}
+	return strings.Join(append(lines, ""), "\r\n")
+}
+
+// sentinelCommand handles the SENTINEL subcommands.
+func sentinelCommand(args []string) []byte {
+	mu.Lock()
+	defer mu.Unlock()
+
+	subcommand := strings.ToUpper(args[0])
+	switch subcommand {
+	case "MYID":
+		return appendBulk(nil, runID)
+	case "MASTERS":
+		out := appendSimple(nil, '*', strconv.Itoa(len(masters)))
+		for _, m := range masters {
+			out = appendCommand(out, m.fields()...)
+		}
+		return out
+	case "IS-MASTER-DOWN-BY-ADDR":
+		if len(args) != 5 {
+			return wrongArity("sentinel|" + strings.ToLower(subcommand))
+		}
+		return isMasterDownByAddr(args[1], args[2], args[3], args[4])
+	case "MASTER", "REPLICAS", "SLAVES", "SENTINELS", "GET-MASTER-ADDR-BY-NAME", "FAILOVER":
+	default:
+		return appendSimple(nil, '-', fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+	}
+
+	if len(args) != 2 {
+		return wrongArity("sentinel|" + strings.ToLower(subcommand))
+	}
+	var m *master
+	for _, candidate := range masters {
+		if candidate.name == args[1] {
+			m = candidate
+		}
+	}
+	if m == nil {
+		if subcommand == "GET-MASTER-ADDR-BY-NAME" {
+			return []byte("*-1\r\n")
+		}
+		return appendSimple(nil, '-', "ERR No such master with that name")
+	}
+
+	switch subcommand {
+	case "MASTER":
+		return appendCommand(nil, m.fields()...)
+	case "REPLICAS", "SLAVES":
+		out := appendSimple(nil, '*', strconv.Itoa(len(m.replicas)))
+		for _, inst := range m.sortedReplicas() {
+			out = appendCommand(out, m.replicaFields(inst)...)
+		}
+		return out
+	case "SENTINELS":
+		out := appendSimple(nil, '*', strconv.Itoa(len(m.peers)))
+		for _, p := range m.peers {
+			host, port, _ := net.SplitHostPort(p.addr)
+			out = appendCommand(out,
+				"name", p.runID, "ip", host, "port", port, "runid", p.runID,
+				"last-hello-message", strconv.FormatInt(time.Since(p.lastHello).Milliseconds(), 10),
+				"voted-leader", p.leader, "voted-leader-epoch", strconv.FormatInt(p.leaderEpoch, 10),
+			)
+		}
+		return out
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(m.primary.addr)
+		return appendCommand(nil, host, port)
+	default: // FAILOVER
+		if m.failoverState != "" {
+			return appendSimple(nil, '-', "INPROG Failover already in progress")
+		}
+		if m.bestReplica(time.Now().Add(-3*infoPeriod)) == nil {
+			return appendSimple(nil, '-', "NOGOODSLAVE No suitable replica to promote")
+		}
+		m.startFailover(true)
+		return appendSimple(nil, '+', "OK")
+	}
+}
+
+// isMasterDownByAddr handles "SENTINEL IS-MASTER-DOWN-BY-ADDR ip port epoch
+// runid" from another sentinel, replying whether the primary at ip and port
+// is down, and voting for the sentinel with run ID runid as the leader of
+// its failover for epoch unless runid is "*". The reply also holds the
+// sentinel voted for and the epoch of the vote. mu must be held.
+func isMasterDownByAddr(host, port, epochArg, id string) []byte {
+	epoch, err := strconv.ParseInt(epochArg, 10, 64)
+	if err != nil {
+		return appendSimple(nil, '-', "ERR invalid epoch")
+	}
+
+	down, leader, leaderEpoch := 0, "*", int64(0)
+	addr := net.JoinHostPort(host, port)
+	for _, m := range masters {
+		if m.primary.addr != addr {
+			continue
+		}
+		if m.primary.sdown {
+			down = 1
+		}
+		if id != "*" {
+			leader, leaderEpoch = m.vote(id, epoch)
+		}
+	}
+
+	out := []byte("*3\r\n")
+	out = appendSimple(out, ':', strconv.Itoa(down))
+	out = appendBulk(out, leader)
+	return appendSimple(out, ':', strconv.FormatInt(leaderEpoch, 10))
+}
+
+// fields describes the primary for SENTINEL MASTER. mu must be held.
+func (m *master) fields() []string {
+	host, port, _ := net.SplitHostPort(m.primary.addr)
+	flags := "master"
+	if m.primary.sdown {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != "" {
+		flags += ",failover_in_progress"
+	}
+	return []string{
+		"name", m.name, "ip", host, "port", port, "flags", flags,
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(m.primary.lastOK).Milliseconds(), 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.peers)),
+		"quorum", strconv.Itoa(m.quorum),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"failover-state", m.failoverState,
+		"down-after-milliseconds", strconv.FormatInt(downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(failoverTimeout.Milliseconds(), 10),
+	}
+}
+
+// replicaFields describes a replica for SENTINEL REPLICAS. mu must be held.
+func (m *master) replicaFields(inst *instance) []string {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	flags := "slave"
+	if inst.sdown {
+		flags += ",s_down"
+	}
+	if inst == m.promoted {
+		flags += ",promoted"
+	}
+	masterHost, masterPort, _ := net.SplitHostPort(inst.masterAddr)
+	linkStatus := "err"
+	if inst.linkUp {
+		linkStatus = "ok"
+	}
+	return []string{
+		"name", inst.addr, "ip", host, "port", port, "flags", flags,
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(inst.lastOK).Milliseconds(), 10),
+		"role-reported", inst.role,
+		"master-host", masterHost, "master-port", masterPort,
+		"master-link-status", linkStatus,
+		"slave-repl-offset", strconv.FormatInt(inst.offset, 10),
+	}
+}
+
+// sortedReplicas returns the replicas by address. mu must be held.
+func (m *master) sortedReplicas() []*instance {
+	replicas := make([]*instance, 0, len(m.replicas))
+	for _, inst := range m.replicas {
+		replicas = append(replicas, inst)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].addr < replicas[j].addr })
+	return replicas
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Command is the metadata of one command. Dispatch uses it to validate
+// arity, find the keys a command touches, decide what gets persisted and
+// evaluate ACLs; COMMAND exposes it to clients.
+//
+// Arity counts the command name itself and is negative for "at least"
+// arities. Key positions are argument indexes, with a negative last key
+// counting from the end; a zero first key means the command names no keys.
+// Commands whose keys can't be found by position, flagged "movablekeys",
+// provide keysFunc instead.
+type Command struct {
+	arity      int
+	flags      []string
+	firstKey   int
+	lastKey    int
+	step       int
+	keysFunc   func(args []Value) []string
+	categories []string
+	group      string
+	summary    string
+}
+
+// Commands is the registry of every command the server knows.
+var Commands = map[string]Command{
+	"PING": {
+		arity: -1, flags: []string{"fast"},
+		categories: []string{"connection", "fast"}, group: "connection", summary: "Returns the server's liveliness response.",
+	},
+	"SET": {
+		arity: 3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"write", "string", "slow"}, group: "string", summary: "Sets the string value of a key.",
+	},
+	"GET": {
+		arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "string", "fast"}, group: "string", summary: "Returns the string value of a key.",
+	},
+	"CAS": {
+		arity: 4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"write", "string", "fast"}, group: "string", summary: "Sets the string value of a key if it holds an expected value.",
+	},
+	"DEL": {
+		arity: -2, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 1,
+		categories: []string{"keyspace", "write", "slow"}, group: "generic", summary: "Deletes one or more keys.",
+	},
+	"UNLINK": {
+		arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Deletes one or more keys with all their values.",
+	},
+	"EXISTS": {
+		arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+		categories: []string{"keyspace", "read", "fast"}, group: "generic", summary: "Determines whether one or more keys exist.",
+	},
+	"INCR": {
+		arity: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"write", "string", "fast"}, group: "string", summary: "Increments the integer value of a key by one.",
+	},
+	"HSET": {
+		arity: 4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"write", "hash", "fast"}, group: "hash", summary: "Sets the value of a field in a hash.",
+	},
+	"HGET": {
+		arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "hash", "fast"}, group: "hash", summary: "Returns the value of a field in a hash.",
+	},
+	"HGETALL": {
+		arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "hash", "slow"}, group: "hash", summary: "Returns all fields and values in a hash.",
+	},
+	"EXPIRE": {
+		arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Sets the expiration time of a key in seconds.",
+	},
+	"PEXPIRE": {
+		arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Sets the expiration time of a key in milliseconds.",
+	},
+	"EXPIREAT": {
+		arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Sets the expiration time of a key to a Unix timestamp.",
+	},
+	"PEXPIREAT": {
+		arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.",
+	},
+	"TTL": {
+		arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "read", "fast"}, group: "generic", summary: "Returns the expiration time in seconds of a key.",
+	},
+	"PTTL": {
+		arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "read", "fast"}, group: "generic", summary: "Returns the expiration time in milliseconds of a key.",
+	},
+	"PERSIST": {
+		arity: 2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Removes the expiration time of a key.",
+	},
+	"SCAN": {
+		arity: -2, flags: []string{"readonly"},
+		categories: []string{"keyspace", "read", "slow"}, group: "generic", summary: "Iterates over the key names in the database.",
+	},
+	"DUMP": {
+		arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "read", "slow"}, group: "generic", summary: "Returns a serialized representation of the values stored at a key.",
+	},
+	"RESTORE": {
+		arity: -4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "slow", "dangerous"}, group: "generic", summary: "Creates a key from the serialized representation of its values.",
+	},
+	"RESTORE-ASKING": {
+		arity: -4, flags: []string{"write", "denyoom", "asking"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "slow", "dangerous"}, group: "server", summary: "An internal command for migrating keys in a cluster.",
+	},
+	"MIGRATE": {
+		arity: -6, flags: []string{"write", "movablekeys"}, keysFunc: migrateKeys,
+		categories: []string{"keyspace", "write", "slow", "dangerous"}, group: "generic", summary: "Atomically transfers keys from one instance to another.",
+	},
+	"SWAPDB": {
+		arity: 3, flags: []string{"write", "fast"},
+		categories: []string{"keyspace", "write", "fast", "dangerous"}, group: "server", summary: "Swaps two databases.",
+	},
+	"MOVE": {
+		arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"keyspace", "write", "fast"}, group: "generic", summary: "Moves a key to another database.",
+	},
+	"FLUSHDB": {
+		arity: -1, flags: []string{"write"},
+		categories: []string{"keyspace", "write", "slow", "dangerous"}, group: "server", summary: "Removes all keys from the current database.",
+	},
+	"FLUSHALL": {
+		arity: -1, flags: []string{"write"},
+		categories: []string{"keyspace", "write", "slow", "dangerous"}, group: "server", summary: "Removes all keys from all databases.",
+	},
+	"DBSIZE": {
+		arity: 1, flags: []string{"readonly", "fast"},
+		categories: []string{"keyspace", "read", "fast"}, group: "server", summary: "Returns the number of keys in the database.",
+	},
+	"HELLO": {
+		arity: -1, flags: []string{"noscript", "fast", "no_auth"},
+		categories: []string{"connection", "fast"}, group: "connection", summary: "Handshakes with the server.",
+	},
+	"CLIENT": {
+		arity: -2, flags: []string{"admin", "noscript"},
+		categories: []string{"connection", "admin", "slow", "dangerous"}, group: "connection", summary: "A container for client connection commands.",
+	},
+	"SELECT": {
+		arity: 2, flags: []string{"fast"},
+		categories: []string{"connection", "fast"}, group: "connection", summary: "Changes the selected database.",
+	},
+	"AUTH": {
+		arity: -2, flags: []string{"noscript", "fast", "no_auth"},
+		categories: []string{"connection", "fast"}, group: "connection", summary: "Authenticates the connection.",
+	},
+	"ACL": {
+		arity: -2, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "A container for Access List Control commands.",
+	},
+	"RESET": {
+		arity: 1, flags: []string{"noscript", "fast", "no_auth"},
+		categories: []string{"connection", "fast"}, group: "connection", summary: "Resets the connection.",
+	},
+	"CONFIG": {
+		arity: -2, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "A container for server configuration commands.",
+	},
+	"BGREWRITEAOF": {
+		arity: 1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Asynchronously rewrites the append-only file to disk.",
+	},
+	"SAVE": {
+		arity: 1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Synchronously saves the database(s) to disk.",
+	},
+	"BGSAVE": {
+		arity: -1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Asynchronously saves the database(s) to disk, or to a backup file.",
+	},
+	"BACKUP": {
+		arity: 1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Returns a snapshot of the database(s) in the RDB format.",
+	},
+	"LASTSAVE": {
+		arity: 1, flags: []string{"fast"},
+		categories: []string{"admin", "fast", "dangerous"}, group: "server", summary: "Returns the Unix timestamp of the last successful save to disk.",
+	},
+	"DEBUG": {
+		arity: -2, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "A container for debugging commands.",
+	},
+	"SLOWLOG": {
+		arity: -2, flags: []string{"admin"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "A container for slow log commands.",
+	},
+	"LATENCY": {
+		arity: -2, flags: []string{"admin"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "A container for latency diagnostics commands.",
+	},
+	"INFO": {
+		arity: -1, flags: []string{},
+		categories: []string{"slow", "dangerous"}, group: "server", summary: "Returns information and statistics about the server.",
+	},
+	"MEMORY": {
+		arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1,
+		categories: []string{"read", "slow"}, group: "server", summary: "A container for memory diagnostics commands.",
+	},
+	"OBJECT": {
+		arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1,
+		categories: []string{"keyspace", "read", "slow"}, group: "generic", summary: "A container for object introspection commands.",
+	},
+	"HOTKEYS": {
+		arity: -1, flags: []string{"readonly"},
+		categories: []string{"keyspace", "read", "slow"}, group: "server", summary: "Returns the most frequently accessed keys.",
+	},
+	"BIGKEYS": {
+		arity: 1, flags: []string{"readonly"},
+		categories: []string{"keyspace", "read", "slow"}, group: "server", summary: "Reports the largest key of every type.",
+	},
+	"SUBSCRIBE": {
+		arity: -2, flags: []string{"pubsub", "noscript"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "Listens for messages published to channels.",
+	},
+	"UNSUBSCRIBE": {
+		arity: -1, flags: []string{"pubsub", "noscript"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "Stops listening to messages posted to channels.",
+	},
+	"PSUBSCRIBE": {
+		arity: -2, flags: []string{"pubsub", "noscript"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "Listens for messages published to channels that match one or more patterns.",
+	},
+	"PUNSUBSCRIBE": {
+		arity: -1, flags: []string{"pubsub", "noscript"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "Stops listening to messages published to channels that match one or more patterns.",
+	},
+	"PUBLISH": {
+		arity: 3, flags: []string{"pubsub", "fast"},
+		categories: []string{"pubsub", "fast"}, group: "pubsub", summary: "Posts a message to a channel.",
+	},
+	"SSUBSCRIBE": {
+		arity: -2, flags: []string{"pubsub", "noscript"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "Listens for messages published to shard channels.",
+	},
+	"SUNSUBSCRIBE": {
+		arity: -1, flags: []string{"pubsub", "noscript"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "Stops listening to messages posted to shard channels.",
+	},
+	"SPUBLISH": {
+		arity: 3, flags: []string{"pubsub", "fast"},
+		categories: []string{"pubsub", "fast"}, group: "pubsub", summary: "Posts a message to a shard channel.",
+	},
+	"PUBSUB": {
+		arity: -2, flags: []string{"pubsub"},
+		categories: []string{"pubsub", "slow"}, group: "pubsub", summary: "A container for Pub/Sub commands.",
+	},
+	"XREAD": {
+		arity: -4, flags: []string{"readonly", "blocking", "movablekeys"}, keysFunc: xreadKeys,
+		categories: []string{"read", "stream", "slow", "blocking"}, group: "stream", summary: "Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise.",
+	},
+	"XRANGE": {
+		arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "stream", "slow"}, group: "stream", summary: "Returns the messages from a stream within a range of IDs.",
+	},
+	"XLEN": {
+		arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "stream", "fast"}, group: "stream", summary: "Returns the number of messages in a stream.",
+	},
+	"MULTI": {
+		arity: 1, flags: []string{"noscript", "fast"},
+		categories: []string{"fast", "transaction"}, group: "transactions", summary: "Starts a transaction.",
+	},
+	"EXEC": {
+		arity: 1, flags: []string{"noscript"},
+		categories: []string{"slow", "transaction"}, group: "transactions", summary: "Executes all commands in a transaction.",
+	},
+	"DISCARD": {
+		arity: 1, flags: []string{"noscript", "fast"},
+		categories: []string{"fast", "transaction"}, group: "transactions", summary: "Discards a transaction.",
+	},
+	"WATCH": {
+		arity: -2, flags: []string{"noscript", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+		categories: []string{"fast", "transaction"}, group: "transactions", summary: "Monitors changes to keys to determine the execution of a transaction.",
+	},
+	"UNWATCH": {
+		arity: 1, flags: []string{"noscript", "fast"},
+		categories: []string{"fast", "transaction"}, group: "transactions", summary: "Forgets about watched keys of a transaction.",
+	},
+	"EVAL": {
+		arity: -3, flags: []string{"noscript", "may_replicate", "movablekeys"}, keysFunc: evalKeys,
+		categories: []string{"slow", "scripting"}, group: "scripting", summary: "Executes a server-side Lua script.",
+	},
+	"EVALSHA": {
+		arity: -3, flags: []string{"noscript", "may_replicate", "movablekeys"}, keysFunc: evalKeys,
+		categories: []string{"slow", "scripting"}, group: "scripting", summary: "Executes a server-side Lua script by SHA1 digest.",
+	},
+	"SCRIPT": {
+		arity: -2, flags: []string{"noscript"},
+		categories: []string{"slow", "scripting"}, group: "scripting", summary: "A container for Lua scripts management commands.",
+	},
+	"FUNCTION": {
+		arity: -2, flags: []string{"noscript"},
+		categories: []string{"slow", "scripting"}, group: "scripting", summary: "A container for function commands.",
+	},
+	"FCALL": {
+		arity: -3, flags: []string{"noscript", "may_replicate", "movablekeys"}, keysFunc: evalKeys,
+		categories: []string{"slow", "scripting"}, group: "scripting", summary: "Invokes a function.",
+	},
+	"REPLICAOF": {
+		arity: 3, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Configures a server as replica of another, or promotes it to a master.",
+	},
+	"SLAVEOF": {
+		arity: 3, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Sets a Redis server as a replica of another, or promotes it to being a master.",
+	},
+	"SYNC": {
+		arity: 1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "An internal command used in replication.",
+	},
+	"PSYNC": {
+		arity: 3, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "An internal command used in replication.",
+	},
+	"FAILOVER": {
+		arity: -1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "Starts a coordinated failover from a server to one of its replicas.",
+	},
+	"REPLCONF": {
+		arity: -1, flags: []string{"admin", "noscript"},
+		categories: []string{"admin", "slow", "dangerous"}, group: "server", summary: "An internal command for configuring the replication stream.",
+	},
+	"WAIT": {
+		arity: 3, flags: []string{"noscript", "blocking"},
+		categories: []string{"slow", "connection", "blocking"}, group: "generic", summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.",
+	},
+	"CRDT": {
+		arity: -3, flags: []string{"write", "admin", "noscript"}, firstKey: 2, lastKey: 2, step: 1,
+		categories: []string{"admin", "write", "slow", "dangerous"}, group: "server", summary: "An internal command merging a key's state from an active-active peer.",
+	},
+	"CLUSTER": {
+		arity: -2, flags: []string{},
+		categories: []string{"slow"}, group: "cluster", summary: "A container for Redis Cluster commands.",
+	},
+	"ASKING": {
+		arity: 1, flags: []string{"fast"},
+		categories: []string{"connection", "fast"}, group: "cluster", summary: "Signals that a cluster client is following an -ASK redirect.",
+	},
+	"COMMAND": {
+		arity: -1, flags: []string{},
+		categories: []string{"connection", "slow"}, group: "server", summary: "Returns detailed information about all commands.",
+	},
+}
+
+// hasFlag reports whether the command carries the given flag.
+func (cmd Command) hasFlag(flag string) bool {
+	for _, f := range cmd.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// isWrite reports whether the command modifies the dataset, and therefore
+// must be persisted and propagated.
+func (cmd Command) isWrite() bool {
+	return cmd.hasFlag("write")
+}
+
+// checkArity reports whether argc, which includes the command name, fits the command's arity.
+func (cmd Command) checkArity(argc int) bool {
+	if cmd.arity < 0 {
+		return argc >= -cmd.arity
+	}
+	return argc == cmd.arity
+}
+
+// keys returns the keys named by the command's arguments (excluding the command name).
+func (cmd Command) keys(args []Value) []string {
+	if cmd.keysFunc != nil {
+		return cmd.keysFunc(args)
+	}
+
+	keys := []string{}
+	if cmd.firstKey == 0 {
+		return keys
+	}
+
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	for i := cmd.firstKey; i <= last && i <= len(args); i += cmd.step {
+		keys = append(keys, args[i-1].bulk)
+	}
+
+	return keys
+}
+
+// handleCommand handles the "COMMAND" command and its subcommands.
+func handleCommand(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return commandInfoReply(sortedCommandNames())
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "COUNT":
+		return Value{typ: "integer", num: len(Commands)}
+	case "INFO":
+		names := []string{}
+		for _, arg := range args[1:] {
+			names = append(names, strings.ToUpper(arg.bulk))
+		}
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		return commandInfoReply(names)
+	case "DOCS":
+		names := []string{}
+		for _, arg := range args[1:] {
+			names = append(names, strings.ToUpper(arg.bulk))
+		}
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		return commandDocsReply(names)
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+}
+
+// sortedCommandNames returns every command name in alphabetical order.
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandInfoReply describes the named commands in the COMMAND INFO format,
+// with a null entry for unknown names.
+func commandInfoReply(names []string) Value {
+	values := []Value{}
+	for _, name := range names {
+		cmd, ok := Commands[name]
+		if !ok {
+			values = append(values, Value{typ: "null"})
+			continue
+		}
+
+		flags := []Value{}
+		for _, flag := range cmd.flags {
+			flags = append(flags, Value{typ: "string", str: flag})
+		}
+		categories := []Value{}
+		for _, category := range cmd.categories {
+			categories = append(categories, Value{typ: "string", str: "@" + category})
+		}
+
+		values = append(values, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: strings.ToLower(name)},
+			{typ: "integer", num: cmd.arity},
+			{typ: "array", array: flags},
+			{typ: "integer", num: cmd.firstKey},
+			{typ: "integer", num: cmd.lastKey},
+			{typ: "integer", num: cmd.step},
+			{typ: "array", array: categories},
+			{typ: "array", array: []Value{}}, // tips
+			{typ: "array", array: []Value{}}, // key specifications
+			{typ: "array", array: []Value{}}, // subcommands
+		}})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// commandDocsReply describes the named commands in the COMMAND DOCS format,
+// skipping unknown names.
+func commandDocsReply(names []string) Value {
+	values := []Value{}
+	for _, name := range names {
+		cmd, ok := Commands[name]
+		if !ok {
+			continue
+		}
+
+		values = append(values,
+			Value{typ: "bulk", bulk: strings.ToLower(name)},
+			Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: "summary"}, {typ: "bulk", bulk: cmd.summary},
+				{typ: "bulk", bulk: "group"}, {typ: "bulk", bulk: cmd.group},
+			}},
+		)
+	}
+
+	return Value{typ: "array", array: values}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// PersistenceCompression is how snapshots and rewritten AOF base files are
+// compressed: "no", "zstd" or "lz4". Either way they are written as standard
+// frames, whose magic numbers tell readers how to decompress them, so files
+// written with any setting load with any other.
+var PersistenceCompression = "no"
+
+// Magic numbers starting zstd and LZ4 frames.
+var (
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	lz4Magic  = []byte{0x04, 0x22, 0x4D, 0x18}
+)
+
+// setPersistenceCompression changes how persistence files are compressed.
+func setPersistenceCompression(value string) error {
+	switch value {
+	case "no", "zstd", "lz4":
+		PersistenceCompression = value
+		return nil
+	default:
+		return fmt.Errorf("argument must be one of: no, zstd, lz4")
+	}
+}
+
+// nopWriteCloser writes uncompressed data.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer compressing what is written to it into w
+// as PersistenceCompression says. Closing it ends the frame but doesn't
+// close w.
+func compressWriter(w io.Writer) (io.WriteCloser, error) {
+	configMu.RLock()
+	compression := PersistenceCompression
+	configMu.RUnlock()
+
+	switch compression {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "lz4":
+		return lz4.NewWriter(w), nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// decompressReader returns a reader of r's content, decompressed if r starts
+// with a zstd or LZ4 frame. Closing it releases the decompressor, not r.
+func decompressReader(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		// Too short to be compressed.
+		return io.NopCloser(r), nil
+	}
+
+	switch {
+	case bytes.Equal(magic, zstdMagic):
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case bytes.Equal(magic, lz4Magic):
+		return io.NopCloser(&stickyEOFReader{r: lz4.NewReader(r)}), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// isCompressedFile reports whether the file at path starts with a zstd or
+// LZ4 frame.
+func isCompressedFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(magic, zstdMagic) || bytes.Equal(magic, lz4Magic), nil
+}
+
+// stickyEOFReader keeps returning io.EOF once r returned it, where the LZ4
+// reader fails when read again.
+type stickyEOFReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (s *stickyEOFReader) Read(p []byte) (int, error) {
+	if s.eof {
+		return 0, io.EOF
+	}
+	n, err := s.r.Read(p)
+	s.eof = err == io.EOF
+	return n, err
+}
+
+// encodeSnapshotFile writes the snapshot to w, compressed as
+// PersistenceCompression says.
+func encodeSnapshotFile(w io.Writer, snapshot datasetSnapshot) error {
+	cw, err := compressWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := encodeSnapshot(cw, snapshot); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConfigFile is the path of the configuration file the server was started
+// with, or empty when it runs from defaults and flags only.
+var ConfigFile = ""
+
+// Dir is the working directory; persistence files are created relative to it.
+var Dir = "."
+
+// LogFile is where server messages go. Empty means standard output.
+var LogFile = ""
+
+// configDefaults holds every parameter's value before the config file and
+// flags were applied. CONFIG REWRITE leaves parameters at their default out
+// of the file.
+var configDefaults = map[string]string{}
+
+// rewriteMu serializes CONFIG REWRITE calls.
+var rewriteMu = sync.Mutex{}
+
+// loadConfigFile applies every directive in a stormy.conf style file. Each
+// line holds a parameter name followed by its value, which may be split over
+// several, optionally quoted, arguments. Blank lines and lines starting with
+// '#' are ignored.
+func loadConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		// Comments are skipped before splitting, as they needn't quote properly.
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), "#") {
+			continue
+		}
+		args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if err := applyDirective(args); err != nil {
+			return fmt.Errorf("%s:%d: '%s': %v", path, lineNum, args[0], err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// applyDirective applies one config file directive.
+func applyDirective(args []string) error {
+	name := strings.ToLower(args[0])
+	if name == "rename-command" {
+		if len(args) != 3 {
+			return fmt.Errorf("expected \"rename-command COMMAND NEWNAME\"")
+		}
+		return renameCommand(args[1], args[2])
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("missing value")
+	}
+	return configLoad(name, strings.Join(args[1:], " "))
+}
+
+// splitConfigLine splits a config line into arguments. Double-quoted
+// arguments support \n, \r, \t, \", \\ and \xHH escapes; single-quoted ones
+// only \'.
+func splitConfigLine(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					case 'x':
+						if i+2 < len(line) {
+							if b, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+								arg.WriteByte(byte(b))
+								i += 2
+								break
+							}
+						}
+						arg.WriteByte('x')
+					default:
+						arg.WriteByte(line[i])
+					}
+					i++
+					continue
+				}
+				arg.WriteByte(line[i])
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				if line[i] == '\'' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg.WriteByte(line[i])
+				i++
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg.WriteByte(line[i])
+				i++
+			}
+			args = append(args, arg.String())
+			continue
+		}
+
+		// A closing quote must end the argument.
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, fmt.Errorf("closing quote must be followed by a space")
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// configFlag records a command-line override of a config parameter. Flags
+// are applied after the config file so they take precedence over it.
+type configFlag struct {
+	name      string
+	overrides *[][2]string
+}
+
+func (f configFlag) String() string {
+	return ""
+}
+
+func (f configFlag) Set(value string) error {
+	*f.overrides = append(*f.overrides, [2]string{f.name, value})
+	return nil
+}
+
+// loadConfig builds the startup configuration from, in increasing order of
+// precedence, the defaults, the config file named by the first positional
+// argument and command-line flags. It then moves to Dir and opens LogFile.
+func loadConfig() error {
+	overrides := [][2]string{}
+	for name, param := range configParams {
+		configDefaults[name] = param.get()
+		flag.Var(configFlag{name: name, overrides: &overrides}, name, param.help)
+	}
+	flag.Var(renameFlag{}, "rename-command", "rename or disable a command: \"COMMAND NEWNAME\" or \"COMMAND ''\" (repeatable)")
+	flag.BoolVar(&RestoreFromRemote, "restore-from-remote", false, "download the newest remote backup to dbfilename and start from it")
+	flag.BoolVar(&Repair, "repair", false, "load a damaged append-only file or snapshot up to the damage, dropping the damaged data, instead of refusing to start")
+	flag.Func("aof-replay-until", "replay the append-only file only up to this Unix time or RFC 3339 date, dropping the commands after it", setAOFReplayUntil)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [/path/to/stormy.conf] [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Allow flags after the config file path too.
+	if flag.NArg() > 0 {
+		// Keep an absolute path: the server changes to Dir below.
+		path, err := filepath.Abs(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		ConfigFile = path
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() > 0 {
+			return fmt.Errorf("unexpected argument %q", flag.Arg(0))
+		}
+		if err := loadConfigFile(ConfigFile); err != nil {
+			return err
+		}
+	}
+
+	for _, override := range overrides {
+		if err := configLoad(override[0], override[1]); err != nil {
+			return fmt.Errorf("invalid value for -%s: %v", override[0], err)
+		}
+	}
+
+	if err := os.Chdir(Dir); err != nil {
+		return fmt.Errorf("can't chdir to '%s': %v", Dir, err)
+	}
+
+	if LogFile != "" {
+		f, err := os.OpenFile(LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("can't open the log file: %v", err)
+		}
+		os.Stdout = f
+	}
+
+	return nil
+}
+
+// rewriteConfigFile updates the config file with the current configuration.
+// Comments, rename-command lines and unknown directives are kept as they are;
+// the first line of each parameter is replaced with its current value, later
+// duplicates are dropped, and changed parameters missing from the file are
+// appended. The new file replaces the old one atomically.
+func rewriteConfigFile() error {
+	rewriteMu.Lock()
+	defer rewriteMu.Unlock()
+
+	content, err := os.ReadFile(ConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := []string{}
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	output := []string{}
+	written := map[string]bool{}
+	for _, line := range lines {
+		args, err := splitConfigLine(line)
+		if err != nil || len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			output = append(output, line)
+			continue
+		}
+
+		name := strings.ToLower(args[0])
+		if _, ok := configParams[name]; !ok {
+			output = append(output, line)
+			continue
+		}
+		if !written[name] {
+			written[name] = true
+			output = append(output, configLines(name)...)
+		}
+	}
+
+	appended := false
+	for _, name := range sortedConfigNames() {
+		if written[name] {
+			continue
+		}
+		if value, _ := configGet(name); value == configDefaults[name] {
+			continue
+		}
+		if !appended {
+			output = append(output, "# Generated by CONFIG REWRITE")
+			appended = true
+		}
+		output = append(output, configLines(name)...)
+	}
+
+	return writeFileAtomic(ConfigFile, []byte(strings.Join(output, "\n")+"\n"))
+}
+
+// sortedConfigNames returns every parameter name in alphabetical order.
+func sortedConfigNames() []string {
+	names := make([]string, 0, len(configParams))
+	for name := range configParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configLines formats a parameter's current value as config file lines.
+func configLines(name string) []string {
+	value, _ := configGet(name)
+
+	switch name {
+	case "bind":
+		// A list of addresses, one argument each.
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return []string{name + ` ""`}
+		}
+		return []string{name + " " + strings.Join(fields, " ")}
+	case "client-output-buffer-limit":
+		// One line per client class.
+		fields := strings.Fields(value)
+		lines := []string{}
+		for i := 0; i+4 <= len(fields); i += 4 {
+			lines = append(lines, name+" "+strings.Join(fields[i:i+4], " "))
+		}
+		return lines
+	default:
+		return []string{name + " " + quoteConfigValue(value)}
+	}
+}
+
+// quoteConfigValue quotes a value so that splitConfigLine reads it back as a
+// single argument.
+func quoteConfigValue(value string) string {
+	plain := value != "" && !strings.HasPrefix(value, "#")
+	for i := 0; i < len(value) && plain; i++ {
+		c := value[i]
+		plain = c > ' ' && c < 0x7f && c != '"' && c != '\'' && c != '\\'
+	}
+	if plain {
+		return value
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// writeFileAtomic replaces path with data by writing and syncing a temporary
+// file in the same directory and renaming it over the original, so readers
+// see either the old or the new content, never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// configMu guards the settings exposed through CONFIG. Code reading a
+// setting that CONFIG SET can change at runtime must hold it for reading.
+var configMu = sync.RWMutex{}
+
+// configParam is one setting in the config store. Every parameter can be set
+// at startup from the config file or command line; only mutable ones can be
+// changed later with CONFIG SET.
+type configParam struct {
+	get     func() string
+	set     func(value string) error
+	mutable bool
+	help    string
+}
+
+// configParams is the config store, keyed by lowercase parameter name.
+var configParams = map[string]*configParam{
+	"port": {
+		get: func() string { return Port }, set: setString(&Port),
+		help: "port for plain TCP connections",
+	},
+	"bind": {
+		get: func() string { return Bind }, set: setString(&Bind),
+		help: "space-separated addresses to listen on, all interfaces when empty",
+	},
+	"databases": {
+		get: func() string { return strconv.Itoa(DatabaseCount) }, set: setPositiveInt(&DatabaseCount),
+		help: "number of logical databases",
+	},
+	"storage-engine": {
+		get: func() string { return StorageEngineName }, set: setStorageEngine,
+		help: "engine databases keep their keys in: memory or tiered",
+	},
+	"tiered-idle-seconds": {
+		get: func() string { return strconv.Itoa(TieredIdleSeconds) }, set: setPositiveInt(&TieredIdleSeconds), mutable: true,
+		help: "seconds a value of the tiered engine goes unused before it is spilled to disk",
+	},
+	"tiered-dirname": {
+		get: func() string { return TieredDirname }, set: setString(&TieredDirname),
+		help: "directory inside dir the tiered engine spills values to",
+	},
+	"dir": {
+		get: func() string { return Dir }, set: setString(&Dir),
+		help: "working directory for persistence files",
+	},
+	"logfile": {
+		get: func() string { return LogFile }, set: setString(&LogFile),
+		help: "file to log to, standard output when empty",
+	},
+	"save": {
+		get: func() string { return SavePoints }, set: setSavePoints, mutable: true,
+		help: "\"seconds changes\" pairs: snapshot once seconds passed and changes writes happened, none when empty",
+	},
+	"dbfilename": {
+		get: func() string { return DBFilename }, set: setString(&DBFilename),
+		help: "name of the snapshot file inside dir",
+	},
+	"appendonly": {
+		get: func() string { return AppendOnly }, set: setYesNo(&AppendOnly),
+		help: "persist writes to the append-only file: yes or no",
+	},
+	"appenddirname": {
+		get: func() string { return AppendDirname }, set: setString(&AppendDirname),
+		help: "directory inside dir holding the append-only file's files",
+	},
+	"appendfilename": {
+		get: func() string { return AppendFilename }, set: setString(&AppendFilename),
+		help: "prefix of the names of the append-only file's files and manifest",
+	},
+	"appendfsync": {
+		get: func() string { return AppendFsync }, set: setAppendFsync, mutable: true,
+		help: "when the append-only file is synced to disk: always, everysec or no",
+	},
+	"min-free-disk": {
+		get: func() string { return strconv.Itoa(MinFreeDisk) }, set: setMemory(&MinFreeDisk), mutable: true,
+		help: "free space in dir below which only reads and deletes are accepted, 0 to disable",
+	},
+	"stop-writes-on-persistence-error": {
+		get: func() string { return StopWritesOnPersistenceError }, set: setYesNo(&StopWritesOnPersistenceError), mutable: true,
+		help: "refuse write commands with MISCONF while the AOF can't be written or synced: yes or no",
+	},
+	"aof-timestamp-enabled": {
+		get: func() string { return AOFTimestampEnabled }, set: setYesNo(&AOFTimestampEnabled), mutable: true,
+		help: "annotate the append-only file with the time of the commands, for -aof-replay-until: yes or no",
+	},
+	"aof-load-truncated": {
+		get: func() string { return AOFLoadTruncated }, set: setYesNo(&AOFLoadTruncated),
+		help: "load an append-only file whose last command was cut short, dropping it: yes or no",
+	},
+	"auto-aof-rewrite-percentage": {
+		get: func() string { return strconv.Itoa(AutoAOFRewritePercentage) }, set: setNonNegativeInt(&AutoAOFRewritePercentage), mutable: true,
+		help: "rewrite the append-only file once it grew by this percentage since the last rewrite, 0 to disable",
+	},
+	"auto-aof-rewrite-min-size": {
+		get: func() string { return strconv.Itoa(AutoAOFRewriteMinSize) }, set: setMemory(&AutoAOFRewriteMinSize), mutable: true,
+		help: "smallest append-only file size, e.g. 64mb, to rewrite automatically",
+	},
+	"persistence-compression": {
+		get: func() string { return PersistenceCompression }, set: setPersistenceCompression, mutable: true,
+		help: "compression of snapshots and rewritten append-only base files: no, zstd or lz4",
+	},
+	"remote-backup-url": {
+		get: func() string { return RemoteBackupURL }, set: setRemoteBackupURL, mutable: true,
+		help: "s3://bucket/prefix or gs://bucket/prefix URL to upload snapshots to, remote backups are disabled when empty",
+	},
+	"remote-backup-endpoint": {
+		get: func() string { return RemoteBackupEndpoint }, set: setString(&RemoteBackupEndpoint), mutable: true,
+		help: "URL of an S3-compatible object store to use instead of the one the remote backup URL's scheme names",
+	},
+	"remote-backup-region": {
+		get: func() string { return RemoteBackupRegion }, set: setString(&RemoteBackupRegion), mutable: true,
+		help: "region of the remote backup bucket",
+	},
+	"remote-backup-access-key": {
+		get: func() string { return RemoteBackupAccessKey }, set: setString(&RemoteBackupAccessKey), mutable: true,
+		help: "access key of the remote backup bucket, AWS_ACCESS_KEY_ID when empty",
+	},
+	"remote-backup-secret-key": {
+		get: func() string { return RemoteBackupSecretKey }, set: setString(&RemoteBackupSecretKey), mutable: true,
+		help: "secret key of the remote backup bucket, AWS_SECRET_ACCESS_KEY when empty",
+	},
+	"remote-backup-retention": {
+		get: func() string { return strconv.Itoa(RemoteBackupRetention) }, set: setNonNegativeInt(&RemoteBackupRetention), mutable: true,
+		help: "newest remote backups to keep, 0 to keep them all",
+	},
+	"remote-backup-interval": {
+		get: func() string { return strconv.Itoa(RemoteBackupInterval) }, set: setNonNegativeInt(&RemoteBackupInterval), mutable: true,
+		help: "seconds between snapshots taken only to be uploaded, 0 to upload only the snapshots the server saves",
+	},
+	"protected-mode": {
+		get: func() string { return ProtectedMode }, set: setYesNo(&ProtectedMode), mutable: true,
+		help: "only accept loopback clients when no password or bind address is set: yes or no",
+	},
+	"proto-max-bulk-len": {
+		get: func() string { return strconv.Itoa(ProtoMaxBulkLen) }, set: setProtoLimit(&ProtoMaxBulkLen, DefaultRESPLimits.MaxBulkLen, true), mutable: true,
+		help: "longest bulk string, e.g. 512mb, a client request may hold",
+	},
+	"proto-max-multibulk-len": {
+		get: func() string { return strconv.Itoa(ProtoMaxMultibulkLen) }, set: setProtoLimit(&ProtoMaxMultibulkLen, DefaultRESPLimits.MaxElements, false), mutable: true,
+		help: "most elements of an array a client request may hold",
+	},
+	"proto-max-depth": {
+		get: func() string { return strconv.Itoa(ProtoMaxDepth) }, set: setProtoLimit(&ProtoMaxDepth, DefaultRESPLimits.MaxDepth, false), mutable: true,
+		help: "deepest nesting of arrays a client request may hold",
+	},
+	"timeout": {
+		get: func() string { return strconv.Itoa(Timeout) }, set: setNonNegativeInt(&Timeout), mutable: true,
+		help: "close client connections idle for this many seconds, 0 to disable",
+	},
+	"replicaof": {
+		get: func() string { return ReplicaOf }, set: setReplicaOf,
+		help: "\"host port\" of the primary to replicate on startup, empty to be a primary",
+	},
+	"masteruser": {
+		get: func() string { return MasterUser }, set: setString(&MasterUser), mutable: true,
+		help: "user to authenticate to the primary as, the default user when empty",
+	},
+	"masterauth": {
+		get: func() string { return MasterAuth }, set: setString(&MasterAuth), mutable: true,
+		help: "password to authenticate to the primary with, none when empty",
+	},
+	"replica-read-only": {
+		get: func() string { return ReplicaReadOnly }, set: setYesNo(&ReplicaReadOnly), mutable: true,
+		help: "refuse write commands from clients other than the primary on a replica: yes or no",
+	},
+	"repl-ping-replica-period": {
+		get: func() string { return strconv.Itoa(ReplPingReplicaPeriod) }, set: setPositiveInt(&ReplPingReplicaPeriod), mutable: true,
+		help: "seconds between the pings a primary sends its replicas",
+	},
+	"repl-timeout": {
+		get: func() string { return strconv.Itoa(ReplTimeout) }, set: setPositiveInt(&ReplTimeout), mutable: true,
+		help: "seconds without news from the other side after which a primary or a replica drops the link",
+	},
+	"repl-diskless-sync": {
+		get: func() string { return ReplDisklessSync }, set: setYesNo(&ReplDisklessSync), mutable: true,
+		help: "stream the dataset to replicas as it is encoded instead of through a file: yes or no",
+	},
+	"active-active": {
+		get: func() string { return ActiveActive }, set: setYesNo(&ActiveActive),
+		help: "experimental: accept writes alongside the peers and converge with them: yes or no",
+	},
+	"active-active-node-id": {
+		get: func() string { return ActiveActiveNodeID }, set: setString(&ActiveActiveNodeID),
+		help: "unique and stable name of the server among the active-active primaries, host:port when empty",
+	},
+	"active-active-peers": {
+		get: func() string { return ActiveActivePeers }, set: setActiveActivePeers, mutable: true,
+		help: "space-separated host:port of every other active-active primary",
+	},
+	"cluster-enabled": {
+		get: func() string { return ClusterEnabled }, set: setYesNo(&ClusterEnabled),
+		help: "run as a node of a cluster, serving the keys of its hash slots: yes or no",
+	},
+	"cluster-config-file": {
+		get: func() string { return ClusterConfigFile }, set: setString(&ClusterConfigFile),
+		help: "file the node keeps its ID, the other nodes and their slots in, relative to dir",
+	},
+	"cluster-proxy-port": {
+		get: func() string { return ClusterProxyPort }, set: setString(&ClusterProxyPort),
+		help: "port routing the commands of clients that don't know about the cluster, disabled when empty",
+	},
+	"cluster-node-timeout": {
+		get: func() string { return strconv.Itoa(ClusterNodeTimeout) }, set: setPositiveInt(&ClusterNodeTimeout), mutable: true,
+		help: "milliseconds a cluster node may not answer before it is suspected to have failed",
+	},
+	"cluster-require-full-coverage": {
+		get: func() string { return ClusterRequireFullCoverage }, set: setYesNo(&ClusterRequireFullCoverage), mutable: true,
+		help: "refuse keys while any hash slot isn't served: yes or no",
+	},
+	"requirepass": {
+		get: func() string { return RequirePass }, set: setRequirePass, mutable: true,
+		help: "password of the default user, clients need no AUTH when empty",
+	},
+	"client-output-buffer-limit": {
+		get: getOutputBufferLimits, set: setOutputBufferLimits, mutable: true,
+		help: "\"class hard soft seconds\" output limits for normal, replica or pubsub clients",
+	},
+	"slowlog-log-slower-than": {
+		get: func() string { return strconv.Itoa(SlowlogLogSlowerThan) }, set: setSlowlogLogSlowerThan, mutable: true,
+		help: "log commands slower than this many microseconds, 0 logs all and -1 disables the slow log",
+	},
+	"slowlog-max-len": {
+		get: func() string { return strconv.Itoa(SlowlogMaxLen) }, set: setNonNegativeInt(&SlowlogMaxLen), mutable: true,
+		help: "number of entries the slow log keeps",
+	},
+	"latency-monitor-threshold": {
+		get: func() string { return strconv.Itoa(LatencyMonitorThreshold) }, set: setNonNegativeInt(&LatencyMonitorThreshold), mutable: true,
+		help: "record events taking at least this many milliseconds in the latency monitor, 0 to disable",
+	},
+	"maxmemory": {
+		get: func() string { return strconv.Itoa(MaxMemory) }, set: setMemory(&MaxMemory), mutable: true,
+		help: "estimated dataset size above which keys are evicted before writes, 0 for no limit",
+	},
+	"maxmemory-policy": {
+		get: func() string { return MaxMemoryPolicy }, set: setMaxMemoryPolicy, mutable: true,
+		help: "keys evicted above maxmemory: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random or volatile-ttl",
+	},
+	"maxmemory-samples": {
+		get: func() string { return strconv.Itoa(MaxMemorySamples) }, set: setPositiveInt(&MaxMemorySamples), mutable: true,
+		help: "keys of each database sampled to pick the one to evict",
+	},
+	"hash-max-listpack-entries": {
+		get: func() string { return strconv.Itoa(HashMaxListpackEntries) }, set: setNonNegativeInt(&HashMaxListpackEntries), mutable: true,
+		help: "most fields a hash is stored compactly with, as a listpack",
+	},
+	"hash-max-listpack-value": {
+		get: func() string { return strconv.Itoa(HashMaxListpackValue) }, set: setNonNegativeInt(&HashMaxListpackValue), mutable: true,
+		help: "longest field or value, in bytes, a hash is stored as a listpack with",
+	},
+	"activedefrag": {
+		get: func() string { return ActiveDefrag }, set: setYesNo(&ActiveDefrag), mutable: true,
+		help: "rebuild, in the background, the maps that deletions left mostly empty",
+	},
+	"active-defrag-threshold": {
+		get: func() string { return strconv.Itoa(ActiveDefragThreshold) }, set: setPercent(&ActiveDefragThreshold), mutable: true,
+		help: "percentage of a map's slots that must be empty for it to be rebuilt",
+	},
+	"active-defrag-ignore-bytes": {
+		get: func() string { return strconv.Itoa(ActiveDefragIgnoreBytes) }, set: setMemory(&ActiveDefragIgnoreBytes), mutable: true,
+		help: "estimated size of a map's empty slots below which it isn't rebuilt",
+	},
+	"active-defrag-cycle-max": {
+		get: func() string { return strconv.Itoa(ActiveDefragCycleMax) }, set: setPercent(&ActiveDefragCycleMax), mutable: true,
+		help: "most percentage of time spent rebuilding maps, during which their database is locked",
+	},
+	"lfu-log-factor": {
+		get: func() string { return strconv.Itoa(LFULogFactor) }, set: setNonNegativeInt(&LFULogFactor), mutable: true,
+		help: "how many accesses it takes to saturate a key's access counter, higher is slower",
+	},
+	"lfu-decay-time": {
+		get: func() string { return strconv.Itoa(LFUDecayTime) }, set: setNonNegativeInt(&LFUDecayTime), mutable: true,
+		help: "minutes of inactivity after which a key's access counter is decremented, 0 to never decay",
+	},
+	"webhook-url": {
+		get: func() string { return WebhookURL }, set: setWebhookURL, mutable: true,
+		help: "http or https URL to POST key change events to, webhooks are disabled when empty",
+	},
+	"webhook-events": {
+		get: func() string { return WebhookEvents }, set: setWebhookEvents, mutable: true,
+		help: "event types to report to the webhook: any of set, del and expire",
+	},
+	"webhook-key-pattern": {
+		get: func() string { return WebhookKeyPattern }, set: setString(&WebhookKeyPattern), mutable: true,
+		help: "glob pattern selecting the keys reported to the webhook",
+	},
+	"webhook-batch-size": {
+		get: func() string { return strconv.Itoa(WebhookBatchSize) }, set: setPositiveInt(&WebhookBatchSize), mutable: true,
+		help: "most events sent to the webhook in one request",
+	},
+	"webhook-flush-interval": {
+		get: func() string { return strconv.Itoa(WebhookFlushInterval) }, set: setPositiveInt(&WebhookFlushInterval), mutable: true,
+		help: "milliseconds an event may wait for its batch to fill before it is sent",
+	},
+	"webhook-max-retries": {
+		get: func() string { return strconv.Itoa(WebhookMaxRetries) }, set: setNonNegativeInt(&WebhookMaxRetries), mutable: true,
+		help: "times a failed webhook request is retried before its events are dropped",
+	},
+	"write-behind-url": {
+		get: func() string { return WriteBehindURL }, set: setWriteBehindURL, mutable: true,
+		help: "postgres:// or mysql:// URL of the database writes are mirrored to, write-behind is disabled when empty",
+	},
+	"write-behind-table": {
+		get: func() string { return WriteBehindTable }, set: setWriteBehindTable, mutable: true,
+		help: "table of the write-behind database keys are mirrored to, created if missing",
+	},
+	"write-behind-key-pattern": {
+		get: func() string { return WriteBehindKeyPattern }, set: setString(&WriteBehindKeyPattern), mutable: true,
+		help: "glob pattern selecting the keys mirrored to the write-behind database",
+	},
+	"write-behind-batch-size": {
+		get: func() string { return strconv.Itoa(WriteBehindBatchSize) }, set: setPositiveInt(&WriteBehindBatchSize), mutable: true,
+		help: "most changes written to the write-behind database in one transaction",
+	},
+	"write-behind-flush-interval": {
+		get: func() string { return strconv.Itoa(WriteBehindFlushInterval) }, set: setPositiveInt(&WriteBehindFlushInterval), mutable: true,
+		help: "milliseconds a change may wait for its batch to fill before it is written",
+	},
+	"write-behind-max-retries": {
+		get: func() string { return strconv.Itoa(WriteBehindMaxRetries) }, set: setNonNegativeInt(&WriteBehindMaxRetries), mutable: true,
+		help: "times a failed write-behind batch is retried before it waits for the next flush",
+	},
+	"read-through-origin": {
+		get: func() string { return ReadThroughOrigin }, set: setReadThroughOrigin, mutable: true,
+		help: "http, https or redis URL GET misses are loaded from, read-through is disabled when empty",
+	},
+	"read-through-ttl": {
+		get: func() string { return strconv.Itoa(ReadThroughTTL) }, set: setPositiveInt(&ReadThroughTTL), mutable: true,
+		help: "seconds keys loaded from the read-through origin are kept",
+	},
+	"read-through-key-pattern": {
+		get: func() string { return ReadThroughKeyPattern }, set: setString(&ReadThroughKeyPattern), mutable: true,
+		help: "glob pattern selecting the keys loaded from the read-through origin",
+	},
+	"cdc-enabled": {
+		get: func() string { return CDCEnabled }, set: setYesNo(&CDCEnabled), mutable: true,
+		help: "append every successful write command to the change-data-capture stream: yes or no",
+	},
+	"cdc-stream-key": {
+		get: func() string { return CDCStreamKey }, set: setString(&CDCStreamKey), mutable: true,
+		help: "key under which XREAD, XRANGE and XLEN find the change-data-capture stream",
+	},
+	"cdc-max-len": {
+		get: func() string { return strconv.Itoa(CDCMaxLen) }, set: setPositiveInt(&CDCMaxLen), mutable: true,
+		help: "number of entries the change-data-capture stream keeps",
+	},
+	"script-engine": {
+		get: func() string { return ScriptEngine }, set: setScriptEngine, mutable: true,
+		help: "engine running scripts that don't name one in a #!<engine> first line: lua or starlark",
+	},
+	"busy-reply-threshold": {
+		get: func() string { return strconv.Itoa(BusyReplyThreshold) }, set: setPositiveInt(&BusyReplyThreshold), mutable: true,
+		help: "milliseconds a script may run before other clients get BUSY and SCRIPT KILL may stop it",
+	},
+	"enable-debug-command": {
+		get: func() string { return EnableDebugCommand }, set: setEnableDebugCommand,
+		help: "allow the DEBUG command: yes, local (loopback clients only) or no",
+	},
+	"websocket-port": {
+		get: func() string { return WebSocketPort }, set: setString(&WebSocketPort),
+		help: "port of the WebSocket pub/sub bridge, disabled when empty",
+	},
+	"websocket-allowed-origins": {
+		get: func() string { return WebSocketAllowedOrigins }, set: setString(&WebSocketAllowedOrigins), mutable: true,
+		help: "space-separated glob patterns the Origin of WebSocket browser clients must match",
+	},
+	"tls-port": {
+		get: func() string { return TLSPort }, set: setString(&TLSPort),
+		help: "port for TLS connections, disabled when empty",
+	},
+	"tls-cert-file": {
+		get: func() string { return TLSCertFile }, set: setString(&TLSCertFile),
+		help: "server certificate for TLS",
+	},
+	"tls-key-file": {
+		get: func() string { return TLSKeyFile }, set: setString(&TLSKeyFile),
+		help: "server private key for TLS",
+	},
+	"tls-ca-cert-file": {
+		get: func() string { return TLSCACertFile }, set: setString(&TLSCACertFile),
+		help: "CA bundle used to verify client certificates",
+	},
+	"tls-auth-clients": {
+		get: func() string { return TLSAuthClients }, set: setString(&TLSAuthClients),
+		help: "require client certificates: yes, optional or no",
+	},
+	"tls-auth-clients-user": {
+		get: func() string { return TLSClientsUser }, set: setTLSClientsUser, mutable: true,
+		help: "map client certificates to ACL users: off or CN",
+	},
+}
+
+// setString returns a setter for a free-form string setting.
+func setString(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+// setPositiveInt returns a setter for an integer setting that must be at least 1.
+func setPositiveInt(target *int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("argument must be a positive integer")
+		}
+		*target = n
+		return nil
+	}
+}
+
+// setYesNo returns a setter for a "yes"/"no" setting.
+func setYesNo(target *string) func(string) error {
+	return func(value string) error {
+		value = strings.ToLower(value)
+		if value != "yes" && value != "no" {
+			return fmt.Errorf("argument must be 'yes' or 'no'")
+		}
+		*target = value
+		return nil
+	}
+}
+
+// setNonNegativeInt returns a setter for an integer setting that can't be negative.
+func setNonNegativeInt(target *int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("argument couldn't be parsed into an integer")
+		}
+		*target = n
+		return nil
+	}
+}
+
+// setPercent returns a setter for a percentage setting, from 1 to 100.
+func setPercent(target *int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			return fmt.Errorf("argument must be between 1 and 100")
+		}
+		*target = n
+		return nil
+	}
+}
+
+// setMemory returns a setter for a byte count setting, which accepts units
+// such as "mb".
+func setMemory(target *int) func(string) error {
+	return func(value string) error {
+		n, err := parseMemory(value)
+		if err != nil {
+			return fmt.Errorf("argument must be a memory value")
+		}
+		*target = n
+		return nil
+	}
+}
+
+// setProtoLimit returns a setter for a limit of client requests, a memory
+// value if memory is set, which can't exceed max.
+func setProtoLimit(target *int, max int, memory bool) func(string) error {
+	return func(value string) error {
+		var n int
+		var err error
+		if memory {
+			n, err = parseMemory(value)
+		} else {
+			n, err = strconv.Atoi(value)
+		}
+		if err != nil || n < 1 || n > max {
+			return fmt.Errorf("argument must be between 1 and %d", max)
+		}
+		*target = n
+		return nil
+	}
+}
+
+// setRequirePass changes the default user's password.
+func setRequirePass(value string) error {
+	RequirePass = value
+	configureRequirePass(value)
+	return nil
+}
+
+// setEnableDebugCommand changes who may run DEBUG.
+func setEnableDebugCommand(value string) error {
+	value = strings.ToLower(value)
+	if value != "yes" && value != "local" && value != "no" {
+		return fmt.Errorf("argument must be 'yes', 'local' or 'no'")
+	}
+	EnableDebugCommand = value
+	return nil
+}
+
+// setTLSClientsUser changes how client certificates map to ACL users.
+func setTLSClientsUser(value string) error {
+	if value != "off" && value != "CN" {
+		return fmt.Errorf("argument must be 'off' or 'CN'")
+	}
+	TLSClientsUser = value
+	return nil
+}
+
+// getOutputBufferLimits formats the output buffer limits as accepted by setOutputBufferLimits.
+func getOutputBufferLimits() string {
+	OutputBufferLimitsMu.RLock()
+	defer OutputBufferLimitsMu.RUnlock()
+
+	classes := make([]string, 0, len(OutputBufferLimits))
+	for class := range OutputBufferLimits {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	parts := []string{}
+	for _, class := range classes {
+		limit := OutputBufferLimits[class]
+		parts = append(parts, fmt.Sprintf("%s %d %d %d", class, limit.hard, limit.soft, limit.softSeconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+// configGet returns the current value of a parameter.
+func configGet(name string) (string, bool) {
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return "", false
+	}
+
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return param.get(), true
+}
+
+// configSet changes a parameter at runtime.
+func configSet(name, value string) error {
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown option '%s'", name)
+	}
+	if !param.mutable {
+		return fmt.Errorf("can't set immutable config '%s'", name)
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return param.set(value)
+}
+
+// configLoad sets a parameter during startup, when immutable ones may still change.
+func configLoad(name, value string) error {
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown option '%s'", name)
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return param.set(value)
+}
+
+// handleConfig handles the "CONFIG" command and its subcommands.
+func handleConfig(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'config' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		return handleConfigGet(c, args[1:])
+	case "SET":
+		return handleConfigSet(args[1:])
+	case "RESETSTAT":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|resetstat' command"}
+		}
+		return handleConfigResetStat()
+	case "REWRITE":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|rewrite' command"}
+		}
+		if ConfigFile == "" {
+			return Value{typ: "error", str: "ERR The server is running without a config file"}
+		}
+		if err := rewriteConfigFile(); err != nil {
+			fmt.Println("CONFIG REWRITE failed:", err)
+			return Value{typ: "error", str: "ERR Rewriting config file: " + err.Error()}
+		}
+		return Value{typ: "string", str: "OK"}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'"}
+	}
+}
+
+// handleConfigGet handles "CONFIG GET pattern [pattern ...]".
+func handleConfigGet(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'config|get' command"}
+	}
+
+	names := []string{}
+	for name := range configParams {
+		for _, arg := range args {
+			if matchGlob(strings.ToLower(arg.bulk), name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	values := []Value{}
+	for _, name := range names {
+		value, _ := configGet(name)
+		values = append(values, Value{typ: "bulk", bulk: name}, Value{typ: "bulk", bulk: value})
+	}
+
+	if c.proto == 3 {
+		return Value{typ: "map", array: values}
+	}
+	return Value{typ: "array", array: values}
+}
+
+// handleConfigSet handles "CONFIG SET parameter value [parameter value ...]".
+// Either every parameter is applied or, on failure, none are.
+func handleConfigSet(args []Value) Value {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'config|set' command"}
+	}
+
+	previous := map[string]string{}
+	for i := 0; i < len(args); i += 2 {
+		name, value := strings.ToLower(args[i].bulk), args[i+1].bulk
+
+		old, _ := configGet(name)
+		if err := configSet(name, value); err != nil {
+			for prevName, prevValue := range previous {
+				configSet(prevName, prevValue)
+			}
+			return Value{typ: "error", str: "ERR CONFIG SET failed (possibly related to argument '" + name + "') - " + err.Error()}
+		}
+		if _, seen := previous[name]; !seen {
+			previous[name] = old
+		}
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
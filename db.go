@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DatabaseCount is the number of logical databases the server exposes.
+var DatabaseCount = 16
+
+// Database is one numbered keyspace, isolated from the others.
+type Database struct {
+	id int
+	// store holds the keys, guarded by mu.
+	store StorageEngine
+	mu    sync.RWMutex
+
+	// access holds the access frequency of keys. It has its own lock so
+	// that reading commands, which only hold mu for reading, can update it.
+	access   map[string]keyAccess
+	accessMu sync.Mutex
+
+	// crdt holds the active-active state of keys, guarded by mu. It outlives
+	// the keys it removes, so that a flush still reaches the peers.
+	crdt map[string]*crdtKey
+}
+
+// dbKey is a key of one database.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// NewDatabase creates an empty database with the given index.
+func NewDatabase(id int) *Database {
+	return &Database{
+		id:     id,
+		store:  newStorageEngine(),
+		access: map[string]keyAccess{},
+		crdt:   map[string]*crdtKey{},
+	}
+}
+
+// Databases holds every logical database, indexed by number.
+var Databases = newDatabases(DatabaseCount)
+
+// newDatabases creates n empty databases.
+func newDatabases(n int) []*Database {
+	dbs := make([]*Database, n)
+	for i := range dbs {
+		dbs[i] = NewDatabase(i)
+	}
+	return dbs
+}
+
+// parseDBIndex parses a database number and checks that it is in range.
+func parseDBIndex(arg Value) (int, *Value) {
+	index, err := strconv.Atoi(arg.bulk)
+	if err != nil {
+		return 0, &Value{typ: "error", str: "ERR invalid DB index"}
+	}
+	if index < 0 || index >= len(Databases) {
+		return 0, &Value{typ: "error", str: "ERR DB index is out of range"}
+	}
+	return index, nil
+}
+
+// lockPair write-locks two databases in index order so concurrent callers can't deadlock.
+func lockPair(a, b *Database) func() {
+	if a == b {
+		a.mu.Lock()
+		return a.mu.Unlock
+	}
+	if a.id > b.id {
+		a, b = b, a
+	}
+	a.mu.Lock()
+	b.mu.Lock()
+	return func() {
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
+
+// handleSelect handles the "SELECT" command, changing the client's current database.
+func handleSelect(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'select' command"}
+	}
+
+	index, errValue := parseDBIndex(args[0])
+	if errValue != nil {
+		return *errValue
+	}
+
+	c.metaMu.Lock()
+	c.db = index
+	c.metaMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleSwapDB handles the "SWAPDB" command, exchanging the contents of two databases.
+func handleSwapDB(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'swapdb' command"}
+	}
+
+	first, errValue := parseDBIndex(args[0])
+	if errValue != nil {
+		return *errValue
+	}
+	second, errValue := parseDBIndex(args[1])
+	if errValue != nil {
+		return *errValue
+	}
+
+	a, b := Databases[first], Databases[second]
+	unlock := lockPair(a, b)
+	a.store, b.store = b.store, a.store
+	a.access, b.access = b.access, a.access
+	a.crdt, b.crdt = b.crdt, a.crdt
+	unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleMove handles the "MOVE" command, moving a key from the current database to another.
+func handleMove(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'move' command"}
+	}
+
+	db := c.database()
+
+	key := args[0].bulk
+	index, errValue := parseDBIndex(args[1])
+	if errValue != nil {
+		return *errValue
+	}
+
+	target := Databases[index]
+	if target == db {
+		return Value{typ: "error", str: "ERR source and destination objects are the same"}
+	}
+
+	unlock := lockPair(db, target)
+	moved := moveKey(db, target, key)
+	unlock()
+
+	if moved == 1 {
+		touchWatchedKeys(target.id, []string{key})
+		notifyKeyEvent(db, "del", key)
+		notifyKeyEvent(target, "set", key)
+	}
+
+	return Value{typ: "integer", num: moved}
+}
+
+// moveKey moves the key to target unless target already has it, returning
+// 1 if it was moved. Both databases must be locked for writing.
+func moveKey(db, target *Database, key string) int {
+	if target.exists(key) {
+		return 0
+	}
+	if !db.exists(key) {
+		db.forgetAccess(key)
+		return 0
+	}
+
+	if value, ok := db.store.Get(key); ok {
+		target.store.Set(key, value)
+	}
+	if hash, ok := db.store.GetHash(key); ok {
+		target.store.SetHash(key, hash)
+	}
+	if when, ok := db.store.ExpireTime(key); ok {
+		target.store.Expire(key, when)
+	}
+	db.store.Remove(key)
+	db.forgetAccess(key)
+
+	return 1
+}
+
+// size returns the number of keys, counting a key holding both a string and
+// a hash once. db.mu must be held.
+func (db *Database) size() int {
+	return db.store.KeyCount()
+}
+
+// datasetKeys returns the number of keys in every database.
+func datasetKeys() int {
+	keys := 0
+	for _, db := range Databases {
+		db.mu.RLock()
+		keys += db.size()
+		db.mu.RUnlock()
+	}
+	return keys
+}
+
+// flushMode validates the optional ASYNC/SYNC argument of FLUSHDB, FLUSHALL
+// and SCRIPT FLUSH.
+// Both modes swap in an empty storage engine in constant time; the old one
+// is reclaimed by the garbage collector in the background either way.
+func flushMode(command string, args []Value) *Value {
+	if len(args) > 1 {
+		return &Value{typ: "error", str: "ERR wrong number of arguments for '" + command + "' command"}
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0].bulk) {
+		case "ASYNC", "SYNC":
+		default:
+			return &Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	return nil
+}
+
+// flush removes every key from the database, closing the engine that held
+// them if it has files of its own.
+func (db *Database) flush() {
+	db.mu.Lock()
+	old := db.store
+	db.store = newStorageEngine()
+	db.accessMu.Lock()
+	db.access = map[string]keyAccess{}
+	db.accessMu.Unlock()
+	db.mu.Unlock()
+
+	if closer, ok := old.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Println("Error closing storage engine:", err)
+		}
+	}
+}
+
+// handleFlushDB handles the "FLUSHDB" command, removing every key from the current database.
+func handleFlushDB(c *Client, args []Value) Value {
+	if errValue := flushMode("flushdb", args); errValue != nil {
+		return *errValue
+	}
+
+	c.database().flush()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleFlushAll handles the "FLUSHALL" command, removing every key from every database.
+func handleFlushAll(c *Client, args []Value) Value {
+	if errValue := flushMode("flushall", args); errValue != nil {
+		return *errValue
+	}
+
+	for _, d := range Databases {
+		d.flush()
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleDBSize handles the "DBSIZE" command, returning the number of keys in the current database.
+func handleDBSize(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'dbsize' command"}
+	}
+
+	db := c.database()
+
+	db.mu.RLock()
+	size := db.size()
+	db.mu.RUnlock()
+
+	return Value{typ: "integer", num: size}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnableDebugCommand controls who may run DEBUG: "yes", "local" for loopback
+// clients only, or "no".
+var EnableDebugCommand = "no"
+
+// debugDenied is returned when enable-debug-command doesn't allow the client to run DEBUG.
+const debugDenied = "ERR DEBUG command not allowed. If the enable-debug-command option is set to \"local\", " +
+	"you can run it from a local connection, otherwise you need to set this option in the configuration " +
+	"file, and then restart the server."
+
+// debugAllowed reports whether enable-debug-command lets the client run DEBUG.
+func debugAllowed(c *Client) bool {
+	configMu.RLock()
+	mode := EnableDebugCommand
+	configMu.RUnlock()
+
+	switch mode {
+	case "yes":
+		return true
+	case "local":
+		return c.conn == nil || isLocalConn(c.conn)
+	default:
+		return false
+	}
+}
+
+// handleDebug handles the "DEBUG" command and its subcommands.
+func handleDebug(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug' command"}
+	}
+
+	if !debugAllowed(c) {
+		return Value{typ: "error", str: debugDenied}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "HELP":
+		return debugHelp()
+	case "SLEEP":
+		return handleDebugSleep(args[1:])
+	case "OBJECT":
+		return handleDebugObject(c, args[1:])
+	case "SET-ACTIVE-EXPIRE":
+		return handleDebugSetActiveExpire(args[1:])
+	case "JMAP":
+		return handleDebugJMap(args[1:])
+	case "POPULATE":
+		return handleDebugPopulate(c, args[1:])
+	case "RELOAD":
+		return handleDebugReload(c, args[1:])
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try DEBUG HELP."}
+	}
+}
+
+// debugHelp lists the DEBUG subcommands.
+func debugHelp() Value {
+	lines := []string{
+		"DEBUG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"SLEEP <seconds>",
+		"    Stop the server for <seconds>. Decimals allowed.",
+		"OBJECT <key>",
+		"    Show low-level info about the key and associated value.",
+		"SET-ACTIVE-EXPIRE <0|1>",
+		"    Setting it to 0 disables expiring keys in background when they are not accessed.",
+		"JMAP",
+		"    Dump runtime memory and keyspace statistics.",
+		"POPULATE <count> [<prefix>] [<size>]",
+		"    Create <count> string keys named key:<num>. If <prefix> is specified it is",
+		"    used instead of the 'key' prefix. These are not propagated to the AOF.",
+		"    If <size> is specified, each value is padded or truncated to that many bytes.",
+		"RELOAD [NOSAVE]",
+		"    Save the dataset to the RDB file, then empty it and load it back from the file.",
+		"    With NOSAVE, the existing RDB file is loaded without saving first.",
+		"HELP",
+		"    Print this help.",
+	}
+
+	values := make([]Value, 0, len(lines))
+	for _, line := range lines {
+		values = append(values, Value{typ: "string", str: line})
+	}
+	return Value{typ: "array", array: values}
+}
+
+// handleDebugSleep handles "DEBUG SLEEP seconds". It stalls the command long
+// enough to simulate a slow operation; shutdown and atomic blocks wait for it.
+func handleDebugSleep(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|sleep' command"}
+	}
+
+	seconds, err := strconv.ParseFloat(args[0].bulk, 64)
+	if err != nil || seconds < 0 {
+		return Value{typ: "error", str: "ERR value is not a valid float"}
+	}
+
+	time.Sleep(time.Duration(seconds * float64(time.Second)))
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleDebugObject handles "DEBUG OBJECT key", describing how the value is stored.
+func handleDebugObject(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|object' command"}
+	}
+
+	db := c.database()
+
+	key := args[0].bulk
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var typ, encoding string
+	var length int
+	var addr interface{}
+	if value, ok := db.store.Get(key); ok {
+		typ, encoding, length = "string", stringEncoding(value), len(value)
+		addr = &value
+	} else if hash, ok := db.store.GetHash(key); ok {
+		typ = "hash"
+		encoding, _ = db.store.HashEncoding(key)
+		for field, value := range hash {
+			length += len(field) + len(value)
+		}
+		addr = hash
+	} else {
+		return Value{typ: "error", str: "ERR no such key"}
+	}
+
+	ttl := int64(-1)
+	if when, ok := db.store.ExpireTime(key); ok {
+		ttl = when - nowMillis()
+	}
+
+	return Value{typ: "string", str: fmt.Sprintf("Value at:%p refcount:1 type:%s encoding:%s serializedlength:%d ttl_ms:%d",
+		addr, typ, encoding, length, ttl)}
+}
+
+// stringEncoding returns the encoding Redis would report for a string value.
+func stringEncoding(value string) string {
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) <= 20 {
+		return "int"
+	}
+	if len(value) <= 44 {
+		return "embstr"
+	}
+	return "raw"
+}
+
+// debugPopulateBatch is how many keys DEBUG POPULATE creates per hold of the database lock.
+const debugPopulateBatch = 1000
+
+// handleDebugPopulate handles "DEBUG POPULATE count [prefix] [size]",
+// creating keys "prefix:N" holding "value:N" for N from 0 to count-1.
+// Existing keys are left untouched.
+func handleDebugPopulate(c *Client, args []Value) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|populate' command"}
+	}
+
+	count, err := strconv.Atoi(args[0].bulk)
+	if err != nil || count < 0 {
+		return Value{typ: "error", str: "ERR count must be a non-negative integer"}
+	}
+	prefix := "key"
+	if len(args) >= 2 {
+		prefix = args[1].bulk
+	}
+	size := -1
+	if len(args) == 3 {
+		size, err = strconv.Atoi(args[2].bulk)
+		if err != nil || size < 0 {
+			return Value{typ: "error", str: "ERR size must be a non-negative integer"}
+		}
+	}
+
+	db := c.database()
+
+	for start := 0; start < count; start += debugPopulateBatch {
+		end := start + debugPopulateBatch
+		if end > count {
+			end = count
+		}
+
+		db.mu.Lock()
+		for i := start; i < end; i++ {
+			key := prefix + ":" + strconv.Itoa(i)
+			if db.exists(key) {
+				continue
+			}
+
+			value := "value:" + strconv.Itoa(i)
+			if size >= 0 {
+				if len(value) > size {
+					value = value[:size]
+				} else {
+					value += strings.Repeat("\x00", size-len(value))
+				}
+			}
+			db.store.Set(key, value)
+		}
+		db.mu.Unlock()
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleDebugReload handles "DEBUG RELOAD [NOSAVE]". It saves the dataset
+// to DBFilename like SAVE, empties it and loads it back from the file, so
+// that whatever a snapshot doesn't round-trip shows. executionMu must be
+// held for writing.
+func handleDebugReload(c *Client, args []Value) Value {
+	save := true
+	for _, arg := range args {
+		if !strings.EqualFold(arg.bulk, "NOSAVE") {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		save = false
+	}
+
+	if save {
+		if reply := handleSave(c, nil); reply.typ == "error" {
+			return reply
+		}
+	} else if _, err := os.Stat(DBFilename); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+
+	emptyDataset()
+	if _, err := loadSnapshot(DBFilename, false); err != nil {
+		fmt.Println("Error reloading snapshot:", err)
+		return Value{typ: "error", str: "ERR Error trying to load the RDB dump: " + err.Error()}
+	}
+
+	invalidateAll(c)
+	touchAllWatchedKeys()
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleDebugSetActiveExpire handles "DEBUG SET-ACTIVE-EXPIRE 0|1".
+func handleDebugSetActiveExpire(args []Value) Value {
+	if len(args) != 1 || (args[0].bulk != "0" && args[0].bulk != "1") {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	activeExpireMu.Lock()
+	activeExpire = args[0].bulk == "1"
+	activeExpireMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleDebugJMap handles "DEBUG JMAP", dumping Go runtime memory statistics
+// and keyspace sizes, one "name:value" pair per line.
+func handleDebugJMap(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|jmap' command"}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Runtime\r\n")
+	fmt.Fprintf(&b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(&b, "goroutines:%d\r\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "heap_alloc:%d\r\n", mem.HeapAlloc)
+	fmt.Fprintf(&b, "heap_inuse:%d\r\n", mem.HeapInuse)
+	fmt.Fprintf(&b, "heap_idle:%d\r\n", mem.HeapIdle)
+	fmt.Fprintf(&b, "heap_released:%d\r\n", mem.HeapReleased)
+	fmt.Fprintf(&b, "heap_objects:%d\r\n", mem.HeapObjects)
+	fmt.Fprintf(&b, "stack_inuse:%d\r\n", mem.StackInuse)
+	fmt.Fprintf(&b, "sys:%d\r\n", mem.Sys)
+	fmt.Fprintf(&b, "total_alloc:%d\r\n", mem.TotalAlloc)
+	fmt.Fprintf(&b, "mallocs:%d\r\n", mem.Mallocs)
+	fmt.Fprintf(&b, "frees:%d\r\n", mem.Frees)
+	fmt.Fprintf(&b, "gc_cycles:%d\r\n", mem.NumGC)
+	fmt.Fprintf(&b, "gc_pause_total_ns:%d\r\n", mem.PauseTotalNs)
+	fmt.Fprintf(&b, "next_gc:%d\r\n", mem.NextGC)
+
+	activeExpireMu.RLock()
+	fmt.Fprintf(&b, "\r\n# Expiry\r\n")
+	fmt.Fprintf(&b, "active_expire:%t\r\n", activeExpire)
+	activeExpireMu.RUnlock()
+
+	fmt.Fprintf(&b, "\r\n# Keyspace\r\n")
+	for _, db := range Databases {
+		db.mu.RLock()
+		strs, hashes, expires := db.store.Counts()
+		db.mu.RUnlock()
+		if strs+hashes == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "db%d:strings=%d,hashes=%d,expires=%d\r\n", db.id, strs, hashes, expires)
+	}
+
+	return Value{typ: "bulk", bulk: b.String()}
+}
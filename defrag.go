@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveDefrag enables rebuilding, in the background, the maps of storage
+// engines that deletions left mostly empty.
+var ActiveDefrag = "no"
+
+// ActiveDefragThreshold is the percentage of a map's slots that must be
+// empty for it to be rebuilt.
+var ActiveDefragThreshold = 50
+
+// ActiveDefragIgnoreBytes is the estimated size of the empty slots of a map
+// below which it isn't worth rebuilding.
+var ActiveDefragIgnoreBytes = 1 << 20
+
+// ActiveDefragCycleMax bounds the percentage of time spent rebuilding maps,
+// as the database being defragmented is locked meanwhile.
+var ActiveDefragCycleMax = 25
+
+// activeDefragInterval is how often databases are checked for maps to
+// rebuild.
+const activeDefragInterval = time.Second
+
+// activeDefragRunning is 1 while maps are being rebuilt, and the counters
+// report the maps rebuilt, the entries they held and the estimated bytes
+// of empty slots reclaimed, updated atomically.
+var (
+	activeDefragRunning   int32
+	activeDefragHits      int64
+	activeDefragEntries   int64
+	activeDefragReclaimed int64
+)
+
+// mapPeaks is the most entries each map of a memoryEngine held. Go maps
+// never shrink: the slots of deleted entries stay allocated, and only
+// copying the entries left to a new map gives them back.
+type mapPeaks struct {
+	strings, hashes, packed, expires int
+}
+
+// runActiveDefrag rebuilds, every activeDefragInterval while ActiveDefrag
+// is on, the maps of every database that are at least ActiveDefragThreshold
+// percent empty slots worth ActiveDefragIgnoreBytes, one at a time. The
+// database is locked while a map is copied, so after each one it rests for
+// long enough that rebuilding takes at most ActiveDefragCycleMax percent of
+// the time.
+func runActiveDefrag() {
+	ticker := time.NewTicker(activeDefragInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		configMu.RLock()
+		enabled := ActiveDefrag == "yes"
+		threshold, ignoreBytes, cycleMax := ActiveDefragThreshold, ActiveDefragIgnoreBytes, ActiveDefragCycleMax
+		configMu.RUnlock()
+		if !enabled {
+			continue
+		}
+
+		for _, db := range Databases {
+			for {
+				start := time.Now()
+				db.mu.Lock()
+				copied, reclaimed := db.store.Defrag(threshold, ignoreBytes)
+				db.mu.Unlock()
+				if reclaimed == 0 {
+					break
+				}
+				elapsed := time.Since(start)
+				latencyAddSample("active-defrag-cycle", elapsed)
+
+				atomic.StoreInt32(&activeDefragRunning, 1)
+				atomic.AddInt64(&activeDefragHits, 1)
+				atomic.AddInt64(&activeDefragEntries, int64(copied))
+				atomic.AddInt64(&activeDefragReclaimed, int64(reclaimed))
+				time.Sleep(elapsed * time.Duration(100-cycleMax) / time.Duration(cycleMax))
+			}
+		}
+		atomic.StoreInt32(&activeDefragRunning, 0)
+	}
+}
+
+// infoActiveDefrag reports the progress of active defragmentation, for INFO.
+func infoActiveDefrag() []string {
+	return []string{
+		fmt.Sprintf("active_defrag_running:%d", atomic.LoadInt32(&activeDefragRunning)),
+		fmt.Sprintf("active_defrag_hits:%d", atomic.LoadInt64(&activeDefragHits)),
+		fmt.Sprintf("active_defrag_entries:%d", atomic.LoadInt64(&activeDefragEntries)),
+		fmt.Sprintf("active_defrag_reclaimed_bytes:%d", atomic.LoadInt64(&activeDefragReclaimed)),
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// MinFreeDisk is the free space, in bytes, in the data directory below
+// which the server turns read-only: it keeps serving reads and deletes, but
+// refuses other writes until space is freed. 0 disables the check.
+var MinFreeDisk = 0
+
+const (
+	diskCheckInterval = time.Second
+	// diskEventsChannel is where the server publishes "read-only" when it
+	// turns read-only for lack of disk space and "read-write" when it
+	// recovers.
+	diskEventsChannel = "__stormy__:disk"
+)
+
+// diskLow is 1 while the server is read-only for lack of disk space.
+var diskLow int32
+
+// diskLowAllowed are the writes accepted while disk space is low, as they
+// only remove data.
+var diskLowAllowed = map[string]bool{
+	"DEL":      true,
+	"UNLINK":   true,
+	"HDEL":     true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+}
+
+// lastDiskCheckErr is the last error checking free space, so that a
+// persistent one is reported once. Only runDiskMonitor uses it.
+var lastDiskCheckErr string
+
+// runDiskMonitor checks the free space in the data directory every
+// diskCheckInterval.
+func runDiskMonitor() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		checkDiskSpace()
+	}
+}
+
+// checkDiskSpace turns the server read-only when free space drops below
+// MinFreeDisk, and back once there is enough again and the AOF could be
+// synced.
+func checkDiskSpace() {
+	configMu.RLock()
+	minFree := MinFreeDisk
+	configMu.RUnlock()
+
+	low := atomic.LoadInt32(&diskLow) == 1
+	if minFree == 0 {
+		if low {
+			setDiskLow(false, "min-free-disk was disabled")
+		}
+		return
+	}
+
+	free, err := freeDiskSpace(".")
+	if err != nil {
+		if err.Error() != lastDiskCheckErr {
+			fmt.Println("Error checking free disk space:", err)
+			lastDiskCheckErr = err.Error()
+		}
+		return
+	}
+	lastDiskCheckErr = ""
+
+	switch {
+	case !low && free < uint64(minFree):
+		setDiskLow(true, fmt.Sprintf("%d bytes free, below min-free-disk", free))
+	case low && free >= uint64(minFree) && aofSyncs():
+		setDiskLow(false, fmt.Sprintf("%d bytes free", free))
+	}
+}
+
+// setDiskLow turns the server read-only or back, logging why and publishing
+// the change to diskEventsChannel.
+func setDiskLow(low bool, reason string) {
+	if low {
+		atomic.StoreInt32(&diskLow, 1)
+		fmt.Println("Disk space low, only accepting reads and deletes:", reason)
+		publish(diskEventsChannel, "read-only")
+		return
+	}
+	atomic.StoreInt32(&diskLow, 0)
+	fmt.Println("Disk space recovered, accepting writes again:", reason)
+	publish(diskEventsChannel, "read-write")
+}
+
+// aofSyncs writes and syncs the AOF, if enabled, reporting whether it
+// succeeded.
+func aofSyncs() bool {
+	if aof == nil {
+		return true
+	}
+	if err := aof.Flush(); err != nil {
+		return false
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return aof.sync() == nil
+}
+
+// diskSpaceCheck returns the error write commands other than deletes fail
+// with while the server is read-only for lack of disk space.
+func diskSpaceCheck(command string) *Value {
+	if atomic.LoadInt32(&diskLow) == 0 || diskLowAllowed[command] {
+		return nil
+	}
+	return &Value{typ: "error", str: "MISCONF Free disk space is below min-free-disk, only reads and deletes are accepted"}
+}
+
+// infoDiskSpace reports whether the server is read-only for lack of disk
+// space, for INFO.
+func infoDiskSpace() []string {
+	return []string{fmt.Sprintf("disk_low_read_only:%d", atomic.LoadInt32(&diskLow))}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// freeDiskSpace isn't supported on this platform, so min-free-disk has no
+// effect.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space can't be checked on this platform")
+}
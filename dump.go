@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// handleDump handles "DUMP key", replying with the key's values serialized
+// for RESTORE, or null if the key doesn't exist. The TTL isn't included.
+func handleDump(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'dump' command"}
+	}
+
+	db := c.database()
+
+	key := args[0].bulk
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.expiredOnReplica(c, key) {
+		return Value{typ: "null"}
+	}
+	value, hasValue := db.store.Get(key)
+	hash, hasHash := db.store.GetHash(key)
+	if !hasValue && !hasHash {
+		return Value{typ: "null"}
+	}
+	if !hasHash {
+		hash = nil
+	}
+	return Value{typ: "bulk", bulk: string(dumpPayload(value, hasValue, hash))}
+}
+
+// dumpPayload serializes a key's string, if hasValue is set, and hash, if
+// not nil, in the format of Redis's DUMP: each value as in an RDB file,
+// then the RDB version and the CRC-64 of everything before it. Redis only
+// restores payloads holding a single value.
+func dumpPayload(value string, hasValue bool, hash map[string]string) []byte {
+	var buf []byte
+	if hasValue {
+		buf = append(buf, rdbTypeString)
+		buf = appendRDBString(buf, value)
+	}
+	if hash != nil {
+		buf = append(buf, rdbTypeHash)
+		buf = appendRDBLength(buf, uint64(len(hash)))
+		for field, value := range hash {
+			buf = appendRDBString(buf, field)
+			buf = appendRDBString(buf, value)
+		}
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	sum := &crc64{}
+	sum.Write(buf)
+	return binary.LittleEndian.AppendUint64(buf, sum.sum)
+}
+
+// parseDumpPayload reads the string and hash serialized by DUMP, by Redis
+// as well, which writes hashes in encodings of its own. It returns the
+// error to reply with for invalid payloads.
+func parseDumpPayload(payload []byte) (value string, hasValue bool, hash map[string]string, errValue *Value) {
+	errPayload := &Value{typ: "error", str: "ERR DUMP payload version or checksum are wrong"}
+	if len(payload) < 10 {
+		return "", false, nil, errPayload
+	}
+	footer := len(payload) - 10
+	version := binary.LittleEndian.Uint16(payload[footer:])
+	sum := &crc64{}
+	sum.Write(payload[:footer+2])
+	if version > rdbVersionMax || binary.LittleEndian.Uint64(payload[footer+2:]) != sum.sum {
+		return "", false, nil, errPayload
+	}
+
+	errFormat := &Value{typ: "error", str: "ERR Bad data format"}
+	r := &rdbReader{r: bufio.NewReader(bytes.NewReader(payload[:footer])), crc: &crc64{}}
+	for {
+		typ, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", false, nil, errFormat
+		}
+		switch {
+		case typ == rdbTypeString && !hasValue:
+			value, err = r.readString()
+			hasValue = true
+		case (typ == rdbTypeHash || typ == rdbTypeHashZiplist || typ == rdbTypeHashListpack) && hash == nil:
+			hash, err = r.readHash(typ)
+		default:
+			return "", false, nil, errFormat
+		}
+		if err != nil {
+			return "", false, nil, errFormat
+		}
+	}
+	if !hasValue && hash == nil {
+		return "", false, nil, errFormat
+	}
+	return value, hasValue, hash, nil
+}
+
+// handleRestore handles "RESTORE key ttl payload [REPLACE] [ABSTTL]",
+// creating the key from a payload DUMP made, with a TTL of ttl milliseconds
+// or, with ABSTTL, expiring at the Unix time ttl in milliseconds, unless it
+// is 0. An existing key is replaced with REPLACE, and an error otherwise.
+func handleRestore(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'restore' command"}
+	}
+
+	key := args[0].bulk
+	ttl, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	if ttl < 0 {
+		return Value{typ: "error", str: "ERR Invalid TTL value, must be >= 0"}
+	}
+	replace, absolute := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absolute = true
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	value, hasValue, hash, errValue := parseDumpPayload([]byte(args[2].bulk))
+	if errValue != nil {
+		return *errValue
+	}
+
+	when := ttl
+	if ttl != 0 && !absolute {
+		when = nowMillis() + ttl
+	}
+
+	db := c.database()
+
+	db.mu.Lock()
+	existed := db.exists(key)
+	if existed && !replace {
+		db.mu.Unlock()
+		return Value{typ: "error", str: "BUSYKEY Target key name already exists."}
+	}
+	if existed {
+		db.removeKey(key)
+	}
+	// A key that expired already isn't created, except while replaying
+	// persisted commands, as setExpire does.
+	expired := when != 0 && when <= nowMillis() && c.conn != nil
+	if !expired {
+		if hasValue {
+			db.store.Set(key, value)
+		}
+		if hash != nil {
+			db.store.SetHash(key, hash)
+		}
+		if when != 0 {
+			db.store.Expire(key, when)
+		}
+	}
+	db.mu.Unlock()
+
+	switch {
+	case !expired:
+		notifyKeyEvent(db, "set", key)
+	case existed:
+		notifyKeyEvent(db, "del", key)
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
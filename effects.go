@@ -0,0 +1,68 @@
+package main
+
+import "strings"
+
+// unchangedReplies are the replies of write commands that left the dataset
+// as it was, e.g. DEL of a missing key, which don't need to be persisted.
+var unchangedReplies = map[string]func(result Value) bool{
+	"DEL":       zeroReply,
+	"UNLINK":    zeroReply,
+	"EXPIRE":    zeroReply,
+	"PEXPIRE":   zeroReply,
+	"EXPIREAT":  zeroReply,
+	"PEXPIREAT": zeroReply,
+	"PERSIST":   zeroReply,
+	"MOVE":      zeroReply,
+	"CRDT":      zeroReply,
+	"MIGRATE": func(result Value) bool {
+		return result.str == "NOKEY"
+	},
+	"CAS": func(result Value) bool {
+		return result.array[0].num == 0
+	},
+}
+
+// zeroReply reports whether a command replied with the integer 0.
+func zeroReply(result Value) bool {
+	return result.typ == "integer" && result.num == 0
+}
+
+// commandEffect returns the command to persist for a write command that ran
+// successfully with the given result, and false if it changed nothing. The
+// command is persisted as its effect when replaying it could turn out
+// differently: a CAS as the SET it performed, so that replaying it doesn't
+// hinge on comparing against a value an earlier command set, and a MIGRATE
+// as the UNLINK of the keys it moved away, which replaying mustn't send
+// again. Other commands, like INCR, are persisted as is: they change the key
+// the same way whatever order they are replayed in, and an INCR keeps the
+// key's TTL, which a SET would drop.
+// value must already have relative expiry times made absolute, see
+// persistentExpire.
+func commandEffect(value Value, result Value) (Value, bool) {
+	command := strings.ToUpper(value.array[0].bulk)
+	if unchanged, ok := unchangedReplies[command]; ok && unchanged(result) {
+		return Value{}, false
+	}
+
+	switch command {
+	case "CAS":
+		return Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "SET"},
+			value.array[1],
+			value.array[3],
+		}}, true
+	case "MIGRATE":
+		keys := migrateKeys(value.array[1:])
+		for _, arg := range value.array[6:] {
+			if strings.EqualFold(arg.bulk, "COPY") {
+				return Value{}, false
+			}
+		}
+		effect := []Value{{typ: "bulk", bulk: "UNLINK"}}
+		for _, key := range keys {
+			effect = append(effect, Value{typ: "bulk", bulk: key})
+		}
+		return Value{typ: "array", array: effect}, true
+	}
+	return value, true
+}
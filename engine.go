@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// StorageEngineName names the engine every database stores its keys in, one
+// of storageEngines.
+var StorageEngineName = "memory"
+
+// StorageEngine stores the keys of one database: string values, hashes and
+// the expiry times of keys. A key name may hold a string and a hash at once,
+// each living in its own namespace. Callers hold the database's lock, so
+// engines need no locking of their own.
+type StorageEngine interface {
+	// Get returns the string value of key.
+	Get(key string) (string, bool)
+	// Set sets the string value of key, keeping its TTL.
+	Set(key, value string)
+	// Delete removes the string value of key and its TTL, reporting whether
+	// there was one.
+	Delete(key string) bool
+
+	// GetHash returns the hash at key, which callers must not modify.
+	GetHash(key string) (map[string]string, bool)
+	// GetField returns the value of a field of the hash at key.
+	GetField(key, field string) (string, bool)
+	// HashEncoding returns how the hash at key is stored, "listpack" or
+	// "hashtable".
+	HashEncoding(key string) (string, bool)
+	// HashLen returns the number of fields of the hash at key, without
+	// decoding it.
+	HashLen(key string) (int, bool)
+	// SetHash replaces the hash at key with hash, which the engine takes
+	// ownership of.
+	SetHash(key string, hash map[string]string)
+	// SetField sets a field of the hash at key, creating the hash if needed.
+	SetField(key, field, value string)
+
+	// Remove removes every value of key and its TTL.
+	Remove(key string)
+
+	// ExpireTime returns the expiry time of key, in Unix milliseconds.
+	ExpireTime(key string) (int64, bool)
+	// Expire sets the expiry time of key, in Unix milliseconds.
+	Expire(key string, when int64)
+	// Persist removes the TTL of key.
+	Persist(key string)
+
+	// IterateStrings, IterateHashes and IterateExpires call fn with each
+	// string, hash or expiry time, in no particular order, until fn returns
+	// false. fn must not modify the engine, except to remove the key it was
+	// called with.
+	IterateStrings(fn func(key, value string) bool)
+	IterateHashes(fn func(key string, hash map[string]string) bool)
+	IterateExpires(fn func(key string, when int64) bool)
+	// IterateKeys calls fn with the name of each key holding a string, a
+	// hash or both, once, like the other iterators but without reading
+	// the values.
+	IterateKeys(fn func(key string) bool)
+
+	// Counts returns the number of strings, hashes and expiry times stored.
+	Counts() (strings, hashes, expires int)
+	// KeyCount returns the number of keys, counting a key holding both a
+	// string and a hash once, without reading the values.
+	KeyCount() int
+	// Defrag rebuilds the map that has the most bytes of slots left empty by
+	// deletions, if they are at least threshold percent of its slots and
+	// ignoreBytes, so the memory goes back to the heap. It returns the
+	// entries copied and the bytes reclaimed, none if no map needed it.
+	Defrag(threshold, ignoreBytes int) (copied, reclaimed int)
+
+	// Usage returns the estimated bytes the keys, values and expiry times
+	// take in memory, by what they hold. Their total is what maxmemory
+	// bounds.
+	Usage() keyspaceUsage
+}
+
+// storageEngines creates an empty engine of each kind, by name. A
+// disk-backed engine, for datasets larger than memory, registers here, and
+// implements io.Closer to release its files once it is flushed away.
+var storageEngines = map[string]func() StorageEngine{
+	"memory": newMemoryEngine,
+	"tiered": newTieredEngine,
+}
+
+// setStorageEngine changes the engine databases are created with.
+func setStorageEngine(value string) error {
+	if _, ok := storageEngines[value]; !ok {
+		names := make([]string, 0, len(storageEngines))
+		for name := range storageEngines {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("argument must be one of: %s", strings.Join(names, ", "))
+	}
+	StorageEngineName = value
+	return nil
+}
+
+// newStorageEngine creates an empty engine of the configured kind.
+func newStorageEngine() StorageEngine {
+	return storageEngines[StorageEngineName]()
+}
+
+// memoryEngine is the default engine, keeping every key in Go maps. Small
+// hashes are kept as listpacks in packed, and the others in hashes.
+type memoryEngine struct {
+	strings map[string]string
+	hashes  map[string]map[string]string
+	packed  map[string]listpack
+	// expires maps keys that have a TTL to their expiry time in Unix milliseconds.
+	expires map[string]int64
+	// used is the estimated size of the maps' entries, kept as they change,
+	// but for the bytes of the fields and values of removed hashes, which
+	// lazyFreed counts once freed in the background.
+	used      keyspaceUsage
+	lazyFreed int64
+	// peak is the most entries each map held since it was created or last
+	// rebuilt, as Go maps keep the slots they grew to, see Defrag.
+	peak mapPeaks
+}
+
+// newMemoryEngine creates an empty in-memory engine.
+func newMemoryEngine() StorageEngine {
+	return &memoryEngine{
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+		packed:  map[string]listpack{},
+		expires: map[string]int64{},
+	}
+}
+
+func (e *memoryEngine) Get(key string) (string, bool) {
+	value, ok := e.strings[key]
+	return value, ok
+}
+
+func (e *memoryEngine) Set(key, value string) {
+	e.dropString(key)
+	e.strings[key] = value
+	e.grew()
+	e.used.strings += stringEntrySize(key, value)
+}
+
+func (e *memoryEngine) Delete(key string) bool {
+	if !e.dropString(key) {
+		return false
+	}
+	e.Persist(key)
+	return true
+}
+
+// GetHash decodes the listpack of a small hash into a new map.
+func (e *memoryEngine) GetHash(key string) (map[string]string, bool) {
+	if lp, ok := e.packed[key]; ok {
+		return lp.unpack(), true
+	}
+	hash, ok := e.hashes[key]
+	return hash, ok
+}
+
+func (e *memoryEngine) GetField(key, field string) (string, bool) {
+	if lp, ok := e.packed[key]; ok {
+		return lp.get(field)
+	}
+	value, ok := e.hashes[key][field]
+	return value, ok
+}
+
+func (e *memoryEngine) HashEncoding(key string) (string, bool) {
+	if _, ok := e.packed[key]; ok {
+		return "listpack", true
+	}
+	if _, ok := e.hashes[key]; ok {
+		return "hashtable", true
+	}
+	return "", false
+}
+
+func (e *memoryEngine) HashLen(key string) (int, bool) {
+	if lp, ok := e.packed[key]; ok {
+		return lp.len(), true
+	}
+	hash, ok := e.hashes[key]
+	return len(hash), ok
+}
+
+func (e *memoryEngine) SetHash(key string, hash map[string]string) {
+	e.dropHash(key)
+	if fitsListpack(hash) {
+		lp := packHash(hash)
+		e.packed[key] = lp
+		e.grew()
+		e.used.listpacks += listpackEntrySize(key, lp)
+		return
+	}
+	e.hashes[key] = hash
+	e.grew()
+	e.used.hashtables += hashEntrySize(key, hash)
+}
+
+// SetField converts a listpack to a map once the field makes it too big.
+func (e *memoryEngine) SetField(key, field, value string) {
+	hash, ok := e.hashes[key]
+	if !ok {
+		lp, packed := e.packed[key]
+		if lp.fits(field, value) {
+			if packed {
+				e.used.listpacks -= listpackEntrySize(key, lp)
+			}
+			lp = lp.set(field, value)
+			e.packed[key] = lp
+			e.grew()
+			e.used.listpacks += listpackEntrySize(key, lp)
+			return
+		}
+		hash = lp.unpack()
+		e.dropHash(key)
+		e.hashes[key] = hash
+		e.grew()
+		e.used.hashtables += hashEntrySize(key, hash)
+	}
+	if old, ok := hash[field]; ok {
+		e.used.hashtables -= hashFieldSize(field, old)
+	}
+	hash[field] = value
+	e.used.hashtables += hashFieldSize(field, value)
+}
+
+func (e *memoryEngine) Remove(key string) {
+	e.dropString(key)
+	e.dropHash(key)
+	e.Persist(key)
+}
+
+func (e *memoryEngine) ExpireTime(key string) (int64, bool) {
+	when, ok := e.expires[key]
+	return when, ok
+}
+
+func (e *memoryEngine) Expire(key string, when int64) {
+	if _, ok := e.expires[key]; !ok {
+		e.used.expires += expireEntrySize
+	}
+	e.expires[key] = when
+	e.grew()
+}
+
+func (e *memoryEngine) Persist(key string) {
+	if _, ok := e.expires[key]; ok {
+		delete(e.expires, key)
+		e.used.expires -= expireEntrySize
+	}
+}
+
+func (e *memoryEngine) IterateStrings(fn func(key, value string) bool) {
+	for key, value := range e.strings {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+// IterateHashes decodes listpacks like GetHash.
+func (e *memoryEngine) IterateHashes(fn func(key string, hash map[string]string) bool) {
+	for key, hash := range e.hashes {
+		if !fn(key, hash) {
+			return
+		}
+	}
+	for key, lp := range e.packed {
+		if !fn(key, lp.unpack()) {
+			return
+		}
+	}
+}
+
+func (e *memoryEngine) IterateExpires(fn func(key string, when int64) bool) {
+	for key, when := range e.expires {
+		if !fn(key, when) {
+			return
+		}
+	}
+}
+
+func (e *memoryEngine) IterateKeys(fn func(key string) bool) {
+	// Either kind may come first, so the first keys are a fair sample for
+	// eviction.
+	if rand.Intn(2) == 0 {
+		if !e.iterateHashKeys(fn) {
+			return
+		}
+		for key := range e.strings {
+			if !e.hasHash(key) && !fn(key) {
+				return
+			}
+		}
+		return
+	}
+	for key := range e.strings {
+		if !fn(key) {
+			return
+		}
+	}
+	e.iterateHashKeys(func(key string) bool {
+		_, ok := e.strings[key]
+		return ok || fn(key)
+	})
+}
+
+func (e *memoryEngine) Counts() (int, int, int) {
+	return len(e.strings), len(e.hashes) + len(e.packed), len(e.expires)
+}
+
+func (e *memoryEngine) KeyCount() int {
+	count := len(e.strings)
+	e.iterateHashKeys(func(key string) bool {
+		if _, ok := e.strings[key]; !ok {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+func (e *memoryEngine) Usage() keyspaceUsage {
+	usage := e.used
+	usage.hashtables -= int(atomic.LoadInt64(&e.lazyFreed))
+	return usage
+}
+
+func (e *memoryEngine) Defrag(threshold, ignoreBytes int) (int, int) {
+	best, waste := "", 0
+	consider := func(name string, peak, entries, slotSize int) {
+		empty := (peak - entries) * slotSize
+		if (peak-entries)*100 >= peak*threshold && empty >= ignoreBytes && empty > waste {
+			best, waste = name, empty
+		}
+	}
+	consider("strings", e.peak.strings, len(e.strings), 2*stringHeaderSize+mapEntryOverhead)
+	consider("hashes", e.peak.hashes, len(e.hashes), stringHeaderSize+8+mapEntryOverhead)
+	consider("packed", e.peak.packed, len(e.packed), 2*stringHeaderSize+mapEntryOverhead)
+	consider("expires", e.peak.expires, len(e.expires), expireEntrySize)
+
+	switch best {
+	case "strings":
+		strs := make(map[string]string, len(e.strings))
+		for key, value := range e.strings {
+			strs[key] = value
+		}
+		e.strings, e.peak.strings = strs, len(strs)
+		return len(strs), waste
+	case "hashes":
+		hashes := make(map[string]map[string]string, len(e.hashes))
+		for key, hash := range e.hashes {
+			hashes[key] = hash
+		}
+		e.hashes, e.peak.hashes = hashes, len(hashes)
+		return len(hashes), waste
+	case "packed":
+		packed := make(map[string]listpack, len(e.packed))
+		for key, lp := range e.packed {
+			packed[key] = lp
+		}
+		e.packed, e.peak.packed = packed, len(packed)
+		return len(packed), waste
+	case "expires":
+		expires := make(map[string]int64, len(e.expires))
+		for key, when := range e.expires {
+			expires[key] = when
+		}
+		e.expires, e.peak.expires = expires, len(expires)
+		return len(expires), waste
+	}
+	return 0, 0
+}
+
+// grew records the sizes of the maps after an entry was added.
+func (e *memoryEngine) grew() {
+	e.peak.strings = max(e.peak.strings, len(e.strings))
+	e.peak.hashes = max(e.peak.hashes, len(e.hashes))
+	e.peak.packed = max(e.peak.packed, len(e.packed))
+	e.peak.expires = max(e.peak.expires, len(e.expires))
+}
+
+// dropString and dropHash remove the string or the hash at key, leaving its
+// TTL, and report whether there was one.
+func (e *memoryEngine) dropString(key string) bool {
+	value, ok := e.strings[key]
+	if ok {
+		delete(e.strings, key)
+		e.used.strings -= stringEntrySize(key, value)
+	}
+	return ok
+}
+
+func (e *memoryEngine) dropHash(key string) bool {
+	if lp, ok := e.packed[key]; ok {
+		delete(e.packed, key)
+		e.used.listpacks -= listpackEntrySize(key, lp)
+		return true
+	}
+	hash, ok := e.hashes[key]
+	if !ok {
+		return false
+	}
+	delete(e.hashes, key)
+	if len(hash) < lazyfreeThreshold {
+		e.used.hashtables -= hashEntrySize(key, hash)
+		return true
+	}
+	// The overhead of a big hash's entries goes now, and the bytes of
+	// its fields and values once freed in the background.
+	e.used.hashtables -= hashEntrySize(key, nil) + len(hash)*hashFieldSize("", "")
+	lazyFree(hash, &e.lazyFreed)
+	return true
+}
+
+// hasHash reports whether key holds a hash, in either encoding.
+func (e *memoryEngine) hasHash(key string) bool {
+	_, ok := e.HashEncoding(key)
+	return ok
+}
+
+// iterateHashKeys calls fn with the key of each hash until it returns
+// false, and reports whether it never did.
+func (e *memoryEngine) iterateHashKeys(fn func(key string) bool) bool {
+	for key := range e.hashes {
+		if !fn(key) {
+			return false
+		}
+	}
+	for key := range e.packed {
+		if !fn(key) {
+			return false
+		}
+	}
+	return true
+}
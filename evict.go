@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaxMemory bounds the estimated size of the dataset in bytes, as storage
+// engines report it: above it, keys are evicted by MaxMemoryPolicy before a
+// write runs. 0 disables the limit.
+var MaxMemory = 0
+
+// MaxMemoryPolicy chooses the keys evicted above MaxMemory, one of
+// evictionPolicies.
+var MaxMemoryPolicy = "noeviction"
+
+// MaxMemorySamples is how many keys of each database are sampled to pick
+// the one to evict. More samples pick better keys but take longer.
+var MaxMemorySamples = 5
+
+// evictionPolicies are the values of MaxMemoryPolicy. The allkeys policies
+// pick among every key and the volatile ones among the keys with a TTL: the
+// least recently used (lru), the least frequently used (lfu), any (random)
+// or the one closest to expiring (ttl). noeviction never evicts.
+var evictionPolicies = []string{
+	"noeviction",
+	"allkeys-lru", "allkeys-lfu", "allkeys-random",
+	"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+}
+
+// setMaxMemoryPolicy changes the eviction policy.
+func setMaxMemoryPolicy(value string) error {
+	value = strings.ToLower(value)
+	for _, policy := range evictionPolicies {
+		if value == policy {
+			MaxMemoryPolicy = value
+			return nil
+		}
+	}
+	return fmt.Errorf("argument must be one of: %s", strings.Join(evictionPolicies, ", "))
+}
+
+// oomError is the error commands adding data fail with above MaxMemory
+// when no key can be evicted.
+var oomError = Value{typ: "error", str: "OOM command not allowed when used memory > 'maxmemory'."}
+
+// usedMemory returns the estimated size of the dataset, which MaxMemory
+// bounds.
+func usedMemory() int {
+	used := 0
+	for _, db := range Databases {
+		db.mu.RLock()
+		used += db.store.Usage().total()
+		db.mu.RUnlock()
+	}
+	return used
+}
+
+// evictionCandidate is a sampled key, with how good a pick it is: the
+// highest score is evicted first.
+type evictionCandidate struct {
+	db    *Database
+	key   string
+	score int64
+}
+
+// evictKeys evicts keys by MaxMemoryPolicy until the dataset fits in
+// MaxMemory again, before a write of c runs, and reports whether it does.
+// Evictions are persisted and streamed to replicas as UNLINK, and reported
+// to webhooks as deletions. Replicas don't evict, but delete the keys their
+// primary evicted.
+func evictKeys(c *Client) bool {
+	configMu.RLock()
+	limit, policy, samples := MaxMemory, MaxMemoryPolicy, MaxMemorySamples
+	configMu.RUnlock()
+	if limit == 0 || atomic.LoadInt32(&replicating) == 1 {
+		return true
+	}
+	used := usedMemory()
+	if used <= limit {
+		return true
+	}
+	if policy == "noeviction" {
+		return false
+	}
+
+	// Evicting is a write, so it must not interleave with atomic blocks or
+	// shutdown.
+	executionMu.RLock()
+	defer executionMu.RUnlock()
+
+	start := time.Now()
+	defer func() { latencyAddSample("eviction-cycle", time.Since(start)) }()
+	for used > limit {
+		candidate, ok := sampleEvictionCandidate(policy, samples)
+		if !ok {
+			return false
+		}
+
+		db, key := candidate.db, candidate.key
+		writeMu.Lock()
+		db.mu.Lock()
+		if !db.exists(key) {
+			db.mu.Unlock()
+			writeMu.Unlock()
+			continue
+		}
+		before := db.store.Usage().total()
+		db.removeKey(key)
+		used -= before - db.store.Usage().total()
+		db.mu.Unlock()
+
+		atomic.AddInt64(&evictedKeys, 1)
+		recordChanges(1)
+		persistIn(c, db.id, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "UNLINK"},
+			{typ: "bulk", bulk: key},
+		}})
+		writeMu.Unlock()
+		invalidateKeys([]string{key}, nil)
+		touchWatchedKeys(db.id, []string{key})
+		notifyKeyEvent(db, "del", key)
+	}
+	return true
+}
+
+// sampleEvictionCandidate samples keys of every database and returns the
+// best one to evict by policy, if any key can be.
+func sampleEvictionCandidate(policy string, samples int) (evictionCandidate, bool) {
+	configMu.RLock()
+	decayTime := LFUDecayTime
+	configMu.RUnlock()
+	now := lruClock()
+	volatile := strings.HasPrefix(policy, "volatile-")
+	kind := policy[strings.IndexByte(policy, '-')+1:]
+
+	var best evictionCandidate
+	found := false
+	for _, db := range Databases {
+		db.mu.RLock()
+		db.accessMu.Lock()
+		consider := func(key string, when int64) {
+			var score int64
+			switch kind {
+			case "lru":
+				score = db.keyAccess(key).idle(now)
+			case "lfu":
+				score = math.MaxUint8 - int64(db.keyAccess(key).decayed(now, decayTime))
+			case "ttl":
+				score = math.MaxInt64 - when
+			default:
+				score = rand.Int63()
+			}
+			if !found || score > best.score {
+				best, found = evictionCandidate{db: db, key: key, score: score}, true
+			}
+		}
+
+		// Go randomizes where iterating a map starts, so the first keys
+		// are a sample.
+		sampled := 0
+		if volatile {
+			db.store.IterateExpires(func(key string, when int64) bool {
+				consider(key, when)
+				sampled++
+				return sampled < samples
+			})
+		} else {
+			db.store.IterateKeys(func(key string) bool {
+				consider(key, 0)
+				sampled++
+				return sampled < samples
+			})
+		}
+		db.accessMu.Unlock()
+		db.mu.RUnlock()
+	}
+	return best, found
+}
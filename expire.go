@@ -0,0 +1,347 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeExpire enables the background cycle that reclaims expired keys
+// nobody accesses. Keys are still expired lazily when it is off.
+var activeExpire = true
+var activeExpireMu = sync.RWMutex{}
+
+const (
+	// activeExpireInterval is how often the active expiry cycle runs.
+	activeExpireInterval = 100 * time.Millisecond
+	// activeExpireSample is how many keys with a TTL are checked per round.
+	activeExpireSample = 20
+	// activeExpireBudget bounds the time one cycle spends on a database.
+	activeExpireBudget = 25 * time.Millisecond
+)
+
+// nowMillis returns the current Unix time in milliseconds.
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// exists reports whether the key holds a value of any type. db.mu must be held.
+func (db *Database) exists(key string) bool {
+	_, isString := db.store.Get(key)
+	_, isHash := db.store.HashEncoding(key)
+	return isString || isHash
+}
+
+// removeKey deletes the key and its TTL. db.mu must be held for writing.
+func (db *Database) removeKey(key string) {
+	db.store.Remove(key)
+	db.forgetAccess(key)
+}
+
+// isExpired reports whether the key has a TTL that has passed. db.mu must be held.
+func (db *Database) isExpired(key string, now int64) bool {
+	when, ok := db.store.ExpireTime(key)
+	return ok && when <= now
+}
+
+// expiredOnReplica reports whether the key must look missing to c, though
+// it is still stored. Replicas don't expire keys but wait for the primary to
+// delete them, so that both hold the same keys, meanwhile hiding expired
+// keys from all but the primary. db.mu must be held.
+func (db *Database) expiredOnReplica(c *Client, key string) bool {
+	return atomic.LoadInt32(&replicating) == 1 && !c.master && db.isExpired(key, nowMillis())
+}
+
+// expireKeys deletes those of the keys whose TTL has passed, so the command
+// about to run sees them as missing, and notifies tracking clients. The
+// deletions are streamed to replicas. On a replica, it does nothing.
+func expireKeys(db *Database, keys []string) {
+	if len(keys) == 0 || atomic.LoadInt32(&replicating) == 1 {
+		return
+	}
+
+	now := nowMillis()
+	expired := []string{}
+
+	db.mu.RLock()
+	for _, key := range keys {
+		if db.isExpired(key, now) {
+			expired = append(expired, key)
+		}
+	}
+	db.mu.RUnlock()
+	if len(expired) == 0 {
+		return
+	}
+
+	removed := []string{}
+	writeMu.Lock()
+	db.mu.Lock()
+	for _, key := range expired {
+		// Re-check: the key may have been rewritten since the read lock was released.
+		if db.isExpired(key, now) {
+			db.removeKey(key)
+			removed = append(removed, key)
+			atomic.AddInt64(&expiredKeys, 1)
+		}
+	}
+	db.mu.Unlock()
+	replicateExpired(db.id, removed)
+	writeMu.Unlock()
+
+	invalidateKeys(expired, nil)
+	touchWatchedKeys(db.id, removed)
+	notifyKeyEvent(db, "expire", removed...)
+}
+
+// runActiveExpire periodically samples keys with a TTL in every database and
+// deletes the expired ones. A database keeps being sampled while more than a
+// quarter of its sample turns out expired, up to activeExpireBudget per cycle.
+// Replicas leave expiring keys to their primary.
+func runActiveExpire() {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		activeExpireMu.RLock()
+		enabled := activeExpire
+		activeExpireMu.RUnlock()
+		if !enabled || atomic.LoadInt32(&replicating) == 1 {
+			continue
+		}
+
+		start := time.Now()
+		for _, db := range Databases {
+			deadline := time.Now().Add(activeExpireBudget)
+			for time.Now().Before(deadline) {
+				expired, sampled := activeExpireRound(db)
+				if len(expired) > 0 {
+					invalidateKeys(expired, nil)
+					touchWatchedKeys(db.id, expired)
+					notifyKeyEvent(db, "expire", expired...)
+				}
+				if sampled == 0 || len(expired)*4 <= sampled {
+					break
+				}
+			}
+		}
+		latencyAddSample("expire-cycle", time.Since(start))
+	}
+}
+
+// activeExpireRound checks up to activeExpireSample keys with a TTL,
+// deleting the expired ones. It returns the deleted keys and the sample size.
+func activeExpireRound(db *Database) ([]string, int) {
+	// Expiring keys is a write, so it must not interleave with atomic blocks or shutdown.
+	executionMu.RLock()
+	defer executionMu.RUnlock()
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := nowMillis()
+	expired := []string{}
+	sampled := 0
+	db.store.IterateExpires(func(key string, when int64) bool {
+		if sampled == activeExpireSample {
+			return false
+		}
+		sampled++
+		if when <= now {
+			db.removeKey(key)
+			expired = append(expired, key)
+		}
+		return true
+	})
+	atomic.AddInt64(&expiredKeys, int64(len(expired)))
+	recordChanges(len(expired))
+	replicateExpired(db.id, expired)
+
+	return expired, sampled
+}
+
+// persistentExpire rewrites relative expiry commands as PEXPIREAT with an
+// absolute time, and RESTORE with ABSTTL, so replaying the AOF later doesn't
+// extend the key's life.
+func persistentExpire(value Value) Value {
+	command := strings.ToUpper(value.array[0].bulk)
+	if command == "RESTORE" || command == "RESTORE-ASKING" {
+		return absoluteRestore(value)
+	}
+	if len(value.array) != 3 {
+		return value
+	}
+
+	n, err := strconv.ParseInt(value.array[2].bulk, 10, 64)
+	if err != nil {
+		return value
+	}
+
+	var when int64
+	switch command {
+	case "EXPIRE":
+		when = nowMillis() + n*1000
+	case "PEXPIRE":
+		when = nowMillis() + n
+	case "EXPIREAT":
+		when = n * 1000
+	default:
+		return value
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "PEXPIREAT"},
+		value.array[1],
+		{typ: "bulk", bulk: strconv.FormatInt(when, 10)},
+	}}
+}
+
+// absoluteRestore rewrites a RESTORE with a relative TTL to take ABSTTL.
+func absoluteRestore(value Value) Value {
+	if len(value.array) < 4 {
+		return value
+	}
+	ttl, err := strconv.ParseInt(value.array[2].bulk, 10, 64)
+	if err != nil || ttl <= 0 {
+		return value
+	}
+	for _, arg := range value.array[4:] {
+		if strings.EqualFold(arg.bulk, "ABSTTL") {
+			return value
+		}
+	}
+
+	args := append([]Value{}, value.array...)
+	args[2] = Value{typ: "bulk", bulk: strconv.FormatInt(nowMillis()+ttl, 10)}
+	args = append(args, Value{typ: "bulk", bulk: "ABSTTL"})
+	return Value{typ: "array", array: args}
+}
+
+// setExpire sets the key's TTL to the absolute Unix time when, in
+// milliseconds. A time in the past deletes the key right away, except while
+// replaying persisted commands: later entries may still have modified the
+// key before it expired, so it is left for the expiry cycle instead.
+func setExpire(c *Client, command string, args []Value, toMillis func(n int64) int64) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + command + "' command"}
+	}
+
+	db := c.database()
+
+	key := args[0].bulk
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	when := toMillis(n)
+
+	db.mu.Lock()
+	if !db.exists(key) {
+		db.mu.Unlock()
+		return Value{typ: "integer", num: 0}
+	}
+
+	deleted := when <= nowMillis() && c.conn != nil
+	if deleted {
+		db.removeKey(key)
+	} else {
+		db.store.Expire(key, when)
+	}
+	db.mu.Unlock()
+
+	if deleted {
+		notifyKeyEvent(db, "del", key)
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// handleExpire handles "EXPIRE key seconds".
+func handleExpire(c *Client, args []Value) Value {
+	return setExpire(c, "expire", args, func(n int64) int64 { return nowMillis() + n*1000 })
+}
+
+// handlePExpire handles "PEXPIRE key milliseconds".
+func handlePExpire(c *Client, args []Value) Value {
+	return setExpire(c, "pexpire", args, func(n int64) int64 { return nowMillis() + n })
+}
+
+// handleExpireAt handles "EXPIREAT key unix-time-seconds".
+func handleExpireAt(c *Client, args []Value) Value {
+	return setExpire(c, "expireat", args, func(n int64) int64 { return n * 1000 })
+}
+
+// handlePExpireAt handles "PEXPIREAT key unix-time-milliseconds".
+func handlePExpireAt(c *Client, args []Value) Value {
+	return setExpire(c, "pexpireat", args, func(n int64) int64 { return n })
+}
+
+// remainingTTL returns the key's remaining time to live in milliseconds, -1
+// if it has no TTL or -2 if it doesn't exist.
+func remainingTTL(c *Client, key string) int64 {
+	db := c.database()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if !db.exists(key) || db.expiredOnReplica(c, key) {
+		return -2
+	}
+	when, ok := db.store.ExpireTime(key)
+	if !ok {
+		return -1
+	}
+	if ttl := when - nowMillis(); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// handleTTL handles "TTL key", returning the remaining time to live in seconds.
+func handleTTL(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ttl' command"}
+	}
+
+	ttl := remainingTTL(c, args[0].bulk)
+	if ttl < 0 {
+		return Value{typ: "integer", num: int(ttl)}
+	}
+
+	// Round to the nearest second like Redis does.
+	return Value{typ: "integer", num: int((ttl + 500) / 1000)}
+}
+
+// handlePTTL handles "PTTL key", returning the remaining time to live in milliseconds.
+func handlePTTL(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pttl' command"}
+	}
+
+	return Value{typ: "integer", num: int(remainingTTL(c, args[0].bulk))}
+}
+
+// handlePersist handles "PERSIST key", removing the key's TTL.
+func handlePersist(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'persist' command"}
+	}
+
+	db := c.database()
+
+	key := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.store.ExpireTime(key); !ok || !db.exists(key) {
+		return Value{typ: "integer", num: 0}
+	}
+	db.store.Persist(key)
+
+	return Value{typ: "integer", num: 1}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FAILOVER starts replicating the replica it promotes, so its handler is
+// registered at init to avoid an initialization cycle, like the other
+// replication handlers.
+func init() {
+	Handlers["FAILOVER"] = handleFailover
+}
+
+// failoverPollInterval is how often a failover checks whether the replica
+// caught up.
+const failoverPollInterval = 10 * time.Millisecond
+
+// failover is the state of the failover in progress, guarded by mu. state
+// is "waiting-for-sync" while writes are paused until the target caught up,
+// and "failover-in-progress" while it is promoted; empty without a
+// failover. abort is closed by FAILOVER ABORT.
+var failover = struct {
+	mu    sync.Mutex
+	state string
+	abort chan struct{}
+}{}
+
+// failoverTarget is the replica to promote: the one at host and port, or
+// the first to catch up when host is empty.
+type failoverTarget struct {
+	host, port string
+	// force promotes the target once the timeout passed even if it didn't
+	// catch up.
+	force   bool
+	timeout time.Duration
+}
+
+// handleFailover handles "FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT
+// milliseconds]". It pauses writes, waits for a replica to acknowledge every
+// write streamed to it, promotes that replica with REPLICAOF NO ONE and
+// turns the server into its replica. Paused writes then fail with READONLY,
+// to be sent to the new primary. The failover gives up, resuming writes,
+// once the timeout passed, or promotes the target anyway with FORCE.
+func handleFailover(c *Client, args []Value) Value {
+	target := failoverTarget{}
+	abort := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "TO":
+			if i+2 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			target.host, target.port = args[i+1].bulk, args[i+2].bulk
+			if !validPort(target.port) {
+				return Value{typ: "error", str: "ERR Invalid port"}
+			}
+			i += 2
+			if i+1 < len(args) && strings.EqualFold(args[i+1].bulk, "FORCE") {
+				target.force = true
+				i++
+			}
+		case "ABORT":
+			abort = true
+		case "TIMEOUT":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			ms, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil || ms <= 0 {
+				return Value{typ: "error", str: "ERR FAILOVER timeout must be greater than 0"}
+			}
+			target.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	if abort {
+		if len(args) > 1 {
+			return Value{typ: "error", str: "ERR FAILOVER ABORT takes no other arguments"}
+		}
+		return abortFailover()
+	}
+	if target.force && target.timeout == 0 {
+		return Value{typ: "error", str: "ERR FAILOVER with force option requires both a timeout and target HOST and PORT"}
+	}
+
+	replication.mu.Lock()
+	isReplica := replication.link != nil
+	online, found := 0, target.host == ""
+	for _, r := range replication.replicas {
+		if r.state == "online" {
+			online++
+			found = found || (r.addr == target.host && r.port == target.port)
+		}
+	}
+	replication.mu.Unlock()
+
+	switch {
+	case isReplica:
+		return Value{typ: "error", str: "ERR FAILOVER is not valid when server is a replica"}
+	case online == 0:
+		return Value{typ: "error", str: "ERR FAILOVER requires connected replicas"}
+	case !found:
+		return Value{typ: "error", str: "ERR FAILOVER target HOST and PORT is not a replica"}
+	}
+
+	failover.mu.Lock()
+	defer failover.mu.Unlock()
+
+	if failover.state != "" {
+		return Value{typ: "error", str: "ERR FAILOVER already in progress"}
+	}
+	failover.state = "waiting-for-sync"
+	failover.abort = make(chan struct{})
+
+	pauseWrites()
+	go runFailover(target, failover.abort)
+	return Value{typ: "string", str: "OK"}
+}
+
+// abortFailover handles "FAILOVER ABORT", which resumes writes unless the
+// target is being promoted already.
+func abortFailover() Value {
+	failover.mu.Lock()
+	defer failover.mu.Unlock()
+
+	switch failover.state {
+	case "":
+		return Value{typ: "error", str: "ERR No failover in progress"}
+	case "waiting-for-sync":
+		close(failover.abort)
+		failover.abort = nil
+		return Value{typ: "string", str: "OK"}
+	default:
+		return Value{typ: "error", str: "ERR Failover is past the point of being aborted"}
+	}
+}
+
+// runFailover waits for the target to catch up and promotes it, unless the
+// failover is aborted or times out first. Writes are resumed either way.
+func runFailover(target failoverTarget, abort chan struct{}) {
+	defer resumeWrites()
+	defer func() {
+		failover.mu.Lock()
+		failover.state = ""
+		failover.abort = nil
+		failover.mu.Unlock()
+	}()
+
+	// Have the replicas acknowledge right away rather than within a second.
+	replication.mu.Lock()
+	getack, _ := Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "REPLCONF"},
+		{typ: "bulk", bulk: "GETACK"},
+		{typ: "bulk", bulk: "*"},
+	}}.Marshal()
+	feedReplicas(getack)
+	replication.mu.Unlock()
+
+	var deadline <-chan time.Time
+	if target.timeout > 0 {
+		deadline = time.After(target.timeout)
+	}
+	ticker := time.NewTicker(failoverPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-abort:
+			fmt.Println("FAILOVER aborted")
+			return
+		case <-deadline:
+			if !target.force {
+				fmt.Println("FAILOVER timed out waiting for the replica to catch up")
+				return
+			}
+			executionMu.Lock()
+			if err := promoteTarget(target.host, target.port); err != nil {
+				fmt.Println("FAILOVER failed:", err)
+			}
+			executionMu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		// Writes that were running when writes were paused may still add
+		// to the stream, so the check is made with no command running.
+		executionMu.Lock()
+		host, port, caughtUp := caughtUpReplica(target)
+		if caughtUp {
+			if err := promoteTarget(host, port); err != nil {
+				fmt.Println("FAILOVER failed:", err)
+			}
+		}
+		executionMu.Unlock()
+		if caughtUp {
+			return
+		}
+	}
+}
+
+// caughtUpReplica returns the host and port of the target once it
+// acknowledged the whole stream, or of any replica doing so without a
+// target.
+func caughtUpReplica(target failoverTarget) (string, string, bool) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	for _, r := range replication.replicas {
+		if r.state != "online" || r.ackOffset < replication.offset {
+			continue
+		}
+		if target.host == "" || (r.addr == target.host && r.port == target.port) {
+			return r.addr, r.port, true
+		}
+	}
+	return "", "", false
+}
+
+// promoteTarget promotes the replica at host and port with REPLICAOF NO ONE
+// and makes the server its replica.
+func promoteTarget(host, port string) error {
+	failover.mu.Lock()
+	if failover.abort == nil {
+		failover.mu.Unlock()
+		return fmt.Errorf("aborted")
+	}
+	failover.state = "failover-in-progress"
+	failover.mu.Unlock()
+
+	if err := promoteReplica(host, port); err != nil {
+		return err
+	}
+	replicateFrom(host, port)
+	configMu.Lock()
+	ReplicaOf = host + " " + port
+	configMu.Unlock()
+	fmt.Printf("FAILOVER promoted %s, the server is its replica now\n", net.JoinHostPort(host, port))
+	return nil
+}
+
+// promoteReplica connects to the replica at host and port, authenticating
+// like to a primary, and sends it REPLICAOF NO ONE.
+func promoteReplica(host, port string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), replicationTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+
+	reader := NewRESP(conn)
+	for _, command := range append(authCommands(), []string{"REPLICAOF", "NO", "ONE"}) {
+		reply, err := roundTrip(conn, reader, command)
+		if err != nil {
+			return err
+		}
+		if reply.typ == "error" {
+			return fmt.Errorf("%s failed: %s", command[0], reply.str)
+		}
+	}
+	return nil
+}
+
+// infoFailover reports the state of the failover, for the replication
+// section of INFO.
+func infoFailover() string {
+	failover.mu.Lock()
+	defer failover.mu.Unlock()
+
+	if failover.state == "" {
+		return "master_failover_state:no-failover"
+	}
+	return "master_failover_state:" + failover.state
+}
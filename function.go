@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// functionLoadTimeout bounds running a library's code on FUNCTION LOAD,
+// which only registers functions and has no business running long.
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionLibrary is a library loaded with FUNCTION LOAD. close releases its
+// functions once it is deleted or replaced.
+type functionLibrary struct {
+	name      string
+	engine    string
+	code      string
+	functions map[string]script
+	close     func()
+}
+
+// Function libraries by name, and the library of each function by name,
+// guarded by functionsMu.
+var (
+	libraries   = map[string]*functionLibrary{}
+	functions   = map[string]*functionLibrary{}
+	functionsMu = sync.RWMutex{}
+)
+
+var (
+	libraryHeader = regexp.MustCompile(`^#!(\w+) name=(\w+)$`)
+	functionName  = regexp.MustCompile(`^\w+$`)
+)
+
+// loadLibrary runs a library's code, which starts with a
+// "#!<engine> name=<name>" line and registers the library's functions.
+func loadLibrary(code string) (*functionLibrary, *Value) {
+	header, body, _ := strings.Cut(code, "\n")
+	match := libraryHeader.FindStringSubmatch(strings.TrimSpace(header))
+	if match == nil {
+		return nil, &Value{typ: "error", str: "ERR Missing library metadata"}
+	}
+	engine, ok := scriptEngines[match[1]]
+	if !ok {
+		return nil, &Value{typ: "error", str: "ERR Engine '" + match[1] + "' not found"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+
+	// The header isn't part of the code; an empty line keeps the line
+	// numbers of errors.
+	fns, closeFns, errValue := engine.load(ctx, "\n"+body)
+	if ctx.Err() != nil {
+		if closeFns != nil {
+			closeFns()
+		}
+		return nil, &Value{typ: "error", str: "ERR FUNCTION LOAD timeout"}
+	}
+	if errValue != nil {
+		return nil, errValue
+	}
+	if len(fns) == 0 {
+		closeFns()
+		return nil, &Value{typ: "error", str: "ERR No functions registered"}
+	}
+
+	return &functionLibrary{name: match[2], engine: match[1], code: code, functions: fns, close: closeFns}, nil
+}
+
+// registerFunction adds a function registered by a library being loaded to
+// its functions, checking its name.
+func registerFunction(fns map[string]script, name string, fn script) error {
+	if !functionName.MatchString(name) {
+		return fmt.Errorf("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, ok := fns[name]; ok {
+		return fmt.Errorf("Function already exists in the library")
+	}
+	fns[name] = fn
+	return nil
+}
+
+// removeLibrary unregisters a library and its functions. functionsMu must
+// be held for writing.
+func removeLibrary(lib *functionLibrary) {
+	for name := range lib.functions {
+		delete(functions, name)
+	}
+	delete(libraries, lib.name)
+	lib.close()
+}
+
+// persistFunctions appends a FUNCTION command that changed the libraries to
+// the AOF, so they are loaded again on restart, and streams it to replicas.
+// Commands replayed from the AOF itself aren't appended again.
+func persistFunctions(c *Client, args []Value) *Value {
+	if c.conn == nil {
+		return nil
+	}
+
+	value := Value{typ: "array", array: append([]Value{{typ: "bulk", bulk: "FUNCTION"}}, args...)}
+	openPersistBlock(c, c.db)
+	replicate(c.db, value)
+	if aof == nil {
+		return nil
+	}
+	if err := aof.Write(c.db, value); err != nil {
+		return &Value{typ: "error", str: "ERR internal server error"}
+	}
+	c.aofPending = true
+	return nil
+}
+
+// handleFunction handles the "FUNCTION" command and its subcommands.
+func handleFunction(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'function' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LOAD":
+		return handleFunctionLoad(c, args)
+	case "DELETE":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'function|delete' command"}
+		}
+		functionsMu.Lock()
+		defer functionsMu.Unlock()
+		lib, ok := libraries[args[1].bulk]
+		if !ok {
+			return Value{typ: "error", str: "ERR Library not found"}
+		}
+		if errValue := persistFunctions(c, args); errValue != nil {
+			return *errValue
+		}
+		removeLibrary(lib)
+		return Value{typ: "string", str: "OK"}
+	case "FLUSH":
+		if errValue := flushMode("function|flush", args[1:]); errValue != nil {
+			return *errValue
+		}
+		functionsMu.Lock()
+		defer functionsMu.Unlock()
+		if errValue := persistFunctions(c, args); errValue != nil {
+			return *errValue
+		}
+		for _, lib := range libraries {
+			removeLibrary(lib)
+		}
+		return Value{typ: "string", str: "OK"}
+	case "LIST":
+		return handleFunctionList(c, args[1:])
+	case "HELP":
+		lines := []string{
+			"FUNCTION <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"LOAD [REPLACE] <FUNCTION CODE>",
+			"    Create a new library with the given library name and code.",
+			"DELETE <LIBRARY NAME>",
+			"    Delete the given library.",
+			"LIST [LIBRARYNAME PATTERN] [WITHCODE]",
+			"    Return general information on all the libraries:",
+			"    * Library name",
+			"    * The engine used to run the Library",
+			"    * List of functions",
+			"    * Library code (if WITHCODE is given)",
+			"    It also possible to get only function that matches a pattern using LIBRARYNAME argument.",
+			"FLUSH [ASYNC|SYNC]",
+			"    Delete all the libraries.",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try FUNCTION HELP."}
+	}
+}
+
+// handleFunctionLoad handles "FUNCTION LOAD [REPLACE] code", returning the
+// name of the loaded library. REPLACE allows replacing a library of the same
+// name; functions must still be unique across libraries.
+func handleFunctionLoad(c *Client, args []Value) Value {
+	replace := len(args) == 3 && strings.ToUpper(args[1].bulk) == "REPLACE"
+	if len(args) != 2 && !replace {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'function|load' command"}
+	}
+
+	lib, errValue := loadLibrary(args[len(args)-1].bulk)
+	if errValue != nil {
+		return *errValue
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	old, exists := libraries[lib.name]
+	if exists && !replace {
+		lib.close()
+		return Value{typ: "error", str: "ERR Library '" + lib.name + "' already exists"}
+	}
+	for name := range lib.functions {
+		if owner, ok := functions[name]; ok && owner != old {
+			lib.close()
+			return Value{typ: "error", str: "ERR Function " + name + " already exists"}
+		}
+	}
+
+	if errValue := persistFunctions(c, args); errValue != nil {
+		lib.close()
+		return *errValue
+	}
+
+	if exists {
+		removeLibrary(old)
+	}
+	libraries[lib.name] = lib
+	for name := range lib.functions {
+		functions[name] = lib
+	}
+
+	return Value{typ: "bulk", bulk: lib.name}
+}
+
+// handleFunctionList handles "FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]".
+func handleFunctionList(c *Client, args []Value) Value {
+	pattern, withCode := "*", false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 == len(args) {
+				return Value{typ: "error", str: "ERR library name argument was not given"}
+			}
+			pattern = args[i+1].bulk
+			i++
+		default:
+			return Value{typ: "error", str: "ERR Unknown argument " + args[i].bulk}
+		}
+	}
+
+	functionsMu.RLock()
+	defer functionsMu.RUnlock()
+
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		if matchGlob(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	values := make([]Value, 0, len(names))
+	for _, name := range names {
+		lib := libraries[name]
+
+		fnNames := make([]string, 0, len(lib.functions))
+		for fnName := range lib.functions {
+			fnNames = append(fnNames, fnName)
+		}
+		sort.Strings(fnNames)
+		fns := make([]Value, 0, len(fnNames))
+		for _, fnName := range fnNames {
+			fns = append(fns, Value{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: fnName},
+				{typ: "bulk", bulk: "description"}, {typ: "null"},
+				{typ: "bulk", bulk: "flags"}, {typ: "array", array: []Value{}},
+			}})
+		}
+
+		entry := Value{typ: "map", array: []Value{
+			{typ: "bulk", bulk: "library_name"}, {typ: "bulk", bulk: lib.name},
+			{typ: "bulk", bulk: "engine"}, {typ: "bulk", bulk: strings.ToUpper(lib.engine)},
+			{typ: "bulk", bulk: "functions"}, {typ: "array", array: fns},
+		}}
+		if withCode {
+			entry.array = append(entry.array, Value{typ: "bulk", bulk: "library_code"}, Value{typ: "bulk", bulk: lib.code})
+		}
+		values = append(values, entry)
+	}
+
+	reply := Value{typ: "array", array: values}
+	if c.proto != 3 {
+		reply = resp2Compatible(reply)
+	}
+	return reply
+}
+
+// handleFCall handles "FCALL function numkeys [key ...] [arg ...]", calling
+// the function with the keys and arguments. executionMu must be held for
+// writing.
+func handleFCall(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'fcall' command"}
+	}
+
+	functionsMu.RLock()
+	lib, ok := functions[args[0].bulk]
+	functionsMu.RUnlock()
+	if !ok {
+		return Value{typ: "error", str: "ERR Function not found"}
+	}
+
+	return runScript(c, lib.functions[args[0].bulk], args[1:])
+}
@@ -0,0 +1,17 @@
+module github.com/AkshatJawne/StormyDB
+
+go 1.27.1
+
+require (
+	github.com/go-sql-driver/mysql v1.10.1
+	github.com/klauspost/compress v1.20.1
+	github.com/lib/pq v1.12.3
+	github.com/pierrec/lz4/v4 v4.1.30
+	github.com/yuin/gopher-lua v1.1.2
+	go.starlark.net v0.0.0-20260908191801-89a6a09411d5
+)
+
+require (
+	filippo.io/edwards25519 v1.2.0 // indirect
+	golang.org/x/sys v0.42.0 // indirect
+)
@@ -2,24 +2,95 @@ package main
 
 import (
 	"strconv"
-	"sync"
 )
 
 // Handlers is a map of commands to their corresponding handler functions.
-var Handlers = map[string]func([]Value) Value{
-	"PING":    handlePing,
-	"SET":     handleSet,
-	"GET":     handleGet,
-	"DEL":     handleDel,
-	"EXISTS":  handleExists,
-	"INCR":    handleIncr,
-	"HSET":    handleHSet,
-	"HGET":    handleHGet,
-	"HGETALL": handleHGetAll,
+var Handlers = map[string]func(*Client, []Value) Value{
+	"PING":           handlePing,
+	"SET":            handleSet,
+	"GET":            handleGet,
+	"CAS":            handleCAS,
+	"DEL":            handleDel,
+	"UNLINK":         handleUnlink,
+	"EXISTS":         handleExists,
+	"INCR":           handleIncr,
+	"HSET":           handleHSet,
+	"HGET":           handleHGet,
+	"HGETALL":        handleHGetAll,
+	"SWAPDB":         handleSwapDB,
+	"MOVE":           handleMove,
+	"FLUSHDB":        handleFlushDB,
+	"FLUSHALL":       handleFlushAll,
+	"DBSIZE":         handleDBSize,
+	"COMMAND":        handleCommand,
+	"HELLO":          handleHello,
+	"CLIENT":         handleClientCommand,
+	"SELECT":         handleSelect,
+	"AUTH":           handleAuth,
+	"ACL":            handleACL,
+	"RESET":          handleReset,
+	"CONFIG":         handleConfig,
+	"EXPIRE":         handleExpire,
+	"PEXPIRE":        handlePExpire,
+	"EXPIREAT":       handleExpireAt,
+	"PEXPIREAT":      handlePExpireAt,
+	"TTL":            handleTTL,
+	"PTTL":           handlePTTL,
+	"PERSIST":        handlePersist,
+	"SCAN":           handleScan,
+	"DUMP":           handleDump,
+	"RESTORE":        handleRestore,
+	"RESTORE-ASKING": handleRestore,
+	"MIGRATE":        handleMigrate,
+	"BGREWRITEAOF":   handleBgRewriteAOF,
+	"SAVE":           handleSave,
+	"BGSAVE":         handleBgSave,
+	"LASTSAVE":       handleLastSave,
+	"BACKUP":         handleBackup,
+	"DEBUG":          handleDebug,
+	"SLOWLOG":        handleSlowlog,
+	"LATENCY":        handleLatency,
+	"INFO":           handleInfo,
+	"MEMORY":         handleMemory,
+	"OBJECT":         handleObject,
+	"HOTKEYS":        handleHotKeys,
+	"BIGKEYS":        handleBigKeys,
+	"SUBSCRIBE":      handleSubscribe,
+	"UNSUBSCRIBE":    handleUnsubscribe,
+	"PUBLISH":        handlePublish,
+	"PSUBSCRIBE":     handlePSubscribe,
+	"PUNSUBSCRIBE":   handlePUnsubscribe,
+	"PUBSUB":         handlePubsub,
+	"SSUBSCRIBE":     handleSSubscribe,
+	"SUNSUBSCRIBE":   handleSUnsubscribe,
+	"SPUBLISH":       handleSPublish,
+	"XREAD":          handleXRead,
+	"XRANGE":         handleXRange,
+	"XLEN":           handleXLen,
+	"MULTI":          handleMulti,
+	"EXEC":           handleExec,
+	"DISCARD":        handleDiscard,
+	"WATCH":          handleWatch,
+	"UNWATCH":        handleUnwatch,
+	"SCRIPT":         handleScript,
+	"CRDT":           handleCRDT,
 }
 
 // handlePing handles the "PING" command and optionally echoes the input.
-func handlePing(args []Value) Value {
+func handlePing(c *Client, args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ping' command"}
+	}
+
+	// Subscribed RESP2 connections carry messages, so PING answers in their framing.
+	if c.proto == 2 && c.subscriptionCount() > 0 {
+		message := ""
+		if len(args) == 1 {
+			message = args[0].bulk
+		}
+		return Value{typ: "array", array: []Value{{typ: "bulk", bulk: "pong"}, {typ: "bulk", bulk: message}}}
+	}
+
 	if len(args) == 0 {
 		return Value{typ: "string", str: "PONG"}
 	}
@@ -27,39 +98,85 @@ func handlePing(args []Value) Value {
 	return Value{typ: "string", str: args[0].bulk}
 }
 
-// Global storage for SET command.
-var SETs = map[string]string{}
-var SETsMu = sync.RWMutex{}
-
 // handleSet handles the "SET" command for storing key-value pairs.
-func handleSet(args []Value) Value {
+func handleSet(c *Client, args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'set' command"}
 	}
 
+	db := c.database()
+
 	key := args[0].bulk
 	value := args[1].bulk
 
-	SETsMu.Lock()
-	SETs[key] = value
-	SETsMu.Unlock()
+	db.mu.Lock()
+	db.store.Set(key, value)
+	db.store.Persist(key)
+	db.mu.Unlock()
+
+	notifyKeyEvent(db, "set", key)
 
 	return Value{typ: "string", str: "OK"}
 }
 
+// handleCAS handles "CAS key expected value", setting the key to value only
+// if it currently holds expected. It replies with whether the value was set
+// and the key's value afterwards, the winner of a race, or null if the key
+// doesn't exist.
+func handleCAS(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'cas' command"}
+	}
+
+	db := c.database()
+
+	key := args[0].bulk
+	expected := args[1].bulk
+	value := args[2].bulk
+
+	db.mu.Lock()
+	current, ok := db.store.Get(key)
+	swapped := ok && current == expected
+	if swapped {
+		db.store.Set(key, value)
+		db.store.Persist(key)
+		current = value
+	}
+	db.mu.Unlock()
+
+	winner := Value{typ: "null"}
+	if ok {
+		winner = Value{typ: "bulk", bulk: current}
+	}
+	if !swapped {
+		return Value{typ: "array", array: []Value{{typ: "integer", num: 0}, winner}}
+	}
+
+	notifyKeyEvent(db, "set", key)
+
+	return Value{typ: "array", array: []Value{{typ: "integer", num: 1}, winner}}
+}
+
 // handleGet handles the "GET" command to retrieve values by key.
-func handleGet(args []Value) Value {
+func handleGet(c *Client, args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'get' command"}
 	}
 
+	db := c.database()
+
 	key := args[0].bulk
 
-	SETsMu.RLock()
-	value, ok := SETs[key]
-	SETsMu.RUnlock()
+	db.mu.RLock()
+	value, ok := db.store.Get(key)
+	ok = ok && !db.expiredOnReplica(c, key)
+	db.mu.RUnlock()
 
+	recordLookup(ok)
 	if !ok {
+		if reply, loaded := readThrough(c, db, key); loaded {
+			return reply
+		}
 		return Value{typ: "null"}
 	}
 
@@ -67,109 +184,144 @@ func handleGet(args []Value) Value {
 }
 
 // handleDel handles the "DEL" command to delete one or more keys.
-func handleDel(args []Value) Value {
+func handleDel(c *Client, args []Value) Value {
 	if len(args) == 0 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'del' command"}
 	}
 
-	deletedCount := 0
-	SETsMu.Lock()
+	db := c.database()
+
+	deleted := []string{}
+	db.mu.Lock()
+	for _, arg := range args {
+		key := arg.bulk
+		if db.store.Delete(key) {
+			db.forgetAccess(key)
+			deleted = append(deleted, key)
+		}
+	}
+	db.mu.Unlock()
+
+	notifyKeyEvent(db, "del", deleted...)
+
+	return Value{typ: "integer", num: len(deleted)}
+}
+
+// handleUnlink handles the "UNLINK" command, which deletes one or more keys
+// with every value they hold, strings and hashes alike.
+func handleUnlink(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'unlink' command"}
+	}
+
+	db := c.database()
+
+	deleted := []string{}
+	db.mu.Lock()
 	for _, arg := range args {
 		key := arg.bulk
-		if _, exists := SETs[key]; exists {
-			delete(SETs, key)
-			deletedCount++
+		if db.exists(key) {
+			db.removeKey(key)
+			deleted = append(deleted, key)
 		}
 	}
-	SETsMu.Unlock()
+	db.mu.Unlock()
+
+	notifyKeyEvent(db, "del", deleted...)
 
-	return Value{typ: "integer", num: deletedCount}
+	return Value{typ: "integer", num: len(deleted)}
 }
 
 // handleExists handles the "EXISTS" command to check if one or more keys exist.
-func handleExists(args []Value) Value {
+func handleExists(c *Client, args []Value) Value {
 	if len(args) == 0 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'exists' command"}
 	}
 
+	db := c.database()
+
 	existsCount := 0
-	SETsMu.RLock()
+	db.mu.RLock()
 	for _, arg := range args {
 		key := arg.bulk
-		if _, exists := SETs[key]; exists {
+		if _, exists := db.store.Get(key); exists && !db.expiredOnReplica(c, key) {
 			existsCount++
 		}
 	}
-	SETsMu.RUnlock()
+	db.mu.RUnlock()
 
 	return Value{typ: "integer", num: existsCount}
 }
 
 // handleIncr handles the "INCR" command to increment the integer value of a key by 1.
-func handleIncr(args []Value) Value {
+func handleIncr(c *Client, args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'incr' command"}
 	}
 
-	key := args[0].bulk
+	db := c.database()
 
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
+	key := args[0].bulk
 
-	value, ok := SETs[key]
+	db.mu.Lock()
+	value, ok := db.store.Get(key)
 	if !ok {
-		SETs[key] = "1"
-		return Value{typ: "integer", num: 1}
+		value = "0"
 	}
 
 	intValue, err := strconv.Atoi(value)
 	if err != nil {
+		db.mu.Unlock()
 		return Value{typ: "error", str: "ERR value is not an integer"}
 	}
 
 	intValue++
-	SETs[key] = strconv.Itoa(intValue)
+	db.store.Set(key, strconv.Itoa(intValue))
+	db.mu.Unlock()
+
+	notifyKeyEvent(db, "set", key)
 
 	return Value{typ: "integer", num: intValue}
 }
 
-// Global storage for HSET command.
-var HSETs = map[string]map[string]string{}
-var HSETsMu = sync.RWMutex{}
-
 // handleHSet handles the "HSET" command for storing field-value pairs in a hash.
-func handleHSet(args []Value) Value {
+func handleHSet(c *Client, args []Value) Value {
 	if len(args) != 3 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'hset' command"}
 	}
 
+	db := c.database()
+
 	hash := args[0].bulk
 	key := args[1].bulk
 	value := args[2].bulk
 
-	HSETsMu.Lock()
-	if _, ok := HSETs[hash]; !ok {
-		HSETs[hash] = map[string]string{}
-	}
-	HSETs[hash][key] = value
-	HSETsMu.Unlock()
+	db.mu.Lock()
+	db.store.SetField(hash, key, value)
+	db.mu.Unlock()
+
+	notifyKeyEvent(db, "set", hash)
 
 	return Value{typ: "string", str: "OK"}
 }
 
 // handleHGet handles the "HGET" command to retrieve a value by hash and field.
-func handleHGet(args []Value) Value {
+func handleHGet(c *Client, args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'hget' command"}
 	}
 
+	db := c.database()
+
 	hash := args[0].bulk
 	key := args[1].bulk
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash][key]
-	HSETsMu.RUnlock()
+	db.mu.RLock()
+	value, ok := db.store.GetField(hash, key)
+	ok = ok && !db.expiredOnReplica(c, hash)
+	db.mu.RUnlock()
 
+	recordLookup(ok)
 	if !ok {
 		return Value{typ: "null"}
 	}
@@ -178,17 +330,21 @@ func handleHGet(args []Value) Value {
 }
 
 // handleHGetAll handles the "HGETALL" command to retrieve all fields and values in a hash.
-func handleHGetAll(args []Value) Value {
+func handleHGetAll(c *Client, args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetall' command"}
 	}
 
+	db := c.database()
+
 	hash := args[0].bulk
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash]
-	HSETsMu.RUnlock()
+	db.mu.RLock()
+	value, ok := db.store.GetHash(hash)
+	ok = ok && !db.expiredOnReplica(c, hash)
+	db.mu.RUnlock()
 
+	recordLookup(ok)
 	if !ok {
 		return Value{typ: "null"}
 	}
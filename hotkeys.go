@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LFULogFactor controls how fast access counters saturate: a counter at n is
+// incremented with probability 1/((n-lfuInitValue)*LFULogFactor+1), so a
+// higher factor needs more accesses to reach the same count.
+var LFULogFactor = 10
+
+// LFUDecayTime is the number of idle minutes after which a key's counter is
+// decremented by one. Zero disables decay.
+var LFUDecayTime = 1
+
+const (
+	// lfuInitValue is the counter of a newly seen key, so it isn't the
+	// coldest one right away.
+	lfuInitValue = 5
+	// defaultHotKeysCount is how many keys HOTKEYS lists by default.
+	defaultHotKeysCount = 10
+)
+
+// untouchedCommands inspect keys without it counting as an access, so
+// looking at a key doesn't make it look used.
+var untouchedCommands = map[string]bool{
+	"OBJECT": true,
+	"MEMORY": true,
+}
+
+// keyAccess is the access estimate of a key, packed in 32 bits so every
+// key can afford one: the LRU clock of its last access in the upper 24 bits,
+// which LRU eviction and OBJECT IDLETIME go by, and its access frequency
+// counter in the lower 8, which grows logarithmically with the number of
+// accesses, for HOTKEYS, LFU eviction and OBJECT FREQ.
+type keyAccess uint32
+
+// lruClockMax is the highest LRU clock, after which it wraps to 0.
+const lruClockMax = 1<<24 - 1
+
+// lruClock returns the LRU clock: Unix seconds, wrapping every 194 days.
+func lruClock() uint32 {
+	return uint32(time.Now().Unix()) & lruClockMax
+}
+
+// newKeyAccess packs an access at clock with counter.
+func newKeyAccess(clock uint32, counter uint8) keyAccess {
+	return keyAccess(clock<<8 | uint32(counter))
+}
+
+// clock returns the LRU clock of the last access.
+func (a keyAccess) clock() uint32 {
+	return uint32(a) >> 8
+}
+
+// counter returns the access frequency counter, as of the last access.
+func (a keyAccess) counter() uint8 {
+	return uint8(a)
+}
+
+// idle returns the seconds since the last access, at LRU clock now. Idle
+// times over 194 days look shorter, as the clock wrapped.
+func (a keyAccess) idle(now uint32) int64 {
+	if now >= a.clock() {
+		return int64(now - a.clock())
+	}
+	return int64(now) + lruClockMax + 1 - int64(a.clock())
+}
+
+// decayed returns the counter after decrementing it once per decayTime
+// minutes elapsed since the last access.
+func (a keyAccess) decayed(now uint32, decayTime int) uint8 {
+	if decayTime == 0 {
+		return a.counter()
+	}
+	periods := a.idle(now) / 60 / int64(decayTime)
+	if periods >= int64(a.counter()) {
+		return 0
+	}
+	return a.counter() - uint8(periods)
+}
+
+// startAccess is the access estimate of keys not accessed since the server
+// started, such as those it loaded.
+var startAccess = newKeyAccess(uint32(startTime.Unix())&lruClockMax, lfuInitValue)
+
+// keyAccess returns the access estimate of key. db.accessMu must be held.
+func (db *Database) keyAccess(key string) keyAccess {
+	if a, ok := db.access[key]; ok {
+		return a
+	}
+	return startAccess
+}
+
+// recordAccess bumps the access counters of the keys that exist in the
+// database, and records that they were accessed now.
+func recordAccess(db *Database, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	configMu.RLock()
+	factor, decayTime := LFULogFactor, LFUDecayTime
+	configMu.RUnlock()
+
+	now := lruClock()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.accessMu.Lock()
+	defer db.accessMu.Unlock()
+
+	for _, key := range keys {
+		if !db.exists(key) {
+			continue
+		}
+
+		// A key first accessed now starts at lfuInitValue.
+		counter := uint8(lfuInitValue)
+		if a, ok := db.access[key]; ok {
+			counter = a.decayed(now, decayTime)
+		}
+		if counter < 255 {
+			base := float64(counter) - lfuInitValue
+			if base < 0 {
+				base = 0
+			}
+			if rand.Float64() < 1/(base*float64(factor)+1) {
+				counter++
+			}
+		}
+		db.access[key] = newKeyAccess(now, counter)
+	}
+}
+
+// forgetAccess drops the access counter of a deleted key. db.mu must be held for writing.
+func (db *Database) forgetAccess(key string) {
+	db.accessMu.Lock()
+	delete(db.access, key)
+	db.accessMu.Unlock()
+}
+
+// handleHotKeys handles "HOTKEYS [count]", listing the most frequently
+// accessed keys of the current database with their access counters.
+func handleHotKeys(c *Client, args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hotkeys' command"}
+	}
+
+	count := defaultHotKeysCount
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n <= 0 {
+			return Value{typ: "error", str: "ERR count must be a positive integer"}
+		}
+		count = n
+	}
+
+	configMu.RLock()
+	decayTime := LFUDecayTime
+	configMu.RUnlock()
+
+	now := lruClock()
+
+	type hotKey struct {
+		key     string
+		counter uint8
+	}
+
+	db := c.database()
+
+	db.mu.RLock()
+	db.accessMu.Lock()
+	keys := make([]hotKey, 0, len(db.access))
+	for key, a := range db.access {
+		if db.exists(key) {
+			keys = append(keys, hotKey{key, a.decayed(now, decayTime)})
+		}
+	}
+	db.accessMu.Unlock()
+	db.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].counter != keys[j].counter {
+			return keys[i].counter > keys[j].counter
+		}
+		return strings.Compare(keys[i].key, keys[j].key) < 0
+	})
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+
+	values := make([]Value, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: k.key},
+			{typ: "integer", num: int(k.counter)},
+		}})
+	}
+
+	return Value{typ: "array", array: values}
+}
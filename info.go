@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// startTime is when the server process started.
+var startTime = time.Now()
+
+// infoSection is one section of the INFO reply.
+type infoSection struct {
+	name string
+	// byDefault includes the section when INFO is called without arguments.
+	byDefault bool
+	// fields returns the section's "name:value" lines.
+	fields func() []string
+}
+
+// infoSections lists the INFO sections in the order they are reported.
+var infoSections = []infoSection{
+	{"server", true, infoServer},
+	{"clients", true, infoClients},
+	{"memory", true, infoMemory},
+	{"persistence", true, infoPersistence},
+	{"stats", true, infoStats},
+	{"replication", true, infoReplication},
+	{"activeactive", false, infoActiveActive},
+	{"commandstats", false, infoCommandStats},
+	{"errorstats", true, infoErrorStats},
+	{"cluster", true, infoCluster},
+	{"keyspace", true, infoKeyspace},
+}
+
+// handleInfo handles "INFO [section ...]". The special sections "default",
+// "all" and "everything" select groups of sections.
+func handleInfo(c *Client, args []Value) Value {
+	wanted := map[string]bool{}
+	all, defaults := false, len(args) == 0
+	for _, arg := range args {
+		switch name := strings.ToLower(arg.bulk); name {
+		case "all", "everything":
+			all = true
+		case "default":
+			defaults = true
+		default:
+			wanted[name] = true
+		}
+	}
+
+	sections := []string{}
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] && !(defaults && section.byDefault) {
+			continue
+		}
+		title := strings.ToUpper(section.name[:1]) + section.name[1:]
+		sections = append(sections, "# "+title+"\r\n"+strings.Join(append(section.fields(), ""), "\r\n"))
+	}
+
+	return Value{typ: "bulk", bulk: strings.Join(sections, "\r\n")}
+}
+
+// infoServer reports general information about the server process.
+func infoServer() []string {
+	uptime := time.Since(startTime)
+
+	configMu.RLock()
+	port := Port
+	configMu.RUnlock()
+
+	executable, _ := os.Executable()
+
+	return []string{
+		"go_version:" + runtime.Version(),
+		fmt.Sprintf("arch_bits:%d", 32<<(^uint(0)>>63)),
+		"os:" + runtime.GOOS + " " + runtime.GOARCH,
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		"tcp_port:" + port,
+		fmt.Sprintf("server_time_usec:%d", time.Now().UnixMicro()),
+		fmt.Sprintf("uptime_in_seconds:%d", int(uptime.Seconds())),
+		fmt.Sprintf("uptime_in_days:%d", int(uptime.Hours()/24)),
+		"executable:" + executable,
+		"config_file:" + ConfigFile,
+	}
+}
+
+// infoClients reports connection counts.
+func infoClients() []string {
+	ClientsMu.RLock()
+	connected := len(Clients)
+	tracking := 0
+	trackingMu.Lock()
+	for _, c := range Clients {
+		if c.tracking {
+			tracking++
+		}
+	}
+	trackingMu.Unlock()
+	ClientsMu.RUnlock()
+
+	return []string{
+		fmt.Sprintf("connected_clients:%d", connected),
+		fmt.Sprintf("tracking_clients:%d", tracking),
+	}
+}
+
+// infoMemory reports heap usage, using the same figures as MEMORY STATS.
+func infoMemory() []string {
+	names := map[string]string{
+		"total.allocated":               "used_memory",
+		"startup.allocated":             "used_memory_startup",
+		"overhead.total":                "used_memory_overhead",
+		"dataset.bytes":                 "used_memory_dataset",
+		"allocator.resident":            "used_memory_rss",
+		"allocator.sys":                 "used_memory_sys",
+		"allocator.fragmentation.ratio": "mem_fragmentation_ratio",
+		"keyspace.bytes":                "used_memory_keyspace",
+		"keyspace.strings":              "used_memory_keyspace_strings",
+		"keyspace.hashes.listpack":      "used_memory_keyspace_listpacks",
+		"keyspace.hashes.hashtable":     "used_memory_keyspace_hashtables",
+		"keyspace.expires":              "used_memory_keyspace_expires",
+		"keyspace.spilled":              "used_memory_keyspace_spilled",
+	}
+
+	lines := []string{}
+	for _, stat := range memoryStats() {
+		name, ok := names[stat.name]
+		if !ok {
+			continue
+		}
+		if stat.value.typ == "double" {
+			lines = append(lines, fmt.Sprintf("%s:%.2f", name, stat.value.double))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s:%d", name, stat.value.num))
+		}
+	}
+	configMu.RLock()
+	limit, policy := MaxMemory, MaxMemoryPolicy
+	configMu.RUnlock()
+	lines = append(lines,
+		fmt.Sprintf("maxmemory:%d", limit),
+		fmt.Sprintf("maxmemory_policy:%s", policy),
+		fmt.Sprintf("lazyfree_pending_objects:%d", atomic.LoadInt64(&lazyfreePending)),
+	)
+	return append(lines, infoTieredStorage()...)
+}
+
+// infoStats reports general server counters.
+func infoStats() []string {
+	return append([]string{
+		fmt.Sprintf("total_connections_received:%d", atomic.LoadInt64(&nextClientID)),
+		fmt.Sprintf("total_commands_processed:%d", totalCommandsProcessed()),
+		fmt.Sprintf("total_error_replies:%d", totalErrorReplies()),
+		fmt.Sprintf("expired_keys:%d", atomic.LoadInt64(&expiredKeys)),
+		fmt.Sprintf("evicted_keys:%d", atomic.LoadInt64(&evictedKeys)),
+		fmt.Sprintf("lazyfreed_objects:%d", atomic.LoadInt64(&lazyfreedObjects)),
+		fmt.Sprintf("keyspace_hits:%d", atomic.LoadInt64(&keyspaceHits)),
+		fmt.Sprintf("keyspace_misses:%d", atomic.LoadInt64(&keyspaceMisses)),
+	}, append(append(append(infoActiveDefrag(), infoWebhooks()...), infoWriteBehind()...), infoReadThrough()...)...)
+}
+
+// infoKeyspace reports the size of every non-empty database.
+func infoKeyspace() []string {
+	lines := []string{}
+	now := nowMillis()
+	for _, db := range Databases {
+		db.mu.RLock()
+		keys := db.size()
+		_, _, expires := db.store.Counts()
+		var ttlSum int64
+		db.store.IterateExpires(func(key string, when int64) bool {
+			if when > now {
+				ttlSum += when - now
+			}
+			return true
+		})
+		db.mu.RUnlock()
+
+		if keys == 0 {
+			continue
+		}
+		avgTTL := int64(0)
+		if expires > 0 {
+			avgTTL = ttlSum / int64(expires)
+		}
+		lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d", db.id, keys, expires, avgTTL))
+	}
+	return lines
+}
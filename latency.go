@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyMonitorThreshold is the latency, in milliseconds, at or above which
+// an event is recorded by the latency monitor. Zero disables the monitor.
+var LatencyMonitorThreshold = 0
+
+// latencyHistoryLen is how many samples each event keeps.
+const latencyHistoryLen = 160
+
+// latencySample is the worst latency of an event within one second.
+type latencySample struct {
+	time    int64 // Unix seconds
+	latency int   // milliseconds
+}
+
+// latencyEvent is the spike history of one kind of event, oldest first.
+type latencyEvent struct {
+	samples []latencySample
+	max     int
+}
+
+// latencyEvents holds the history of every event that spiked, by name.
+var latencyEvents = map[string]*latencyEvent{}
+var latencyMu = sync.Mutex{}
+
+// latencyAddSample records the duration of an event if the latency monitor
+// is enabled and it reaches the threshold. Samples within the same second
+// are merged, keeping the worst.
+func latencyAddSample(event string, duration time.Duration) {
+	configMu.RLock()
+	threshold := LatencyMonitorThreshold
+	configMu.RUnlock()
+
+	latency := int(duration.Milliseconds())
+	if threshold == 0 || latency < threshold {
+		return
+	}
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	e, ok := latencyEvents[event]
+	if !ok {
+		e = &latencyEvent{}
+		latencyEvents[event] = e
+	}
+	if latency > e.max {
+		e.max = latency
+	}
+
+	now := time.Now().Unix()
+	if n := len(e.samples); n > 0 && e.samples[n-1].time == now {
+		if latency > e.samples[n-1].latency {
+			e.samples[n-1].latency = latency
+		}
+		return
+	}
+
+	e.samples = append(e.samples, latencySample{time: now, latency: latency})
+	if len(e.samples) > latencyHistoryLen {
+		e.samples = append([]latencySample{}, e.samples[len(e.samples)-latencyHistoryLen:]...)
+	}
+}
+
+// handleLatency handles the "LATENCY" command and its subcommands.
+func handleLatency(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'latency' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LATEST":
+		return handleLatencyLatest()
+	case "HISTORY":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'latency|history' command"}
+		}
+		return handleLatencyHistory(args[1].bulk)
+	case "RESET":
+		return handleLatencyReset(args[1:])
+	case "DOCTOR":
+		return Value{typ: "bulk", bulk: latencyDoctor()}
+	case "HELP":
+		lines := []string{
+			"LATENCY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return a human readable latency analysis report.",
+			"HISTORY <event>",
+			"    Return time-latency samples for the <event> class.",
+			"LATEST",
+			"    Return the latest latency samples for all events.",
+			"RESET [<event> ...]",
+			"    Reset latency data of one or more <event> classes.",
+			"    (default: reset all data for all event classes)",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try LATENCY HELP."}
+	}
+}
+
+// sortedLatencyEvents returns the names of the recorded events in
+// alphabetical order. latencyMu must be held.
+func sortedLatencyEvents() []string {
+	names := make([]string, 0, len(latencyEvents))
+	for name := range latencyEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleLatencyLatest handles "LATENCY LATEST".
+func handleLatencyLatest() Value {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	values := []Value{}
+	for _, name := range sortedLatencyEvents() {
+		e := latencyEvents[name]
+		last := e.samples[len(e.samples)-1]
+		values = append(values, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: name},
+			{typ: "integer", num: int(last.time)},
+			{typ: "integer", num: last.latency},
+			{typ: "integer", num: e.max},
+		}})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// handleLatencyHistory handles "LATENCY HISTORY event".
+func handleLatencyHistory(event string) Value {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	values := []Value{}
+	if e, ok := latencyEvents[event]; ok {
+		for _, sample := range e.samples {
+			values = append(values, Value{typ: "array", array: []Value{
+				{typ: "integer", num: int(sample.time)},
+				{typ: "integer", num: sample.latency},
+			}})
+		}
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// handleLatencyReset handles "LATENCY RESET [event ...]".
+func handleLatencyReset(events []Value) Value {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	reset := 0
+	if len(events) == 0 {
+		reset = len(latencyEvents)
+		latencyEvents = map[string]*latencyEvent{}
+	}
+	for _, event := range events {
+		if _, ok := latencyEvents[event.bulk]; ok {
+			delete(latencyEvents, event.bulk)
+			reset++
+		}
+	}
+
+	return Value{typ: "integer", num: reset}
+}
+
+// latencyAdvice explains what commonly causes spikes of each event.
+var latencyAdvice = map[string]string{
+	"command":      "Slow commands were observed. Check SLOWLOG GET for the offending commands and avoid O(N) operations on large values.",
+	"fast-command": "Commands that should be O(1) were slow. This usually means the host is overloaded or the process was stalled, e.g. by swapping or a noisy neighbour.",
+	"aof-fsync":    "Flushing the AOF to disk was slow. Check the disk, or move the AOF to a faster device.",
+	"expire-cycle": "The active expiry cycle was slow. Many keys expiring at the same time is the usual cause; spread out expiry times with some randomness.",
+}
+
+// latencyDoctor returns a human readable analysis of the recorded latency spikes.
+func latencyDoctor() string {
+	configMu.RLock()
+	threshold := LatencyMonitorThreshold
+	configMu.RUnlock()
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	var b strings.Builder
+	if threshold == 0 {
+		b.WriteString("The latency monitor is disabled. Enable it with " +
+			"'CONFIG SET latency-monitor-threshold <milliseconds>' to record latency spikes.\n")
+		if len(latencyEvents) == 0 {
+			return b.String()
+		}
+		b.WriteString("\n")
+	}
+
+	if len(latencyEvents) == 0 {
+		b.WriteString("No latency spike at or above " + strconv.Itoa(threshold) +
+			" milliseconds was observed since the monitor was enabled or last reset.\n")
+		return b.String()
+	}
+
+	b.WriteString("Latency spikes were observed for the following events:\n\n")
+	for i, name := range sortedLatencyEvents() {
+		e := latencyEvents[name]
+
+		sum := 0
+		for _, sample := range e.samples {
+			sum += sample.latency
+		}
+		avg := float64(sum) / float64(len(e.samples))
+		deviation := 0.0
+		for _, sample := range e.samples {
+			d := float64(sample.latency) - avg
+			if d < 0 {
+				d = -d
+			}
+			deviation += d
+		}
+		deviation /= float64(len(e.samples))
+
+		period := 0.0
+		if len(e.samples) > 1 {
+			period = float64(e.samples[len(e.samples)-1].time-e.samples[0].time) / float64(len(e.samples)-1)
+		}
+
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %.0fms, mean deviation %.0fms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, name, len(e.samples), avg, deviation, period, e.max)
+	}
+
+	b.WriteString("\nAdvice:\n\n")
+	for _, name := range sortedLatencyEvents() {
+		if advice, ok := latencyAdvice[name]; ok {
+			fmt.Fprintf(&b, "- %s: %s\n", name, advice)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// lazyfreeThreshold is the number of fields from which a removed hash is
+// freed in the background.
+const lazyfreeThreshold = 64
+
+// lazyfreePending counts the hashes queued to be freed, and lazyfreedObjects
+// those freed in the background, updated atomically.
+var (
+	lazyfreePending  int64
+	lazyfreedObjects int64
+)
+
+// lazyfreeJob is a removed hash, with the counter of the engine it was
+// removed from that the bytes of its fields and values are added to.
+type lazyfreeJob struct {
+	hash  map[string]string
+	freed *int64
+}
+
+// lazyfreeQueue holds the hashes waiting to be freed.
+var lazyfreeQueue = make(chan lazyfreeJob, 1024)
+
+// lazyFree hands a hash removed from an engine to the background, so that
+// removing it, by UNLINK, eviction or an overwrite, doesn't hold up the
+// command for as long as walking its fields takes. Go's collector reclaims
+// the memory; the walk is what accounts for it in used memory. Nothing may
+// modify the hash anymore. It is freed right away when the queue is full.
+func lazyFree(hash map[string]string, freed *int64) {
+	atomic.AddInt64(&lazyfreePending, 1)
+	job := lazyfreeJob{hash: hash, freed: freed}
+	select {
+	case lazyfreeQueue <- job:
+	default:
+		job.free()
+	}
+}
+
+// runLazyFree frees the queued hashes.
+func runLazyFree() {
+	for job := range lazyfreeQueue {
+		job.free()
+	}
+}
+
+// free adds the bytes of the hash's fields and values to the engine's
+// counter, dropping the last reference to it.
+func (job lazyfreeJob) free() {
+	size := 0
+	for field, value := range job.hash {
+		size += len(field) + len(value)
+	}
+	atomic.AddInt64(job.freed, int64(size))
+	atomic.AddInt64(&lazyfreePending, -1)
+	atomic.AddInt64(&lazyfreedObjects, 1)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// Port is the TCP port for plain connections.
+var Port = "5000"
+
+// Bind is a space-separated list of addresses to listen on; empty means all interfaces.
+var Bind = ""
+
+// bindAddresses returns the configured bind addresses, or a single empty
+// host (all interfaces) when none are configured.
+func bindAddresses() []string {
+	addrs := strings.Fields(Bind)
+	if len(addrs) == 0 {
+		return []string{""}
+	}
+	return addrs
+}
+
+// listenAll opens one listener per bind address on the given port. IPv6
+// addresses such as "::1" are bracketed as needed. If any address fails, the
+// listeners opened so far are closed.
+func listenAll(port string, listen func(addr string) (net.Listener, error)) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	for _, host := range bindAddresses() {
+		listener, err := listen(net.JoinHostPort(host, port))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenTCP opens a plain TCP listener on addr.
+func listenTCP(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// ProtectedMode restricts an unsecured server (no password, no explicit bind
+// addresses) to loopback clients.
+var ProtectedMode = "yes"
+
+// protectedModeError is sent to external clients rejected by protected mode.
+const protectedModeError = "DENIED StormyDB is running in protected mode because protected mode is enabled " +
+	"and no password is set for the default user. In this mode connections are only accepted from the " +
+	"loopback interface. If you want to connect from external computers, either: 1) set a password with " +
+	"--requirepass or CONFIG SET requirepass, 2) bind explicit addresses with --bind, or 3) disable " +
+	"protected mode with --protected-mode no."
+
+// protectedModeBlocks reports whether a connection must be refused because of protected mode.
+func protectedModeBlocks(conn net.Conn) bool {
+	configMu.RLock()
+	enabled := ProtectedMode == "yes" && Bind == ""
+	configMu.RUnlock()
+
+	if !enabled || autoAuthUser() == nil {
+		return false
+	}
+
+	return !isLocalConn(conn)
+}
+
+// isLocalConn reports whether the connection comes from the loopback
+// interface. Connections that aren't TCP, such as in-process ones, count as local.
+func isLocalConn(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return addr.IP.IsLoopback()
+}
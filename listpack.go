@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// HashMaxListpackEntries is the most fields a hash is stored as a listpack
+// with. 0 stores every hash as a map.
+var HashMaxListpackEntries = 128
+
+// HashMaxListpackValue is the longest field or value, in bytes, a hash is
+// stored as a listpack with.
+var HashMaxListpackValue = 64
+
+// listpack is the compact encoding of a small hash: its fields and values in
+// a single string, each prefixed by its length as a uvarint. A map spends a
+// bucket of eight entries and a header on even a one-field hash, and leaves
+// pointers for the GC to scan, where a listpack takes little more than the
+// bytes of its fields and values. Lookups and updates go through every
+// field, so hashes past HashMaxListpackEntries fields, or with a field or
+// value longer than HashMaxListpackValue, are converted to maps for good.
+type listpack string
+
+// listpackLimits returns HashMaxListpackEntries and HashMaxListpackValue.
+func listpackLimits() (int, int) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return HashMaxListpackEntries, HashMaxListpackValue
+}
+
+// fitsListpack reports whether hash is small enough to store as a listpack.
+func fitsListpack(hash map[string]string) bool {
+	entries, size := listpackLimits()
+	if len(hash) > entries {
+		return false
+	}
+	for field, value := range hash {
+		if len(field) > size || len(value) > size {
+			return false
+		}
+	}
+	return true
+}
+
+// fits reports whether the listpack can take field set to value.
+func (lp listpack) fits(field, value string) bool {
+	entries, size := listpackLimits()
+	if len(field) > size || len(value) > size {
+		return false
+	}
+	if _, ok := lp.get(field); ok {
+		return true
+	}
+	return lp.len() < entries
+}
+
+// packHash encodes hash as a listpack.
+func packHash(hash map[string]string) listpack {
+	buf := make([]byte, 0, listpackSize(hash))
+	for field, value := range hash {
+		buf = appendListpackEntry(buf, field, value)
+	}
+	return listpack(buf)
+}
+
+// listpackSize returns the length of the listpack encoding hash.
+func listpackSize(hash map[string]string) int {
+	size := 0
+	for field, value := range hash {
+		size += listpackFieldSize(field, value)
+	}
+	return size
+}
+
+// listpackFieldSize returns the bytes a field and its value take in a
+// listpack.
+func listpackFieldSize(field, value string) int {
+	var prefix [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(prefix[:], uint64(len(field))) + len(field) +
+		binary.PutUvarint(prefix[:], uint64(len(value))) + len(value)
+}
+
+// appendListpackEntry appends a field and its value to a listpack's bytes.
+func appendListpackEntry(buf []byte, field, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(field)))
+	buf = append(buf, field...)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// next returns the field and value at offset i of the listpack and the
+// offset of the following entry.
+func (lp listpack) next(i int) (string, string, int) {
+	n, i := lp.uvarint(i)
+	field := string(lp[i : i+n])
+	n, i = lp.uvarint(i + n)
+	return field, string(lp[i : i+n]), i + n
+}
+
+// uvarint decodes the length prefix at offset i of the listpack and returns
+// it with the offset past it.
+func (lp listpack) uvarint(i int) (int, int) {
+	n := 0
+	for shift := 0; ; shift += 7 {
+		b := lp[i]
+		i++
+		n |= int(b&0x7f) << shift
+		if b < 0x80 {
+			return n, i
+		}
+	}
+}
+
+// get returns the value of field.
+func (lp listpack) get(field string) (string, bool) {
+	for i := 0; i < len(lp); {
+		f, value, next := lp.next(i)
+		if f == field {
+			return value, true
+		}
+		i = next
+	}
+	return "", false
+}
+
+// len returns the number of fields.
+func (lp listpack) len() int {
+	n := 0
+	for i := 0; i < len(lp); n++ {
+		_, _, i = lp.next(i)
+	}
+	return n
+}
+
+// set returns the listpack with field set to value.
+func (lp listpack) set(field, value string) listpack {
+	buf := make([]byte, 0, len(lp)+listpackFieldSize(field, value))
+	for i := 0; i < len(lp); {
+		f, v, next := lp.next(i)
+		if f != field {
+			buf = appendListpackEntry(buf, f, v)
+		}
+		i = next
+	}
+	return listpack(appendListpackEntry(buf, field, value))
+}
+
+// unpack decodes the listpack into a map.
+func (lp listpack) unpack() map[string]string {
+	hash := map[string]string{}
+	for i := 0; i < len(lp); {
+		field, value, next := lp.next(i)
+		hash[field] = value
+		i = next
+	}
+	return hash
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// luaEngine runs scripts written in Lua. Scripts read their keys and
+// arguments from the KEYS and ARGV globals and return their reply.
+type luaEngine struct{}
+
+// luaScript is a compiled Lua script, run in a fresh state each time.
+type luaScript struct {
+	proto *lua.FunctionProto
+}
+
+// luaLibrary is the state shared by the functions of a Lua library. client
+// is the script client their commands are issued as, set only while one of
+// them runs.
+type luaLibrary struct {
+	state  *lua.LState
+	client *Client
+}
+
+// luaFunction is a function registered by a Lua library.
+type luaFunction struct {
+	lib *luaLibrary
+	fn  *lua.LFunction
+}
+
+// compile compiles a Lua script.
+func (luaEngine) compile(body string) (script, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), "user_script")
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return nil, err
+	}
+	return luaScript{proto}, nil
+}
+
+// load runs a Lua library, which registers its functions with
+// redis.register_function(name, callback) or
+// redis.register_function{function_name=name, callback=callback}.
+func (luaEngine) load(ctx context.Context, body string) (map[string]script, func(), *Value) {
+	lib := &luaLibrary{}
+	L := newLuaState(func() *Client { return lib.client })
+	fns := map[string]script{}
+
+	// redis.register_function only exists while the library loads.
+	redis := L.GetGlobal("redis").(*lua.LTable)
+	redis.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		name, callback := "", (*lua.LFunction)(nil)
+		if t, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+			unknown := false
+			t.ForEach(func(k, v lua.LValue) {
+				switch k.String() {
+				case "function_name":
+					name = v.String()
+				case "callback":
+					callback, _ = v.(*lua.LFunction)
+				default:
+					unknown = true
+				}
+			})
+			if unknown {
+				L.RaiseError("unknown argument given to redis.register_function")
+			}
+		} else {
+			name, callback = L.CheckString(1), L.CheckFunction(2)
+		}
+
+		if callback == nil {
+			L.RaiseError("callback must be a function")
+		}
+		if err := registerFunction(fns, name, luaFunction{lib, callback}); err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		return 0
+	}))
+
+	chunk, err := L.Load(strings.NewReader(body), "user_function")
+	if err != nil {
+		L.Close()
+		return nil, nil, &Value{typ: "error", str: "ERR Error compiling function: " + oneLine(err.Error())}
+	}
+
+	L.SetContext(ctx)
+	L.Push(chunk)
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+	redis.RawSetString("register_function", lua.LNil)
+
+	if err != nil {
+		L.Close()
+		reply := luaError(err)
+		return nil, nil, &reply
+	}
+
+	lib.state = L
+	return fns, L.Close, nil
+}
+
+// run runs the script in a new state, with KEYS and ARGV set.
+func (s luaScript) run(ctx context.Context, sc *Client, keys, argv []Value) Value {
+	L := newLuaState(func() *Client { return sc })
+	defer L.Close()
+
+	L.SetGlobal("KEYS", stringsTable(L, keys))
+	L.SetGlobal("ARGV", stringsTable(L, argv))
+
+	return callLua(ctx, L, L.NewFunctionFromProto(s.proto))
+}
+
+// run calls the function with the keys and arguments as two Lua arrays.
+func (f luaFunction) run(ctx context.Context, sc *Client, keys, argv []Value) Value {
+	f.lib.client = sc
+	defer func() { f.lib.client = nil }()
+
+	L := f.lib.state
+	return callLua(ctx, L, f.fn, stringsTable(L, keys), stringsTable(L, argv))
+}
+
+// callLua calls fn with the arguments until ctx is done, and converts its
+// return value to a reply.
+func callLua(ctx context.Context, L *lua.LState, fn *lua.LFunction, args ...lua.LValue) Value {
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), 1, nil); err != nil {
+		return luaError(err)
+	}
+
+	result := L.Get(-1)
+	L.Pop(1)
+	return luaToValue(result)
+}
+
+// newLuaState creates the Lua state a script runs in: the base, table,
+// string and math libraries, without file access, and the redis library
+// issuing commands as the client returned by client.
+func newLuaState(client func() *Client) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":  func(L *lua.LState) int { return luaCall(L, client(), true) },
+		"pcall": func(L *lua.LState) int { return luaCall(L, client(), false) },
+		"error_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(scriptSHA(L.CheckString(1))))
+			return 1
+		},
+		"log": func(L *lua.LState) int {
+			L.CheckInt(1)
+			fmt.Println("Script log:", L.CheckString(2))
+			return 0
+		},
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+
+	return L
+}
+
+// luaCall implements redis.call and redis.pcall: it runs the command given
+// by the Lua arguments and pushes its reply. When raise is set, an error
+// reply is raised as a Lua error instead of being returned.
+func luaCall(L *lua.LState, sc *Client, raise bool) int {
+	value := Value{typ: "array", array: make([]Value, 0, L.GetTop())}
+	for i := 1; i <= L.GetTop(); i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			value.array = append(value.array, Value{typ: "bulk", bulk: string(arg)})
+		case lua.LNumber:
+			value.array = append(value.array, Value{typ: "bulk", bulk: arg.String()})
+		default:
+			L.Error(replyTable(L, "err", "ERR Lua redis lib command arguments must be strings or integers"), 1)
+			return 0
+		}
+	}
+
+	reply := scriptCommand(sc, value)
+	if reply.typ == "error" && raise {
+		L.Error(replyTable(L, "err", reply.str), 1)
+		return 0
+	}
+	L.Push(valueToLua(L, reply))
+	return 1
+}
+
+// stringsTable returns a Lua array of the bulk strings of values.
+func stringsTable(L *lua.LState, values []Value) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v.bulk))
+	}
+	return t
+}
+
+// replyTable returns a table with a single field, the way Lua represents
+// error ("err") and status ("ok") replies.
+func replyTable(L *lua.LState, field, message string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(message))
+	return t
+}
+
+// valueToLua converts a command reply to Lua: integers to numbers, bulk
+// strings to strings, nulls to false, aggregates to arrays, and status and
+// error replies to tables with an "ok" or "err" field.
+func valueToLua(L *lua.LState, v Value) lua.LValue {
+	switch v.typ {
+	case "integer":
+		return lua.LNumber(v.num)
+	case "double":
+		return lua.LString(strconv.FormatFloat(v.double, 'f', -1, 64))
+	case "bulk":
+		return lua.LString(v.bulk)
+	case "string":
+		return replyTable(L, "ok", v.str)
+	case "error":
+		return replyTable(L, "err", v.str)
+	case "array", "map", "push":
+		t := L.CreateTable(len(v.array), 0)
+		for _, item := range v.array {
+			t.Append(valueToLua(L, item))
+		}
+		return t
+	default:
+		return lua.LFalse
+	}
+}
+
+// luaToValue converts a script's return value to a reply: numbers to
+// integers, truncating them, strings to bulk strings, true to 1, false and
+// nil to null, tables with an "ok" or "err" field to status or error replies
+// and other tables to arrays, up to their first nil.
+func luaToValue(lv lua.LValue) Value {
+	switch lv := lv.(type) {
+	case lua.LNumber:
+		return Value{typ: "integer", num: int(lv)}
+	case lua.LString:
+		return Value{typ: "bulk", bulk: string(lv)}
+	case lua.LBool:
+		if lv {
+			return Value{typ: "integer", num: 1}
+		}
+		return Value{typ: "null"}
+	case *lua.LTable:
+		if err, ok := lv.RawGetString("err").(lua.LString); ok {
+			return Value{typ: "error", str: string(err)}
+		}
+		if status, ok := lv.RawGetString("ok").(lua.LString); ok {
+			return Value{typ: "string", str: string(status)}
+		}
+		values := []Value{}
+		for i := 1; ; i++ {
+			item := lv.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			values = append(values, luaToValue(item))
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "null"}
+	}
+}
+
+// luaError converts an error raised by a Lua script to an error reply. Errors
+// raised by redis.call or redis.error_reply keep their message.
+func luaError(err error) Value {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		if t, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := t.RawGetString("err").(lua.LString); ok {
+				return Value{typ: "error", str: string(msg)}
+			}
+		}
+		return Value{typ: "error", str: "ERR Error running script: " + oneLine(apiErr.Object.String())}
+	}
+	return Value{typ: "error", str: "ERR Error running script: " + oneLine(err.Error())}
+}
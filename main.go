@@ -1,70 +1,215 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
+	"time"
 )
 
 func main() {
-	fmt.Println("Listening on port :5000")
+	if err := loadConfig(); err != nil {
+		fmt.Println("Error loading configuration:", err)
+		os.Exit(1)
+	}
+	Databases = newDatabases(DatabaseCount)
+	go runActiveExpire()
+	go runLazyFree()
+	go runActiveDefrag()
+	if StorageEngineName == "tiered" {
+		go runTieredStorage()
+	}
 
-	// Start a TCP server listening on port 5000.
-	listener, err := net.Listen("tcp", ":5000")
+	// Start a TCP listener on every bind address.
+	listeners, err := listenAll(Port, listenTCP)
 	if err != nil {
 		fmt.Println("Error starting server:", err)
 		return
 	}
-	defer listener.Close()
+	for _, listener := range listeners {
+		defer listener.Close()
+		fmt.Println("Listening on", listener.Addr())
+	}
 
-	// Create an Append-Only File (AOF) for persistence.
-	aof, err := NewAOF("database.aof")
-	if err != nil {
-		fmt.Println("Error initializing AOF:", err)
+	if !AOFReplayUntil.IsZero() && AppendOnly != "yes" {
+		fmt.Println("Error: -aof-replay-until needs appendonly yes")
 		return
 	}
-	defer aof.Close()
 
-	// Replay commands from the AOF to restore state.
-	aof.Read(func(value Value) {
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+	// Open the Append-Only File (AOF) for persistence, unless disabled.
+	if AppendOnly == "yes" {
+		aof, err = NewAOF(AppendDirname, AppendFilename)
+		if err != nil {
+			fmt.Println("Error initializing AOF:", err)
+			return
+		}
+		defer aof.Close()
+
+		// A restored snapshot replaces the dataset, so it can't be mixed with
+		// an AOF that holds one already.
+		if RestoreFromRemote && aof.size > 0 {
+			fmt.Println("Error restoring from remote backup: the AOF in", AppendDirname, "isn't empty, move it away first")
+			return
+		}
+
+		// Replay commands from the AOF to restore state.
+		loader := newAOFLoader(aof.size)
+		err = aof.Read(loader.load)
+		if err != nil {
+			fmt.Println("Error loading AOF:", err)
+			fmt.Println("Check or repair it with stormy-check-aof")
+			return
+		}
+		loader.done(aof.corrupt)
+	}
+
+	// Fetch the snapshot to start from, once it's known not to clash with
+	// the AOF.
+	if RestoreFromRemote {
+		if err := restoreFromRemote(); err != nil {
+			fmt.Println("Error restoring from remote backup:", err)
+			return
+		}
+	}
+
+	// Without an AOF, restore state from the last snapshot instead. With
+	// neither an AOF nor save points, the server is an in-memory cache and
+	// starts empty rather than from a stale snapshot. A snapshot restored
+	// from a remote backup is always loaded, and becomes the AOF's base.
+	if AppendOnly != "yes" && len(savePoints) == 0 && !RestoreFromRemote {
+		fmt.Println("Persistence is disabled, the dataset is kept in memory only")
+	} else if AppendOnly != "yes" || RestoreFromRemote {
+		loaded, err := loadSnapshot(DBFilename, false)
+		if err != nil {
+			fmt.Println("Error loading snapshot:", err)
+			return
+		}
+		if loaded {
+			fmt.Printf("Loaded snapshot %s: %d keys loaded\n", DBFilename, datasetKeys())
+		}
+		if RestoreFromRemote && aof != nil {
+			executionMu.Lock()
+			err = aof.startRewrite()
+			executionMu.Unlock()
+			if err != nil {
+				fmt.Println("Error rewriting AOF from the restored snapshot:", err)
+				return
+			}
+		}
+	}
+
+	go runSavePoints()
+	go runDiskMonitor()
+	go runRemoteBackups()
+	go runReplicationHeartbeat()
+	startWebhooks()
+	startWriteBehind()
+	startReplication()
+	startActiveActive()
+	if err := startCluster(); err != nil {
+		fmt.Println("Error loading cluster configuration:", err)
+		return
+	}
+
+	if TLSPort != "" {
+		tlsListeners, err := listenTLS()
+		if err != nil {
+			fmt.Println("Error starting TLS server:", err)
+			return
+		}
+		for _, listener := range tlsListeners {
+			defer listener.Close()
+			fmt.Println("Listening for TLS on", listener.Addr())
+		}
+		listeners = append(listeners, tlsListeners...)
+	}
 
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command during AOF replay:", command)
+	if WebSocketPort != "" {
+		wsListeners, err := listenWebSocket()
+		if err != nil {
+			fmt.Println("Error starting WebSocket bridge:", err)
 			return
 		}
+		for _, listener := range wsListeners {
+			defer listener.Close()
+			fmt.Println("Listening for WebSocket pub/sub on", listener.Addr())
+		}
+		listeners = append(listeners, wsListeners...)
+	}
+
+	// Every listener feeds the same accept/handle pipeline.
+	for _, listener := range listeners {
+		go serve(listener)
+	}
 
-		// Execute the handler to restore state.
-		handler(args)
-	})
+	waitForShutdown(listeners)
+}
 
+// serve accepts connections from the listener and handles each in its own goroutine.
+func serve(listener net.Listener) {
 	for {
 		// Accept a new client connection.
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("Error accepting connection:", err)
 			continue
 		}
 
 		// Handle the client in a new goroutine.
-		go handleClient(conn, aof)
+		go handleClient(conn)
 	}
 }
 
 // handleClient processes commands from a single client connection.
-func handleClient(conn net.Conn, aof *AOF) {
+func handleClient(conn net.Conn) {
 	defer conn.Close()
 
 	resp := NewRESP(conn)
-	writer := NewRESPWriter(conn)
+	client := NewClient(conn)
+	defer client.Close()
+
+	if protectedModeBlocks(conn) {
+		client.Write(Value{typ: "error", str: protectedModeError})
+		client.Flush()
+		return
+	}
+
+	if err := authenticateTLSClient(client); err != nil {
+		fmt.Println("Error during TLS handshake:", err)
+		return
+	}
 
 	for {
-		// Read a command from the client.
+		// Flush pending replies only once the input buffer is drained, so a
+		// pipelined batch of commands is answered with a single write, and
+		// its writes reach the AOF with another.
+		if resp.Buffered() == 0 {
+			if err := client.flushReplies(); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+		}
+
+		// Read a command from the client, within limits CONFIG SET may
+		// have changed since the last one.
+		client.refreshIdleDeadline()
+		resp.SetLimits(clientRESPLimits())
 		value, err := resp.Read()
 		if err != nil {
-			if err.Error() != "EOF" {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Println("Closing idle client:", conn.RemoteAddr())
+				return
+			}
+			if errors.Is(err, ErrProtocol) {
+				client.Write(Value{typ: "error", str: "ERR " + err.Error()})
+				client.Flush()
+			}
+			if err.Error() != "EOF" && !errors.Is(err, net.ErrClosed) {
 				fmt.Println("Error reading command:", err)
 			}
 			return
@@ -73,32 +218,259 @@ func handleClient(conn net.Conn, aof *AOF) {
 		// Validate that the command is an array.
 		if value.typ != "array" || len(value.array) == 0 {
 			fmt.Println("Invalid request: expected non-empty array")
-			writer.Write(Value{typ: "error", str: "ERR invalid request format"})
+			if err := client.Write(Value{typ: "error", str: "ERR invalid request format"}); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
 			continue
 		}
 
 		command := strings.ToUpper(value.array[0].bulk)
 		args := value.array[1:]
 
-		// Find the command handler.
-		handler, ok := Handlers[command]
-		if !ok {
-			writer.Write(Value{typ: "error", str: "ERR unknown command: " + command})
+		// Apply rename-command; persistence and ACLs always see the real name.
+		command, ok := resolveCommand(command)
+		cmd, known := Commands[command]
+		if !ok || !known {
+			if err := client.reject("", Value{typ: "error", str: "ERR unknown command: " + strings.ToUpper(value.array[0].bulk)}); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
 			continue
 		}
+		value.array[0] = Value{typ: "bulk", bulk: command}
+		client.touch(command)
 
-		// For write commands, persist to AOF.
-		if command == "SET" || command == "DEL" || command == "HSET" || command == "INCR" {
-			err = aof.Write(value)
-			if err != nil {
-				fmt.Println("Error writing to AOF:", err)
-				writer.Write(Value{typ: "error", str: "ERR internal server error"})
+		// Until the client authenticates, only commands flagged no_auth are accepted.
+		if !isAuthenticated(client) && !cmd.hasFlag("no_auth") {
+			if err := client.reject(command, Value{typ: "error", str: "NOAUTH Authentication required."}); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		if client.proto == 2 && client.subscriptionCount() > 0 && !subscribedCommands[command] {
+			if err := client.reject(command, subscribedContextError(command)); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		if !cmd.checkArity(len(value.array)) {
+			if err := client.reject(command, Value{typ: "error", str: "ERR wrong number of arguments for '" + strings.ToLower(command) + "' command"}); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		// Check the command and its keys against the client's ACL user.
+		if errValue := aclCheck(client, command, cmd, args); errValue != nil {
+			if err := client.reject(command, *errValue); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		// In cluster mode, send the client to the node serving the keys.
+		if errValue := clusterCheck(client, command, cmd, args); errValue != nil {
+			if err := client.reject(command, *errValue); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		// While a script runs too long, other clients may only kill it.
+		if errValue := busyCheck(command, args); errValue != nil {
+			if err := client.reject(command, *errValue); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		// Inside MULTI, validated commands wait for EXEC.
+		if client.multi && !transactionCommands[command] {
+			if err := client.queueCommand(command, cmd, value); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+		exec := command == "EXEC" && client.multi
+
+		// Scripts may write, so they are paused like writes.
+		isWrite := cmd.isWrite() || cmd.hasFlag("may_replicate")
+		if exec {
+			isWrite = client.transactionWrites()
+		}
+
+		// Refuse writes while they can't be persisted, all but deletes while
+		// disk space is low, and all on a read-only replica, where scripts
+		// are refused only the writes they issue.
+		if isWrite {
+			errValue := persistenceCheck()
+			if errValue == nil {
+				errValue = diskSpaceCheck(command)
+			}
+			if errValue == nil && !cmd.hasFlag("may_replicate") {
+				errValue = readOnlyCheck(client)
+			}
+			if errValue != nil {
+				if exec {
+					client.discardTransaction()
+				}
+				if err := client.reject(command, *errValue); err != nil {
+					fmt.Println("Error writing response:", err)
+					return
+				}
 				continue
 			}
 		}
 
-		// Execute the command and write the response.
-		result := handler(args)
-		writer.Write(result)
+		// Hold the command while CLIENT PAUSE covers it. CLIENT itself is
+		// never paused so that CLIENT UNPAUSE stays reachable.
+		if command != "CLIENT" {
+			waitWhilePaused(isWrite)
+		}
+
+		// Make room for writes above maxmemory. Without any, commands that
+		// add data are refused, and transactions queuing one; scripts are
+		// refused only such commands they issue.
+		client.oom = isWrite && !evictKeys(client)
+		if client.oom && (cmd.hasFlag("denyoom") || exec && client.transactionDeniesOOM()) {
+			if exec {
+				client.discardTransaction()
+			}
+			if err := client.reject(command, oomError); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
+
+		// Shutdown waits for commands that got this far. Transactions and
+		// scripts hold the lock exclusively, so no other command runs in the
+		// middle of them.
+		var result Value
+		if killsScript(command, args) {
+			// The script to kill holds the lock, and SCRIPT KILL touches no
+			// keys, so it runs without it.
+			result = call(client, command, cmd, value)
+		} else if exec {
+			executionMu.Lock()
+			result = execTransaction(client)
+			executionMu.Unlock()
+		} else if isExclusive(command, args) {
+			executionMu.Lock()
+			result = call(client, command, cmd, value)
+			executionMu.Unlock()
+		} else {
+			executionMu.RLock()
+			result = call(client, command, cmd, value)
+			executionMu.RUnlock()
+		}
+		if err := client.Write(result); err != nil {
+			fmt.Println("Error writing response:", err)
+			return
+		}
+	}
+}
+
+// call executes a validated command: it expires and tracks the keys
+// involved, runs the handler, persists successful writes and accounts for
+// the call. executionMu must be held.
+func call(client *Client, command string, cmd Command, value Value) Value {
+	args := value.array[1:]
+
+	// Find the command handler.
+	handler, ok := Handlers[command]
+	if !ok {
+		return Value{typ: "error", str: "ERR unknown command: " + command}
+	}
+
+	isWrite := cmd.isWrite()
+
+	// A failover may have made the server a replica since dispatch checked
+	// the command.
+	if isWrite {
+		if errValue := readOnlyCheck(client); errValue != nil {
+			return *errValue
+		}
+		if errValue := activeActiveCheck(command); errValue != nil {
+			return *errValue
+		}
+	}
+
+	// Make relative expiry times absolute now, before the command runs, so
+	// the persisted command expires the key at the same time.
+	persisted := value
+	if isWrite {
+		persisted = persistentExpire(value)
+	}
+
+	// Expire the keys the command touches before it can see them.
+	expireKeys(client.database(), cmd.keys(args))
+
+	// Remember keys read by tracking clients before reading them, so a
+	// concurrent write can't slip in unnoticed.
+	if !isWrite {
+		trackKeys(client, cmd.keys(args))
+	}
+
+	// Execute the command, timing it for the slow log. Writes are applied
+	// and persisted one at a time.
+	if isWrite {
+		writeMu.Lock()
+	}
+	start := time.Now()
+	result := handler(client, args)
+	duration := time.Since(start)
+	if !untouchedCommands[command] {
+		recordAccess(client.database(), cmd.keys(args))
+	}
+	if isWrite && result.typ != "error" {
+		// Persist writes only once they succeeded, and only if they
+		// changed anything, so replaying them can't fail.
+		if effect, changed := commandEffect(persisted, result); changed {
+			// In active-active mode, writes are persisted and sent to the
+			// peers as the changes they made, except merges from peers.
+			if activeActiveWrites() && command != "CRDT" {
+				recordWrites(client, command, cmd, args)
+			} else {
+				persist(client, effect)
+			}
+			recordChanges(max(len(cmd.keys(args)), 1))
+			mirrorWrite(client.database(), cmd.keys(args))
+			cdcAppend(client.db, effect)
+		}
+	}
+	if isWrite {
+		writeMu.Unlock()
+	}
+	recordCall(command, duration, result)
+	slowlogPush(client, value.array, duration)
+	if cmd.hasFlag("fast") {
+		latencyAddSample("fast-command", duration)
+	} else {
+		latencyAddSample("command", duration)
+	}
+
+	// Keep client-side caches and watched keys coherent. Writes that name
+	// no keys, such as FLUSHALL, affect the whole keyspace.
+	if isWrite && result.typ != "error" {
+		if cmd.firstKey == 0 {
+			invalidateAll(client)
+			touchAllWatchedKeys()
+		} else {
+			invalidateKeys(cmd.keys(args), client)
+			touchWatchedKeys(client.db, cmd.keys(args))
+		}
 	}
+
+	return result
 }
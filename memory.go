@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Estimated sizes, in bytes, of the structures holding a key. They follow
+// the layout of Go strings and maps on 64-bit platforms.
+const (
+	// stringHeaderSize is the pointer and length of a string.
+	stringHeaderSize = 16
+	// mapEntryOverhead is the bucket space a map spends per entry beyond its key and value.
+	mapEntryOverhead = 8
+	// mapHeaderSize is the fixed cost of a map.
+	mapHeaderSize = 48
+	// expireEntrySize is an entry of a database's expires map: key header and expiry time.
+	expireEntrySize = stringHeaderSize + 8 + mapEntryOverhead
+)
+
+// keyspaceUsage is the estimated bytes the keys of a storage engine take in
+// memory, by what they hold: string values, hashes stored as listpacks or
+// hash tables, expiry times, and the keys of values spilled to disk by the
+// tiered engine. Engines keep it as keys change, so reading it is cheap.
+type keyspaceUsage struct {
+	strings, listpacks, hashtables, expires, spilled int
+}
+
+// add adds other to u.
+func (u *keyspaceUsage) add(other keyspaceUsage) {
+	u.strings += other.strings
+	u.listpacks += other.listpacks
+	u.hashtables += other.hashtables
+	u.expires += other.expires
+	u.spilled += other.spilled
+}
+
+// total returns the bytes of every kind.
+func (u keyspaceUsage) total() int {
+	return u.strings + u.listpacks + u.hashtables + u.expires + u.spilled
+}
+
+// defaultMemorySamples is how many fields MEMORY USAGE inspects by default.
+const defaultMemorySamples = 5
+
+// startupAllocated is the heap in use before any data was loaded.
+var startupAllocated = heapAlloc()
+
+// heapAlloc returns the bytes of allocated heap objects.
+func heapAlloc() uint64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.HeapAlloc
+}
+
+// keyMemoryUsage estimates the bytes used by a key and its value. Aggregate
+// values are estimated from up to samples of their elements, or all of them
+// when samples is 0, but listpacks are small enough to measure whole. db.mu
+// must be held.
+func (db *Database) keyMemoryUsage(key string, samples int) (int, bool) {
+	size := len(key) + stringHeaderSize + mapEntryOverhead
+	if _, ok := db.store.ExpireTime(key); ok {
+		size += expireEntrySize
+	}
+
+	if value, ok := db.store.Get(key); ok {
+		return size + len(value) + stringHeaderSize, true
+	}
+
+	hash, ok := db.store.GetHash(key)
+	if !ok {
+		return 0, false
+	}
+	if encoding, _ := db.store.HashEncoding(key); encoding == "listpack" {
+		return size + stringHeaderSize + listpackSize(hash), true
+	}
+
+	size += mapHeaderSize
+	fieldsSize, seen := 0, 0
+	for field, value := range hash {
+		if samples > 0 && seen == samples {
+			break
+		}
+		fieldsSize += hashFieldSize(field, value)
+		seen++
+	}
+	if seen > 0 {
+		fieldsSize = fieldsSize * len(hash) / seen
+	}
+
+	return size + fieldsSize, true
+}
+
+// stringEntrySize estimates the bytes of the entry of the string value at
+// key, as keyMemoryUsage counts them.
+func stringEntrySize(key, value string) int {
+	return len(key) + len(value) + 2*stringHeaderSize + mapEntryOverhead
+}
+
+// hashEntrySize estimates the bytes of the entry of the hash at key, with
+// every field.
+func hashEntrySize(key string, hash map[string]string) int {
+	size := len(key) + stringHeaderSize + mapEntryOverhead + mapHeaderSize
+	for field, value := range hash {
+		size += hashFieldSize(field, value)
+	}
+	return size
+}
+
+// listpackEntrySize estimates the bytes of the entry of the hash at key
+// stored as the listpack lp.
+func listpackEntrySize(key string, lp listpack) int {
+	return len(key) + len(lp) + 2*stringHeaderSize + mapEntryOverhead
+}
+
+// hashFieldSize estimates the bytes of a field of a hash.
+func hashFieldSize(field, value string) int {
+	return len(field) + len(value) + 2*stringHeaderSize + mapEntryOverhead
+}
+
+// handleMemory handles the "MEMORY" command and its subcommands.
+func handleMemory(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'memory' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "USAGE":
+		return handleMemoryUsage(c, args[1:])
+	case "STATS":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'memory|stats' command"}
+		}
+		return memoryStatsReply(c)
+	case "DOCTOR":
+		return Value{typ: "bulk", bulk: memoryDoctor()}
+	case "PURGE":
+		debug.FreeOSMemory()
+		return Value{typ: "string", str: "OK"}
+	case "HELP":
+		lines := []string{
+			"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"PURGE",
+			"    Return unused heap memory to the operating system.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try MEMORY HELP."}
+	}
+}
+
+// handleMemoryUsage handles "MEMORY USAGE key [SAMPLES count]".
+func handleMemoryUsage(c *Client, args []Value) Value {
+	if len(args) != 1 && len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'memory|usage' command"}
+	}
+
+	samples := defaultMemorySamples
+	if len(args) == 3 {
+		if strings.ToUpper(args[1].bulk) != "SAMPLES" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		n, err := strconv.Atoi(args[2].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		samples = n
+	}
+
+	db := c.database()
+
+	db.mu.RLock()
+	size, ok := db.keyMemoryUsage(args[0].bulk, samples)
+	db.mu.RUnlock()
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "integer", num: size}
+}
+
+// memoryStat is one named figure of MEMORY STATS.
+type memoryStat struct {
+	name  string
+	value Value
+}
+
+// memoryStats gathers the figures reported by MEMORY STATS. Overheads are
+// estimated from structure counts rather than by walking every key, so the
+// command stays cheap on large datasets.
+func memoryStats() []memoryStat {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	ClientsMu.RLock()
+	clientCount := len(Clients)
+	clientsOutput := 0
+	for _, c := range Clients {
+		clientsOutput += c.output.Size()
+	}
+	ClientsMu.RUnlock()
+
+	stats := []memoryStat{
+		{"total.allocated", Value{typ: "integer", num: int(mem.HeapAlloc)}},
+		{"startup.allocated", Value{typ: "integer", num: int(startupAllocated)}},
+		{"clients.normal", Value{typ: "integer", num: clientsOutput}},
+	}
+
+	overhead := int(startupAllocated) + clientsOutput
+	keys := 0
+	var keyspace keyspaceUsage
+	for _, db := range Databases {
+		db.mu.RLock()
+		strs, hashes, expires := db.store.Counts()
+		usage := db.store.Usage()
+		count := strs + hashes
+		db.mu.RUnlock()
+		keyspace.add(usage)
+		if count == 0 {
+			continue
+		}
+		keys += count
+
+		mainOverhead := count * (stringHeaderSize*2 + mapEntryOverhead)
+		expiresOverhead := expires * expireEntrySize
+		overhead += mainOverhead + expiresOverhead
+		figures := []Value{
+			{typ: "bulk", bulk: "overhead.hashtable.main"}, {typ: "integer", num: mainOverhead},
+			{typ: "bulk", bulk: "overhead.hashtable.expires"}, {typ: "integer", num: expiresOverhead},
+		}
+		for _, stat := range keyspaceStats(usage) {
+			figures = append(figures, Value{typ: "bulk", bulk: stat.name}, stat.value)
+		}
+		stats = append(stats, memoryStat{fmt.Sprintf("db.%d", db.id), Value{typ: "map", array: figures}})
+	}
+	stats = append(stats, keyspaceStats(keyspace)...)
+
+	dataset := int(mem.HeapAlloc) - overhead
+	if dataset < 0 {
+		dataset = 0
+	}
+	netUsage := int(mem.HeapAlloc) - int(startupAllocated)
+	datasetPercentage, bytesPerKey := 0.0, 0
+	if netUsage > 0 {
+		datasetPercentage = float64(dataset) * 100 / float64(netUsage)
+	}
+	if keys > 0 {
+		bytesPerKey = netUsage / keys
+	}
+	fragmentation := 0.0
+	if mem.HeapAlloc > 0 {
+		fragmentation = float64(mem.HeapInuse) / float64(mem.HeapAlloc)
+	}
+
+	return append(stats,
+		memoryStat{"overhead.total", Value{typ: "integer", num: overhead}},
+		memoryStat{"clients.count", Value{typ: "integer", num: clientCount}},
+		memoryStat{"keys.count", Value{typ: "integer", num: keys}},
+		memoryStat{"keys.bytes-per-key", Value{typ: "integer", num: bytesPerKey}},
+		memoryStat{"dataset.bytes", Value{typ: "integer", num: dataset}},
+		memoryStat{"dataset.percentage", Value{typ: "double", double: datasetPercentage}},
+		memoryStat{"allocator.allocated", Value{typ: "integer", num: int(mem.HeapAlloc)}},
+		memoryStat{"allocator.active", Value{typ: "integer", num: int(mem.HeapInuse)}},
+		memoryStat{"allocator.resident", Value{typ: "integer", num: int(mem.HeapInuse + mem.StackInuse)}},
+		memoryStat{"allocator.released", Value{typ: "integer", num: int(mem.HeapReleased)}},
+		memoryStat{"allocator.sys", Value{typ: "integer", num: int(mem.Sys)}},
+		memoryStat{"allocator.fragmentation.ratio", Value{typ: "double", double: fragmentation}},
+		memoryStat{"gc.cycles", Value{typ: "integer", num: int(mem.NumGC)}},
+	)
+}
+
+// keyspaceStats returns the figures of MEMORY STATS breaking down the
+// estimated size of keys by what they hold.
+func keyspaceStats(usage keyspaceUsage) []memoryStat {
+	return []memoryStat{
+		{"keyspace.bytes", Value{typ: "integer", num: usage.total()}},
+		{"keyspace.strings", Value{typ: "integer", num: usage.strings}},
+		{"keyspace.hashes.listpack", Value{typ: "integer", num: usage.listpacks}},
+		{"keyspace.hashes.hashtable", Value{typ: "integer", num: usage.hashtables}},
+		{"keyspace.expires", Value{typ: "integer", num: usage.expires}},
+		{"keyspace.spilled", Value{typ: "integer", num: usage.spilled}},
+	}
+}
+
+// memoryStatsReply formats the memory figures for the client's protocol
+// version: a map in RESP3, a flat name/value array in RESP2.
+func memoryStatsReply(c *Client) Value {
+	values := []Value{}
+	for _, stat := range memoryStats() {
+		value := stat.value
+		if c.proto != 3 {
+			value = resp2Compatible(value)
+		}
+		values = append(values, Value{typ: "bulk", bulk: stat.name}, value)
+	}
+
+	if c.proto == 3 {
+		return Value{typ: "map", array: values}
+	}
+	return Value{typ: "array", array: values}
+}
+
+// resp2Compatible converts RESP3-only types in v to their RESP2 equivalents:
+// maps become flat arrays and doubles become bulk strings, at any depth.
+func resp2Compatible(v Value) Value {
+	switch v.typ {
+	case "map", "array":
+		values := make([]Value, 0, len(v.array))
+		for _, item := range v.array {
+			values = append(values, resp2Compatible(item))
+		}
+		return Value{typ: "array", array: values}
+	case "double":
+		return Value{typ: "bulk", bulk: strconv.FormatFloat(v.double, 'f', -1, 64)}
+	default:
+		return v
+	}
+}
+
+// memoryDoctor returns a human readable report of memory problems.
+func memoryDoctor() string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	if mem.HeapAlloc < 5*1024*1024 {
+		return "This instance is empty or is using very little memory, so there is nothing to report. " +
+			"Come back when it holds some data.\n"
+	}
+
+	problems := []string{}
+
+	if mem.HeapAlloc > 0 {
+		ratio := float64(mem.HeapInuse) / float64(mem.HeapAlloc)
+		if ratio > 1.4 {
+			problems = append(problems, fmt.Sprintf("High heap fragmentation: %.2f bytes of heap are in use for every "+
+				"allocated byte. This is common after deleting many keys; MEMORY PURGE returns idle memory to the "+
+				"operating system.", ratio))
+		}
+	}
+
+	if released := mem.HeapIdle - mem.HeapReleased; released > mem.HeapAlloc && released > 64*1024*1024 {
+		problems = append(problems, fmt.Sprintf("The process holds %d bytes of idle heap that were not returned to "+
+			"the operating system. MEMORY PURGE releases them.", released))
+	}
+
+	ClientsMu.RLock()
+	biggest, total := 0, 0
+	for _, c := range Clients {
+		size := c.output.Size()
+		total += size
+		if size > biggest {
+			biggest = size
+		}
+	}
+	clients := len(Clients)
+	ClientsMu.RUnlock()
+
+	if total > 0 && uint64(total) > mem.HeapAlloc/10 {
+		problems = append(problems, fmt.Sprintf("Client output buffers hold %d bytes, more than 10%% of the heap. "+
+			"The biggest holds %d bytes: look for slow readers with CLIENT LIST and bound them with "+
+			"client-output-buffer-limit.", total, biggest))
+	}
+	if clients > 0 && total/clients > 200*1024 {
+		problems = append(problems, "Clients average more than 200KB of pending output each. Check for clients "+
+			"that pipeline without reading replies.")
+	}
+
+	if len(problems) == 0 {
+		return "No memory problems were detected in this instance.\n"
+	}
+
+	var b strings.Builder
+	b.WriteString("The following memory issues were detected:\n\n")
+	for _, problem := range problems {
+		b.WriteString(" * " + problem + "\n\n")
+	}
+	return b.String()
+}
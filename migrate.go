@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrateDefaultTimeout bounds MIGRATE's round trips when its timeout is 0.
+const migrateDefaultTimeout = time.Second
+
+// migrateKeys returns the keys of "MIGRATE host port key db timeout
+// [... KEYS key ...]": the key, or those after KEYS when it is empty.
+func migrateKeys(args []Value) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	if args[2].bulk != "" {
+		return []string{args[2].bulk}
+	}
+	for i := 5; i < len(args); i++ {
+		if strings.EqualFold(args[i].bulk, "KEYS") {
+			keys := make([]string, 0, len(args)-i-1)
+			for _, arg := range args[i+1:] {
+				keys = append(keys, arg.bulk)
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// handleMigrate handles "MIGRATE host port key|"" db timeout [COPY]
+// [REPLACE] [AUTH password | AUTH2 username password] [KEYS key ...]",
+// moving keys to another server: each is restored there with its TTL, by
+// RESTORE-ASKING so a cluster node importing the key's slot accepts it, and
+// deleted here once all were, unless COPY is given. Keys that exist on the
+// target are replaced with REPLACE, and an error otherwise. timeout bounds
+// each round trip in milliseconds. Keys stay here if any key couldn't be
+// restored, so the move can be retried, with REPLACE.
+func handleMigrate(c *Client, args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'migrate' command"}
+	}
+
+	addr := net.JoinHostPort(args[0].bulk, args[1].bulk)
+	targetDB, err := strconv.Atoi(args[3].bulk)
+	if err != nil || targetDB < 0 {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	ms, err := strconv.ParseInt(args[4].bulk, 10, 64)
+	if err != nil || ms < 0 {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout == 0 {
+		timeout = migrateDefaultTimeout
+	}
+
+	copyKeys, replace := false, false
+	var auth []string
+	for i := 5; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].bulk); {
+		case option == "COPY":
+			copyKeys = true
+		case option == "REPLACE":
+			replace = true
+		case option == "AUTH" && i+1 < len(args):
+			auth = []string{"AUTH", args[i+1].bulk}
+			i++
+		case option == "AUTH2" && i+2 < len(args):
+			auth = []string{"AUTH", args[i+1].bulk, args[i+2].bulk}
+			i += 2
+		case option == "KEYS":
+			if args[2].bulk != "" {
+				return Value{typ: "error", str: "ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"}
+			}
+			i = len(args)
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	// Serialize the keys that exist, as DUMP and PTTL would.
+	db := c.database()
+	var keys []string
+	var commands [][]string
+	if auth != nil {
+		commands = append(commands, auth)
+	}
+	commands = append(commands, []string{"SELECT", strconv.Itoa(targetDB)})
+	now := nowMillis()
+	db.mu.RLock()
+	for _, key := range migrateKeys(args) {
+		if !db.exists(key) || db.expiredOnReplica(c, key) {
+			continue
+		}
+		value, hasValue := db.store.Get(key)
+		hash, hasHash := db.store.GetHash(key)
+		if !hasHash {
+			hash = nil
+		}
+		ttl := int64(0)
+		if when, ok := db.store.ExpireTime(key); ok {
+			ttl = max(when-now, 1)
+		}
+		restore := []string{"RESTORE-ASKING", key, strconv.FormatInt(ttl, 10), string(dumpPayload(value, hasValue, hash))}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		commands = append(commands, restore)
+		keys = append(keys, key)
+	}
+	db.mu.RUnlock()
+	if len(keys) == 0 {
+		return Value{typ: "string", str: "NOKEY"}
+	}
+
+	var errValue *Value
+	writeUnlocked(func() {
+		errValue = sendMigration(addr, timeout, commands)
+	})
+	if errValue != nil {
+		return *errValue
+	}
+
+	if !copyKeys {
+		db.mu.Lock()
+		for _, key := range keys {
+			db.removeKey(key)
+		}
+		db.mu.Unlock()
+		notifyKeyEvent(db, "del", keys...)
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// sendMigration pipelines the commands of a MIGRATE to the server at addr,
+// returning the error to reply with if any failed.
+func sendMigration(addr string, timeout time.Duration, commands [][]string) *Value {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return &Value{typ: "error", str: "IOERR error or timeout connecting to the client"}
+	}
+	defer conn.Close()
+
+	var buf []byte
+	for _, command := range commands {
+		args := make([]Value, 0, len(command))
+		for _, arg := range command {
+			args = append(args, Value{typ: "bulk", bulk: arg})
+		}
+		encoded, err := Value{typ: "array", array: args}.Marshal()
+		if err != nil {
+			return &Value{typ: "error", str: "ERR " + err.Error()}
+		}
+		buf = append(buf, encoded...)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(buf); err != nil {
+		return &Value{typ: "error", str: "IOERR error or timeout writing to target instance"}
+	}
+
+	reader := NewRESP(conn)
+	var failed *Value
+	for range commands {
+		conn.SetDeadline(time.Now().Add(timeout))
+		reply, err := reader.ReadReply()
+		if err != nil {
+			return &Value{typ: "error", str: "IOERR error or timeout reading to target instance"}
+		}
+		if reply.typ == "error" && failed == nil {
+			failed = &Value{typ: "error", str: "ERR Target instance replied with error: " + reply.str}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,169 @@
+package main
+
+import "time"
+
+// queuedCommand is a command queued by a client inside MULTI, validated and
+// waiting for EXEC.
+type queuedCommand struct {
+	command string
+	cmd     Command
+	value   Value
+}
+
+// transactionCommands are run right away inside MULTI instead of being queued.
+var transactionCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"RESET":   true,
+}
+
+// persistBlock tracks the transactions and scripts running under the
+// exclusive execution lock, whose writes are persisted and streamed to
+// replicas inside a MULTI block, so that a replica never serves, and the AOF
+// never replays, part of them. depth counts those running, as a transaction
+// may run scripts, and open is set once the MULTI was persisted, in front of
+// the first write. db is the database of the last write, which the EXEC
+// applies to so that it isn't preceded by a SELECT. Only the goroutine
+// holding executionMu for writing changes it.
+var persistBlock struct {
+	depth int
+	open  bool
+	db    int
+}
+
+// beginAtomic records that a transaction or script starts running.
+// executionMu must be held for writing.
+func beginAtomic() {
+	persistBlock.depth++
+}
+
+// openPersistBlock persists the MULTI opening the block of the running
+// transaction or script in front of its first write, about to apply to
+// database db. executionMu must be held.
+func openPersistBlock(c *Client, db int) {
+	if persistBlock.depth == 0 {
+		return
+	}
+	persistBlock.db = db
+	if persistBlock.open {
+		return
+	}
+	persistBlock.open = true
+	writePersisted(c, db, Value{typ: "array", array: []Value{{typ: "bulk", bulk: "MULTI"}}})
+}
+
+// endAtomic records that a transaction or script returned, persisting the
+// EXEC closing the MULTI block once the outermost one did, if it wrote.
+// executionMu must be held for writing.
+func endAtomic(c *Client) {
+	persistBlock.depth--
+	if persistBlock.depth > 0 || !persistBlock.open {
+		return
+	}
+	persistBlock.open = false
+	writePersisted(c, persistBlock.db, Value{typ: "array", array: []Value{{typ: "bulk", bulk: "EXEC"}}})
+}
+
+// queueCommand adds a command to the client's open transaction, returning
+// the error of writing the reply like Write.
+func (c *Client) queueCommand(command string, cmd Command, value Value) error {
+	c.queued = append(c.queued, queuedCommand{command: command, cmd: cmd, value: value})
+	return c.Write(Value{typ: "string", str: "QUEUED"})
+}
+
+// reject answers a command refused before execution, returning the error of
+// writing the reply like Write. Inside MULTI the refusal also makes EXEC
+// abort, since the transaction lost a command.
+func (c *Client) reject(command string, reply Value) error {
+	if c.multi {
+		c.multiDirty = true
+	}
+	return c.Write(recordRejected(command, reply))
+}
+
+// discardTransaction closes the client's transaction, dropping its queue
+// and its watched keys.
+func (c *Client) discardTransaction() {
+	c.multi = false
+	c.multiDirty = false
+	c.queued = nil
+	unwatchAll(c)
+}
+
+// transactionWrites reports whether the client's transaction queued any write.
+func (c *Client) transactionWrites() bool {
+	for _, q := range c.queued {
+		if q.cmd.isWrite() {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionDeniesOOM reports whether a queued command is flagged denyoom,
+// which refuses the transaction above maxmemory.
+func (c *Client) transactionDeniesOOM() bool {
+	for _, q := range c.queued {
+		if q.cmd.hasFlag("denyoom") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMulti handles the "MULTI" command, opening a transaction.
+func handleMulti(c *Client, args []Value) Value {
+	if c.multi {
+		return Value{typ: "error", str: "ERR MULTI calls can not be nested"}
+	}
+	c.multi = true
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleDiscard handles the "DISCARD" command, dropping the open transaction.
+func handleDiscard(c *Client, args []Value) Value {
+	if !c.multi {
+		return Value{typ: "error", str: "ERR DISCARD without MULTI"}
+	}
+	c.discardTransaction()
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleExec handles the "EXEC" command outside a transaction. Inside one,
+// dispatch runs execTransaction instead, as executing the queued commands
+// takes the execution lock exclusively.
+func handleExec(c *Client, args []Value) Value {
+	return Value{typ: "error", str: "ERR EXEC without MULTI"}
+}
+
+// execTransaction runs the commands queued by the client, returning their
+// replies. A transaction in which a command was refused while queueing is
+// discarded instead, and one whose watched keys were modified returns null.
+// executionMu must be held for writing, so that no other client's command
+// runs in between.
+func execTransaction(c *Client) Value {
+	queued, dirty := c.queued, c.multiDirty
+	failed := watchFailed(c)
+	c.discardTransaction()
+
+	start := time.Now()
+	result := Value{typ: "null"}
+	if dirty {
+		result = Value{typ: "error", str: "EXECABORT Transaction discarded because of previous errors."}
+	} else if !failed {
+		c.exclusive = true
+		beginAtomic()
+		replies := make([]Value, 0, len(queued))
+		for _, q := range queued {
+			replies = append(replies, call(c, q.command, q.cmd, q.value))
+		}
+		endAtomic(c)
+		c.exclusive = false
+		result = Value{typ: "array", array: replies}
+	}
+	recordCall("EXEC", time.Since(start), result)
+
+	return result
+}
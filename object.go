@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+// handleObject handles the "OBJECT" command and its subcommands, which
+// inspect a key without counting as an access to it.
+func handleObject(c *Client, args []Value) Value {
+	switch strings.ToUpper(args[0].bulk) {
+	case "ENCODING", "IDLETIME", "FREQ":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'object|" + strings.ToLower(args[0].bulk) + "' command"}
+		}
+	case "HELP":
+		lines := []string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the key <key>.",
+			"IDLETIME <key>",
+			"    Return the idle time of the key <key>.",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try OBJECT HELP."}
+	}
+
+	configMu.RLock()
+	decayTime := LFUDecayTime
+	configMu.RUnlock()
+
+	db := c.database()
+	key := args[1].bulk
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if !db.exists(key) || db.expiredOnReplica(c, key) {
+		return Value{typ: "null"}
+	}
+
+	if strings.ToUpper(args[0].bulk) == "ENCODING" {
+		if value, ok := db.store.Get(key); ok {
+			return Value{typ: "bulk", bulk: stringEncoding(value)}
+		}
+		encoding, _ := db.store.HashEncoding(key)
+		return Value{typ: "bulk", bulk: encoding}
+	}
+
+	db.accessMu.Lock()
+	a := db.keyAccess(key)
+	db.accessMu.Unlock()
+
+	// Both are tracked whatever the eviction policy, unlike in Redis.
+	if strings.ToUpper(args[0].bulk) == "IDLETIME" {
+		return Value{typ: "integer", num: int(a.idle(lruClock()))}
+	}
+	return Value{typ: "integer", num: int(a.decayed(lruClock(), decayTime))}
+}
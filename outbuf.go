@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputLimit bounds the pending output of one class of clients. A client is
+// disconnected as soon as it reaches hard bytes, or once it has stayed at or
+// above soft bytes for softSeconds. Zero disables a limit.
+type outputLimit struct {
+	hard        int
+	soft        int
+	softSeconds int
+}
+
+// OutputBufferLimits holds the limits per client class.
+var OutputBufferLimits = map[string]outputLimit{
+	"normal":  {0, 0, 0},
+	"replica": {256 * 1024 * 1024, 64 * 1024 * 1024, 60},
+	"pubsub":  {32 * 1024 * 1024, 8 * 1024 * 1024, 60},
+}
+var OutputBufferLimitsMu = sync.RWMutex{}
+
+// errOutputLimit is returned once a client has been dropped for exceeding its limits.
+var errOutputLimit = errors.New("client output buffer limit reached")
+
+// outputBuffer queues a client's outgoing bytes and drains them to the
+// connection from its own goroutine, so producers never block on a slow
+// reader and the amount of pending output can be measured and capped.
+type outputBuffer struct {
+	conn  net.Conn
+	class func() string
+
+	mu sync.Mutex
+	// drained is signaled when output was written or the buffer stopped.
+	drained  *sync.Cond
+	pending  []byte
+	inflight int
+	// held counts output queued outside the buffer until it can be written,
+	// which the limits apply to as well.
+	held      int
+	softSince time.Time
+	closed    bool
+	err       error
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// newOutputBuffer creates an output buffer for conn and starts its writer.
+// class reports the client's limit class each time output is queued.
+func newOutputBuffer(conn net.Conn, class func() string) *outputBuffer {
+	b := &outputBuffer{
+		conn:  conn,
+		class: class,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	b.drained = sync.NewCond(&b.mu)
+	go b.run()
+	return b
+}
+
+// Write queues p for sending, disconnecting the client if that exceeds its limits.
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return 0, b.err
+	}
+	b.pending = append(b.pending, p...)
+	size := len(b.pending) + b.inflight + b.held
+	err := b.checkLimits(size)
+	b.mu.Unlock()
+
+	if err != nil {
+		b.drop()
+		return 0, err
+	}
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// hold counts n bytes queued outside the buffer against the limits, until
+// release, disconnecting the client if that exceeds them.
+func (b *outputBuffer) hold(n int) error {
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return b.err
+	}
+	b.held += n
+	err := b.checkLimits(len(b.pending) + b.inflight + b.held)
+	b.mu.Unlock()
+
+	if err != nil {
+		b.drop()
+	}
+	return err
+}
+
+// release stops counting n bytes counted by hold.
+func (b *outputBuffer) release(n int) {
+	b.mu.Lock()
+	b.held -= n
+	b.mu.Unlock()
+}
+
+// drop disconnects a client that exceeded its limits.
+func (b *outputBuffer) drop() {
+	fmt.Println("Closing client that exceeded its output buffer limits:", b.conn.RemoteAddr())
+	b.conn.Close()
+}
+
+// checkLimits applies the limits of the client's class to size. b.mu must be held.
+func (b *outputBuffer) checkLimits(size int) error {
+	OutputBufferLimitsMu.RLock()
+	limit := OutputBufferLimits[b.class()]
+	OutputBufferLimitsMu.RUnlock()
+
+	if limit.hard > 0 && size >= limit.hard {
+		b.err = errOutputLimit
+		return b.err
+	}
+
+	if limit.soft > 0 && size >= limit.soft {
+		if b.softSince.IsZero() {
+			b.softSince = time.Now()
+		} else if time.Since(b.softSince) >= time.Duration(limit.softSeconds)*time.Second {
+			b.err = errOutputLimit
+			return b.err
+		}
+	} else {
+		b.softSince = time.Time{}
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes queued, held or being written.
+func (b *outputBuffer) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.pending) + b.inflight + b.held
+}
+
+// waitBelow waits until less than size bytes are queued or being written,
+// for producers of large output to let it drain first. It returns the error
+// that stopped the buffer, if any.
+func (b *outputBuffer) waitBelow(size int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		err := b.err
+		if err == nil && b.closed {
+			err = net.ErrClosed
+		}
+		if err != nil || len(b.pending)+b.inflight < size {
+			return err
+		}
+		b.drained.Wait()
+	}
+}
+
+// run drains queued output to the connection until the buffer is closed.
+func (b *outputBuffer) run() {
+	defer close(b.done)
+	defer b.drained.Broadcast()
+
+	for {
+		b.mu.Lock()
+		data := b.pending
+		b.pending = nil
+		b.inflight = len(data)
+		closed := b.closed
+		b.mu.Unlock()
+
+		if len(data) > 0 {
+			_, err := b.conn.Write(data)
+
+			b.mu.Lock()
+			b.inflight = 0
+			if err != nil && b.err == nil {
+				b.err = err
+			}
+			failed := b.err != nil
+			b.drained.Broadcast()
+			b.mu.Unlock()
+
+			if failed {
+				return
+			}
+			continue
+		}
+
+		if closed {
+			return
+		}
+		<-b.wake
+	}
+}
+
+// Close stops accepting output and waits up to timeout for queued output to be sent.
+func (b *outputBuffer) Close(timeout time.Duration) {
+	b.mu.Lock()
+	b.closed = true
+	b.drained.Broadcast()
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+
+	b.conn.SetWriteDeadline(time.Now().Add(timeout))
+	<-b.done
+}
+
+// memoryUnits are the suffixes accepted by parseMemory, longest first.
+var memoryUnits = []struct {
+	suffix     string
+	multiplier int
+}{
+	{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+}
+
+// parseMemory parses a byte count with an optional unit suffix such as "mb".
+func parseMemory(s string) (int, error) {
+	number := strings.ToLower(s)
+	multiplier := 1
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory value %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// setOutputBufferLimits parses "class hard soft seconds" groups, as used by
+// the client-output-buffer-limit option, and applies them.
+func setOutputBufferLimits(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return fmt.Errorf("expected groups of \"class hard soft seconds\", got %q", s)
+	}
+
+	limits := map[string]outputLimit{}
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = "replica"
+		}
+		if class != "normal" && class != "replica" && class != "pubsub" {
+			return fmt.Errorf("invalid client class %q", fields[i])
+		}
+		hard, err := parseMemory(fields[i+1])
+		if err != nil {
+			return err
+		}
+		soft, err := parseMemory(fields[i+2])
+		if err != nil {
+			return err
+		}
+		seconds, err := strconv.Atoi(fields[i+3])
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid soft limit seconds %q", fields[i+3])
+		}
+		limits[class] = outputLimit{hard: hard, soft: soft, softSeconds: seconds}
+	}
+
+	OutputBufferLimitsMu.Lock()
+	for class, limit := range limits {
+		OutputBufferLimits[class] = limit
+	}
+	OutputBufferLimitsMu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client pause state set by CLIENT PAUSE. While a pause is active, affected
+// commands wait until resume is closed by CLIENT UNPAUSE or by the timer.
+var pauseMu = sync.Mutex{}
+var pauseUntil time.Time
+var pauseWritesOnly bool
+var pauseResume chan struct{}
+
+// handleClientPause handles "CLIENT PAUSE timeout [WRITE|ALL]".
+func handleClientPause(args []Value) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|pause' command"}
+	}
+
+	ms, err := strconv.Atoi(args[0].bulk)
+	if err != nil || ms < 0 {
+		return Value{typ: "error", str: "ERR timeout is not an integer or out of range"}
+	}
+
+	writesOnly := false
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1].bulk) {
+		case "WRITE":
+			writesOnly = true
+		case "ALL":
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	timeout := time.Duration(ms) * time.Millisecond
+	until := time.Now().Add(timeout)
+
+	pauseMu.Lock()
+	if pauseResume == nil {
+		pauseResume = make(chan struct{})
+		pauseWritesOnly = writesOnly
+	} else if !writesOnly {
+		// A pause can be widened to all commands but never narrowed.
+		pauseWritesOnly = false
+	}
+	if until.After(pauseUntil) {
+		pauseUntil = until
+	}
+	pauseMu.Unlock()
+
+	time.AfterFunc(timeout, expirePause)
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleClientUnpause handles "CLIENT UNPAUSE".
+func handleClientUnpause(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|unpause' command"}
+	}
+
+	pauseMu.Lock()
+	resumeClients()
+	pauseMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// expirePause ends the pause once its deadline has passed. It runs from the
+// timer of every CLIENT PAUSE, so earlier timers of an extended pause do nothing.
+func expirePause() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	if pauseResume != nil && !time.Now().Before(pauseUntil) {
+		resumeClients()
+	}
+}
+
+// resumeClients releases every waiting client. pauseMu must be held.
+func resumeClients() {
+	if pauseResume != nil {
+		close(pauseResume)
+		pauseResume = nil
+	}
+	pauseUntil = time.Time{}
+}
+
+// pauseWrites pauses write commands until resumeWrites, for FAILOVER. A
+// CLIENT PAUSE may widen it to all commands meanwhile.
+func pauseWrites() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	if pauseResume == nil {
+		pauseResume = make(chan struct{})
+		pauseWritesOnly = true
+	}
+}
+
+// resumeWrites ends the pause started by pauseWrites.
+func resumeWrites() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	resumeClients()
+}
+
+// waitWhilePaused blocks the caller while an active pause covers the command.
+func waitWhilePaused(isWrite bool) {
+	for {
+		pauseMu.Lock()
+		resume := pauseResume
+		covered := resume != nil && (isWrite || !pauseWritesOnly)
+		pauseMu.Unlock()
+
+		if !covered {
+			return
+		}
+		<-resume
+	}
+}
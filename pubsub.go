@@ -0,0 +1,417 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pubsubChannels maps each channel to its subscribers by client id.
+var pubsubChannels = map[string]map[int64]*Client{}
+
+// pubsubPatterns maps each glob pattern to its subscribers by client id.
+var pubsubPatterns = map[string]map[int64]*Client{}
+
+// pubsubShardChannels maps each shard channel to its subscribers by client id.
+var pubsubShardChannels = map[string]map[int64]*Client{}
+
+// pubsubMu guards the registries above and the subscriptions recorded on clients.
+var pubsubMu = sync.RWMutex{}
+
+// subscriptionKind describes one flavour of subscription: which registry it
+// lives in, which set of the client records it, how its confirmations are
+// named and which subscriptions they count.
+type subscriptionKind struct {
+	subscribe   string
+	unsubscribe string
+	registry    *map[string]map[int64]*Client
+	set         func(c *Client) *map[string]bool
+	count       func(c *Client) int
+}
+
+var (
+	channelKind = subscriptionKind{
+		subscribe: "subscribe", unsubscribe: "unsubscribe", registry: &pubsubChannels,
+		set:   func(c *Client) *map[string]bool { return &c.channels },
+		count: func(c *Client) int { return len(c.channels) + len(c.patterns) },
+	}
+	patternKind = subscriptionKind{
+		subscribe: "psubscribe", unsubscribe: "punsubscribe", registry: &pubsubPatterns,
+		set:   func(c *Client) *map[string]bool { return &c.patterns },
+		count: func(c *Client) int { return len(c.channels) + len(c.patterns) },
+	}
+	// Shard channels are counted apart from channels and patterns, as they
+	// are scoped to the shard owning the channel's slot rather than the
+	// whole cluster.
+	shardChannelKind = subscriptionKind{
+		subscribe: "ssubscribe", unsubscribe: "sunsubscribe", registry: &pubsubShardChannels,
+		set:   func(c *Client) *map[string]bool { return &c.shardChannels },
+		count: func(c *Client) int { return len(c.shardChannels) },
+	}
+)
+
+// subscribedCommands are the only commands a RESP2 client may run while it
+// has subscriptions, because its connection now carries messages.
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"RESET":        true,
+}
+
+// subscriptionCount returns the number of channels, patterns and shard
+// channels the client is subscribed to.
+func (c *Client) subscriptionCount() int {
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	return len(c.channels) + len(c.patterns) + len(c.shardChannels)
+}
+
+// pubsubValue frames a pub/sub message or confirmation for the client: a
+// push in RESP3, an array in RESP2.
+func pubsubValue(c *Client, parts ...Value) Value {
+	c.metaMu.Lock()
+	proto := c.proto
+	c.metaMu.Unlock()
+
+	if proto == 3 {
+		return Value{typ: "push", array: parts}
+	}
+	return Value{typ: "array", array: parts}
+}
+
+// multiReply sends all but the last of the replies and returns the last one,
+// for commands such as SUBSCRIBE that answer once per argument.
+func multiReply(c *Client, replies []Value) Value {
+	for _, reply := range replies[:len(replies)-1] {
+		c.Write(reply)
+	}
+	return replies[len(replies)-1]
+}
+
+// subscribe adds the client to each of the channels or patterns of the kind,
+// confirming every one with the client's resulting subscription count.
+func subscribe(c *Client, kind subscriptionKind, names []Value) Value {
+	pubsubMu.Lock()
+	counts := make([]int, 0, len(names))
+	set := kind.set(c)
+	registry := *kind.registry
+	for _, name := range names {
+		if *set == nil {
+			*set = map[string]bool{}
+		}
+		if !(*set)[name.bulk] {
+			(*set)[name.bulk] = true
+			if registry[name.bulk] == nil {
+				registry[name.bulk] = map[int64]*Client{}
+			}
+			registry[name.bulk][c.id] = c
+		}
+		counts = append(counts, kind.count(c))
+	}
+	pubsubMu.Unlock()
+
+	replies := make([]Value, 0, len(names))
+	for i, name := range names {
+		replies = append(replies, pubsubValue(c,
+			Value{typ: "bulk", bulk: kind.subscribe},
+			Value{typ: "bulk", bulk: name.bulk},
+			Value{typ: "integer", num: counts[i]},
+		))
+	}
+	return multiReply(c, replies)
+}
+
+// unsubscribeOne removes one subscription of the kind. pubsubMu must be held for writing.
+func unsubscribeOne(c *Client, kind subscriptionKind, name string) {
+	set := *kind.set(c)
+	if !set[name] {
+		return
+	}
+	delete(set, name)
+
+	registry := *kind.registry
+	delete(registry[name], c.id)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+}
+
+// unsubscribe removes the client from the named channels or patterns of the
+// kind, or from all of them when none are named, confirming each one.
+func unsubscribe(c *Client, kind subscriptionKind, names []Value) Value {
+	pubsubMu.Lock()
+	targets := make([]string, 0, len(names))
+	for _, name := range names {
+		targets = append(targets, name.bulk)
+	}
+	if len(names) == 0 {
+		for name := range *kind.set(c) {
+			targets = append(targets, name)
+		}
+	}
+
+	counts := make([]int, 0, len(targets))
+	for _, name := range targets {
+		unsubscribeOne(c, kind, name)
+		counts = append(counts, kind.count(c))
+	}
+	pubsubMu.Unlock()
+
+	if len(targets) == 0 {
+		pubsubMu.RLock()
+		count := kind.count(c)
+		pubsubMu.RUnlock()
+
+		return pubsubValue(c,
+			Value{typ: "bulk", bulk: kind.unsubscribe},
+			Value{typ: "null"},
+			Value{typ: "integer", num: count},
+		)
+	}
+
+	replies := make([]Value, 0, len(targets))
+	for i, name := range targets {
+		replies = append(replies, pubsubValue(c,
+			Value{typ: "bulk", bulk: kind.unsubscribe},
+			Value{typ: "bulk", bulk: name},
+			Value{typ: "integer", num: counts[i]},
+		))
+	}
+	return multiReply(c, replies)
+}
+
+// unsubscribeAll silently drops every subscription of the client, as on
+// disconnect or RESET.
+func unsubscribeAll(c *Client) {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	for _, kind := range []subscriptionKind{channelKind, patternKind, shardChannelKind} {
+		for name := range *kind.set(c) {
+			unsubscribeOne(c, kind, name)
+		}
+	}
+}
+
+// handleSubscribe handles "SUBSCRIBE channel [channel ...]".
+func handleSubscribe(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'subscribe' command"}
+	}
+	return subscribe(c, channelKind, args)
+}
+
+// handleUnsubscribe handles "UNSUBSCRIBE [channel ...]". Without arguments
+// the client leaves every channel.
+func handleUnsubscribe(c *Client, args []Value) Value {
+	return unsubscribe(c, channelKind, args)
+}
+
+// handlePSubscribe handles "PSUBSCRIBE pattern [pattern ...]".
+func handlePSubscribe(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'psubscribe' command"}
+	}
+	return subscribe(c, patternKind, args)
+}
+
+// handlePUnsubscribe handles "PUNSUBSCRIBE [pattern ...]". Without
+// arguments the client leaves every pattern.
+func handlePUnsubscribe(c *Client, args []Value) Value {
+	return unsubscribe(c, patternKind, args)
+}
+
+// handleSSubscribe handles "SSUBSCRIBE shardchannel [shardchannel ...]".
+func handleSSubscribe(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ssubscribe' command"}
+	}
+	return subscribe(c, shardChannelKind, args)
+}
+
+// handleSUnsubscribe handles "SUNSUBSCRIBE [shardchannel ...]". Without
+// arguments the client leaves every shard channel.
+func handleSUnsubscribe(c *Client, args []Value) Value {
+	return unsubscribe(c, shardChannelKind, args)
+}
+
+// publish delivers a message to the subscribers of the channel and of the
+// patterns matching it, and returns the number of deliveries. A client
+// subscribed both ways receives, and counts, the message more than once.
+func publish(channel, message string) int {
+	type delivery struct {
+		c       *Client
+		pattern string
+	}
+
+	pubsubMu.RLock()
+	deliveries := make([]delivery, 0, len(pubsubChannels[channel]))
+	for _, c := range pubsubChannels[channel] {
+		deliveries = append(deliveries, delivery{c: c})
+	}
+	for pattern, clients := range pubsubPatterns {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		for _, c := range clients {
+			deliveries = append(deliveries, delivery{c: c, pattern: pattern})
+		}
+	}
+	pubsubMu.RUnlock()
+
+	for _, d := range deliveries {
+		if d.pattern == "" {
+			d.c.Push(pubsubValue(d.c,
+				Value{typ: "bulk", bulk: "message"},
+				Value{typ: "bulk", bulk: channel},
+				Value{typ: "bulk", bulk: message},
+			))
+			continue
+		}
+		d.c.Push(pubsubValue(d.c,
+			Value{typ: "bulk", bulk: "pmessage"},
+			Value{typ: "bulk", bulk: d.pattern},
+			Value{typ: "bulk", bulk: channel},
+			Value{typ: "bulk", bulk: message},
+		))
+	}
+
+	return len(deliveries)
+}
+
+// spublish delivers a message to the subscribers of the shard channel and
+// returns their number. Patterns never match shard channels.
+func spublish(channel, message string) int {
+	pubsubMu.RLock()
+	clients := make([]*Client, 0, len(pubsubShardChannels[channel]))
+	for _, c := range pubsubShardChannels[channel] {
+		clients = append(clients, c)
+	}
+	pubsubMu.RUnlock()
+
+	for _, c := range clients {
+		c.Push(pubsubValue(c,
+			Value{typ: "bulk", bulk: "smessage"},
+			Value{typ: "bulk", bulk: channel},
+			Value{typ: "bulk", bulk: message},
+		))
+	}
+
+	return len(clients)
+}
+
+// handlePublish handles "PUBLISH channel message".
+func handlePublish(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'publish' command"}
+	}
+
+	return Value{typ: "integer", num: publish(args[0].bulk, args[1].bulk)}
+}
+
+// handleSPublish handles "SPUBLISH shardchannel message".
+func handleSPublish(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'spublish' command"}
+	}
+
+	return Value{typ: "integer", num: spublish(args[0].bulk, args[1].bulk)}
+}
+
+// handlePubsub handles the "PUBSUB" command and its subcommands.
+func handlePubsub(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pubsub' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'pubsub|" + strings.ToLower(args[0].bulk) + "' command"}
+		}
+		pattern := "*"
+		if len(args) == 2 {
+			pattern = args[1].bulk
+		}
+		registry := pubsubChannels
+		if strings.ToUpper(args[0].bulk) == "SHARDCHANNELS" {
+			registry = pubsubShardChannels
+		}
+
+		pubsubMu.RLock()
+		channels := []string{}
+		for channel := range registry {
+			if matchGlob(pattern, channel) {
+				channels = append(channels, channel)
+			}
+		}
+		pubsubMu.RUnlock()
+		sort.Strings(channels)
+
+		values := make([]Value, 0, len(channels))
+		for _, channel := range channels {
+			values = append(values, Value{typ: "bulk", bulk: channel})
+		}
+		return Value{typ: "array", array: values}
+	case "NUMSUB", "SHARDNUMSUB":
+		registry := pubsubChannels
+		if strings.ToUpper(args[0].bulk) == "SHARDNUMSUB" {
+			registry = pubsubShardChannels
+		}
+
+		pubsubMu.RLock()
+		values := make([]Value, 0, 2*(len(args)-1))
+		for _, channel := range args[1:] {
+			values = append(values,
+				Value{typ: "bulk", bulk: channel.bulk},
+				Value{typ: "integer", num: len(registry[channel.bulk])},
+			)
+		}
+		pubsubMu.RUnlock()
+		return Value{typ: "array", array: values}
+	case "NUMPAT":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'pubsub|numpat' command"}
+		}
+		pubsubMu.RLock()
+		defer pubsubMu.RUnlock()
+		return Value{typ: "integer", num: len(pubsubPatterns)}
+	case "HELP":
+		lines := []string{
+			"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CHANNELS [<pattern>]",
+			"    Return the currently active channels matching a <pattern> (default: '*').",
+			"NUMPAT",
+			"    Return number of subscriptions to patterns.",
+			"NUMSUB [<channel> ...]",
+			"    Return the number of subscribers for the specified channels, excluding",
+			"    pattern subscriptions(default: no channels).",
+			"SHARDCHANNELS [<pattern>]",
+			"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+			"SHARDNUMSUB [<shardchannel> ...]",
+			"    Return the number of subscribers for the specified shard level channel(s)",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try PUBSUB HELP."}
+	}
+}
+
+// subscribedContextError is returned to subscribed RESP2 clients running
+// anything but the pub/sub commands.
+func subscribedContextError(command string) Value {
+	return Value{typ: "error", str: "ERR Can't execute '" + strings.ToLower(command) +
+		"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / RESET are allowed in this context"}
+}
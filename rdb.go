@@ -0,0 +1,1011 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DBFilename is the name of the snapshot file inside Dir.
+var DBFilename = "dump.rdb"
+
+// Snapshots use the Redis RDB format: "REDIS" and a four-digit version,
+// then records, each starting with an opcode or a value type, then
+// rdbOpEOF and the CRC-64 of everything before it.
+const (
+	// rdbVersion is written when no function library needs rdbVersionFunctions,
+	// as Redis 5 and later and most RDB tools read it.
+	rdbVersion          = 9
+	rdbVersionFunctions = 10
+	// rdbVersionMax is the newest version read.
+	rdbVersionMax = 12
+
+	rdbOpSlotInfo     = 0xF4 // cluster slot sizes, ignored
+	rdbOpFunction     = 0xF5 // library code
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8 // LRU idle time of the next key, ignored
+	rdbOpFreq         = 0xF9 // LFU frequency of the next key, ignored
+	rdbOpAux          = 0xFA // name and value of a field describing the file
+	rdbOpResizeDB     = 0xFB // sizes of the database's tables, ignored
+	rdbOpExpireTimeMs = 0xFC // expiry time of the next key, in Unix milliseconds
+	rdbOpExpireTime   = 0xFD // expiry time of the next key, in Unix seconds
+	rdbOpSelectDB     = 0xFE // database number, for the keys that follow
+	rdbOpEOF          = 0xFF
+
+	rdbTypeString       = 0
+	rdbTypeHash         = 4  // number of fields, then field and value pairs
+	rdbTypeHashZiplist  = 13 // a ziplist of fields and values
+	rdbTypeHashListpack = 16 // a listpack of fields and values
+
+	// Types of Redis values StormyDB doesn't have, which are only skipped.
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeZset2            = 5
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZsetZiplist      = 12
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+	rdbTypeHashMetadata     = 24 // hashes with field TTLs
+	rdbTypeHashListpackEx   = 25
+
+	// Encodings of strings, flagged by a length whose top bits are set.
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// State of snapshots, guarded by saveMu.
+var (
+	// lastSave is when the last snapshot was written successfully.
+	lastSave = time.Now()
+	// lastBgsaveErr is the outcome of the last BGSAVE, started at lastBgsaveTry.
+	lastBgsaveErr error
+	lastBgsaveTry time.Time
+	// bgsaveInProgress is set while BGSAVE writes a snapshot.
+	bgsaveInProgress bool
+	saveMu           = sync.Mutex{}
+)
+
+// bgsaves counts the snapshots BGSAVE is writing, for shutdown to wait for.
+var bgsaves = sync.WaitGroup{}
+
+// handleSave handles the "SAVE" command, writing a snapshot before replying.
+// executionMu must be held for writing, for the snapshot.
+func handleSave(c *Client, args []Value) Value {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	if bgsaveInProgress {
+		return Value{typ: "error", str: "ERR Background save already in progress"}
+	}
+	changes := atomic.LoadInt64(&dirty)
+	if err := writeSnapshot(DBFilename, snapshotDataset()); err != nil {
+		fmt.Println("Error saving snapshot:", err)
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	atomic.AddInt64(&dirty, -changes)
+	lastSave = time.Now()
+	queueRemoteBackup()
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleBgSave handles "BGSAVE [TO path]", writing a snapshot of the
+// dataset as it is now in the background, to DBFilename or, as a backup, to
+// path. executionMu must be held for writing, for the snapshot.
+func handleBgSave(c *Client, args []Value) Value {
+	if len(args) > 0 {
+		return handleBgSaveTo(c, args)
+	}
+	if !startBgsave() {
+		return Value{typ: "error", str: "ERR Background save already in progress"}
+	}
+	return Value{typ: "string", str: "Background saving started"}
+}
+
+// startBgsave snapshots the dataset and writes the snapshot in the
+// background, unless a BGSAVE is already in progress. executionMu must be
+// held for writing.
+func startBgsave() bool {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	if bgsaveInProgress {
+		return false
+	}
+	bgsaveInProgress = true
+	lastBgsaveTry = time.Now()
+
+	bgsaves.Add(1)
+	go bgsave(snapshotDataset(), atomic.LoadInt64(&dirty))
+	return true
+}
+
+// bgsave writes a snapshot taken by BGSAVE, when the dataset had the given
+// number of unsaved changes.
+func bgsave(snapshot datasetSnapshot, changes int64) {
+	defer bgsaves.Done()
+	err := writeSnapshot(DBFilename, snapshot)
+
+	saveMu.Lock()
+	bgsaveInProgress = false
+	lastBgsaveErr = err
+	if err == nil {
+		atomic.AddInt64(&dirty, -changes)
+		lastSave = time.Now()
+	}
+	saveMu.Unlock()
+
+	if err != nil {
+		fmt.Println("Error in background saving:", err)
+		return
+	}
+	fmt.Println("Background saving terminated with success")
+	queueRemoteBackup()
+}
+
+// handleLastSave handles the "LASTSAVE" command, returning the Unix time of
+// the last successful snapshot.
+func handleLastSave(c *Client, args []Value) Value {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	return Value{typ: "integer", num: int(lastSave.Unix())}
+}
+
+// infoSnapshots reports the state of snapshots for INFO.
+func infoSnapshots() []string {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	inProgress, backupRunning := 0, 0
+	if bgsaveInProgress {
+		inProgress = 1
+	}
+	if backupInProgress {
+		backupRunning = 1
+	}
+
+	return []string{
+		fmt.Sprintf("rdb_changes_since_last_save:%d", atomic.LoadInt64(&dirty)),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", inProgress),
+		fmt.Sprintf("rdb_last_save_time:%d", lastSave.Unix()),
+		"rdb_last_bgsave_status:" + statusString(lastBgsaveErr),
+		fmt.Sprintf("rdb_backup_in_progress:%d", backupRunning),
+		"rdb_last_backup_status:" + statusString(lastBackupErr),
+	}
+}
+
+// tempSnapshots numbers the temporary files snapshots are written to, as a
+// backup may be written alongside BGSAVE.
+var tempSnapshots int64
+
+// writeSnapshot writes the snapshot to a temporary file in the same
+// directory and atomically replaces the file at path with it.
+func writeSnapshot(path string, snapshot datasetSnapshot) error {
+	tempPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d-%d.rdb", os.Getpid(), atomic.AddInt64(&tempSnapshots, 1)))
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	if err := encodeSnapshotFile(f, snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// encodeSnapshot writes the snapshot to w. Keys that have expired are left
+// out.
+func encodeSnapshot(w io.Writer, snapshot datasetSnapshot) error {
+	crc := &crc64{}
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	version := rdbVersion
+	if len(snapshot.libraries) > 0 {
+		version = rdbVersionFunctions
+	}
+	buf := []byte(fmt.Sprintf("REDIS%04d", version))
+	aux := func(name, value string) {
+		buf = append(buf, rdbOpAux)
+		buf = appendRDBString(buf, name)
+		buf = appendRDBString(buf, value)
+	}
+	flush := func() error {
+		_, err := bw.Write(buf)
+		buf = buf[:0]
+		return err
+	}
+
+	aux("redis-bits", "64")
+	aux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	if snapshot.stream.db != 0 {
+		aux("repl-stream-db", strconv.Itoa(snapshot.stream.db))
+	}
+	if snapshot.stream.redis {
+		aux("stormy-stream-origin", "redis")
+	}
+	for _, code := range snapshot.libraries {
+		buf = append(buf, rdbOpFunction)
+		buf = appendRDBString(buf, code)
+	}
+
+	now := nowMillis()
+	for _, db := range snapshot.dbs {
+		expired := func(key string) bool {
+			when, ok := db.expires[key]
+			return ok && when <= now
+		}
+
+		keys, expiring := 0, 0
+		for key := range db.sets {
+			if !expired(key) {
+				keys++
+			}
+		}
+		for key := range db.hsets {
+			if !expired(key) {
+				keys++
+			}
+		}
+		for key := range db.expires {
+			if !expired(key) {
+				expiring++
+			}
+		}
+		if keys == 0 && len(db.crdt) == 0 {
+			continue
+		}
+
+		buf = append(buf, rdbOpSelectDB)
+		buf = appendRDBLength(buf, uint64(db.id))
+		buf = append(buf, rdbOpResizeDB)
+		buf = appendRDBLength(buf, uint64(keys))
+		buf = appendRDBLength(buf, uint64(expiring))
+
+		// key writes the key's expiry time, if any, and its type and name.
+		key := func(typ byte, key string) {
+			if when, ok := db.expires[key]; ok {
+				buf = append(buf, rdbOpExpireTimeMs)
+				buf = binary.LittleEndian.AppendUint64(buf, uint64(when))
+			}
+			buf = append(buf, typ)
+			buf = appendRDBString(buf, key)
+		}
+
+		for k, value := range db.sets {
+			if expired(k) {
+				continue
+			}
+			key(rdbTypeString, k)
+			buf = appendRDBString(buf, value)
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		for k, hash := range db.hsets {
+			if expired(k) {
+				continue
+			}
+			key(rdbTypeHash, k)
+			buf = appendRDBLength(buf, uint64(len(hash)))
+			for field, value := range hash {
+				buf = appendRDBString(buf, field)
+				buf = appendRDBString(buf, value)
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		// The active-active state of the keys, kept for removed keys too,
+		// follows them as auxiliary fields other servers ignore.
+		for _, value := range db.crdt {
+			command, err := value.Marshal()
+			if err != nil {
+				return err
+			}
+			aux("stormy-crdt", string(command))
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	buf = append(buf, rdbOpEOF)
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, crc.sum))
+	return err
+}
+
+// appendRDBLength appends a length: 6 bits in one byte, 14 bits in two, or
+// a marker byte and 32 or 64 bits, big-endian.
+func appendRDBLength(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0x80), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0x81), n)
+	}
+}
+
+// appendRDBString appends a string, as its length and its bytes.
+func appendRDBString(buf []byte, s string) []byte {
+	return append(appendRDBLength(buf, uint64(len(s))), s...)
+}
+
+// loadSnapshot loads the snapshot at path into the databases and function
+// libraries, reporting whether there was one. Keys that have expired since
+// are skipped, and so are keys of types StormyDB doesn't have with
+// skipUnsupported, which fail loading otherwise.
+func loadSnapshot(path string, skipUnsupported bool) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	dr, err := decompressReader(bufio.NewReader(f))
+	if err != nil {
+		return true, err
+	}
+	defer dr.Close()
+
+	r := &rdbReader{r: bufio.NewReader(dr), crc: &crc64{}, skipUnsupported: skipUnsupported}
+	err = decodeSnapshot(r)
+	if r.skipped > 0 {
+		fmt.Printf("Skipped %d keys of types StormyDB doesn't have from %s\n", r.skipped, path)
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		// Past a valid header, -repair keeps what was read before the damage.
+		// The file stays as it is until the next save replaces it.
+		if Repair && r.header {
+			fmt.Printf("Repaired %s: %v, kept the keys read before the damage\n", path, err)
+			return true, nil
+		}
+		return true, err
+	}
+	return true, nil
+}
+
+// loadedStream describes the primary's stream following the snapshot last
+// loaded, from its auxiliary fields: the database it applies to, from
+// repl-stream-db, and whether it comes from Redis, which writes redis-ver,
+// or from a replica of Redis forwarding its stream. executionMu must be held
+// for writing.
+var loadedStream replicationStream
+
+// emptyDataset flushes every database and removes every function library,
+// for a snapshot to be loaded in their place. executionMu must be held for
+// writing.
+func emptyDataset() {
+	for _, db := range Databases {
+		db.flush()
+		db.mu.Lock()
+		db.crdt = map[string]*crdtKey{}
+		db.mu.Unlock()
+	}
+	functionsMu.Lock()
+	for _, lib := range libraries {
+		removeLibrary(lib)
+	}
+	functionsMu.Unlock()
+}
+
+// decodeSnapshot applies the records read from r. Besides strings and
+// hashes, values of other types, which StormyDB doesn't have, fail loading
+// unless r skips them, and so does module data.
+func decodeSnapshot(r *rdbReader) error {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return fmt.Errorf("not an RDB file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbVersionMax {
+		return fmt.Errorf("unsupported RDB version %q", header[5:])
+	}
+	r.header = true
+	loadedStream = replicationStream{}
+
+	now := nowMillis()
+	db := Databases[0]
+	expireAt := int64(0)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case rdbOpAux:
+			name, err := r.readString()
+			if err != nil {
+				return err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return err
+			}
+			switch name {
+			case "stormy-crdt":
+				if err := loadCRDTState(db, value); err != nil {
+					return err
+				}
+			case "repl-stream-db":
+				loadedStream.db, _ = strconv.Atoi(value)
+			case "redis-ver":
+				loadedStream.redis = true
+			case "stormy-stream-origin":
+				loadedStream.redis = value == "redis"
+			}
+		case rdbOpFunction:
+			code, err := r.readString()
+			if err != nil {
+				return err
+			}
+			reply := handleFunctionLoad(newReplayClient(), []Value{{typ: "bulk", bulk: "LOAD"}, {typ: "bulk", bulk: code}})
+			if reply.typ == "error" {
+				if !r.skipUnsupported {
+					return fmt.Errorf("loading function library: %s", reply.str)
+				}
+				fmt.Println("Skipped function library:", reply.str)
+			}
+		case rdbOpSelectDB:
+			id, err := r.readLength()
+			if err != nil {
+				return err
+			}
+			if id >= uint64(len(Databases)) {
+				return fmt.Errorf("database %d is out of range", id)
+			}
+			db = Databases[id]
+		case rdbOpResizeDB:
+			for i := 0; i < 2; i++ {
+				if _, err := r.readLength(); err != nil {
+					return err
+				}
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return err
+				}
+			}
+		case rdbOpIdle:
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+		case rdbOpFreq:
+			if _, err := r.ReadByte(); err != nil {
+				return err
+			}
+		case rdbOpExpireTimeMs:
+			var when [8]byte
+			if _, err := io.ReadFull(r, when[:]); err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(when[:]))
+		case rdbOpExpireTime:
+			var when [4]byte
+			if _, err := io.ReadFull(r, when[:]); err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(when[:])) * 1000
+		case rdbOpEOF:
+			sum := r.crc.sum
+			if version < 5 {
+				return nil
+			}
+			var trailer [8]byte
+			if _, err := io.ReadFull(r.r, trailer[:]); err != nil {
+				return err
+			}
+			// A zero checksum means the writer had checksums disabled.
+			if stored := binary.LittleEndian.Uint64(trailer[:]); stored != 0 && stored != sum {
+				return fmt.Errorf("RDB checksum mismatch")
+			}
+			return nil
+		case rdbOpModuleAux:
+			if !r.skipUnsupported {
+				return fmt.Errorf("RDB files with module data aren't supported")
+			}
+			// The module ID, when the data is loaded and what it is loaded
+			// before or after.
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return err
+				}
+			}
+			if err := r.skipModuleValue(); err != nil {
+				return err
+			}
+		case rdbTypeString, rdbTypeHash, rdbTypeHashZiplist, rdbTypeHashListpack:
+			key, err := r.readString()
+			if err != nil {
+				return err
+			}
+			var value string
+			var hash map[string]string
+			if op == rdbTypeString {
+				value, err = r.readString()
+			} else {
+				hash, err = r.readHash(op)
+			}
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+
+			when := expireAt
+			expireAt = 0
+			if when != 0 && when <= now {
+				continue
+			}
+			db.mu.Lock()
+			if op == rdbTypeString {
+				db.store.Set(key, value)
+			} else {
+				db.store.SetHash(key, hash)
+			}
+			if when != 0 {
+				db.store.Expire(key, when)
+			}
+			db.mu.Unlock()
+		default:
+			if !r.skipUnsupported {
+				return fmt.Errorf("unsupported RDB value type or opcode %d", op)
+			}
+			key, err := r.readString()
+			if err != nil {
+				return err
+			}
+			if err := r.skipValue(op); err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			expireAt = 0
+			r.skipped++
+		}
+	}
+}
+
+// rdbReader reads an RDB file, computing the checksum of what it read.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc *crc64
+	// header is set once a valid header was read.
+	header bool
+	// skipUnsupported skips the keys of types StormyDB doesn't have, which
+	// are counted in skipped.
+	skipUnsupported bool
+	skipped         int
+}
+
+func (r *rdbReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	return n, err
+}
+
+func (r *rdbReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// readLength reads a length, which must not be a string encoding.
+func (r *rdbReader) readLength() (uint64, error) {
+	n, encoded, err := r.readLengthOrEncoding()
+	if err == nil && encoded {
+		err = fmt.Errorf("unexpected string encoding")
+	}
+	return n, err
+}
+
+// readLengthOrEncoding reads a length or, when encoded is set, the encoding
+// of a string that isn't stored as its length and bytes.
+func (r *rdbReader) readLengthOrEncoding() (n uint64, encoded bool, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		low, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(low), false, nil
+	case 2:
+		var size [8]byte
+		switch b {
+		case 0x80:
+			_, err = io.ReadFull(r, size[:4])
+			return uint64(binary.BigEndian.Uint32(size[:4])), false, err
+		case 0x81:
+			_, err = io.ReadFull(r, size[:])
+			return binary.BigEndian.Uint64(size[:]), false, err
+		default:
+			return 0, false, fmt.Errorf("invalid RDB length 0x%02X", b)
+		}
+	default:
+		return uint64(b & 0x3F), true, nil
+	}
+}
+
+// readString reads a string, stored as its length and bytes, as an integer
+// or LZF-compressed.
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+
+	if !encoded {
+		b, err := r.readBytes(n)
+		return string(b), err
+	}
+
+	switch n {
+	case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+		b, err := r.readBytes(1 << n)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(leInt(b), 10), nil
+	case rdbEncLZF:
+		compressed, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		if length > uint64(DefaultRESPLimits.MaxBulkLen) {
+			return "", fmt.Errorf("string length %d is too large", length)
+		}
+		b, err := r.readBytes(compressed)
+		if err != nil {
+			return "", err
+		}
+		b, err = lzfDecompress(b, int(length))
+		return string(b), err
+	default:
+		return "", fmt.Errorf("unknown RDB string encoding %d", n)
+	}
+}
+
+// readBytes reads n bytes.
+func (r *rdbReader) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(DefaultRESPLimits.MaxBulkLen) {
+		return nil, fmt.Errorf("string length %d is too large", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// readHash reads a hash of the given value type.
+func (r *rdbReader) readHash(typ byte) (map[string]string, error) {
+	hash := map[string]string{}
+
+	if typ == rdbTypeHash {
+		n, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			field, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			hash[field] = value
+		}
+		return hash, nil
+	}
+
+	blob, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	if typ == rdbTypeHashZiplist {
+		entries, err = parseZiplist([]byte(blob))
+	} else {
+		entries, err = parseListpack([]byte(blob))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries)%2 != 0 {
+		return nil, errRDBCorrupt
+	}
+	for i := 0; i < len(entries); i += 2 {
+		hash[entries[i]] = entries[i+1]
+	}
+	return hash, nil
+}
+
+// skipValue reads a value of a type StormyDB doesn't have without keeping it.
+func (r *rdbReader) skipValue(typ byte) error {
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		return r.skipStrings()
+	case rdbTypeZset:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			// A score is written as text after its length, except for
+			// NaN and the infinities, flagged by the length alone.
+			size, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if size < 253 {
+				if _, err := r.readBytes(uint64(size)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeZset2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if _, err := r.readBytes(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZsetZiplist,
+		rdbTypeZsetListpack, rdbTypeSetListpack:
+		_, err := r.readString()
+		return err
+	case rdbTypeListQuicklist2:
+		// Each node is its container type, then a listpack or a plain value.
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeModule2:
+		if _, err := r.readLength(); err != nil {
+			return err
+		}
+		return r.skipModuleValue()
+	case rdbTypeHashMetadata:
+		// The earliest field expiry, then fields with their TTL relative to it.
+		if _, err := r.readBytes(8); err != nil {
+			return err
+		}
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+			for j := 0; j < 2; j++ {
+				if _, err := r.readString(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeHashListpackEx:
+		if _, err := r.readBytes(8); err != nil {
+			return err
+		}
+		_, err := r.readString()
+		return err
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return r.skipStream(typ)
+	default:
+		return fmt.Errorf("unsupported RDB value type %d", typ)
+	}
+}
+
+// skipStrings reads a count, then that many strings.
+func (r *rdbReader) skipStrings() error {
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipStream reads a stream of the given type: its listpacks of entries,
+// its metadata and its consumer groups with their pending entries.
+func (r *rdbReader) skipStream(typ byte) error {
+	lengths := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < 2*n; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+	// The length and last ID, then the first ID, the largest deleted ID and
+	// the count of entries ever added.
+	if err := lengths(3); err != nil {
+		return err
+	}
+	if typ >= rdbTypeStreamListpacks2 {
+		if err := lengths(5); err != nil {
+			return err
+		}
+	}
+
+	groups, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for ; groups > 0; groups-- {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+		if err := lengths(2); err != nil {
+			return err
+		}
+		if typ >= rdbTypeStreamListpacks2 {
+			if err := lengths(1); err != nil {
+				return err
+			}
+		}
+		// Pending entries: a raw ID, the delivery time and count.
+		pending, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for ; pending > 0; pending-- {
+			if _, err := r.readBytes(16 + 8); err != nil {
+				return err
+			}
+			if err := lengths(1); err != nil {
+				return err
+			}
+		}
+		// Consumers: the name, the seen and active times and the raw IDs of
+		// their pending entries.
+		consumers, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for ; consumers > 0; consumers-- {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			times := uint64(8)
+			if typ >= rdbTypeStreamListpacks3 {
+				times = 16
+			}
+			if _, err := r.readBytes(times); err != nil {
+				return err
+			}
+			pending, err := r.readLength()
+			if err != nil {
+				return err
+			}
+			for ; pending > 0; pending-- {
+				if _, err := r.readBytes(16); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// skipModuleValue reads the data a module wrote, a sequence of typed values
+// ended by a zero opcode.
+func (r *rdbReader) skipModuleValue() error {
+	for {
+		opcode, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case 0:
+			return nil
+		case 1, 2: // signed and unsigned integers
+			_, err = r.readLength()
+		case 3: // float
+			_, err = r.readBytes(4)
+		case 4: // double
+			_, err = r.readBytes(8)
+		case 5:
+			_, err = r.readString()
+		default:
+			return fmt.Errorf("unknown module data opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
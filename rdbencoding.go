@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// errRDBCorrupt is returned for a compact encoding that doesn't decode.
+var errRDBCorrupt = errors.New("corrupt RDB value encoding")
+
+// crc64Table is the table of the CRC-64 Redis checksums RDB files with: the
+// Jones polynomial, reflected, with no initial or final XOR.
+var crc64Table = func() (table [256]uint64) {
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0x95ac9329ac4bc9b5
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc64 computes the checksum of the bytes written to it.
+type crc64 struct {
+	sum uint64
+}
+
+func (c *crc64) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.sum = crc64Table[byte(c.sum)^b] ^ c.sum>>8
+	}
+	return len(p), nil
+}
+
+// lzfDecompress decompresses LZF data, which Redis compresses long strings
+// with, into outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// A run of ctrl+1 literal bytes.
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errRDBCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// A back reference: copy n+2 bytes from earlier output.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errRDBCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errRDBCorrupt
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errRDBCorrupt
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errRDBCorrupt
+	}
+	return out, nil
+}
+
+// byteCursor reads a compact encoding, checking it doesn't run past its end.
+type byteCursor struct {
+	b   []byte
+	pos int
+}
+
+// next returns the next n bytes.
+func (c *byteCursor) next(n int) ([]byte, error) {
+	if n < 0 || c.pos+n > len(c.b) {
+		return nil, errRDBCorrupt
+	}
+	b := c.b[c.pos : c.pos+n]
+	c.pos += n
+	return b, nil
+}
+
+// leInt decodes a signed little-endian integer of len(b) bytes.
+func leInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(v<<shift) >> shift
+}
+
+// parseZiplist returns the entries of a ziplist, which Redis before 7.0
+// encodes small hashes as.
+func parseZiplist(b []byte) ([]string, error) {
+	c := &byteCursor{b: b}
+	// Total bytes, offset of the last entry and number of entries.
+	if _, err := c.next(10); err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for {
+		head, err := c.next(1)
+		if err != nil {
+			return nil, err
+		}
+		if head[0] == 0xFF {
+			return entries, nil
+		}
+
+		// Skip the length of the previous entry.
+		if head[0] == 0xFE {
+			if _, err := c.next(4); err != nil {
+				return nil, err
+			}
+		}
+
+		encoding, err := c.next(1)
+		if err != nil {
+			return nil, err
+		}
+		enc := encoding[0]
+
+		var entry string
+		switch {
+		case enc>>6 != 3:
+			var n int
+			switch enc >> 6 {
+			case 0:
+				n = int(enc & 0x3F)
+			case 1:
+				low, err := c.next(1)
+				if err != nil {
+					return nil, err
+				}
+				n = int(enc&0x3F)<<8 | int(low[0])
+			default:
+				size, err := c.next(4)
+				if err != nil {
+					return nil, err
+				}
+				n = int(binary.BigEndian.Uint32(size))
+			}
+			s, err := c.next(n)
+			if err != nil {
+				return nil, err
+			}
+			entry = string(s)
+		case enc >= 0xF1 && enc <= 0xFD:
+			entry = strconv.Itoa(int(enc&0x0F) - 1)
+		default:
+			sizes := map[byte]int{0xC0: 2, 0xD0: 4, 0xE0: 8, 0xF0: 3, 0xFE: 1}
+			size, ok := sizes[enc]
+			if !ok {
+				return nil, errRDBCorrupt
+			}
+			v, err := c.next(size)
+			if err != nil {
+				return nil, err
+			}
+			entry = strconv.FormatInt(leInt(v), 10)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// parseListpack returns the entries of a listpack, which Redis 7.0 and
+// later encodes small hashes as.
+func parseListpack(b []byte) ([]string, error) {
+	c := &byteCursor{b: b}
+	// Total bytes and number of entries.
+	if _, err := c.next(6); err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for {
+		encoding, err := c.next(1)
+		if err != nil {
+			return nil, err
+		}
+		enc := encoding[0]
+		if enc == 0xFF {
+			return entries, nil
+		}
+
+		var entry string
+		size := 1 // of the encoding and data, which the back length gives
+		switch {
+		case enc&0x80 == 0:
+			entry = strconv.Itoa(int(enc & 0x7F))
+		case enc&0xC0 == 0x80:
+			s, err := c.next(int(enc & 0x3F))
+			if err != nil {
+				return nil, err
+			}
+			entry = string(s)
+			size += len(s)
+		case enc&0xE0 == 0xC0:
+			low, err := c.next(1)
+			if err != nil {
+				return nil, err
+			}
+			v := int(enc&0x1F)<<8 | int(low[0])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry = strconv.Itoa(v)
+			size++
+		case enc&0xF0 == 0xE0:
+			low, err := c.next(1)
+			if err != nil {
+				return nil, err
+			}
+			s, err := c.next(int(enc&0x0F)<<8 | int(low[0]))
+			if err != nil {
+				return nil, err
+			}
+			entry = string(s)
+			size += 1 + len(s)
+		case enc == 0xF0:
+			n, err := c.next(4)
+			if err != nil {
+				return nil, err
+			}
+			s, err := c.next(int(binary.LittleEndian.Uint32(n)))
+			if err != nil {
+				return nil, err
+			}
+			entry = string(s)
+			size += 4 + len(s)
+		case enc >= 0xF1 && enc <= 0xF4:
+			n := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[enc]
+			v, err := c.next(n)
+			if err != nil {
+				return nil, err
+			}
+			entry = strconv.FormatInt(leInt(v), 10)
+			size += n
+		default:
+			return nil, errRDBCorrupt
+		}
+		entries = append(entries, entry)
+
+		// Skip the back length, which takes about a byte per 7 bits of size.
+		backlen := 5
+		switch {
+		case size <= 127:
+			backlen = 1
+		case size < 16383:
+			backlen = 2
+		case size < 2097151:
+			backlen = 3
+		case size < 268435455:
+			backlen = 4
+		}
+		if _, err := c.next(backlen); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Read-through settings. A GET of a key missing from the dataset and
+// matching ReadThroughKeyPattern fetches it from ReadThroughOrigin, stores
+// it for ReadThroughTTL seconds and replies with it. The origin is an http
+// or https URL, where "{key}" stands for the key and is otherwise appended
+// as the last path segment, or the redis://[:password@]host[:port][/db] URL
+// of an upstream server. An empty origin disables read-through.
+var (
+	ReadThroughOrigin     = ""
+	ReadThroughTTL        = 300
+	ReadThroughKeyPattern = "*"
+)
+
+// readThroughTimeout bounds each fetch from the origin.
+const readThroughTimeout = 5 * time.Second
+
+// readThroughFetch is a fetch from the origin in flight. done is closed once
+// the result is known and, if found, stored.
+type readThroughFetch struct {
+	done  chan struct{}
+	value string
+	found bool
+	err   error
+}
+
+// readThroughFetches holds the fetches in flight by key, so concurrent
+// misses of a key wait for a single fetch. Guarded by readThroughMu.
+var (
+	readThroughFetches = map[dbKey]*readThroughFetch{}
+	readThroughMu      = sync.Mutex{}
+)
+
+// Read-through counters, updated atomically: keys loaded from the origin,
+// keys the origin doesn't have either and failed fetches.
+var (
+	readThroughLoads  int64
+	readThroughMisses int64
+	readThroughErrors int64
+)
+
+var readThroughClient = &http.Client{Timeout: readThroughTimeout}
+
+// setReadThroughOrigin changes the origin. Only http, https and redis URLs
+// are accepted.
+func setReadThroughOrigin(value string) error {
+	if value != "" {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "redis") || u.Host == "" {
+			return fmt.Errorf("argument must be an http, https or redis URL")
+		}
+	}
+	ReadThroughOrigin = value
+	return nil
+}
+
+// readThrough loads a key missing from db from the origin and replies with
+// it, or with null if the origin doesn't have it either. It reports false
+// when read-through doesn't apply: it is disabled, the key pattern doesn't
+// select the key, or the client is in a transaction or script, which can't
+// wait for the origin. executionMu must be held for reading.
+func readThrough(c *Client, db *Database, key string) (Value, bool) {
+	configMu.RLock()
+	origin, pattern := ReadThroughOrigin, ReadThroughKeyPattern
+	configMu.RUnlock()
+	if origin == "" || c.exclusive || !matchGlob(pattern, key) {
+		return Value{}, false
+	}
+
+	id := dbKey{db.id, key}
+	readThroughMu.Lock()
+	fetch, waiting := readThroughFetches[id]
+	if !waiting {
+		fetch = &readThroughFetch{done: make(chan struct{})}
+		readThroughFetches[id] = fetch
+	}
+	readThroughMu.Unlock()
+
+	if waiting {
+		blockUnlocked(func() { <-fetch.done })
+	} else {
+		blockUnlocked(func() {
+			fetch.value, fetch.found, fetch.err = fetchFromOrigin(origin, key)
+		})
+		if fetch.found {
+			fetch.value = storeFetched(c, db, key, fetch.value)
+		}
+
+		readThroughMu.Lock()
+		delete(readThroughFetches, id)
+		readThroughMu.Unlock()
+		close(fetch.done)
+	}
+
+	if fetch.err != nil {
+		return Value{typ: "error", str: "ERR read-through origin failed: " + fetch.err.Error()}, true
+	}
+	if !fetch.found {
+		return Value{typ: "null"}, true
+	}
+	return Value{typ: "bulk", bulk: fetch.value}, true
+}
+
+// storeFetched stores a value fetched from the origin with the read-through
+// TTL and persists it like a write, returning the key's value. A key written
+// while the fetch ran keeps its value.
+func storeFetched(c *Client, db *Database, key, value string) string {
+	configMu.RLock()
+	when := nowMillis() + int64(ReadThroughTTL)*1000
+	configMu.RUnlock()
+
+	writeMu.Lock()
+	db.mu.Lock()
+	current, exists := db.store.Get(key)
+	if !exists {
+		db.store.Set(key, value)
+		db.store.Expire(key, when)
+	}
+	db.mu.Unlock()
+	if exists {
+		writeMu.Unlock()
+		return current
+	}
+
+	set := Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "SET"},
+		{typ: "bulk", bulk: key},
+		{typ: "bulk", bulk: value},
+	}}
+	expire := Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "PEXPIREAT"},
+		{typ: "bulk", bulk: key},
+		{typ: "bulk", bulk: strconv.FormatInt(when, 10)},
+	}}
+	persist(c, set)
+	persist(c, expire)
+	recordChanges(1)
+	cdcAppend(db.id, set)
+	cdcAppend(db.id, expire)
+	writeMu.Unlock()
+
+	notifyKeyEvent(db, "set", key)
+	invalidateKeys([]string{key}, c)
+	touchWatchedKeys(db.id, []string{key})
+	return value
+}
+
+// fetchFromOrigin fetches key from the origin, reporting whether the origin
+// has it.
+func fetchFromOrigin(origin, key string) (string, bool, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", false, err
+	}
+
+	var value string
+	var found bool
+	if u.Scheme == "redis" {
+		value, found, err = fetchFromRedis(u, key)
+	} else {
+		value, found, err = fetchFromHTTP(origin, key)
+	}
+
+	switch {
+	case err != nil:
+		atomic.AddInt64(&readThroughErrors, 1)
+		fmt.Println("Error fetching key from read-through origin:", err)
+	case found:
+		atomic.AddInt64(&readThroughLoads, 1)
+	default:
+		atomic.AddInt64(&readThroughMisses, 1)
+	}
+	return value, found, err
+}
+
+// fetchFromHTTP GETs key from an HTTP origin, which answers with the value
+// as the body, or with 404 if it doesn't have the key.
+func fetchFromHTTP(origin, key string) (string, bool, error) {
+	target := strings.TrimSuffix(origin, "/") + "/" + url.PathEscape(key)
+	if strings.Contains(origin, "{key}") {
+		target = strings.ReplaceAll(origin, "{key}", url.PathEscape(key))
+	}
+
+	resp, err := readThroughClient.Get(target)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(body), true, nil
+}
+
+// fetchFromRedis GETs key from an upstream server speaking RESP, over a
+// connection of its own.
+func fetchFromRedis(u *url.URL, key string) (string, bool, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := net.DialTimeout("tcp", addr, readThroughTimeout)
+	if err != nil {
+		return "", false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(readThroughTimeout))
+
+	commands := [][]string{}
+	if password, ok := u.User.Password(); ok {
+		if user := u.User.Username(); user != "" {
+			commands = append(commands, []string{"AUTH", user, password})
+		} else {
+			commands = append(commands, []string{"AUTH", password})
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		commands = append(commands, []string{"SELECT", db})
+	}
+	commands = append(commands, []string{"GET", key})
+
+	writer := NewRESPWriter(conn)
+	for _, command := range commands {
+		args := make([]Value, 0, len(command))
+		for _, arg := range command {
+			args = append(args, Value{typ: "bulk", bulk: arg})
+		}
+		if err := writer.Write(Value{typ: "array", array: args}); err != nil {
+			return "", false, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return "", false, err
+	}
+
+	reader := NewRESP(conn)
+	var reply Value
+	for range commands {
+		reply, err = reader.ReadReply()
+		if err != nil {
+			return "", false, err
+		}
+		if reply.typ == "error" {
+			return "", false, fmt.Errorf("upstream replied: %s", reply.str)
+		}
+	}
+
+	switch reply.typ {
+	case "null":
+		return "", false, nil
+	case "bulk":
+		return reply.bulk, true, nil
+	default:
+		return "", false, fmt.Errorf("unexpected reply to GET")
+	}
+}
+
+// infoReadThrough reports read-through counters for the stats section of INFO.
+func infoReadThrough() []string {
+	return []string{
+		fmt.Sprintf("read_through_loads:%d", atomic.LoadInt64(&readThroughLoads)),
+		fmt.Sprintf("read_through_misses:%d", atomic.LoadInt64(&readThroughMisses)),
+		fmt.Sprintf("read_through_errors:%d", atomic.LoadInt64(&readThroughErrors)),
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// redisCommands translates a write command streamed by a Redis primary into
+// StormyDB commands with the same effect on client's database, for a
+// replica of Redis. Redis has commands and options StormyDB doesn't, and a
+// key holds a single type there: DEL and SET replace a hash, which they
+// leave alone here. The primary only streams the writes that took place,
+// so conditions like SET NX are ignored. Other commands are returned as
+// is, including those StormyDB doesn't have, for the caller to report.
+// executionMu must be held.
+func redisCommands(client *Client, value Value) []Value {
+	t := &redisTranslation{db: client.database(), selected: client.db}
+	args := make([]string, 0, len(value.array)-1)
+	for _, arg := range value.array[1:] {
+		args = append(args, arg.bulk)
+	}
+	if !t.translate(strings.ToUpper(value.array[0].bulk), args) {
+		return []Value{value}
+	}
+	return t.commands
+}
+
+// redisTranslation collects the commands a Redis command translates into.
+type redisTranslation struct {
+	db       *Database
+	selected int
+	commands []Value
+}
+
+// redisKey is what a key holds, for commands recreating it as a whole.
+type redisKey struct {
+	value    string
+	hasValue bool
+	hash     map[string]string
+	// expire is the key's expiry time in Unix milliseconds, 0 without a TTL.
+	expire int64
+}
+
+// translate adds the commands the Redis command translates into, reporting
+// false when it is to run as is.
+func (t *redisTranslation) translate(command string, args []string) bool {
+	switch command {
+	case "DEL", "GETDEL":
+		if len(args) == 0 {
+			return false
+		}
+		t.add(append([]string{"UNLINK"}, args...)...)
+	case "SET":
+		if len(args) < 2 {
+			return false
+		}
+		expire := int64(0)
+		for i := 2; i < len(args); i++ {
+			switch option := strings.ToUpper(args[i]); option {
+			case "NX", "XX", "GET":
+			case "KEEPTTL":
+				expire = t.key(args[0]).expire
+			case "EX", "PX", "EXAT", "PXAT":
+				if i+1 == len(args) {
+					return false
+				}
+				i++
+				n, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil {
+					return false
+				}
+				expire = absoluteExpire(option, n)
+			default:
+				return false
+			}
+		}
+		t.setString(args[0], args[1], expire)
+	case "SETEX", "PSETEX":
+		if len(args) != 3 {
+			return false
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return false
+		}
+		option := "EX"
+		if command == "PSETEX" {
+			option = "PX"
+		}
+		t.setString(args[0], args[2], absoluteExpire(option, n))
+	case "SETNX", "GETSET":
+		if len(args) != 2 {
+			return false
+		}
+		t.setString(args[0], args[1], 0)
+	case "MSET", "MSETNX":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return false
+		}
+		for i := 0; i < len(args); i += 2 {
+			t.setString(args[i], args[i+1], 0)
+		}
+	case "INCRBY", "DECRBY", "DECR":
+		by := int64(-1)
+		if command != "DECR" {
+			if len(args) != 2 {
+				return false
+			}
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return false
+			}
+			by = n
+			if command == "DECRBY" {
+				by = -n
+			}
+		} else if len(args) != 1 {
+			return false
+		}
+		k := t.key(args[0])
+		current := int64(0)
+		if k.hasValue {
+			n, err := strconv.ParseInt(k.value, 10, 64)
+			if err != nil {
+				return false
+			}
+			current = n
+		}
+		t.setString(args[0], strconv.FormatInt(current+by, 10), k.expire)
+	case "APPEND":
+		if len(args) != 2 {
+			return false
+		}
+		k := t.key(args[0])
+		t.setString(args[0], k.value+args[1], k.expire)
+	case "SETRANGE":
+		if len(args) != 3 {
+			return false
+		}
+		offset, err := strconv.Atoi(args[1])
+		if err != nil || offset < 0 {
+			return false
+		}
+		k := t.key(args[0])
+		if !k.hasValue && args[2] == "" {
+			return true
+		}
+		value := []byte(k.value)
+		if end := offset + len(args[2]); end > len(value) {
+			value = append(value, make([]byte, end-len(value))...)
+		}
+		copy(value[offset:], args[2])
+		t.setString(args[0], string(value), k.expire)
+	case "HSET", "HMSET", "HSETNX":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return false
+		}
+		for i := 1; i < len(args); i += 2 {
+			t.add("HSET", args[0], args[i], args[i+1])
+		}
+	case "HINCRBY":
+		if len(args) != 3 {
+			return false
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return false
+		}
+		current := int64(0)
+		if value, ok := t.key(args[0]).hash[args[1]]; ok {
+			if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return false
+			}
+		}
+		t.add("HSET", args[0], args[1], strconv.FormatInt(current+by, 10))
+	case "HDEL":
+		if len(args) < 2 {
+			return false
+		}
+		k := t.key(args[0])
+		for _, field := range args[1:] {
+			delete(k.hash, field)
+		}
+		// StormyDB can only remove a hash as a whole.
+		t.add("UNLINK", args[0])
+		t.restore(args[0], k)
+	case "RENAME", "RENAMENX":
+		if len(args) != 2 {
+			return false
+		}
+		k := t.key(args[0])
+		t.add("UNLINK", args[0], args[1])
+		t.restore(args[1], k)
+	case "COPY":
+		if len(args) < 2 {
+			return false
+		}
+		db := t.selected
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "REPLACE":
+			case "DB":
+				if i+1 == len(args) {
+					return false
+				}
+				i++
+				n, err := strconv.Atoi(args[i])
+				if err != nil {
+					return false
+				}
+				db = n
+			default:
+				return false
+			}
+		}
+		k := t.key(args[0])
+		if db != t.selected {
+			t.add("SELECT", strconv.Itoa(db))
+		}
+		t.add("UNLINK", args[1])
+		t.restore(args[1], k)
+		if db != t.selected {
+			t.add("SELECT", strconv.Itoa(t.selected))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// add adds a command.
+func (t *redisTranslation) add(args ...string) {
+	value := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+	}
+	t.commands = append(t.commands, value)
+}
+
+// key returns what the key holds before the command, with a copy of its
+// hash. Keys whose TTL passed count, as the primary deletes them itself.
+func (t *redisTranslation) key(key string) redisKey {
+	t.db.mu.RLock()
+	defer t.db.mu.RUnlock()
+
+	k := redisKey{hash: map[string]string{}}
+	k.value, k.hasValue = t.db.store.Get(key)
+	if hash, ok := t.db.store.GetHash(key); ok {
+		for field, value := range hash {
+			k.hash[field] = value
+		}
+	}
+	k.expire, _ = t.db.store.ExpireTime(key)
+	return k
+}
+
+// setString adds the commands setting the key to a string expiring at
+// expire, or never when 0, replacing any hash.
+func (t *redisTranslation) setString(key, value string, expire int64) {
+	if len(t.key(key).hash) > 0 {
+		t.add("UNLINK", key)
+	}
+	t.add("SET", key, value)
+	if expire != 0 {
+		t.add("PEXPIREAT", key, strconv.FormatInt(expire, 10))
+	}
+}
+
+// restore adds the commands recreating a key that was removed as k.
+func (t *redisTranslation) restore(key string, k redisKey) {
+	if k.hasValue {
+		t.add("SET", key, k.value)
+	}
+	for field, value := range k.hash {
+		t.add("HSET", key, field, value)
+	}
+	if k.expire != 0 && (k.hasValue || len(k.hash) > 0) {
+		t.add("PEXPIREAT", key, strconv.FormatInt(k.expire, 10))
+	}
+}
+
+// absoluteExpire returns the expiry time in Unix milliseconds set by a SET
+// option with argument n.
+func absoluteExpire(option string, n int64) int64 {
+	switch option {
+	case "EX":
+		return nowMillis() + n*1000
+	case "PX":
+		return nowMillis() + n
+	case "EXAT":
+		return n * 1000
+	default:
+		return n
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote backup settings. Snapshots are uploaded to RemoteBackupURL, an
+// s3://bucket/prefix or gs://bucket/prefix URL; an empty URL disables
+// remote backups.
+var (
+	RemoteBackupURL = ""
+	// RemoteBackupEndpoint overrides the object store's endpoint, e.g. to use
+	// an S3-compatible server such as MinIO.
+	RemoteBackupEndpoint = ""
+	RemoteBackupRegion   = "us-east-1"
+	// The credentials are read from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY when empty.
+	RemoteBackupAccessKey = ""
+	RemoteBackupSecretKey = ""
+	// RemoteBackupRetention is how many of the newest backups are kept; 0
+	// keeps them all.
+	RemoteBackupRetention = 7
+	// RemoteBackupInterval is how many seconds apart snapshots are taken
+	// only to be uploaded, for when the server doesn't save any; 0 uploads
+	// only the snapshots the server saves.
+	RemoteBackupInterval = 0
+)
+
+// RestoreFromRemote is set by the -restore-from-remote flag: the newest
+// remote backup is downloaded to DBFilename and loaded on startup.
+var RestoreFromRemote bool
+
+const (
+	// remoteBackupRetries is how many times a failed upload is retried,
+	// after remoteBackupRetryDelay, doubled on each following retry.
+	remoteBackupRetries    = 3
+	remoteBackupRetryDelay = time.Second
+	// remoteBackupPrefix starts the names of backups, followed by the time
+	// they were uploaded, so that they sort by age.
+	remoteBackupPrefix = "dump-"
+)
+
+// remoteBackupPending signals that DBFilename was saved. It holds at most
+// one signal, so that the saves made while an upload runs are uploaded
+// once, as the latest.
+var remoteBackupPending = make(chan struct{}, 1)
+
+// State of remote backups, guarded by remoteBackupMu.
+var (
+	// lastRemoteBackup is when the last backup was uploaded.
+	lastRemoteBackup time.Time
+	// lastRemoteBackupErr is the outcome of the last upload.
+	lastRemoteBackupErr error
+	remoteBackupMu      = sync.Mutex{}
+)
+
+// setRemoteBackupURL changes where backups are uploaded. Only s3 and gs URLs
+// naming a bucket are accepted.
+func setRemoteBackupURL(value string) error {
+	if value != "" {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" {
+			return fmt.Errorf("argument must be an s3://bucket/prefix or gs://bucket/prefix URL")
+		}
+	}
+	RemoteBackupURL = value
+	return nil
+}
+
+// remoteStore returns the bucket backups are uploaded to and the prefix of
+// their names.
+func remoteStore() (*objectStore, string, error) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	if RemoteBackupURL == "" {
+		return nil, "", fmt.Errorf("remote-backup-url is not set")
+	}
+	u, err := url.Parse(RemoteBackupURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	store := &objectStore{
+		endpoint:  RemoteBackupEndpoint,
+		region:    RemoteBackupRegion,
+		bucket:    u.Host,
+		accessKey: RemoteBackupAccessKey,
+		secretKey: RemoteBackupSecretKey,
+		client:    &http.Client{Timeout: objectStoreTimeout},
+	}
+	if store.endpoint == "" && u.Scheme == "gs" {
+		store.endpoint = "https://storage.googleapis.com"
+	} else if store.endpoint == "" {
+		store.endpoint = "https://s3." + store.region + ".amazonaws.com"
+	}
+	store.endpoint = strings.TrimSuffix(store.endpoint, "/")
+	if store.accessKey == "" {
+		store.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if store.secretKey == "" {
+		store.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return store, prefix + remoteBackupPrefix, nil
+}
+
+// queueRemoteBackup has the snapshot just saved to DBFilename uploaded, if
+// remote backups are enabled.
+func queueRemoteBackup() {
+	configMu.RLock()
+	enabled := RemoteBackupURL != ""
+	configMu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	select {
+	case remoteBackupPending <- struct{}{}:
+	default:
+	}
+}
+
+// runRemoteBackups uploads the snapshots saved to DBFilename and, every
+// RemoteBackupInterval seconds, a snapshot taken only to be uploaded, until
+// shutdown.
+func runRemoteBackups() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+
+	for {
+		var data []byte
+		select {
+		case <-shuttingDown:
+			return
+		case <-remoteBackupPending:
+			var err error
+			data, err = os.ReadFile(DBFilename)
+			if err != nil {
+				fmt.Println("Error reading snapshot to upload:", err)
+				continue
+			}
+		case <-ticker.C:
+			configMu.RLock()
+			enabled, interval := RemoteBackupURL != "", time.Duration(RemoteBackupInterval)*time.Second
+			configMu.RUnlock()
+			if !enabled || interval == 0 || time.Since(last) < interval {
+				continue
+			}
+
+			executionMu.Lock()
+			snapshot := snapshotDataset()
+			executionMu.Unlock()
+
+			var buf bytes.Buffer
+			if err := encodeSnapshotFile(&buf, snapshot); err != nil {
+				fmt.Println("Error encoding snapshot to upload:", err)
+				continue
+			}
+			data = buf.Bytes()
+		}
+
+		last = time.Now()
+		uploadRemoteBackup(data)
+	}
+}
+
+// uploadRemoteBackup uploads a snapshot, retrying with exponential backoff,
+// then deletes the oldest backups beyond RemoteBackupRetention.
+func uploadRemoteBackup(data []byte) {
+	var err error
+	delay := remoteBackupRetryDelay
+	for attempt := 0; ; attempt++ {
+		var store *objectStore
+		var prefix string
+		store, prefix, err = remoteStore()
+		if err != nil {
+			// Remote backups were disabled while the snapshot waited.
+			return
+		}
+
+		key := prefix + time.Now().UTC().Format("20060102T150405.000Z") + ".rdb"
+		err = store.put(key, data)
+		if err == nil {
+			fmt.Printf("Uploaded backup %s/%s\n", store.bucket, key)
+			expireRemoteBackups(store, prefix)
+			break
+		}
+		if attempt >= remoteBackupRetries {
+			fmt.Println("Error uploading backup, giving up:", err)
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	remoteBackupMu.Lock()
+	lastRemoteBackupErr = err
+	if err == nil {
+		lastRemoteBackup = time.Now()
+	}
+	remoteBackupMu.Unlock()
+}
+
+// expireRemoteBackups deletes the oldest backups beyond RemoteBackupRetention.
+func expireRemoteBackups(store *objectStore, prefix string) {
+	configMu.RLock()
+	retention := RemoteBackupRetention
+	configMu.RUnlock()
+	if retention == 0 {
+		return
+	}
+
+	keys, err := store.list(prefix)
+	if err != nil {
+		fmt.Println("Error listing backups:", err)
+		return
+	}
+	for len(keys) > retention {
+		if err := store.remove(keys[0]); err != nil {
+			fmt.Println("Error deleting old backup:", err)
+			return
+		}
+		keys = keys[1:]
+	}
+}
+
+// restoreFromRemote downloads the newest remote backup to DBFilename.
+func restoreFromRemote() error {
+	store, prefix, err := remoteStore()
+	if err != nil {
+		return err
+	}
+
+	keys, err := store.list(prefix)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no backups found in %s", RemoteBackupURL)
+	}
+
+	key := keys[len(keys)-1]
+	data, err := store.get(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(DBFilename, data); err != nil {
+		return err
+	}
+	fmt.Printf("Downloaded backup %s/%s to %s\n", store.bucket, key, DBFilename)
+	return nil
+}
+
+// infoRemoteBackups reports the state of remote backups for INFO.
+func infoRemoteBackups() []string {
+	configMu.RLock()
+	enabled := RemoteBackupURL != ""
+	configMu.RUnlock()
+	if !enabled {
+		return []string{"remote_backup_enabled:0"}
+	}
+
+	remoteBackupMu.Lock()
+	defer remoteBackupMu.Unlock()
+
+	lastTime := int64(0)
+	if !lastRemoteBackup.IsZero() {
+		lastTime = lastRemoteBackup.Unix()
+	}
+	return []string{
+		"remote_backup_enabled:1",
+		fmt.Sprintf("remote_backup_last_time:%d", lastTime),
+		"remote_backup_last_status:" + statusString(lastRemoteBackupErr),
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Commands renamed or disabled by rename-command. renamedCommands maps the
+// new external name to the real command; hiddenCommands holds real commands
+// that no longer answer to their own name.
+var renamedCommands = map[string]string{}
+var hiddenCommands = map[string]bool{}
+
+// renameCommand makes a command reachable only as newName, or disables it
+// entirely when newName is empty.
+func renameCommand(command, newName string) error {
+	command = strings.ToUpper(command)
+	newName = strings.ToUpper(newName)
+
+	if _, ok := Commands[command]; !ok {
+		return fmt.Errorf("no such command %q", command)
+	}
+	if _, ok := Commands[newName]; ok && !hiddenCommands[newName] {
+		return fmt.Errorf("target name %q is already used by a command", newName)
+	}
+
+	hiddenCommands[command] = true
+	if newName != "" {
+		renamedCommands[newName] = command
+	}
+
+	return nil
+}
+
+// resolveCommand maps the name a client used to the real command, reporting
+// false if the name was renamed away or disabled.
+func resolveCommand(name string) (string, bool) {
+	if command, ok := renamedCommands[name]; ok {
+		return command, true
+	}
+	if hiddenCommands[name] {
+		return "", false
+	}
+	return name, true
+}
+
+// renameFlag collects repeated -rename-command "COMMAND NEWNAME" options. An
+// empty or quoted-empty NEWNAME disables the command.
+type renameFlag struct{}
+
+func (renameFlag) String() string {
+	return ""
+}
+
+func (renameFlag) Set(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) == 1 {
+		fields = append(fields, "")
+	}
+	if len(fields) != 2 {
+		return fmt.Errorf("expected \"COMMAND NEWNAME\", got %q", s)
+	}
+
+	newName := strings.Trim(fields[1], `"'`)
+	return renameCommand(fields[0], newName)
+}
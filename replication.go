@@ -0,0 +1,1163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication handlers run commands from the primary through call, which
+// looks handlers up in Handlers, so they are registered at init to avoid an
+// initialization cycle.
+func init() {
+	Handlers["REPLICAOF"] = handleReplicaOf
+	Handlers["SLAVEOF"] = handleReplicaOf
+	Handlers["SYNC"] = handlePSync
+	Handlers["PSYNC"] = handlePSync
+	Handlers["REPLCONF"] = handleReplConf
+	Handlers["WAIT"] = handleWait
+}
+
+// Replication settings. ReplicaOf is the "host port" of the primary the
+// server replicates, or empty while it is a primary itself. MasterUser and
+// MasterAuth are the credentials it authenticates to the primary with, the
+// default user when MasterUser is empty. ReplDisklessSync streams the
+// dataset to replicas as it is encoded rather than through a file.
+// ReplicaReadOnly refuses writes from clients other than the primary while
+// the server is a replica. A primary pings its replicas every
+// ReplPingReplicaPeriod seconds, and either side drops the link once the
+// other was silent for ReplTimeout seconds.
+var (
+	ReplicaOf             = ""
+	MasterUser            = ""
+	MasterAuth            = ""
+	ReplDisklessSync      = "no"
+	ReplicaReadOnly       = "yes"
+	ReplPingReplicaPeriod = 10
+	ReplTimeout           = 60
+)
+
+// replicationTimeout bounds connecting to the primary and each step of the
+// handshake.
+const replicationTimeout = 5 * time.Second
+
+// replicationRetryInterval is how long a replica waits before connecting to
+// its primary again after the link failed.
+const replicationRetryInterval = time.Second
+
+// replicationChunkSize is how much of the dataset is queued for a replica at
+// a time, once the previous chunks were sent.
+const replicationChunkSize = 64 * 1024
+
+// replicationMarkSize is the length of the mark ending a dataset streamed
+// without a file, whose size isn't known up front.
+const replicationMarkSize = 40
+
+// replicationPingInterval is how often a newline is sent to a replica while
+// its dataset is being written, to keep the link alive.
+const replicationPingInterval = time.Second
+
+// replicationAckInterval is how often a replica acknowledges the offset it
+// applied the stream up to with REPLCONF ACK.
+const replicationAckInterval = time.Second
+
+// replica is a connection that attached as a replica with SYNC or PSYNC.
+type replica struct {
+	addr string
+	// port is the port the replica listens on, from REPLCONF listening-port.
+	port     string
+	attached time.Time
+	// state is "wait_bgsave" while the dataset is written to a file,
+	// "send_bulk" while it is sent and "online" once the replica gets the
+	// command stream. Until then, commands are buffered in pending.
+	state   string
+	pending []byte
+	// ackOffset is the offset the replica last acknowledged, at ackTime, or
+	// when it attached until then. acks is set once it sent an ACK, as
+	// replicas attached with SYNC never do.
+	ackOffset int64
+	ackTime   time.Time
+	acks      bool
+}
+
+// replicationStream describes a primary's command stream from a point on:
+// the database it applies to until it selects another, and whether it comes
+// from Redis, whose commands are translated, see redisCommands.
+type replicationStream struct {
+	db    int
+	redis bool
+}
+
+// replicationLink is a replica's connection to its primary.
+type replicationLink struct {
+	host, port string
+	// stop is closed when the server stops replicating this primary.
+	stop chan struct{}
+	// ackNow asks for the stream to be acknowledged right away.
+	ackNow chan struct{}
+
+	// The fields below are guarded by replication.mu.
+	conn net.Conn
+	// status is "connect" while waiting to connect, "connecting" during the
+	// handshake, "sync" while receiving the dataset and "connected" while
+	// applying the command stream.
+	status    string
+	lastIO    time.Time
+	downSince time.Time
+}
+
+// replicating is set, atomically, while the server is a replica, for the
+// checks on every command not to take replication.mu.
+var replicating int32
+
+// replication holds the state of both sides of replication, guarded by mu.
+var replication = struct {
+	mu sync.Mutex
+	// id identifies the history of the dataset, and offset counts the bytes
+	// of commands streamed in it. A replica takes both from its primary.
+	id     string
+	offset int64
+	// selected is the database the stream last selected, -1 to select one
+	// before the next command.
+	selected int
+	// stream describes the primary's stream where it was last applied up
+	// to, on a replica, which forwards it as is to its own replicas.
+	stream   replicationStream
+	replicas map[*Client]*replica
+	// acked is closed and replaced whenever a replica acknowledges the
+	// stream, waking clients blocked in WAIT.
+	acked chan struct{}
+	// link is the connection to the primary, nil on a primary.
+	link *replicationLink
+}{id: newReplicationID(), selected: -1, replicas: map[*Client]*replica{}, acked: make(chan struct{})}
+
+// newReplicationID returns a random 40 character replication ID.
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// setReplicaOf changes the primary the server replicates on startup: "host
+// port", or "no one" or empty to be a primary.
+func setReplicaOf(value string) error {
+	fields := strings.Fields(value)
+	switch {
+	case len(fields) == 0 || (len(fields) == 2 && strings.EqualFold(fields[0], "no") && strings.EqualFold(fields[1], "one")):
+		ReplicaOf = ""
+	case len(fields) == 2 && validPort(fields[1]):
+		ReplicaOf = fields[0] + " " + fields[1]
+	default:
+		return fmt.Errorf("argument must be \"host port\" or \"no one\"")
+	}
+	return nil
+}
+
+// validPort reports whether s is a TCP port number.
+func validPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port < 65536
+}
+
+// startReplication connects to the primary set by replicaof, once the
+// dataset was loaded.
+func startReplication() {
+	if host, port, ok := strings.Cut(ReplicaOf, " "); ok {
+		replicateFrom(host, port)
+	}
+}
+
+// handleReplicaOf handles "REPLICAOF host port", making the server a replica
+// of another, and "REPLICAOF NO ONE", making it a primary again. The
+// dataset is replaced by the primary's once the link is up. Replicas
+// attached to the server are disconnected either way, to sync again.
+func handleReplicaOf(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'replicaof' command"}
+	}
+	host, port := args[0].bulk, args[1].bulk
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if stopReplication() {
+			fmt.Println("Stopped replicating, the server is a primary now")
+		}
+		configMu.Lock()
+		ReplicaOf = ""
+		configMu.Unlock()
+		return Value{typ: "string", str: "OK"}
+	}
+
+	if !validPort(port) {
+		return Value{typ: "error", str: "ERR Invalid master port"}
+	}
+
+	replication.mu.Lock()
+	link := replication.link
+	replication.mu.Unlock()
+	if link != nil && link.host == host && link.port == port {
+		return Value{typ: "string", str: "OK Already connected to specified master"}
+	}
+
+	replicateFrom(host, port)
+	configMu.Lock()
+	ReplicaOf = host + " " + port
+	configMu.Unlock()
+	return Value{typ: "string", str: "OK"}
+}
+
+// replicateFrom makes the server a replica of the primary at host and port,
+// replacing the link to any other primary.
+func replicateFrom(host, port string) {
+	stopReplication()
+
+	link := &replicationLink{
+		host: host, port: port,
+		stop: make(chan struct{}), ackNow: make(chan struct{}, 1),
+		status: "connect", downSince: time.Now(),
+	}
+	replication.mu.Lock()
+	replication.link = link
+	atomic.StoreInt32(&replicating, 1)
+	replication.mu.Unlock()
+	disconnectReplicas()
+
+	fmt.Printf("Replicating %s\n", net.JoinHostPort(host, port))
+	go link.run()
+}
+
+// stopReplication closes the link to the primary, if any, reporting whether
+// there was one. The dataset is kept as it is.
+func stopReplication() bool {
+	replication.mu.Lock()
+	link := replication.link
+	replication.link = nil
+	atomic.StoreInt32(&replicating, 0)
+	if link != nil {
+		close(link.stop)
+		if link.conn != nil {
+			link.conn.Close()
+		}
+		// The server's history diverges from the primary's from now on.
+		replication.id = newReplicationID()
+	}
+	replication.mu.Unlock()
+
+	if link != nil {
+		disconnectReplicas()
+	}
+	return link != nil
+}
+
+// disconnectReplicas closes the connections of the attached replicas, which
+// then sync again.
+func disconnectReplicas() {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	for c := range replication.replicas {
+		c.conn.Close()
+	}
+}
+
+// readOnlyCheck returns the READONLY error write commands of c fail with
+// while the server is a read-only replica. The commands the primary streams,
+// and those of the scripts it runs, are applied.
+func readOnlyCheck(c *Client) *Value {
+	configMu.RLock()
+	readOnly := ReplicaReadOnly == "yes"
+	configMu.RUnlock()
+
+	if !readOnly || atomic.LoadInt32(&replicating) == 0 || c.master {
+		return nil
+	}
+	return &Value{typ: "error", str: "READONLY You can't write against a read only replica."}
+}
+
+// handleReplConf handles "REPLCONF option value [option value ...]", with
+// which a replica describes itself before PSYNC, and "REPLCONF ACK offset",
+// with which an attached replica acknowledges the stream up to offset. ACK
+// gets no reply, and neither does "REPLCONF GETACK *", with which a primary
+// asks its replicas to acknowledge right away, see replicationLink.stream.
+func handleReplConf(c *Client, args []Value) Value {
+	if len(args)%2 != 0 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i].bulk) {
+		case "ack":
+			offset, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "raw"}
+			}
+			replication.mu.Lock()
+			if r, ok := replication.replicas[c]; ok {
+				r.ackOffset = offset
+				r.ackTime = time.Now()
+				r.acks = true
+				close(replication.acked)
+				replication.acked = make(chan struct{})
+			}
+			replication.mu.Unlock()
+			return Value{typ: "raw"}
+		case "getack":
+			return Value{typ: "raw"}
+		case "listening-port":
+			if !validPort(args[i+1].bulk) {
+				return Value{typ: "error", str: "ERR Invalid listening port"}
+			}
+			c.replicaPort = args[i+1].bulk
+		case "capa":
+			if strings.EqualFold(args[i+1].bulk, "eof") {
+				c.replicaEOF = true
+			}
+		case "ip-address":
+		default:
+			return Value{typ: "error", str: "ERR Unrecognized REPLCONF option: " + args[i].bulk}
+		}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleWait handles "WAIT numreplicas timeout", which blocks until at least
+// numreplicas replicas acknowledged the stream up to where it is, and so the
+// writes made before, or for timeout milliseconds, 0 to wait for good. It
+// returns how many replicas acknowledged them, fewer on timeout.
+func handleWait(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'wait' command"}
+	}
+	numReplicas, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	timeout, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR timeout is not an integer or out of range"}
+	}
+	if timeout < 0 {
+		return Value{typ: "error", str: "ERR timeout is negative"}
+	}
+
+	replication.mu.Lock()
+	target, isReplica := replication.offset, replication.link != nil
+	replication.mu.Unlock()
+	if isReplica {
+		return Value{typ: "error", str: "ERR WAIT cannot be used with replica instances."}
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	askedAck, timedOut := false, false
+	for {
+		replication.mu.Lock()
+		acked := 0
+		for _, r := range replication.replicas {
+			if r.state == "online" && r.ackOffset >= target {
+				acked++
+			}
+		}
+		ackedChanged := replication.acked
+		if acked < numReplicas && !askedAck {
+			getack, _ := Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: "REPLCONF"}, {typ: "bulk", bulk: "GETACK"}, {typ: "bulk", bulk: "*"},
+			}}.Marshal()
+			feedReplicas(getack)
+			askedAck = true
+		}
+		replication.mu.Unlock()
+
+		// Replicas acknowledge with commands of their own, which can't run
+		// while a transaction or a script holds the exclusive lock.
+		if acked >= numReplicas || timedOut || c.exclusive {
+			return Value{typ: "integer", num: acked}
+		}
+
+		blockUnlocked(func() {
+			select {
+			case <-ackedChanged:
+			case <-deadline:
+				timedOut = true
+			case <-shuttingDown:
+				timedOut = true
+			}
+		})
+	}
+}
+
+// handlePSync handles "PSYNC replicationid offset" and "SYNC", which turn the
+// connection into a replica. It replies with "+FULLRESYNC <id> <offset>",
+// for PSYNC only, then the dataset as an RDB file in a bulk string without
+// a trailing CRLF, and streams every write command after it. Partial
+// resynchronization isn't supported: replicas always get the whole dataset.
+// Only copying the dataset holds up other commands: it is written and sent
+// in the background, while the commands after it are buffered for the
+// replica. With repl-diskless-sync, replicas announcing "capa eof" get it
+// as it is encoded, as "$EOF:<mark>" followed by the RDB file and the mark.
+// A replica serves its own replicas the same way once it synced with its
+// primary, streaming them the primary's stream, so that replicas of
+// replicas share the primary's replication ID and offsets.
+// executionMu must be held for writing.
+func handlePSync(c *Client, args []Value) Value {
+	if c.exclusive {
+		return Value{typ: "error", str: "ERR Replica can't sync inside a transaction"}
+	}
+	if atomic.LoadInt32(&c.replica) == 1 {
+		return Value{typ: "error", str: "ERR Connection is already a replica"}
+	}
+	replication.mu.Lock()
+	link := replication.link
+	synced := link == nil || link.status == "connected"
+	replication.mu.Unlock()
+	if !synced {
+		return Value{typ: "error", str: "NOMASTERLINK Can't SYNC while not connected with my master"}
+	}
+
+	snapshot := snapshotDataset()
+	configMu.RLock()
+	diskless := ReplDisklessSync == "yes" && c.replicaEOF
+	configMu.RUnlock()
+
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if len(args) > 0 {
+		c.Push(Value{typ: "string", str: fmt.Sprintf("FULLRESYNC %s %d", replication.id, replication.offset)})
+	}
+
+	addr, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	now := time.Now()
+	r := &replica{addr: addr, port: c.replicaPort, attached: now, state: "wait_bgsave", ackTime: now}
+	replication.replicas[c] = r
+	if replication.link == nil {
+		replication.selected = -1
+	} else {
+		// The forwarded stream goes on in the database it selected last.
+		snapshot.stream = replication.stream
+	}
+	atomic.StoreInt32(&c.replica, 1)
+
+	go sendDataset(c, r, snapshot, diskless)
+	return Value{typ: "raw"}
+}
+
+// sendDataset sends the snapshot to the replica, through a temporary file
+// unless diskless, followed by the commands buffered meanwhile, after which
+// the replica gets the command stream. The replica is disconnected if that
+// fails.
+func sendDataset(c *Client, r *replica, snapshot datasetSnapshot, diskless bool) {
+	send := sendSnapshot
+	if diskless {
+		send = streamSnapshot
+	}
+	size, err := send(c, r, snapshot)
+	if err == nil {
+		replication.mu.Lock()
+		if len(r.pending) > 0 {
+			err = c.Push(Value{typ: "raw", bulk: string(r.pending)})
+		}
+		r.pending = nil
+		r.state = "online"
+		replication.mu.Unlock()
+	}
+
+	if err != nil {
+		fmt.Println("Error sending the dataset to replica", c.conn.RemoteAddr(), err)
+		c.conn.Close()
+		return
+	}
+	fmt.Printf("Replica %s synced, sent %d bytes of dataset\n", c.conn.RemoteAddr(), size)
+}
+
+// sendSnapshot writes the snapshot to a temporary file, sending newlines to
+// the replica meanwhile, then sends the file in chunks as the replica reads
+// them. It returns the size of the file.
+func sendSnapshot(c *Client, r *replica, snapshot datasetSnapshot) (int64, error) {
+	path := fmt.Sprintf("temp-sync-%d-%d.rdb", os.Getpid(), atomic.AddInt64(&tempSnapshots, 1))
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	written := make(chan error, 1)
+	go func() { written <- encodeSnapshot(f, snapshot) }()
+	ticker := time.NewTicker(replicationPingInterval)
+	defer ticker.Stop()
+	for written != nil {
+		select {
+		case err := <-written:
+			if err != nil {
+				return 0, err
+			}
+			written = nil
+		case <-ticker.C:
+			if err := c.Push(Value{typ: "raw", bulk: "\n"}); err != nil {
+				<-written
+				return 0, err
+			}
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	replication.mu.Lock()
+	r.state = "send_bulk"
+	replication.mu.Unlock()
+
+	if err := c.Push(Value{typ: "raw", bulk: "$" + strconv.FormatInt(info.Size(), 10) + "\r\n"}); err != nil {
+		return 0, err
+	}
+	chunk := make([]byte, replicationChunkSize)
+	for {
+		n, err := f.Read(chunk)
+		if n > 0 {
+			if err := c.output.waitBelow(replicationChunkSize); err != nil {
+				return 0, err
+			}
+			if err := c.Push(Value{typ: "raw", bulk: string(chunk[:n])}); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			return info.Size(), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// streamSnapshot sends the snapshot to the replica as it is encoded,
+// between two copies of a random mark, as the replica reads it. It returns
+// the size of the snapshot.
+func streamSnapshot(c *Client, r *replica, snapshot datasetSnapshot) (int64, error) {
+	replication.mu.Lock()
+	r.state = "send_bulk"
+	replication.mu.Unlock()
+
+	mark := newReplicationID()[:replicationMarkSize]
+	if err := c.Push(Value{typ: "raw", bulk: "$EOF:" + mark + "\r\n"}); err != nil {
+		return 0, err
+	}
+	w := &replicaWriter{c: c}
+	bw := bufio.NewWriterSize(w, replicationChunkSize)
+	if err := encodeSnapshot(bw, snapshot); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return w.n, c.Push(Value{typ: "raw", bulk: mark})
+}
+
+// replicaWriter sends what is written to it to a replica, once the replica
+// read most of what was sent before.
+type replicaWriter struct {
+	c *Client
+	n int64
+}
+
+func (w *replicaWriter) Write(p []byte) (int, error) {
+	if err := w.c.output.waitBelow(replicationChunkSize); err != nil {
+		return 0, err
+	}
+	if err := w.c.Push(Value{typ: "raw", bulk: string(p)}); err != nil {
+		return 0, err
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// removeReplica forgets a replica whose connection closed.
+func removeReplica(c *Client) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if _, ok := replication.replicas[c]; ok {
+		delete(replication.replicas, c)
+		fmt.Println("Replica", c.conn.RemoteAddr(), "detached")
+	}
+}
+
+// replicate streams a write command applying to database db to the
+// attached replicas. A replica's replicas get its primary's stream instead,
+// see replicationLink.stream, and not the writes of its own clients.
+func replicate(db int, value Value) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if len(replication.replicas) == 0 || replication.link != nil {
+		return
+	}
+	command, err := encodeCommand(&replication.selected, db, value)
+	if err != nil {
+		fmt.Println("Error encoding command for replicas:", err)
+		return
+	}
+	feedReplicas(command)
+}
+
+// feedReplicas appends an encoded command to the stream of every replica.
+// replication.mu must be held.
+func feedReplicas(command []byte) {
+	// A replica's offset follows its primary's stream instead.
+	if replication.link == nil {
+		replication.offset += int64(len(command))
+	}
+	for c, r := range replication.replicas {
+		if r.state == "online" {
+			c.Push(Value{typ: "raw", bulk: string(command)})
+		} else {
+			r.pending = append(r.pending, command...)
+		}
+	}
+}
+
+// runReplicationHeartbeat pings the replicas every repl-ping-replica-period
+// seconds, for them to tell a quiet primary from a dead link, and
+// disconnects the replicas that didn't acknowledge the stream for
+// repl-timeout seconds.
+func runReplicationHeartbeat() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+	for range ticker.C {
+		configMu.RLock()
+		period := time.Duration(ReplPingReplicaPeriod) * time.Second
+		timeout := time.Duration(ReplTimeout) * time.Second
+		configMu.RUnlock()
+
+		replication.mu.Lock()
+		if time.Since(lastPing) >= period {
+			lastPing = time.Now()
+			if len(replication.replicas) > 0 && replication.link == nil {
+				ping, _ := Value{typ: "array", array: []Value{{typ: "bulk", bulk: "PING"}}}.Marshal()
+				feedReplicas(ping)
+			}
+		}
+		for c, r := range replication.replicas {
+			if r.state == "online" && r.acks && time.Since(r.ackTime) >= timeout {
+				fmt.Println("Disconnecting timed out replica", c.conn.RemoteAddr())
+				c.conn.Close()
+			}
+		}
+		replication.mu.Unlock()
+	}
+}
+
+// replicateExpired streams the deletion of keys that expired on the primary
+// to the replicas, which don't expire keys themselves, as UNLINK, which
+// unlike DEL deletes hashes too.
+func replicateExpired(db int, keys []string) {
+	for _, key := range keys {
+		replicate(db, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "UNLINK"},
+			{typ: "bulk", bulk: key},
+		}})
+	}
+}
+
+// setStatus records the state of the link.
+func (link *replicationLink) setStatus(status string) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if status != "connected" && link.status == "connected" {
+		link.downSince = time.Now()
+	}
+	link.status = status
+}
+
+// stopped reports whether the server stopped replicating this primary.
+func (link *replicationLink) stopped() bool {
+	select {
+	case <-link.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run keeps the link to the primary up until it is stopped, syncing again
+// whenever it fails.
+func (link *replicationLink) run() {
+	for !link.stopped() {
+		err := link.sync()
+		link.setStatus("connect")
+		if link.stopped() {
+			return
+		}
+		fmt.Println("Error replicating from primary:", err)
+
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// sync connects to the primary, loads its dataset and applies the commands
+// it streams until the connection fails or the link is stopped.
+func (link *replicationLink) sync() error {
+	link.setStatus("connecting")
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(link.host, link.port), replicationTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	replication.mu.Lock()
+	if link.stopped() {
+		replication.mu.Unlock()
+		return nil
+	}
+	link.conn = conn
+	replication.mu.Unlock()
+
+	counter := &countingReader{r: conn}
+	reader := NewRESP(counter)
+	id, offset, err := link.handshake(conn, reader)
+	if err != nil {
+		return err
+	}
+
+	link.setStatus("sync")
+	stream, err := link.loadDataset(conn, reader)
+	if err != nil {
+		return err
+	}
+
+	replication.mu.Lock()
+	if link.stopped() {
+		replication.mu.Unlock()
+		return nil
+	}
+	replication.id = id
+	replication.offset = offset
+	replication.selected = -1
+	replication.stream = stream
+	link.status = "connected"
+	link.lastIO = time.Now()
+	replication.mu.Unlock()
+	if stream.redis {
+		fmt.Printf("Synced with Redis primary %s\n", conn.RemoteAddr())
+	} else {
+		fmt.Printf("Synced with primary %s\n", conn.RemoteAddr())
+	}
+
+	return link.stream(conn, counter, reader, stream)
+}
+
+// handshake authenticates to the primary, describes the replica and asks
+// for the dataset, returning the replication ID and offset it starts at.
+func (link *replicationLink) handshake(conn net.Conn, reader *RESP) (string, int64, error) {
+	configMu.RLock()
+	port := Port
+	configMu.RUnlock()
+
+	commands := append([][]string{{"PING"}}, authCommands()...)
+	commands = append(commands,
+		[]string{"REPLCONF", "listening-port", port},
+		[]string{"REPLCONF", "capa", "eof", "capa", "psync2"},
+		[]string{"PSYNC", "?", "-1"},
+	)
+
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var reply Value
+	for _, command := range commands {
+		var err error
+		reply, err = roundTrip(conn, reader, command)
+		if err != nil {
+			return "", 0, err
+		}
+		// A primary without a password answers PING with NOAUTH.
+		if reply.typ == "error" && !(command[0] == "PING" && strings.HasPrefix(reply.str, "NOAUTH")) {
+			return "", 0, fmt.Errorf("%s failed: %s", command[0], reply.str)
+		}
+	}
+
+	fields := strings.Fields(reply.str)
+	if reply.typ != "string" || len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		return "", 0, fmt.Errorf("unexpected reply to PSYNC: %q", reply.str)
+	}
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected reply to PSYNC: %q", reply.str)
+	}
+	return fields[1], offset, nil
+}
+
+// authCommands returns the AUTH command authenticating to the primary with
+// masteruser and masterauth, if a password is set.
+func authCommands() [][]string {
+	configMu.RLock()
+	user, password := MasterUser, MasterAuth
+	configMu.RUnlock()
+
+	switch {
+	case password == "":
+		return nil
+	case user == "":
+		return [][]string{{"AUTH", password}}
+	default:
+		return [][]string{{"AUTH", user, password}}
+	}
+}
+
+// roundTrip sends a command over conn and reads the reply.
+func roundTrip(conn net.Conn, reader *RESP, command []string) (Value, error) {
+	args := make([]Value, 0, len(command))
+	for _, arg := range command {
+		args = append(args, Value{typ: "bulk", bulk: arg})
+	}
+	writer := NewRESPWriter(conn)
+	if err := writer.Write(Value{typ: "array", array: args}); err != nil {
+		return Value{}, err
+	}
+	if err := writer.Flush(); err != nil {
+		return Value{}, err
+	}
+	return reader.ReadReply()
+}
+
+// loadDataset receives the primary's dataset into a temporary file and
+// replaces the server's dataset with it, returning what it tells of the
+// stream after it. With the AOF enabled, it is rewritten from the new
+// dataset. The server's own replicas sync again, from the new dataset.
+// Keys of types StormyDB doesn't have, which Redis primaries may hold, are
+// skipped.
+func (link *replicationLink) loadDataset(conn net.Conn, reader *RESP) (replicationStream, error) {
+	// The primary may send newlines to keep the link alive while it
+	// prepares the dataset.
+	var line string
+	for line == "" {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		l, err := reader.reader.ReadString('\n')
+		if err != nil {
+			return replicationStream{}, err
+		}
+		line = strings.TrimRight(l, "\r\n")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	mark, diskless := strings.CutPrefix(line, "$EOF:")
+	size, err := strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64)
+	switch {
+	case diskless && len(mark) != replicationMarkSize:
+		return replicationStream{}, fmt.Errorf("unexpected dataset header %q", line)
+	case !diskless && (!strings.HasPrefix(line, "$") || err != nil || size < 0):
+		return replicationStream{}, fmt.Errorf("unexpected dataset header %q", line)
+	}
+
+	path := fmt.Sprintf("temp-repl-%d.rdb", os.Getpid())
+	f, err := os.Create(path)
+	if err != nil {
+		return replicationStream{}, err
+	}
+	defer os.Remove(path)
+	if diskless {
+		err = copyUntilMark(f, reader.reader, mark)
+	} else {
+		_, err = io.CopyN(f, reader.reader, size)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return replicationStream{}, err
+	}
+
+	executionMu.Lock()
+	defer executionMu.Unlock()
+
+	emptyDataset()
+	if _, err := loadSnapshot(path, true); err != nil {
+		return replicationStream{}, fmt.Errorf("loading the primary's dataset: %w", err)
+	}
+	invalidateAll(nil)
+	touchAllWatchedKeys()
+	disconnectReplicas()
+
+	if aof != nil {
+		if err := aof.startRewrite(); err != nil {
+			fmt.Println("Error rewriting AOF after syncing with primary:", err)
+		}
+	}
+	return loadedStream, nil
+}
+
+// copyUntilMark copies from r to w until the mark ending a dataset streamed
+// without a file, which is skipped.
+func copyUntilMark(w io.Writer, r *bufio.Reader, mark string) error {
+	for {
+		if _, err := r.Peek(len(mark)); err != nil {
+			return err
+		}
+		buffered, _ := r.Peek(r.Buffered())
+		if i := bytes.Index(buffered, []byte(mark)); i >= 0 {
+			if _, err := w.Write(buffered[:i]); err != nil {
+				return err
+			}
+			_, err := r.Discard(i + len(mark))
+			return err
+		}
+
+		// Keep the bytes that may start the mark.
+		n := len(buffered) - len(mark) + 1
+		if _, err := w.Write(buffered[:n]); err != nil {
+			return err
+		}
+		r.Discard(n)
+	}
+}
+
+// stream applies the write commands the primary streams, like a client
+// whose replies are discarded, and forwards them to the server's own
+// replicas. counter counts the bytes read from conn.
+func (link *replicationLink) stream(conn net.Conn, counter *countingReader, reader *RESP, stream replicationStream) error {
+	client := newReplayClient()
+	client.conn = conn
+	client.master = true
+	client.db = stream.db
+	// Commands StormyDB doesn't have are reported once each.
+	unknown := map[string]bool{}
+	// The commands of the MULTI block being received, from the stream
+	// offset blockStart on, and the bytes to forward with them.
+	var (
+		inBlock        bool
+		block          []Value
+		blockStart     int
+		blockForwarded []byte
+	)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go link.acknowledge(conn, stop)
+
+	for {
+		if reader.Buffered() == 0 {
+			// Acknowledge the commands applied so far to the AOF in batches,
+			// like the replies to a pipeline.
+			if client.aofPending {
+				client.aofPending = false
+				if err := aof.Flush(); err != nil {
+					fmt.Println("Error writing to AOF:", err)
+				}
+			}
+
+			// The primary pings at least every repl-ping-replica-period.
+			configMu.RLock()
+			timeout := time.Duration(ReplTimeout) * time.Second
+			configMu.RUnlock()
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		start := counter.n - reader.Buffered()
+		value, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		if value.typ != "array" || len(value.array) == 0 {
+			return fmt.Errorf("invalid command from primary")
+		}
+		// The stream is forwarded as the primary sent it, whose offsets the
+		// replicas count.
+		forwarded, err := value.Marshal()
+		if err != nil {
+			return err
+		}
+
+		command := strings.ToUpper(value.array[0].bulk)
+		value.array[0] = Value{typ: "bulk", bulk: command}
+
+		// A transaction or script arrives as a MULTI block, which is applied
+		// and forwarded once its EXEC arrived, so that the replica never
+		// holds part of it, and counted in the offset only then.
+		if inBlock && command != "EXEC" {
+			block = append(block, value)
+			blockForwarded = append(blockForwarded, forwarded...)
+			continue
+		}
+		if command == "MULTI" {
+			inBlock, block, blockStart, blockForwarded = true, nil, start, forwarded
+			continue
+		}
+		values, atomic := []Value{value}, inBlock
+		if atomic {
+			values, start, forwarded = block, blockStart, append(blockForwarded, forwarded...)
+			inBlock, block, blockForwarded = false, nil, nil
+		}
+
+		lock, unlock := executionMu.RLock, executionMu.RUnlock
+		if atomic || isExclusive(command, value.array[1:]) {
+			lock, unlock = executionMu.Lock, executionMu.Unlock
+		}
+
+		// Forward the command before a replica can sync, so that the
+		// dataset it gets holds the command or its stream does, not both.
+		lock()
+		if atomic {
+			client.exclusive = true
+			beginAtomic()
+		}
+		for _, value := range values {
+			commands := []Value{value}
+			if stream.redis {
+				commands = redisCommands(client, value)
+			}
+			for _, value := range commands {
+				command := strings.ToUpper(value.array[0].bulk)
+				value.array[0] = Value{typ: "bulk", bulk: command}
+				if cmd, known := Commands[command]; known {
+					call(client, command, cmd, value)
+				} else if !unknown[command] {
+					unknown[command] = true
+					fmt.Println("Unknown command from primary, not applied:", command)
+				}
+			}
+		}
+		if atomic {
+			endAtomic(client)
+			client.exclusive = false
+		}
+		replication.mu.Lock()
+		replication.offset += int64(counter.n - reader.Buffered() - start)
+		replication.stream = replicationStream{client.db, stream.redis}
+		feedReplicas(forwarded)
+		link.lastIO = time.Now()
+		replication.mu.Unlock()
+		unlock()
+
+		if command == "REPLCONF" && len(value.array) > 1 && strings.EqualFold(value.array[1].bulk, "GETACK") {
+			select {
+			case link.ackNow <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// acknowledge sends the primary the offset the stream was applied up to
+// every replicationAckInterval, and whenever it asks with REPLCONF GETACK,
+// until stop is closed. The connection is closed if that fails.
+func (link *replicationLink) acknowledge(conn net.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(replicationAckInterval)
+	defer ticker.Stop()
+
+	writer := NewRESPWriter(conn)
+	for {
+		replication.mu.Lock()
+		offset := replication.offset
+		replication.mu.Unlock()
+
+		writer.Write(Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "REPLCONF"},
+			{typ: "bulk", bulk: "ACK"},
+			{typ: "bulk", bulk: strconv.FormatInt(offset, 10)},
+		}})
+		if err := writer.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-link.ackNow:
+		}
+	}
+}
+
+// infoReplication reports the server's role and the state of its link to
+// the primary or of its replicas, for INFO.
+func infoReplication() []string {
+	configMu.RLock()
+	readOnly := 0
+	if ReplicaReadOnly == "yes" {
+		readOnly = 1
+	}
+	configMu.RUnlock()
+
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	lines := []string{}
+	if link := replication.link; link != nil {
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+link.host,
+			"master_port:"+link.port,
+		)
+		if link.status == "connected" {
+			lines = append(lines,
+				"master_link_status:up",
+				fmt.Sprintf("master_last_io_seconds_ago:%d", int(time.Since(link.lastIO).Seconds())),
+			)
+		} else {
+			lines = append(lines,
+				"master_link_status:down",
+				"master_last_io_seconds_ago:-1",
+			)
+		}
+		syncing := 0
+		if link.status == "sync" {
+			syncing = 1
+		}
+		lines = append(lines, fmt.Sprintf("master_sync_in_progress:%d", syncing))
+		if link.status != "connected" {
+			lines = append(lines, fmt.Sprintf("master_link_down_since_seconds:%d", int(time.Since(link.downSince).Seconds())))
+		}
+		lines = append(lines,
+			fmt.Sprintf("slave_repl_offset:%d", replication.offset),
+			fmt.Sprintf("slave_read_only:%d", readOnly),
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+
+	replicas := make([]*replica, 0, len(replication.replicas))
+	for _, r := range replication.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].attached.Before(replicas[j].attached) })
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(replicas)))
+	for i, r := range replicas {
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			i, r.addr, r.port, r.state, r.ackOffset, int(time.Since(r.ackTime).Seconds())))
+	}
+
+	return append(lines,
+		infoFailover(),
+		"master_replid:"+replication.id,
+		fmt.Sprintf("master_repl_offset:%d", replication.offset),
+	)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 )
 
@@ -13,29 +15,107 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+	DOUBLE  = ','
+	MAP     = '%'
+	PUSH    = '>'
 )
 
 // Value represents a Redis-like data type with multiple possible types.
 type Value struct {
-	typ   string
-	str   string
-	num   int
-	bulk  string
-	array []Value
+	typ    string
+	str    string
+	num    int
+	double float64
+	bulk   string
+	array  []Value
+}
+
+// ErrProtocol is wrapped by every error caused by a malformed or oversized request.
+var ErrProtocol = errors.New("Protocol error")
+
+// RESPLimits caps what a single request may allocate while being parsed.
+type RESPLimits struct {
+	MaxDepth       int // maximum nesting depth of arrays
+	MaxElements    int // maximum number of elements in one array
+	MaxBulkLen     int // maximum length of one bulk string
+	MaxRequestSize int // maximum total bytes of one request
+}
+
+// respArrayPrealloc is how many elements of an array are allocated up front.
+const respArrayPrealloc = 8
+
+// respBulkPrealloc is how much of a bulk string is allocated up front. The
+// buffer doubles as the rest arrives, so a client can't make the server
+// allocate more than twice what it sent.
+const respBulkPrealloc = 64 * 1024
+
+// DefaultRESPLimits are the limits applied by NewRESP, to the AOF,
+// snapshots and streams from other servers.
+var DefaultRESPLimits = RESPLimits{
+	MaxDepth:       8,
+	MaxElements:    1024 * 1024,
+	MaxBulkLen:     512 * 1024 * 1024,
+	MaxRequestSize: 1024 * 1024 * 1024,
+}
+
+// Limits of client requests, from proto-max-bulk-len,
+// proto-max-multibulk-len and proto-max-depth. They can't exceed
+// DefaultRESPLimits, so whatever clients write can be read back from the
+// AOF and by replicas.
+var (
+	ProtoMaxBulkLen      = DefaultRESPLimits.MaxBulkLen
+	ProtoMaxMultibulkLen = DefaultRESPLimits.MaxElements
+	ProtoMaxDepth        = DefaultRESPLimits.MaxDepth
+)
+
+// clientRESPLimits returns the limits client requests are parsed with.
+func clientRESPLimits() RESPLimits {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	limits := DefaultRESPLimits
+	limits.MaxBulkLen = ProtoMaxBulkLen
+	limits.MaxElements = ProtoMaxMultibulkLen
+	limits.MaxDepth = ProtoMaxDepth
+	return limits
 }
 
 // RESP handles the parsing of RESP (Redis Serialization Protocol) messages.
 type RESP struct {
 	reader *bufio.Reader
+	limits RESPLimits
+
+	// Per-request accounting, reset by Read.
+	depth int
+	size  int
+
+	// replies is set while ReadReply parses a server's reply.
+	replies bool
+
+	// line is reused by readLine, whose callers are done with a line before
+	// reading the next.
+	line []byte
 }
 
 // NewRESP creates a new RESP instance with the given io.Reader.
 func NewRESP(rd io.Reader) *RESP {
-	return &RESP{reader: bufio.NewReader(rd)}
+	return &RESP{reader: bufio.NewReader(rd), limits: DefaultRESPLimits}
+}
+
+// NewRESPSize creates a new RESP instance reading rd through a buffer of at
+// least size bytes, for parsing long streams of values such as the AOF.
+func NewRESPSize(rd io.Reader, size int) *RESP {
+	return &RESP{reader: bufio.NewReaderSize(rd, size), limits: DefaultRESPLimits}
+}
+
+// SetLimits replaces the parser limits used for subsequent requests.
+func (r *RESP) SetLimits(limits RESPLimits) {
+	r.limits = limits
 }
 
 // readLine reads a line of input, terminated by CRLF, and trims the trailing CRLF.
 func (r *RESP) readLine() (line []byte, n int, err error) {
+	line = r.line[:0]
 	for {
 		b, err := r.reader.ReadByte()
 		if err != nil {
@@ -46,7 +126,11 @@ func (r *RESP) readLine() (line []byte, n int, err error) {
 		if len(line) >= 2 && line[len(line)-2] == '\r' {
 			break
 		}
+		if err := r.account(1); err != nil {
+			return nil, 0, err
+		}
 	}
+	r.line = line
 	return line[:len(line)-2], n, nil
 }
 
@@ -63,8 +147,41 @@ func (r *RESP) readInteger() (x int, n int, err error) {
 	return int(i64), n, nil
 }
 
+// lengthError returns the error for a failure reading the length of an
+// array or bulk string: ErrProtocol with msg if it didn't parse, or the
+// error reading it, such as the client disconnecting, as it is.
+func lengthError(err error, msg string) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return fmt.Errorf("%w: %s", ErrProtocol, msg)
+	}
+	return err
+}
+
+// Buffered returns the number of bytes already read from the connection but not yet parsed.
+func (r *RESP) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// account adds n bytes to the size of the current request and enforces MaxRequestSize.
+func (r *RESP) account(n int) error {
+	r.size += n
+	if r.size > r.limits.MaxRequestSize {
+		return fmt.Errorf("%w: request too large", ErrProtocol)
+	}
+	return nil
+}
+
 // Read parses a single RESP value from the input.
 func (r *RESP) Read() (Value, error) {
+	r.depth = 0
+	r.size = 0
+
+	return r.readValue()
+}
+
+// readValue parses the next RESP value, which may be nested inside an array.
+func (r *RESP) readValue() (Value, error) {
 	_type, err := r.reader.ReadByte()
 
 	if err != nil {
@@ -76,9 +193,42 @@ func (r *RESP) Read() (Value, error) {
 		return r.readArray()
 	case BULK:
 		return r.readBulk()
+	case STRING, ERROR, INTEGER:
+		if r.replies {
+			return r.readSimple(_type)
+		}
+	}
+	fmt.Printf("Unknown type: %v", string(_type))
+	return Value{}, nil
+}
+
+// ReadReply parses a single reply of a server, which unlike a request may
+// also be a simple string, an error or an integer.
+func (r *RESP) ReadReply() (Value, error) {
+	r.replies = true
+	defer func() { r.replies = false }()
+
+	return r.Read()
+}
+
+// readSimple parses a simple string, error or integer reply.
+func (r *RESP) readSimple(_type byte) (Value, error) {
+	line, _, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch _type {
+	case STRING:
+		return Value{typ: "string", str: string(line)}, nil
+	case ERROR:
+		return Value{typ: "error", str: string(line)}, nil
 	default:
-		fmt.Printf("Unknown type: %v", string(_type))
-		return Value{}, nil
+		num, err := strconv.Atoi(string(line))
+		if err != nil {
+			return Value{}, fmt.Errorf("%w: invalid integer", ErrProtocol)
+		}
+		return Value{typ: "integer", num: num}, nil
 	}
 }
 
@@ -87,16 +237,35 @@ func (r *RESP) readArray() (Value, error) {
 	v := Value{}
 	v.typ = "array"
 
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > r.limits.MaxDepth {
+		return v, fmt.Errorf("%w: nesting too deep", ErrProtocol)
+	}
+
 	// Read the length of the array.
 	len, _, err := r.readInteger()
 	if err != nil {
-		return v, err
+		return v, lengthError(err, "invalid multibulk length")
+	}
+	if len < 0 {
+		v.typ = "null"
+		return v, nil
+	}
+	if len > r.limits.MaxElements {
+		return v, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
 	}
 
-	// Parse each element in the array.
-	v.array = make([]Value, 0)
+	// Parse each element in the array. The slice grows as elements arrive
+	// rather than trusting the declared length up front, past the few
+	// elements most commands have.
+	prealloc := len
+	if prealloc > respArrayPrealloc {
+		prealloc = respArrayPrealloc
+	}
+	v.array = make([]Value, 0, prealloc)
 	for i := 0; i < len; i++ {
-		val, err := r.Read()
+		val, err := r.readValue()
 		if err != nil {
 			return v, err
 		}
@@ -113,38 +282,73 @@ func (r *RESP) readBulk() (Value, error) {
 
 	v.typ = "bulk"
 
-	len, _, err := r.readInteger()
+	length, _, err := r.readInteger()
 	if err != nil {
+		return v, lengthError(err, "invalid bulk length")
+	}
+	if length < 0 {
+		v.typ = "null"
+		return v, nil
+	}
+	if length > r.limits.MaxBulkLen {
+		return v, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+	if err := r.account(length + 2); err != nil {
 		return v, err
 	}
 
-	bulk := make([]byte, len)
-
-	r.reader.Read(bulk)
+	// Rather than trusting the declared length up front, the buffer grows
+	// as the payload arrives.
+	bulk := make([]byte, 0, min(length, respBulkPrealloc))
+	for len(bulk) < length {
+		if len(bulk) == cap(bulk) {
+			grown := make([]byte, len(bulk), min(2*cap(bulk), length))
+			copy(grown, bulk)
+			bulk = grown
+		}
+		n, err := io.ReadFull(r.reader, bulk[len(bulk):cap(bulk)])
+		bulk = bulk[:len(bulk)+n]
+		if err != nil {
+			return v, err
+		}
+	}
 
 	v.bulk = string(bulk)
 
 	// Read the trailing CRLF.
-	r.readLine()
+	if _, _, err := r.readLine(); err != nil {
+		return v, err
+	}
 
 	return v, nil
 }
 
 // Marshal serializes a Value into its RESP representation.
-func (v Value) Marshal() []byte {
+func (v Value) Marshal() ([]byte, error) {
 	switch v.typ {
 	case "array":
 		return v.marshalArray()
+	case "map":
+		return v.marshalAggregate(MAP, len(v.array)/2)
+	case "push":
+		return v.marshalAggregate(PUSH, len(v.array))
 	case "bulk":
-		return v.marshalBulk()
+		return v.marshalBulk(), nil
 	case "string":
-		return v.marshalString()
+		return v.marshalString(), nil
+	case "integer":
+		return v.marshalInteger(), nil
+	case "double":
+		return v.marshalDouble(), nil
 	case "null":
-		return v.marshallNull()
+		return v.marshallNull(), nil
 	case "error":
-		return v.marshallError()
+		return v.marshallError(), nil
+	case "raw":
+		// Already serialized, such as the replication stream.
+		return []byte(v.bulk), nil
 	default:
-		return []byte{}
+		return nil, fmt.Errorf("cannot marshal value of unknown type %q", v.typ)
 	}
 }
 
@@ -158,6 +362,33 @@ func (v Value) marshalString() []byte {
 	return bytes
 }
 
+// marshalInteger serializes an integer.
+func (v Value) marshalInteger() []byte {
+	var bytes []byte
+	bytes = append(bytes, INTEGER)
+	bytes = append(bytes, strconv.Itoa(v.num)...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
+// marshalDouble serializes a RESP3 double.
+func (v Value) marshalDouble() []byte {
+	var bytes []byte
+	bytes = append(bytes, DOUBLE)
+	switch {
+	case math.IsInf(v.double, 1):
+		bytes = append(bytes, "inf"...)
+	case math.IsInf(v.double, -1):
+		bytes = append(bytes, "-inf"...)
+	default:
+		bytes = strconv.AppendFloat(bytes, v.double, 'g', -1, 64)
+	}
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
 // marshalBulk serializes a bulk string.
 func (v Value) marshalBulk() []byte {
 	var bytes []byte
@@ -171,18 +402,27 @@ func (v Value) marshalBulk() []byte {
 }
 
 // marshalArray serializes an array.
-func (v Value) marshalArray() []byte {
-	len := len(v.array)
+func (v Value) marshalArray() ([]byte, error) {
+	return v.marshalAggregate(ARRAY, len(v.array))
+}
+
+// marshalAggregate serializes a RESP3 aggregate whose elements are stored flat in
+// v.array. For maps, count is the number of key/value pairs.
+func (v Value) marshalAggregate(prefix byte, count int) ([]byte, error) {
 	var bytes []byte
-	bytes = append(bytes, ARRAY)
-	bytes = append(bytes, strconv.Itoa(len)...)
+	bytes = append(bytes, prefix)
+	bytes = append(bytes, strconv.Itoa(count)...)
 	bytes = append(bytes, '\r', '\n')
 
-	for i := 0; i < len; i++ {
-		bytes = append(bytes, v.array[i].Marshal()...)
+	for i := 0; i < len(v.array); i++ {
+		element, err := v.array[i].Marshal()
+		if err != nil {
+			return nil, err
+		}
+		bytes = append(bytes, element...)
 	}
 
-	return bytes
+	return bytes, nil
 }
 
 // marshallError serializes an error message.
@@ -200,24 +440,156 @@ func (v Value) marshallNull() []byte {
 	return []byte("$-1\r\n")
 }
 
-// RESPWriter writes RESP values to an io.Writer.
+// replyChunkSize is how much of a large reply is serialized ahead of what
+// the client read, see RESPWriter.Stream.
+const replyChunkSize = 64 * 1024
+
+// large reports whether v serializes to more than replyChunkSize bytes,
+// roughly: only its strings are counted.
+func (v Value) large() bool {
+	size := 0
+	var count func(v Value) bool
+	count = func(v Value) bool {
+		size += len(v.str) + len(v.bulk)
+		if size > replyChunkSize {
+			return true
+		}
+		for _, element := range v.array {
+			if count(element) {
+				return true
+			}
+		}
+		return false
+	}
+	return count(v)
+}
+
+// RESPWriter writes RESP values to a buffered io.Writer.
 type RESPWriter struct {
-	writer io.Writer
+	writer *bufio.Writer
+	out    io.Writer
+	// marshal serializes values when the connection speaks another encoding
+	// than RESP, which is streamed when it is nil.
+	marshal func(v Value) ([]byte, error)
 }
 
 // NewRESPWriter creates a new RESPWriter instance.
 func NewRESPWriter(w io.Writer) *RESPWriter {
-	return &RESPWriter{writer: w}
+	return &RESPWriter{writer: bufio.NewWriter(w), out: w}
 }
 
-// Write writes a serialized RESP value to the output.
+// Write buffers a serialized RESP value; call Flush to send it.
 func (w *RESPWriter) Write(v Value) error {
-	var bytes = v.Marshal()
+	marshal := w.marshal
+	if marshal == nil {
+		marshal = Value.Marshal
+	}
+	bytes, err := marshal(v)
+	if err != nil {
+		return err
+	}
 
-	_, err := w.writer.Write(bytes)
+	_, err = w.writer.Write(bytes)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Stream buffers a RESP value like Write, but serializes it straight into
+// the buffer and, every replyChunkSize bytes, flushes them and calls wait,
+// which waits for the client to read most of them. A large reply thus never
+// takes more than a few chunks of memory, where Write would build it whole
+// and then queue it whole. Values that fail to serialize may be written in
+// part. Other encodings than RESP are written whole.
+func (w *RESPWriter) Stream(v Value, wait func() error) error {
+	if w.marshal != nil {
+		return w.Write(v)
+	}
+	e := respEncoder{w: w.writer, wait: wait}
+	return e.encode(v)
+}
+
+// respEncoder serializes values into a buffered writer for Stream.
+type respEncoder struct {
+	w    *bufio.Writer
+	wait func() error
+	// n is how much was written since the last wait.
+	n int
+}
+
+// encode serializes v as Value.Marshal does.
+func (e *respEncoder) encode(v Value) error {
+	switch v.typ {
+	case "array":
+		return e.encodeAggregate(ARRAY, len(v.array), v.array)
+	case "map":
+		return e.encodeAggregate(MAP, len(v.array)/2, v.array)
+	case "push":
+		return e.encodeAggregate(PUSH, len(v.array), v.array)
+	case "bulk":
+		if err := e.write(string(BULK) + strconv.Itoa(len(v.bulk)) + "\r\n"); err != nil {
+			return err
+		}
+		if err := e.write(v.bulk); err != nil {
+			return err
+		}
+		return e.write("\r\n")
+	case "raw":
+		return e.write(v.bulk)
+	default:
+		bytes, err := v.Marshal()
+		if err != nil {
+			return err
+		}
+		return e.write(string(bytes))
+	}
+}
+
+// encodeAggregate serializes an aggregate of count elements, stored flat in
+// elements.
+func (e *respEncoder) encodeAggregate(prefix byte, count int, elements []Value) error {
+	if err := e.write(string(prefix) + strconv.Itoa(count) + "\r\n"); err != nil {
+		return err
+	}
+	for _, element := range elements {
+		if err := e.encode(element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write buffers s, waiting every replyChunkSize bytes.
+func (e *respEncoder) write(s string) error {
+	for len(s) > 0 {
+		n := min(len(s), replyChunkSize-e.n)
+		if _, err := e.w.WriteString(s[:n]); err != nil {
+			return err
+		}
+		e.n += n
+		s = s[n:]
+		if e.n == replyChunkSize {
+			if err := e.w.Flush(); err != nil {
+				return err
+			}
+			if err := e.wait(); err != nil {
+				return err
+			}
+			e.n = 0
+		}
+	}
+	return nil
+}
+
+// Flush sends any buffered replies to the underlying writer.
+func (w *RESPWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+// Discard drops the buffered replies without sending them. Replies that
+// overflowed the buffer were sent already.
+func (w *RESPWriter) Discard() {
+	w.writer.Reset(w.out)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bgsaveRetryDelay is how long a failed automatic snapshot waits before the
+// next attempt, so a full disk isn't hammered every second.
+const bgsaveRetryDelay = 5 * time.Second
+
+// savePoint triggers a snapshot once seconds have passed since the last
+// snapshot and the dataset changed at least changes times.
+type savePoint struct {
+	seconds int
+	changes int
+}
+
+// SavePoints holds the save points as "seconds changes" pairs, no automatic
+// snapshots when empty.
+var SavePoints = "3600 1 300 100 60 10000"
+
+// savePoints are the parsed SavePoints.
+var savePoints = mustParseSavePoints(SavePoints)
+
+// dirty counts the changes to the dataset since the last snapshot.
+var dirty int64
+
+// recordChanges adds n changes to the dataset to the count of unsaved ones.
+func recordChanges(n int) {
+	atomic.AddInt64(&dirty, int64(n))
+}
+
+// parseSavePoints parses "seconds changes" pairs.
+func parseSavePoints(value string) ([]savePoint, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("argument must be \"seconds changes\" pairs")
+	}
+
+	points := []savePoint{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save point seconds %q", fields[i])
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save point changes %q", fields[i+1])
+		}
+		points = append(points, savePoint{seconds, changes})
+	}
+	return points, nil
+}
+
+// mustParseSavePoints parses the default save points.
+func mustParseSavePoints(value string) []savePoint {
+	points, err := parseSavePoints(value)
+	if err != nil {
+		panic(err)
+	}
+	return points
+}
+
+// setSavePoints changes the save points.
+func setSavePoints(value string) error {
+	points, err := parseSavePoints(value)
+	if err != nil {
+		return err
+	}
+	SavePoints = strings.Join(strings.Fields(value), " ")
+	savePoints = points
+	return nil
+}
+
+// runSavePoints starts a BGSAVE once a second whenever a save point is
+// reached, until shutdown.
+func runSavePoints() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shuttingDown:
+			return
+		case <-ticker.C:
+		}
+
+		point, ok := dueSavePoint()
+		if !ok {
+			continue
+		}
+
+		executionMu.Lock()
+		if startBgsave() {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", point.changes, point.seconds)
+		}
+		executionMu.Unlock()
+	}
+}
+
+// dueSavePoint returns a save point that was reached, if any. After a failed
+// BGSAVE, none is until bgsaveRetryDelay has passed.
+func dueSavePoint() (savePoint, bool) {
+	configMu.RLock()
+	points := savePoints
+	configMu.RUnlock()
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	if bgsaveInProgress || (lastBgsaveErr != nil && time.Since(lastBgsaveTry) < bgsaveRetryDelay) {
+		return savePoint{}, false
+	}
+	changes := atomic.LoadInt64(&dirty)
+	for _, point := range points {
+		if changes >= int64(point.changes) && time.Since(lastSave) > time.Duration(point.seconds)*time.Second {
+			return point, true
+		}
+	}
+	return savePoint{}, false
+}
+
+// saveOnShutdown writes a final snapshot when save points are configured,
+// after any BGSAVE in progress finishes. executionMu must be held for
+// writing.
+func saveOnShutdown() {
+	configMu.RLock()
+	enabled := len(savePoints) > 0
+	configMu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	bgsaves.Wait()
+	fmt.Println("Saving the final RDB snapshot before exiting.")
+	if err := writeSnapshot(DBFilename, snapshotDataset()); err != nil {
+		fmt.Println("Error saving the final snapshot:", err)
+		return
+	}
+	fmt.Println("DB saved on disk")
+}
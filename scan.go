@@ -0,0 +1,146 @@
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultScanCount is the number of keys SCAN returns per call without COUNT.
+const defaultScanCount = 10
+
+// handleScan handles "SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]",
+// iterating over the database's keys a page at a time: it replies with the
+// cursor to pass next, 0 once done, and the keys of the page that match the
+// pattern and hold a value of the type. Keys are ordered by a hash of their
+// name, which the cursor is a position in, so every key that exists for
+// the whole iteration is returned exactly once, whatever is written
+// meanwhile. A page holds about count keys, before filtering. Each call
+// goes over the whole database to find its page, so a larger count makes a
+// full iteration cheaper.
+func handleScan(c *Client, args []Value) Value {
+	if len(args) == 0 || len(args)%2 == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'scan' command"}
+	}
+
+	cursor, err := strconv.ParseUint(args[0].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR invalid cursor"}
+	}
+	pattern, count, typ := "*", defaultScanCount, ""
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].bulk) {
+		case "MATCH":
+			pattern = args[i+1].bulk
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil || n <= 0 {
+				return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+			}
+			count = n
+		case "TYPE":
+			typ = strings.ToLower(args[i+1].bulk)
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	db := c.database()
+
+	db.mu.RLock()
+	page, next := db.scan(cursor, count)
+	now := nowMillis()
+	keys := make([]Value, 0, len(page))
+	for _, key := range page {
+		if db.isExpired(key, now) || !matchGlob(pattern, key) {
+			continue
+		}
+		switch typ {
+		case "string":
+			if _, ok := db.store.Get(key); !ok {
+				continue
+			}
+		case "hash":
+			if _, ok := db.store.HashEncoding(key); !ok {
+				continue
+			}
+		case "":
+		default:
+			continue
+		}
+		keys = append(keys, Value{typ: "bulk", bulk: key})
+	}
+	db.mu.RUnlock()
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(next, 10)},
+		{typ: "array", array: keys},
+	}}
+}
+
+// scanHash orders keys for SCAN.
+func scanHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// scan returns the page of keys starting at cursor, in scanHash order: the
+// count keys with the lowest hashes from cursor on, and those sharing the
+// hash of the last one, and the cursor of the next page, 0 after the last
+// page. db.mu must be held.
+func (db *Database) scan(cursor uint64, count int) ([]string, uint64) {
+	// The count lowest hashes from cursor on, in a max-heap, to find the
+	// last one of the page.
+	lowest := &hashHeap{}
+	db.store.IterateKeys(func(key string) bool {
+		h := scanHash(key)
+		switch {
+		case h < cursor:
+		case lowest.Len() < count:
+			heap.Push(lowest, h)
+		case h < (*lowest)[0]:
+			(*lowest)[0] = h
+			heap.Fix(lowest, 0)
+		}
+		return true
+	})
+	last := uint64(math.MaxUint64)
+	if lowest.Len() == count {
+		last = (*lowest)[0]
+	}
+
+	page := make([]string, 0, lowest.Len())
+	more := false
+	db.store.IterateKeys(func(key string) bool {
+		switch h := scanHash(key); {
+		case h < cursor:
+		case h <= last:
+			page = append(page, key)
+		default:
+			more = true
+		}
+		return true
+	})
+	if !more {
+		return page, 0
+	}
+	return page, last + 1
+}
+
+// hashHeap is a max-heap of hashes.
+type hashHeap []uint64
+
+func (h hashHeap) Len() int            { return len(h) }
+func (h hashHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+
+func (h *hashHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
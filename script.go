@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Script and function handlers run commands through call, which looks
+// handlers up in Handlers, so they are registered at init to avoid an
+// initialization cycle.
+func init() {
+	Handlers["EVAL"] = handleEval
+	Handlers["EVALSHA"] = handleEvalSha
+	Handlers["FUNCTION"] = handleFunction
+	Handlers["FCALL"] = handleFCall
+}
+
+// ScriptEngine is the engine running scripts that don't name one in a
+// "#!<engine>" first line.
+var ScriptEngine = "lua"
+
+// BusyReplyThreshold is how many milliseconds a script may run before other
+// clients are answered with BUSY and SCRIPT KILL may stop it.
+var BusyReplyThreshold = 5000
+
+// scriptEngine compiles and runs scripts written in one language.
+type scriptEngine interface {
+	// compile compiles the body of a script run with EVAL.
+	compile(body string) (script, error)
+	// load runs the body of a function library until ctx is done, returning
+	// the functions it registers and a function releasing them.
+	load(ctx context.Context, body string) (map[string]script, func(), *Value)
+}
+
+// script is a compiled script or a library function.
+type script interface {
+	// run calls the script as sc with its keys and arguments until ctx is
+	// done, converting its result to a reply.
+	run(ctx context.Context, sc *Client, keys, argv []Value) Value
+}
+
+// scriptEngines are the available scripting engines by name.
+var scriptEngines = map[string]scriptEngine{
+	"lua":      luaEngine{},
+	"starlark": starlarkEngine{},
+}
+
+// setScriptEngine changes the default scripting engine.
+func setScriptEngine(value string) error {
+	if _, ok := scriptEngines[value]; !ok {
+		return fmt.Errorf("unknown scripting engine '%s'", value)
+	}
+	ScriptEngine = value
+	return nil
+}
+
+// runningScript is the script being run, if any. wrote is set once it runs a
+// write command: killing it then would leave its effects half applied.
+var runningScript = struct {
+	mu      sync.Mutex
+	running bool
+	started time.Time
+	wrote   bool
+	killed  bool
+	cancel  func()
+}{}
+
+// scripts caches compiled scripts by the SHA1 of their source, for EVALSHA.
+var scripts = map[string]script{}
+var scriptsMu = sync.RWMutex{}
+
+// scriptHeader matches the optional first line of a script naming its engine.
+var scriptHeader = regexp.MustCompile(`^#!(\w+)$`)
+
+// scriptSHA returns the lowercase hex SHA1 digest of a script's source.
+func scriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// compileScript compiles a script with the engine its first line names, or
+// else the default one, and caches it under its SHA1. A cached script keeps
+// the engine it was compiled with.
+func compileScript(body string) (script, *Value) {
+	sha := scriptSHA(body)
+
+	scriptsMu.RLock()
+	s, ok := scripts[sha]
+	scriptsMu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	configMu.RLock()
+	name := ScriptEngine
+	configMu.RUnlock()
+
+	// The header isn't part of the code; an empty line keeps the line
+	// numbers of errors.
+	code := body
+	if strings.HasPrefix(body, "#!") {
+		header, rest, _ := strings.Cut(body, "\n")
+		match := scriptHeader.FindStringSubmatch(strings.TrimSpace(header))
+		if match == nil {
+			return nil, &Value{typ: "error", str: "ERR Invalid script header, expected #!<engine>"}
+		}
+		name, code = match[1], "\n"+rest
+	}
+	engine, ok := scriptEngines[name]
+	if !ok {
+		return nil, &Value{typ: "error", str: "ERR Could not find scripting engine '" + name + "'"}
+	}
+
+	s, err := engine.compile(code)
+	if err != nil {
+		return nil, &Value{typ: "error", str: "ERR Error compiling script (new function): " + oneLine(err.Error())}
+	}
+
+	scriptsMu.Lock()
+	scripts[sha] = s
+	scriptsMu.Unlock()
+
+	return s, nil
+}
+
+// evalKeys returns the keys of "EVAL script numkeys [key ...] [arg ...]",
+// and likewise of EVALSHA and FCALL, or none when numkeys is invalid; the
+// handler reports the error.
+func evalKeys(args []Value) []string {
+	keys := []string{}
+	if len(args) < 2 {
+		return keys
+	}
+	n, err := strconv.Atoi(args[1].bulk)
+	if err != nil || n < 0 || n > len(args)-2 {
+		return keys
+	}
+	for _, arg := range args[2 : 2+n] {
+		keys = append(keys, arg.bulk)
+	}
+	return keys
+}
+
+// handleEval handles "EVAL script numkeys [key ...] [arg ...]".
+func handleEval(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'eval' command"}
+	}
+
+	s, errValue := compileScript(args[0].bulk)
+	if errValue != nil {
+		return *errValue
+	}
+	return runScript(c, s, args[1:])
+}
+
+// handleEvalSha handles "EVALSHA sha1 numkeys [key ...] [arg ...]", running a
+// script cached by an earlier EVAL.
+func handleEvalSha(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'evalsha' command"}
+	}
+
+	scriptsMu.RLock()
+	s, ok := scripts[strings.ToLower(args[0].bulk)]
+	scriptsMu.RUnlock()
+	if !ok {
+		return Value{typ: "error", str: "NOSCRIPT No matching script. Please use EVAL."}
+	}
+	return runScript(c, s, args[1:])
+}
+
+// runScript runs a script or function given "numkeys [key ...] [arg ...]"
+// as the running script, which SCRIPT KILL can stop. executionMu must be
+// held for writing.
+func runScript(c *Client, s script, args []Value) Value {
+	keys, argv, errValue := splitKeys(args)
+	if errValue != nil {
+		return *errValue
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startScript(cancel)
+	sc := newScriptClient(c)
+	beginAtomic()
+	result := s.run(ctx, sc, keys, argv)
+	endAtomic(sc)
+	c.aofPending = c.aofPending || sc.aofPending
+	if killed := finishScript(); killed {
+		return Value{typ: "error", str: "ERR Script killed by user with SCRIPT KILL..."}
+	}
+	return result
+}
+
+// splitKeys splits "numkeys [key ...] [arg ...]" into keys and arguments.
+func splitKeys(args []Value) ([]Value, []Value, *Value) {
+	n, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return nil, nil, &Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	if n < 0 {
+		return nil, nil, &Value{typ: "error", str: "ERR Number of keys can't be negative"}
+	}
+	if n > len(args)-1 {
+		return nil, nil, &Value{typ: "error", str: "ERR Number of keys can't be greater than number of args"}
+	}
+	return args[1 : 1+n], args[1+n:], nil
+}
+
+// startScript records that a script started running; cancel stops it.
+func startScript(cancel func()) {
+	runningScript.mu.Lock()
+	defer runningScript.mu.Unlock()
+
+	runningScript.running = true
+	runningScript.started = time.Now()
+	runningScript.wrote = false
+	runningScript.killed = false
+	runningScript.cancel = cancel
+}
+
+// finishScript records that the running script returned, reporting whether
+// it was killed.
+func finishScript() bool {
+	runningScript.mu.Lock()
+	defer runningScript.mu.Unlock()
+
+	runningScript.running = false
+	runningScript.cancel = nil
+	return runningScript.killed
+}
+
+// killsScript reports whether the command is SCRIPT KILL. Dispatch runs it
+// without the execution lock, which the script to kill holds.
+func killsScript(command string, args []Value) bool {
+	return command == "SCRIPT" && len(args) > 0 && strings.ToUpper(args[0].bulk) == "KILL"
+}
+
+// busyCheck returns a BUSY error for the command when a script has run past
+// the busy reply threshold, and nil otherwise. Only SCRIPT KILL gets through.
+func busyCheck(command string, args []Value) *Value {
+	if killsScript(command, args) {
+		return nil
+	}
+
+	configMu.RLock()
+	threshold := time.Duration(BusyReplyThreshold) * time.Millisecond
+	configMu.RUnlock()
+
+	runningScript.mu.Lock()
+	defer runningScript.mu.Unlock()
+
+	if !runningScript.running || time.Since(runningScript.started) < threshold {
+		return nil
+	}
+	return &Value{typ: "error", str: "BUSY StormyDB is busy running a script. You can only call SCRIPT KILL."}
+}
+
+// killScript stops the running script, unless it already wrote to the dataset.
+func killScript() Value {
+	runningScript.mu.Lock()
+	defer runningScript.mu.Unlock()
+
+	if !runningScript.running {
+		return Value{typ: "error", str: "NOTBUSY No scripts in execution right now."}
+	}
+	if runningScript.wrote {
+		return Value{typ: "error", str: "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way."}
+	}
+	runningScript.killed = true
+	runningScript.cancel()
+	return Value{typ: "string", str: "OK"}
+}
+
+// newScriptClient creates the client a script runs its commands as. It acts
+// for the caller, with the caller's user and selected database, but speaks
+// RESP2 and keeps its own database selection, so a SELECT inside the script
+// doesn't change the caller's.
+func newScriptClient(caller *Client) *Client {
+	return &Client{
+		id:        caller.id,
+		conn:      caller.conn,
+		proto:     2,
+		created:   time.Now(),
+		db:        caller.db,
+		user:      caller.user,
+		exclusive: true,
+		master:    caller.master,
+		oom:       caller.oom,
+	}
+}
+
+// scriptCommand validates and runs a command a script issued as sc with
+// redis.call, the same way dispatch does for a client, minus what can't
+// happen inside a script: transactions, blocking and pausing. sc is nil while
+// a function library is being loaded, when commands may not be issued.
+func scriptCommand(sc *Client, value Value) Value {
+	if sc == nil {
+		return Value{typ: "error", str: "ERR Commands can't be called while loading a library"}
+	}
+	if len(value.array) == 0 {
+		return Value{typ: "error", str: "ERR Please specify at least one argument for this redis lib call"}
+	}
+
+	command, ok := resolveCommand(strings.ToUpper(value.array[0].bulk))
+	cmd, known := Commands[command]
+	if !ok || !known {
+		return recordRejected("", Value{typ: "error", str: "ERR Unknown Redis command called from script"})
+	}
+	value.array[0] = Value{typ: "bulk", bulk: command}
+	args := value.array[1:]
+
+	if cmd.hasFlag("noscript") {
+		return recordRejected(command, Value{typ: "error", str: "ERR This Redis command is not allowed from script"})
+	}
+	if !cmd.checkArity(len(value.array)) {
+		return recordRejected(command, Value{typ: "error", str: "ERR Wrong number of args calling Redis command from script"})
+	}
+	if errValue := aclCheck(sc, command, cmd, args); errValue != nil {
+		return recordRejected(command, *errValue)
+	}
+	if cmd.isWrite() {
+		if errValue := readOnlyCheck(sc); errValue != nil {
+			return recordRejected(command, *errValue)
+		}
+	}
+	// The script may add data only if the dataset was below maxmemory when
+	// it started, so it doesn't fail halfway through its writes.
+	if sc.oom && cmd.hasFlag("denyoom") {
+		return recordRejected(command, oomError)
+	}
+
+	// From the first write on, the script can no longer be killed.
+	if cmd.isWrite() {
+		runningScript.mu.Lock()
+		runningScript.wrote = true
+		runningScript.mu.Unlock()
+	}
+
+	return call(sc, command, cmd, value)
+}
+
+// handleScript handles the "SCRIPT" command and its subcommands.
+func handleScript(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'script' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LOAD":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'script|load' command"}
+		}
+		if _, errValue := compileScript(args[1].bulk); errValue != nil {
+			return *errValue
+		}
+		return Value{typ: "bulk", bulk: scriptSHA(args[1].bulk)}
+	case "EXISTS":
+		if len(args) < 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'script|exists' command"}
+		}
+		scriptsMu.RLock()
+		defer scriptsMu.RUnlock()
+		values := make([]Value, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			exists := 0
+			if _, ok := scripts[strings.ToLower(arg.bulk)]; ok {
+				exists = 1
+			}
+			values = append(values, Value{typ: "integer", num: exists})
+		}
+		return Value{typ: "array", array: values}
+	case "FLUSH":
+		if errValue := flushMode("script|flush", args[1:]); errValue != nil {
+			return *errValue
+		}
+		scriptsMu.Lock()
+		scripts = map[string]script{}
+		scriptsMu.Unlock()
+		return Value{typ: "string", str: "OK"}
+	case "KILL":
+		return killScript()
+	case "HELP":
+		lines := []string{
+			"SCRIPT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"EXISTS <sha1> [<sha1> ...]",
+			"    Return information about the existence of the scripts in the script cache.",
+			"FLUSH [ASYNC|SYNC]",
+			"    Flush the scripts cache.",
+			"KILL",
+			"    Kill the currently executing script, unless it already wrote to the dataset.",
+			"LOAD <script>",
+			"    Load a script into the scripts cache without executing it.",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try SCRIPT HELP."}
+	}
+}
+
+// oneLine joins the lines of a script error message, as error replies can't
+// contain newlines.
+func oneLine(msg string) string {
+	return strings.Join(strings.Fields(msg), " ")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// executionMu is held for reading while a command executes. Shutdown takes it
+// for writing, which waits for in-flight commands and keeps new ones from starting.
+var executionMu = sync.RWMutex{}
+
+// exclusiveCommands hold executionMu for writing instead, so no other
+// command runs at the same time: scripts and functions, which are atomic,
+// and commands that snapshot the dataset, replicas syncing included.
+var exclusiveCommands = map[string]bool{
+	"EVAL":         true,
+	"EVALSHA":      true,
+	"FCALL":        true,
+	"BGREWRITEAOF": true,
+	"SAVE":         true,
+	"BGSAVE":       true,
+	"BACKUP":       true,
+	"SYNC":         true,
+	"PSYNC":        true,
+}
+
+// isExclusive reports whether a command holds executionMu for writing: those
+// of exclusiveCommands, and DEBUG RELOAD, which replaces the dataset.
+func isExclusive(command string, args []Value) bool {
+	if exclusiveCommands[command] {
+		return true
+	}
+	return command == "DEBUG" && len(args) > 0 && strings.EqualFold(args[0].bulk, "RELOAD")
+}
+
+// shuttingDown is closed when shutdown begins, waking blocked commands.
+var shuttingDown = make(chan struct{})
+
+// blockUnlocked runs wait, which blocks the executing command until it can
+// make progress, without holding executionMu, so that a blocked command
+// doesn't hold up shutdown.
+func blockUnlocked(wait func()) {
+	executionMu.RUnlock()
+	defer executionMu.RLock()
+
+	wait()
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM arrives, then stops the
+// server gracefully: it stops accepting connections, lets in-flight commands
+// finish, writes a final snapshot if save points are configured, fsyncs and
+// closes the AOF, writes the changes pending for the write-behind sink, and
+// closes client connections after their pending replies have been sent.
+func waitForShutdown(listeners []net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	fmt.Println("Received", sig, "- shutting down")
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	close(shuttingDown)
+
+	// Never released: commands arriving from now on wait until the process exits.
+	executionMu.Lock()
+
+	saveOnShutdown()
+
+	if aof != nil {
+		if err := aof.Close(); err != nil {
+			fmt.Println("Error closing AOF:", err)
+		}
+	}
+
+	stopWriteBehind()
+
+	ClientsMu.RLock()
+	clients := make([]*Client, 0, len(Clients))
+	for _, c := range Clients {
+		clients = append(clients, c)
+	}
+	ClientsMu.RUnlock()
+
+	for _, c := range clients {
+		c.Flush()
+		c.output.Close(time.Second)
+		c.conn.Close()
+	}
+
+	fmt.Println("StormyDB is now ready to exit, bye bye...")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowlogLogSlowerThan is the execution time, in microseconds, above which a
+// command is recorded in the slow log. Zero logs every command and a negative
+// value disables the slow log.
+var SlowlogLogSlowerThan = 10000
+
+// SlowlogMaxLen is the number of entries the slow log keeps.
+var SlowlogMaxLen = 128
+
+const (
+	// slowlogMaxArgs is how many arguments of a command an entry keeps.
+	slowlogMaxArgs = 32
+	// slowlogMaxArgLen is how many bytes of each argument an entry keeps.
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is one command recorded in the slow log.
+type slowlogEntry struct {
+	id         int64
+	time       time.Time
+	duration   time.Duration
+	args       []string
+	clientAddr string
+	clientName string
+}
+
+// slowlog holds the most recent slow commands, oldest first.
+var slowlog = []slowlogEntry{}
+var slowlogNextID int64
+var slowlogMu = sync.Mutex{}
+
+// setSlowlogLogSlowerThan changes the slow log threshold.
+func setSlowlogLogSlowerThan(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < -1 {
+		return fmt.Errorf("argument must be -1 or a non-negative integer")
+	}
+	SlowlogLogSlowerThan = n
+	return nil
+}
+
+// slowlogPush records the command if it ran for longer than the threshold.
+func slowlogPush(c *Client, command []Value, duration time.Duration) {
+	configMu.RLock()
+	threshold, maxLen := SlowlogLogSlowerThan, SlowlogMaxLen
+	configMu.RUnlock()
+
+	if threshold < 0 || duration < time.Duration(threshold)*time.Microsecond {
+		return
+	}
+
+	args := []string{}
+	for i, arg := range command {
+		if i == slowlogMaxArgs-1 && len(command) > slowlogMaxArgs {
+			args = append(args, fmt.Sprintf("... (%d more arguments)", len(command)-slowlogMaxArgs+1))
+			break
+		}
+		s := arg.bulk
+		if len(s) > slowlogMaxArgLen {
+			s = fmt.Sprintf("%s... (%d more bytes)", s[:slowlogMaxArgLen], len(s)-slowlogMaxArgLen)
+		}
+		args = append(args, s)
+	}
+
+	entry := slowlogEntry{time: time.Now(), duration: duration, args: args}
+	if c.conn != nil {
+		entry.clientAddr = c.conn.RemoteAddr().String()
+	}
+	c.metaMu.Lock()
+	entry.clientName = c.name
+	c.metaMu.Unlock()
+
+	slowlogMu.Lock()
+	defer slowlogMu.Unlock()
+
+	entry.id = slowlogNextID
+	slowlogNextID++
+	slowlog = append(slowlog, entry)
+	if len(slowlog) > maxLen {
+		slowlog = append([]slowlogEntry{}, slowlog[len(slowlog)-maxLen:]...)
+	}
+}
+
+// handleSlowlog handles the "SLOWLOG" command and its subcommands.
+func handleSlowlog(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		return handleSlowlogGet(args[1:])
+	case "LEN":
+		slowlogMu.Lock()
+		defer slowlogMu.Unlock()
+		return Value{typ: "integer", num: len(slowlog)}
+	case "RESET":
+		slowlogMu.Lock()
+		slowlog = []slowlogEntry{}
+		slowlogMu.Unlock()
+		return Value{typ: "string", str: "OK"}
+	case "HELP":
+		lines := []string{
+			"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GET [<count>]",
+			"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+			"    Entries are made of:",
+			"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+			"    client name",
+			"LEN",
+			"    Return the length of the slowlog.",
+			"RESET",
+			"    Reset the slowlog.",
+			"HELP",
+			"    Print this help.",
+		}
+		values := make([]Value, 0, len(lines))
+		for _, line := range lines {
+			values = append(values, Value{typ: "string", str: line})
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + args[0].bulk + "'. Try SLOWLOG HELP."}
+	}
+}
+
+// handleSlowlogGet handles "SLOWLOG GET [count]", newest entries first.
+func handleSlowlogGet(args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog|get' command"}
+	}
+
+	count := 10
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n < -1 {
+			return Value{typ: "error", str: "ERR count should be greater than or equal to -1"}
+		}
+		count = n
+	}
+
+	slowlogMu.Lock()
+	defer slowlogMu.Unlock()
+
+	if count == -1 || count > len(slowlog) {
+		count = len(slowlog)
+	}
+
+	values := []Value{}
+	for i := len(slowlog) - 1; i >= len(slowlog)-count; i-- {
+		entry := slowlog[i]
+		args := make([]Value, 0, len(entry.args))
+		for _, arg := range entry.args {
+			args = append(args, Value{typ: "bulk", bulk: arg})
+		}
+		values = append(values, Value{typ: "array", array: []Value{
+			{typ: "integer", num: int(entry.id)},
+			{typ: "integer", num: int(entry.time.Unix())},
+			{typ: "integer", num: int(entry.duration.Microseconds())},
+			{typ: "array", array: args},
+			{typ: "bulk", bulk: entry.clientAddr},
+			{typ: "bulk", bulk: entry.clientName},
+		}})
+	}
+
+	return Value{typ: "array", array: values}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// starlarkEngine runs scripts written in Starlark. Starlark has no top-level
+// return, so a script defines main(keys, args), whose result is the reply.
+type starlarkEngine struct{}
+
+// starlarkOptions allow while loops and if/for statements at top level,
+// which Starlark otherwise rejects.
+var starlarkOptions = &syntax.FileOptions{While: true, TopLevelControl: true}
+
+// starlarkScript is a compiled Starlark script, initialized afresh each run.
+type starlarkScript struct {
+	program *starlark.Program
+}
+
+// starlarkFunction is a function registered by a Starlark library.
+type starlarkFunction struct {
+	fn starlark.Callable
+}
+
+// starlarkReplyError is raised by redis.call for an error reply, so the
+// script fails with the reply's message.
+type starlarkReplyError struct {
+	reply string
+}
+
+func (e starlarkReplyError) Error() string {
+	return e.reply
+}
+
+// compile compiles a Starlark script.
+func (starlarkEngine) compile(body string) (script, error) {
+	_, program, err := starlark.SourceProgramOptions(starlarkOptions, "user_script", body, func(name string) bool {
+		return name == "redis"
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlarkScript{program}, nil
+}
+
+// load runs a Starlark library, which registers its functions with
+// redis.register_function(name, callback).
+func (starlarkEngine) load(ctx context.Context, body string) (map[string]script, func(), *Value) {
+	fns := map[string]script{}
+
+	redis := starlarkRedis(starlark.StringDict{
+		"register_function": starlark.NewBuiltin("register_function", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			var callback starlark.Callable
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "function_name", &name, "callback", &callback); err != nil {
+				return nil, err
+			}
+			return starlark.None, registerFunction(fns, name, starlarkFunction{callback})
+		}),
+	})
+
+	thread := &starlark.Thread{Name: "load"}
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("timeout") })
+	defer stop()
+
+	if _, err := starlark.ExecFileOptions(starlarkOptions, thread, "user_function", body, starlark.StringDict{"redis": redis}); err != nil {
+		reply := starlarkError(err)
+		return nil, nil, &reply
+	}
+	return fns, func() {}, nil
+}
+
+// run initializes the script and calls its main function.
+func (s starlarkScript) run(ctx context.Context, sc *Client, keys, argv []Value) Value {
+	thread := newStarlarkThread(sc)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("killed") })
+	defer stop()
+
+	globals, err := s.program.Init(thread, starlark.StringDict{"redis": starlarkRedis(nil)})
+	if err != nil {
+		return starlarkError(err)
+	}
+	main, ok := globals["main"].(starlark.Callable)
+	if !ok {
+		return Value{typ: "error", str: "ERR Error running script: Starlark scripts must define main(keys, args)"}
+	}
+	return callStarlark(thread, main, keys, argv)
+}
+
+// run calls the function with the keys and arguments as two lists.
+func (f starlarkFunction) run(ctx context.Context, sc *Client, keys, argv []Value) Value {
+	thread := newStarlarkThread(sc)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("killed") })
+	defer stop()
+
+	return callStarlark(thread, f.fn, keys, argv)
+}
+
+// newStarlarkThread creates a thread whose redis.call issues commands as sc.
+func newStarlarkThread(sc *Client) *starlark.Thread {
+	thread := &starlark.Thread{Name: "script"}
+	thread.SetLocal("client", sc)
+	return thread
+}
+
+// callStarlark calls fn with the keys and arguments as two lists, and
+// converts its result to a reply.
+func callStarlark(thread *starlark.Thread, fn starlark.Callable, keys, argv []Value) Value {
+	result, err := starlark.Call(thread, fn, starlark.Tuple{stringsList(keys), stringsList(argv)}, nil)
+	if err != nil {
+		return starlarkError(err)
+	}
+	return starlarkToValue(result)
+}
+
+// starlarkRedis returns the redis module scripts use, with the extra members
+// given.
+func starlarkRedis(extra starlark.StringDict) *starlarkstruct.Module {
+	members := starlark.StringDict{
+		"call":  starlark.NewBuiltin("call", starlarkCall(true)),
+		"pcall": starlark.NewBuiltin("pcall", starlarkCall(false)),
+		"error_reply": starlark.NewBuiltin("error_reply", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var msg string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &msg); err != nil {
+				return nil, err
+			}
+			return replyDict("err", msg), nil
+		}),
+		"status_reply": starlark.NewBuiltin("status_reply", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var msg string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &msg); err != nil {
+				return nil, err
+			}
+			return replyDict("ok", msg), nil
+		}),
+		"sha1hex": starlark.NewBuiltin("sha1hex", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var s string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+				return nil, err
+			}
+			return starlark.String(scriptSHA(s)), nil
+		}),
+		"log": starlark.NewBuiltin("log", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var level int
+			var msg string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &level, &msg); err != nil {
+				return nil, err
+			}
+			fmt.Println("Script log:", msg)
+			return starlark.None, nil
+		}),
+	}
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		members[level] = starlark.MakeInt(i)
+	}
+	for name, member := range extra {
+		members[name] = member
+	}
+	return &starlarkstruct.Module{Name: "redis", Members: members}
+}
+
+// starlarkCall implements redis.call and redis.pcall: it runs the command
+// given by the arguments and returns its reply. When raise is set, an error
+// reply fails the script instead of being returned.
+func starlarkCall(raise bool) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		value := Value{typ: "array", array: make([]Value, 0, len(args))}
+		for _, arg := range args {
+			switch arg := arg.(type) {
+			case starlark.String:
+				value.array = append(value.array, Value{typ: "bulk", bulk: string(arg)})
+			case starlark.Int:
+				value.array = append(value.array, Value{typ: "bulk", bulk: arg.String()})
+			default:
+				return nil, starlarkReplyError{"ERR Starlark redis lib command arguments must be strings or integers"}
+			}
+		}
+
+		sc, _ := thread.Local("client").(*Client)
+		reply := scriptCommand(sc, value)
+		if reply.typ == "error" && raise {
+			return nil, starlarkReplyError{reply.str}
+		}
+		return valueToStarlark(reply), nil
+	}
+}
+
+// stringsList returns a Starlark list of the bulk strings of values.
+func stringsList(values []Value) *starlark.List {
+	elems := make([]starlark.Value, 0, len(values))
+	for _, v := range values {
+		elems = append(elems, starlark.String(v.bulk))
+	}
+	return starlark.NewList(elems)
+}
+
+// replyDict returns a dict with a single entry, the way Starlark represents
+// error ("err") and status ("ok") replies.
+func replyDict(field, message string) *starlark.Dict {
+	d := starlark.NewDict(1)
+	d.SetKey(starlark.String(field), starlark.String(message))
+	return d
+}
+
+// valueToStarlark converts a command reply to Starlark: integers to ints,
+// bulk strings to strings, nulls to None, aggregates to lists, and status and
+// error replies to dicts with an "ok" or "err" entry.
+func valueToStarlark(v Value) starlark.Value {
+	switch v.typ {
+	case "integer":
+		return starlark.MakeInt(v.num)
+	case "double":
+		return starlark.String(strconv.FormatFloat(v.double, 'f', -1, 64))
+	case "bulk":
+		return starlark.String(v.bulk)
+	case "string":
+		return replyDict("ok", v.str)
+	case "error":
+		return replyDict("err", v.str)
+	case "array", "map", "push":
+		elems := make([]starlark.Value, 0, len(v.array))
+		for _, item := range v.array {
+			elems = append(elems, valueToStarlark(item))
+		}
+		return starlark.NewList(elems)
+	default:
+		return starlark.None
+	}
+}
+
+// starlarkToValue converts a script's result to a reply: ints to integers,
+// floats to integers, truncating them, strings to bulk strings, True to 1,
+// False and None to null, dicts with an "ok" or "err" entry to status or
+// error replies and lists and tuples to arrays.
+func starlarkToValue(sv starlark.Value) Value {
+	switch sv := sv.(type) {
+	case starlark.Int:
+		n, _ := sv.Int64()
+		return Value{typ: "integer", num: int(n)}
+	case starlark.Float:
+		return Value{typ: "integer", num: int(sv)}
+	case starlark.String:
+		return Value{typ: "bulk", bulk: string(sv)}
+	case starlark.Bool:
+		if sv {
+			return Value{typ: "integer", num: 1}
+		}
+		return Value{typ: "null"}
+	case *starlark.Dict:
+		if err, ok, _ := sv.Get(starlark.String("err")); ok {
+			if msg, ok := err.(starlark.String); ok {
+				return Value{typ: "error", str: string(msg)}
+			}
+		}
+		if status, ok, _ := sv.Get(starlark.String("ok")); ok {
+			if msg, ok := status.(starlark.String); ok {
+				return Value{typ: "string", str: string(msg)}
+			}
+		}
+		return Value{typ: "null"}
+	case starlark.Indexable:
+		values := make([]Value, 0, sv.Len())
+		for i := 0; i < sv.Len(); i++ {
+			values = append(values, starlarkToValue(sv.Index(i)))
+		}
+		return Value{typ: "array", array: values}
+	default:
+		return Value{typ: "null"}
+	}
+}
+
+// starlarkError converts an error failing a Starlark script to an error
+// reply. Errors raised by redis.call keep their message.
+func starlarkError(err error) Value {
+	var replyErr starlarkReplyError
+	if errors.As(err, &replyErr) {
+		return Value{typ: "error", str: replyErr.reply}
+	}
+	return Value{typ: "error", str: "ERR Error running script: " + oneLine(err.Error())}
+}
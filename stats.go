@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// commandStat accumulates the calls of one command.
+type commandStat struct {
+	calls    int64
+	duration time.Duration
+	// rejected counts calls refused before execution, e.g. by arity or ACL
+	// checks; failed counts calls whose execution returned an error.
+	rejected int64
+	failed   int64
+}
+
+// commandStats holds the statistics of every command called so far, by name.
+var commandStats = map[string]*commandStat{}
+
+// errorStats counts error replies by their error code, e.g. "ERR" or "NOPERM".
+var errorStats = map[string]int64{}
+var statsMu = sync.Mutex{}
+
+// Keyspace counters, updated atomically. Hits and misses count lookups of
+// keys by reading commands; expired and evicted count keys removed because
+// their TTL passed or to free memory.
+var (
+	keyspaceHits   int64
+	keyspaceMisses int64
+	expiredKeys    int64
+	evictedKeys    int64
+)
+
+// recordLookup counts a read lookup of a key as a hit or a miss.
+func recordLookup(found bool) {
+	if found {
+		atomic.AddInt64(&keyspaceHits, 1)
+	} else {
+		atomic.AddInt64(&keyspaceMisses, 1)
+	}
+}
+
+// statFor returns the statistics of the command, creating them. statsMu must be held.
+func statFor(command string) *commandStat {
+	stat, ok := commandStats[command]
+	if !ok {
+		stat = &commandStat{}
+		commandStats[command] = stat
+	}
+	return stat
+}
+
+// countError counts an error reply under its code. statsMu must be held.
+func countError(reply Value) {
+	code := reply.str
+	if i := strings.IndexByte(code, ' '); i >= 0 {
+		code = code[:i]
+	}
+	errorStats[code]++
+}
+
+// recordCall accounts for an executed command and its reply.
+func recordCall(command string, duration time.Duration, reply Value) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	stat := statFor(command)
+	stat.calls++
+	stat.duration += duration
+	if reply.typ == "error" {
+		stat.failed++
+		countError(reply)
+	}
+}
+
+// recordRejected accounts for a command refused before execution and returns
+// the error reply unchanged. An empty command counts only the error, for
+// requests naming no known command.
+func recordRejected(command string, reply Value) Value {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	if command != "" {
+		statFor(command).rejected++
+	}
+	countError(reply)
+	return reply
+}
+
+// totalCommandsProcessed returns the number of commands executed.
+func totalCommandsProcessed() int64 {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	total := int64(0)
+	for _, stat := range commandStats {
+		total += stat.calls
+	}
+	return total
+}
+
+// totalErrorReplies returns the number of error replies sent for commands.
+func totalErrorReplies() int64 {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	total := int64(0)
+	for _, count := range errorStats {
+		total += count
+	}
+	return total
+}
+
+// infoCommandStats reports per-command call counts and latency.
+func infoCommandStats() []string {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	names := make([]string, 0, len(commandStats))
+	for name := range commandStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		stat := commandStats[name]
+		usec := stat.duration.Microseconds()
+		perCall := 0.0
+		if stat.calls > 0 {
+			perCall = float64(usec) / float64(stat.calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			strings.ToLower(name), stat.calls, usec, perCall, stat.rejected, stat.failed))
+	}
+	return lines
+}
+
+// infoErrorStats reports error replies by error code.
+func infoErrorStats() []string {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	codes := make([]string, 0, len(errorStats))
+	for code := range errorStats {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	lines := []string{}
+	for _, code := range codes {
+		lines = append(lines, fmt.Sprintf("errorstat_%s:count=%d", code, errorStats[code]))
+	}
+	return lines
+}
+
+// handleConfigResetStat handles "CONFIG RESETSTAT", clearing the statistics
+// reported by INFO.
+func handleConfigResetStat() Value {
+	statsMu.Lock()
+	commandStats = map[string]*commandStat{}
+	errorStats = map[string]int64{}
+	statsMu.Unlock()
+
+	for _, counter := range []*int64{&keyspaceHits, &keyspaceMisses, &expiredKeys, &evictedKeys, &lazyfreedObjects, &activeDefragHits, &activeDefragEntries, &activeDefragReclaimed, &webhookSent, &webhookFailed, &webhookDropped} {
+		atomic.StoreInt64(counter, 0)
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TieredIdleSeconds is how long a value of the tiered engine goes unused
+// before it is spilled to disk.
+var TieredIdleSeconds = 300
+
+// TieredDirname is the directory inside Dir the tiered engine spills values to.
+var TieredDirname = "tiereddir"
+
+const (
+	// tieredSpillScan bounds how many keys of a database are checked for
+	// idleness each second, so that it isn't locked for long.
+	tieredSpillScan = 10000
+	// tieredCompactMin is the size from which a spill file is compacted once
+	// more than half of it is values read back in or overwritten since.
+	tieredCompactMin = 1 << 20
+)
+
+// tieredFaults counts the values read back in from disk.
+var tieredFaults int64
+
+// extent is where a spilled value lies in a spill file.
+type extent struct {
+	offset, length int64
+}
+
+// tieredEngine keeps recently used values in memory, like memoryEngine, and
+// spills those unused for TieredIdleSeconds to a file, reading them back in
+// when they are next used. Key names and TTLs always stay in memory, so
+// keyspace-wide figures don't touch the disk.
+//
+// Reading commands fault values back in while the database is only locked
+// for reading, so mu guards everything but the TTLs, which only change
+// under the database's write lock.
+type tieredEngine struct {
+	mu  sync.Mutex
+	hot *memoryEngine
+	// used holds when each key with a value in memory was last used, in
+	// Unix seconds.
+	used        map[string]int64
+	coldStrings map[string]extent
+	coldHashes  map[string]extent
+
+	// file holds the spilled values. It is created on the first spill and
+	// closed by Close, once the engine is flushed away.
+	file *os.File
+	// size is the length of file and garbage how much of it no value
+	// refers to anymore.
+	size, garbage int64
+	// coldUsed is the estimated size of the entries of the spilled values,
+	// whose keys stay in memory.
+	coldUsed int
+}
+
+// newTieredEngine creates an empty tiered engine.
+func newTieredEngine() StorageEngine {
+	return &tieredEngine{
+		hot:         newMemoryEngine().(*memoryEngine),
+		used:        map[string]int64{},
+		coldStrings: map[string]extent{},
+		coldHashes:  map[string]extent{},
+	}
+}
+
+func (e *tieredEngine) Get(key string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.faultString(key)
+}
+
+func (e *tieredEngine) Set(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropCold(e.coldStrings, key)
+	e.hot.Set(key, value)
+	e.touch(key)
+}
+
+func (e *tieredEngine) Delete(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, cold := e.coldStrings[key]
+	e.dropCold(e.coldStrings, key)
+	deleted := e.hot.Delete(key)
+	if cold && !deleted {
+		// Delete removes the TTL along with the value.
+		e.hot.Persist(key)
+	}
+	if !e.hot.hasHash(key) {
+		delete(e.used, key)
+	}
+	return deleted || cold
+}
+
+func (e *tieredEngine) GetHash(key string) (map[string]string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.faultHash(key) {
+		return nil, false
+	}
+	return e.hot.GetHash(key)
+}
+
+func (e *tieredEngine) GetField(key, field string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.faultHash(key) {
+		return "", false
+	}
+	return e.hot.GetField(key, field)
+}
+
+func (e *tieredEngine) HashEncoding(key string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.faultHash(key) {
+		return "", false
+	}
+	return e.hot.HashEncoding(key)
+}
+
+// HashLen reads only the field count of a spilled hash, without faulting
+// it in.
+func (e *tieredEngine) HashLen(key string) (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if n, ok := e.hot.HashLen(key); ok {
+		return n, true
+	}
+	ext, ok := e.coldHashes[key]
+	if !ok {
+		return 0, false
+	}
+	data, ok := e.readCold(extent{ext.offset, min(ext.length, binary.MaxVarintLen64)})
+	if !ok {
+		return 0, false
+	}
+	count, size := binary.Uvarint(data)
+	if size <= 0 {
+		fmt.Println("Error reading spilled value: invalid spilled hash")
+		return 0, false
+	}
+	return int(count), true
+}
+
+func (e *tieredEngine) SetHash(key string, hash map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropCold(e.coldHashes, key)
+	e.hot.SetHash(key, hash)
+	e.touch(key)
+}
+
+func (e *tieredEngine) SetField(key, field, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.faultHash(key)
+	e.hot.SetField(key, field, value)
+	e.touch(key)
+}
+
+func (e *tieredEngine) Remove(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropCold(e.coldStrings, key)
+	e.dropCold(e.coldHashes, key)
+	e.hot.Remove(key)
+	delete(e.used, key)
+}
+
+func (e *tieredEngine) ExpireTime(key string) (int64, bool) {
+	return e.hot.ExpireTime(key)
+}
+
+func (e *tieredEngine) Expire(key string, when int64) {
+	e.hot.Expire(key, when)
+}
+
+func (e *tieredEngine) Persist(key string) {
+	e.hot.Persist(key)
+}
+
+// IterateStrings reads spilled values from disk without faulting them in,
+// so that scanning the keyspace doesn't load all of it. It iterates over a
+// copy of the key names, so fn may call the engine.
+func (e *tieredEngine) IterateStrings(fn func(key, value string) bool) {
+	e.mu.Lock()
+	keys := make([]string, 0, len(e.hot.strings)+len(e.coldStrings))
+	for key := range e.hot.strings {
+		keys = append(keys, key)
+	}
+	for key := range e.coldStrings {
+		keys = append(keys, key)
+	}
+	e.mu.Unlock()
+
+	for _, key := range keys {
+		e.mu.Lock()
+		value, ok := e.hot.strings[key]
+		if ext, cold := e.coldStrings[key]; cold {
+			var data []byte
+			data, ok = e.readCold(ext)
+			value = string(data)
+		}
+		e.mu.Unlock()
+
+		if ok && !fn(key, value) {
+			return
+		}
+	}
+}
+
+// IterateHashes reads spilled hashes like IterateStrings does.
+func (e *tieredEngine) IterateHashes(fn func(key string, hash map[string]string) bool) {
+	e.mu.Lock()
+	keys := make([]string, 0, len(e.hot.hashes)+len(e.hot.packed)+len(e.coldHashes))
+	e.hot.iterateHashKeys(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for key := range e.coldHashes {
+		keys = append(keys, key)
+	}
+	e.mu.Unlock()
+
+	for _, key := range keys {
+		e.mu.Lock()
+		hash, ok := e.hot.GetHash(key)
+		if ext, cold := e.coldHashes[key]; cold {
+			hash, ok = e.readColdHash(ext)
+		}
+		e.mu.Unlock()
+
+		if ok && !fn(key, hash) {
+			return
+		}
+	}
+}
+
+func (e *tieredEngine) IterateExpires(fn func(key string, when int64) bool) {
+	e.hot.IterateExpires(fn)
+}
+
+// IterateKeys iterates over a copy of the key names, like IterateStrings,
+// without reading spilled values.
+func (e *tieredEngine) IterateKeys(fn func(key string) bool) {
+	e.mu.Lock()
+	keys := make([]string, 0, len(e.hot.strings)+len(e.coldStrings)+len(e.hot.hashes)+len(e.hot.packed)+len(e.coldHashes))
+	for key := range e.hot.strings {
+		keys = append(keys, key)
+	}
+	for key := range e.coldStrings {
+		keys = append(keys, key)
+	}
+	hasString := func(key string) bool {
+		_, hot := e.hot.strings[key]
+		_, cold := e.coldStrings[key]
+		return hot || cold
+	}
+	e.hot.iterateHashKeys(func(key string) bool {
+		if !hasString(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for key := range e.coldHashes {
+		if !hasString(key) {
+			keys = append(keys, key)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, key := range keys {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+func (e *tieredEngine) Counts() (int, int, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	strs, hashes, expires := e.hot.Counts()
+	return strs + len(e.coldStrings), hashes + len(e.coldHashes), expires
+}
+
+func (e *tieredEngine) KeyCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	count := len(e.hot.strings) + len(e.coldStrings)
+	hasString := func(key string) bool {
+		_, hot := e.hot.strings[key]
+		_, cold := e.coldStrings[key]
+		return hot || cold
+	}
+	e.hot.iterateHashKeys(func(key string) bool {
+		if !hasString(key) {
+			count++
+		}
+		return true
+	})
+	for key := range e.coldHashes {
+		if !hasString(key) {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *tieredEngine) Usage() keyspaceUsage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	usage := e.hot.Usage()
+	usage.spilled = e.coldUsed
+	return usage
+}
+
+// Defrag rebuilds the maps of the values in memory; spilled values are
+// compacted on disk as they are overwritten.
+func (e *tieredEngine) Defrag(threshold, ignoreBytes int) (int, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.hot.Defrag(threshold, ignoreBytes)
+}
+
+// Close closes the spill file, once the engine is discarded. Its descriptor
+// would otherwise stay open, and the unlinked file keep its disk space, until
+// the engine is garbage collected.
+func (e *tieredEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file, e.size, e.garbage = nil, 0, 0
+	return err
+}
+
+// touch records that key was just used. e.mu must be held.
+func (e *tieredEngine) touch(key string) {
+	e.used[key] = time.Now().Unix()
+}
+
+// dropCold forgets the spilled value of key in cold, if any. e.mu must be held.
+func (e *tieredEngine) dropCold(cold map[string]extent, key string) {
+	if ext, ok := cold[key]; ok {
+		e.garbage += ext.length
+		e.coldUsed -= coldEntrySize(key)
+		delete(cold, key)
+	}
+}
+
+// coldEntrySize estimates the bytes of the entry of a spilled value.
+func coldEntrySize(key string) int {
+	return len(key) + stringHeaderSize + 16 + mapEntryOverhead
+}
+
+// faultString returns the string value of key, reading it back in if it
+// was spilled. e.mu must be held.
+func (e *tieredEngine) faultString(key string) (string, bool) {
+	if value, ok := e.hot.strings[key]; ok {
+		e.touch(key)
+		return value, true
+	}
+	ext, ok := e.coldStrings[key]
+	if !ok {
+		return "", false
+	}
+	data, ok := e.readCold(ext)
+	if !ok {
+		return "", false
+	}
+
+	value := string(data)
+	e.dropCold(e.coldStrings, key)
+	e.hot.Set(key, value)
+	e.touch(key)
+	atomic.AddInt64(&tieredFaults, 1)
+	return value, true
+}
+
+// faultHash reads the hash at key back in if it was spilled, and reports
+// whether there is one. e.mu must be held.
+func (e *tieredEngine) faultHash(key string) bool {
+	if e.hot.hasHash(key) {
+		e.touch(key)
+		return true
+	}
+	ext, ok := e.coldHashes[key]
+	if !ok {
+		return false
+	}
+	hash, ok := e.readColdHash(ext)
+	if !ok {
+		return false
+	}
+
+	e.dropCold(e.coldHashes, key)
+	e.hot.SetHash(key, hash)
+	e.touch(key)
+	atomic.AddInt64(&tieredFaults, 1)
+	return true
+}
+
+// readCold reads a spilled value. A value that can't be read is reported
+// and treated as missing, but stays spilled. e.mu must be held.
+func (e *tieredEngine) readCold(ext extent) ([]byte, bool) {
+	data := make([]byte, ext.length)
+	if _, err := e.file.ReadAt(data, ext.offset); err != nil {
+		fmt.Println("Error reading spilled value:", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// readColdHash reads a spilled hash. e.mu must be held.
+func (e *tieredEngine) readColdHash(ext extent) (map[string]string, bool) {
+	data, ok := e.readCold(ext)
+	if !ok {
+		return nil, false
+	}
+	hash, err := decodeHash(data)
+	if err != nil {
+		fmt.Println("Error reading spilled value:", err)
+		return nil, false
+	}
+	return hash, true
+}
+
+// spill writes the values of up to tieredSpillScan keys unused since
+// cutoff, in Unix seconds, to the spill file and drops them from memory,
+// then compacts the file if it's mostly garbage.
+func (e *tieredEngine) spill(cutoff int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	type spilled struct {
+		key  string
+		hash bool
+		ext  extent
+	}
+	var buf []byte
+	batch := []spilled{}
+	add := func(key string, hash bool, data []byte) {
+		batch = append(batch, spilled{key, hash, extent{e.size + int64(len(buf)), int64(len(data))}})
+		buf = append(buf, data...)
+	}
+
+	scanned := 0
+	for key, used := range e.used {
+		if scanned == tieredSpillScan {
+			break
+		}
+		scanned++
+		if used > cutoff {
+			continue
+		}
+		if value, ok := e.hot.strings[key]; ok {
+			add(key, false, []byte(value))
+		}
+		if hash, ok := e.hot.GetHash(key); ok {
+			add(key, true, encodeHash(hash))
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if e.file == nil {
+		file, err := createSpillFile()
+		if err != nil {
+			return err
+		}
+		e.file = file
+	}
+	if _, err := e.file.WriteAt(buf, e.size); err != nil {
+		return err
+	}
+	e.size += int64(len(buf))
+
+	for _, s := range batch {
+		delete(e.used, s.key)
+		if s.hash {
+			e.coldHashes[s.key] = s.ext
+			e.hot.dropHash(s.key)
+		} else {
+			e.coldStrings[s.key] = s.ext
+			e.hot.dropString(s.key)
+		}
+		e.coldUsed += coldEntrySize(s.key)
+	}
+
+	if e.size >= tieredCompactMin && e.garbage*2 > e.size {
+		return e.compact()
+	}
+	return nil
+}
+
+// compact copies the spilled values still referred to into a new spill
+// file, replacing the old one. e.mu must be held.
+func (e *tieredEngine) compact() error {
+	file, err := createSpillFile()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	size := int64(0)
+	strs, hashes := map[string]extent{}, map[string]extent{}
+	copyCold := func(cold, moved map[string]extent) error {
+		for key, ext := range cold {
+			data, ok := e.readCold(ext)
+			if !ok {
+				return fmt.Errorf("can't read spilled value of %q", key)
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			moved[key] = extent{size, ext.length}
+			size += ext.length
+		}
+		return nil
+	}
+	if err := copyCold(e.coldStrings, strs); err != nil {
+		file.Close()
+		return err
+	}
+	if err := copyCold(e.coldHashes, hashes); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	e.file.Close()
+	e.file, e.size, e.garbage = file, size, 0
+	e.coldStrings, e.coldHashes = strs, hashes
+	return nil
+}
+
+// createSpillFile creates an empty spill file in TieredDirname. Spilled
+// values only matter while the server runs, as the AOF or snapshots persist
+// them, so the file is unlinked right away and leaves nothing behind.
+func createSpillFile() (*os.File, error) {
+	configMu.RLock()
+	dir := TieredDirname
+	configMu.RUnlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "spill-*.dat")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	return file, nil
+}
+
+// encodeHash encodes a hash as its number of fields followed by each field
+// and value, all prefixed by their length.
+func encodeHash(hash map[string]string) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(hash)))
+	for field, value := range hash {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// decodeHash decodes a hash encoded by encodeHash.
+func decodeHash(data []byte) (map[string]string, error) {
+	next := func() (string, bool) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return "", false
+		}
+		s := string(data[size : size+int(n)])
+		data = data[size+int(n):]
+		return s, true
+	}
+
+	count, size := binary.Uvarint(data)
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid spilled hash")
+	}
+	data = data[size:]
+
+	hash := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		field, ok := next()
+		if !ok {
+			return nil, fmt.Errorf("invalid spilled hash")
+		}
+		value, ok := next()
+		if !ok {
+			return nil, fmt.Errorf("invalid spilled hash")
+		}
+		hash[field] = value
+	}
+	return hash, nil
+}
+
+// runTieredStorage spills the values of every database that went unused
+// for TieredIdleSeconds to disk, once a second.
+func runTieredStorage() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		configMu.RLock()
+		cutoff := time.Now().Unix() - int64(TieredIdleSeconds)
+		configMu.RUnlock()
+
+		for _, db := range Databases {
+			// The read lock keeps the engine from being swapped or flushed
+			// away; the engine's own lock keeps readers out while spilling.
+			db.mu.RLock()
+			if e, ok := db.store.(*tieredEngine); ok {
+				if err := e.spill(cutoff); err != nil {
+					fmt.Println("Error spilling values to disk:", err)
+				}
+			}
+			db.mu.RUnlock()
+		}
+	}
+}
+
+// infoTieredStorage reports how much of the dataset is spilled to disk for
+// INFO, when the tiered engine is in use.
+func infoTieredStorage() []string {
+	if StorageEngineName != "tiered" {
+		return nil
+	}
+
+	cold, fileSize := 0, int64(0)
+	for _, db := range Databases {
+		db.mu.RLock()
+		if e, ok := db.store.(*tieredEngine); ok {
+			e.mu.Lock()
+			cold += len(e.coldStrings) + len(e.coldHashes)
+			fileSize += e.size
+			e.mu.Unlock()
+		}
+		db.mu.RUnlock()
+	}
+
+	return []string{
+		fmt.Sprintf("tiered_spilled_values:%d", cold),
+		fmt.Sprintf("tiered_spill_file_bytes:%d", fileSize),
+		fmt.Sprintf("tiered_faults:%d", atomic.LoadInt64(&tieredFaults)),
+	}
+}
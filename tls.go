@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// TLS listener settings; the listener is disabled while TLSPort is empty.
+var (
+	TLSPort        = ""
+	TLSCertFile    = ""
+	TLSKeyFile     = ""
+	TLSCACertFile  = ""
+	TLSAuthClients = "yes" // yes, optional or no
+	TLSClientsUser = "off" // off, or CN to log clients in as the ACL user named by their certificate
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a new connection, so that
+// a client that connects and never completes it doesn't hold on to it.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// newTLSConfig builds the server TLS configuration, including client
+// certificate verification when TLSAuthClients asks for it.
+func newTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch TLSAuthClients {
+	case "yes":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		config.ClientAuth = tls.NoClientCert
+		return config, nil
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients value %q", TLSAuthClients)
+	}
+
+	if TLSCACertFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to verify client certificates")
+	}
+	pem, err := os.ReadFile(TLSCACertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", TLSCACertFile)
+	}
+	config.ClientCAs = pool
+
+	return config, nil
+}
+
+// listenTLS starts a TLS listener on TLSPort for every bind address.
+func listenTLS() ([]net.Listener, error) {
+	config, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return listenAll(TLSPort, func(addr string) (net.Listener, error) {
+		return tls.Listen("tcp", addr, config)
+	})
+}
+
+// authenticateTLSClient completes the handshake of a TLS connection and, when
+// TLSClientsUser is "CN", logs the client in as the ACL user whose name matches
+// the common name of its verified certificate.
+func authenticateTLSClient(c *Client) error {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	configMu.RLock()
+	mapUsers := TLSClientsUser == "CN"
+	configMu.RUnlock()
+
+	if !mapUsers {
+		return nil
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	if u, ok := Users[name]; ok && u.enabled {
+		c.metaMu.Lock()
+		c.user = u
+		c.metaMu.Unlock()
+	}
+
+	return nil
+}
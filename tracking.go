@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Invalidation table for client-side caching. In default mode the server
+// remembers which clients read which keys and notifies them once when a key
+// changes; in broadcast mode clients subscribe to key prefixes instead and are
+// notified about every change under them.
+var trackedKeys = map[string]map[int64]*Client{}
+var trackingPrefixes = map[string]map[int64]*Client{}
+var trackingMu = sync.Mutex{}
+
+// handleClientTracking handles "CLIENT TRACKING ON|OFF [BCAST] [PREFIX prefix ...] [NOLOOP]".
+func handleClientTracking(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|tracking' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "OFF":
+		disableTracking(c)
+		return Value{typ: "string", str: "OK"}
+	case "ON":
+	default:
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	if c.proto < 3 {
+		return Value{typ: "error", str: "ERR client tracking requires RESP3, switch protocols with HELLO 3"}
+	}
+
+	bcast, noloop := false, false
+	prefixes := []string{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "BCAST":
+			bcast = true
+		case "NOLOOP":
+			noloop = true
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			i++
+			prefixes = append(prefixes, args[i].bulk)
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	if len(prefixes) > 0 && !bcast {
+		return Value{typ: "error", str: "ERR PREFIX option requires BCAST mode to be enabled"}
+	}
+	if bcast && len(prefixes) == 0 {
+		// An empty prefix matches every key.
+		prefixes = append(prefixes, "")
+	}
+
+	disableTracking(c)
+
+	trackingMu.Lock()
+	c.tracking = true
+	c.bcast = bcast
+	c.noloop = noloop
+	c.prefixes = prefixes
+	for _, prefix := range prefixes {
+		if _, ok := trackingPrefixes[prefix]; !ok {
+			trackingPrefixes[prefix] = map[int64]*Client{}
+		}
+		trackingPrefixes[prefix][c.id] = c
+	}
+	trackingMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// disableTracking turns tracking off for a client, forgetting the keys it
+// read in default mode.
+func disableTracking(c *Client) {
+	trackingMu.Lock()
+	defer trackingMu.Unlock()
+
+	for _, prefix := range c.prefixes {
+		delete(trackingPrefixes[prefix], c.id)
+		if len(trackingPrefixes[prefix]) == 0 {
+			delete(trackingPrefixes, prefix)
+		}
+	}
+	for key := range c.tracked {
+		delete(trackedKeys[key], c.id)
+		if len(trackedKeys[key]) == 0 {
+			delete(trackedKeys, key)
+		}
+	}
+	c.tracked = nil
+	c.tracking = false
+	c.bcast = false
+	c.noloop = false
+	c.prefixes = nil
+}
+
+// trackKeys remembers that a client in default tracking mode has read the given keys.
+func trackKeys(c *Client, keys []string) {
+	trackingMu.Lock()
+	defer trackingMu.Unlock()
+
+	if !c.tracking || c.bcast {
+		return
+	}
+
+	if c.tracked == nil {
+		c.tracked = map[string]struct{}{}
+	}
+	for _, key := range keys {
+		if _, ok := trackedKeys[key]; !ok {
+			trackedKeys[key] = map[int64]*Client{}
+		}
+		trackedKeys[key][c.id] = c
+		c.tracked[key] = struct{}{}
+	}
+}
+
+// invalidateKeys notifies every tracking client interested in the given keys
+// that they changed. The writer is skipped if it asked for NOLOOP.
+func invalidateKeys(keys []string, writer *Client) {
+	pending := map[*Client][]string{}
+
+	trackingMu.Lock()
+	for _, key := range keys {
+		for _, c := range trackedKeys[key] {
+			delete(c.tracked, key)
+			pending[c] = append(pending[c], key)
+		}
+		delete(trackedKeys, key)
+
+		for prefix, clients := range trackingPrefixes {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for _, c := range clients {
+				pending[c] = append(pending[c], key)
+			}
+		}
+	}
+	if writer != nil && writer.noloop {
+		delete(pending, writer)
+	}
+	trackingMu.Unlock()
+
+	for c, keys := range pending {
+		values := make([]Value, 0, len(keys))
+		for _, key := range keys {
+			values = append(values, Value{typ: "bulk", bulk: key})
+		}
+		c.Push(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: "invalidate"},
+			{typ: "array", array: values},
+		}})
+	}
+}
+
+// invalidateAll tells every tracking client to drop its whole cache, which is
+// signalled by an invalidation message with a null key list.
+func invalidateAll(writer *Client) {
+	pending := map[*Client]bool{}
+
+	trackingMu.Lock()
+	for _, clients := range trackedKeys {
+		for _, c := range clients {
+			c.tracked = nil
+			pending[c] = true
+		}
+	}
+	trackedKeys = map[string]map[int64]*Client{}
+
+	for _, clients := range trackingPrefixes {
+		for _, c := range clients {
+			pending[c] = true
+		}
+	}
+	if writer != nil && writer.noloop {
+		delete(pending, writer)
+	}
+	trackingMu.Unlock()
+
+	for c := range pending {
+		c.Push(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: "invalidate"},
+			{typ: "null"},
+		}})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import "sync"
+
+// watchedKey is a key of one database watched with WATCH.
+type watchedKey struct {
+	db  int
+	key string
+}
+
+// watchers maps each watched key to the clients watching it by id.
+var watchers = map[watchedKey]map[int64]*Client{}
+
+// watchMu guards watchers and the watch state recorded on clients.
+var watchMu = sync.Mutex{}
+
+// touchWatchedKeys marks the transactions of the clients watching any of the
+// keys of database db as failed, because the keys were modified.
+func touchWatchedKeys(db int, keys []string) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for _, key := range keys {
+		for _, c := range watchers[watchedKey{db, key}] {
+			c.watchDirty = true
+		}
+	}
+}
+
+// touchAllWatchedKeys fails every transaction watching keys, for writes
+// such as FLUSHALL that don't name the keys they affect.
+func touchAllWatchedKeys() {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for _, clients := range watchers {
+		for _, c := range clients {
+			c.watchDirty = true
+		}
+	}
+}
+
+// unwatchAll stops watching every key the client watches.
+func unwatchAll(c *Client) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for w := range c.watched {
+		delete(watchers[w], c.id)
+		if len(watchers[w]) == 0 {
+			delete(watchers, w)
+		}
+	}
+	c.watched = nil
+	c.watchDirty = false
+}
+
+// watchFailed reports whether a key watched by the client was modified. Keys
+// that expired meanwhile count as modified, so they are expired first.
+// executionMu must be held for writing.
+func watchFailed(c *Client) bool {
+	watchMu.Lock()
+	keys := make([]watchedKey, 0, len(c.watched))
+	for w := range c.watched {
+		keys = append(keys, w)
+	}
+	watchMu.Unlock()
+
+	for _, w := range keys {
+		expireKeys(Databases[w.db], []string{w.key})
+	}
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	return c.watchDirty
+}
+
+// handleWatch handles "WATCH key [key ...]". EXEC aborts with a null reply if
+// any of the keys is modified before it runs.
+func handleWatch(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'watch' command"}
+	}
+	if c.multi {
+		return Value{typ: "error", str: "ERR WATCH inside MULTI is not allowed"}
+	}
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	if c.watched == nil {
+		c.watched = map[watchedKey]bool{}
+	}
+	for _, arg := range args {
+		w := watchedKey{c.db, arg.bulk}
+		if c.watched[w] {
+			continue
+		}
+		c.watched[w] = true
+		if watchers[w] == nil {
+			watchers[w] = map[int64]*Client{}
+		}
+		watchers[w][c.id] = c
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// handleUnwatch handles the "UNWATCH" command.
+func handleUnwatch(c *Client, args []Value) Value {
+	unwatchAll(c)
+	return Value{typ: "string", str: "OK"}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Webhook settings. Key changes are POSTed to WebhookURL as JSON arrays of
+// events; an empty URL disables webhooks.
+var (
+	WebhookURL        = ""
+	WebhookEvents     = "set del expire"
+	WebhookKeyPattern = "*"
+	// WebhookBatchSize is the most events sent in one request.
+	WebhookBatchSize = 100
+	// WebhookFlushInterval is how many milliseconds an event may wait for
+	// its batch to fill before the batch is sent anyway.
+	WebhookFlushInterval = 1000
+	// WebhookMaxRetries is how many times a failed request is retried
+	// before its events are given up on.
+	WebhookMaxRetries = 3
+)
+
+const (
+	// webhookQueueLimit bounds the events waiting to be sent. Events beyond
+	// it are dropped, so a slow or unreachable endpoint can't grow memory
+	// without bound.
+	webhookQueueLimit = 10000
+	// webhookRetryDelay is the wait before the first retry, doubled on each
+	// following one.
+	webhookRetryDelay = 500 * time.Millisecond
+	webhookTimeout    = 5 * time.Second
+)
+
+// webhookEventTypes are the event types webhooks can report: "set" when a
+// command creates or modifies a key, "del" when a command deletes it and
+// "expire" when its TTL passes.
+var webhookEventTypes = []string{"set", "del", "expire"}
+
+// webhookEvent is one key change, as encoded in webhook requests.
+type webhookEvent struct {
+	Event string `json:"event"`
+	DB    int    `json:"db"`
+	Key   string `json:"key"`
+	// Timestamp is when the change happened, in Unix milliseconds.
+	Timestamp int64 `json:"timestamp"`
+}
+
+var webhookQueue = make(chan webhookEvent, webhookQueueLimit)
+
+// webhooksStarted is set once the AOF has been replayed, so restoring the
+// dataset doesn't report every persisted write again.
+var webhooksStarted int32
+
+// Webhook counters, updated atomically: events delivered, events given up on
+// after their retries and events dropped because the queue was full.
+var (
+	webhookSent    int64
+	webhookFailed  int64
+	webhookDropped int64
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// setWebhookURL changes the webhook endpoint. Only http and https URLs are accepted.
+func setWebhookURL(value string) error {
+	if value != "" {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("argument must be an http or https URL")
+		}
+	}
+	WebhookURL = value
+	return nil
+}
+
+// setWebhookEvents changes the event types reported to the webhook, given as
+// a space or comma separated list.
+func setWebhookEvents(value string) error {
+	types := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool { return r == ' ' || r == ',' })
+	for _, t := range types {
+		known := false
+		for _, eventType := range webhookEventTypes {
+			known = known || t == eventType
+		}
+		if !known {
+			return fmt.Errorf("unknown event type '%s', must be one of: %s", t, strings.Join(webhookEventTypes, ", "))
+		}
+	}
+	WebhookEvents = strings.Join(types, " ")
+	return nil
+}
+
+// startWebhooks starts delivering key change events.
+func startWebhooks() {
+	atomic.StoreInt32(&webhooksStarted, 1)
+	go runWebhooks()
+}
+
+// notifyKeyEvent queues an event for each of the keys that the configured
+// event types and key pattern select. It never blocks: when the queue is
+// full the events are dropped and counted.
+func notifyKeyEvent(db *Database, event string, keys ...string) {
+	if atomic.LoadInt32(&webhooksStarted) == 0 || len(keys) == 0 {
+		return
+	}
+
+	configMu.RLock()
+	enabled := WebhookURL != "" && strings.Contains(" "+WebhookEvents+" ", " "+event+" ")
+	pattern := WebhookKeyPattern
+	configMu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	now := nowMillis()
+	for _, key := range keys {
+		if !matchGlob(pattern, key) {
+			continue
+		}
+		select {
+		case webhookQueue <- webhookEvent{Event: event, DB: db.id, Key: key, Timestamp: now}:
+		default:
+			atomic.AddInt64(&webhookDropped, 1)
+		}
+	}
+}
+
+// runWebhooks collects queued events into batches and sends them. A batch
+// is sent when it reaches the batch size or when its oldest event has waited
+// for the flush interval.
+func runWebhooks() {
+	batch := []webhookEvent{}
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case event := <-webhookQueue:
+			configMu.RLock()
+			size, interval := WebhookBatchSize, WebhookFlushInterval
+			configMu.RUnlock()
+
+			if len(batch) == 0 {
+				flush = time.After(time.Duration(interval) * time.Millisecond)
+			}
+			batch = append(batch, event)
+			if len(batch) < size {
+				continue
+			}
+		case <-flush:
+		}
+
+		sendWebhookBatch(batch)
+		batch = []webhookEvent{}
+		flush = nil
+	}
+}
+
+// sendWebhookBatch POSTs the events to the webhook, retrying with
+// exponential backoff when the request fails or isn't answered with a 2xx
+// status.
+func sendWebhookBatch(batch []webhookEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Println("Error encoding webhook events:", err)
+		atomic.AddInt64(&webhookFailed, int64(len(batch)))
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		configMu.RLock()
+		target, retries := WebhookURL, WebhookMaxRetries
+		configMu.RUnlock()
+
+		// The webhook was disabled while the batch waited.
+		if target == "" {
+			atomic.AddInt64(&webhookDropped, int64(len(batch)))
+			return
+		}
+
+		err := postWebhook(target, body)
+		if err == nil {
+			atomic.AddInt64(&webhookSent, int64(len(batch)))
+			return
+		}
+		if attempt >= retries {
+			fmt.Println("Error sending webhook, giving up on", len(batch), "events:", err)
+			atomic.AddInt64(&webhookFailed, int64(len(batch)))
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postWebhook sends one request to the webhook.
+func postWebhook(target string, body []byte) error {
+	resp, err := webhookClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// infoWebhooks reports webhook delivery counters for the stats section of INFO.
+func infoWebhooks() []string {
+	return []string{
+		fmt.Sprintf("webhook_events_sent:%d", atomic.LoadInt64(&webhookSent)),
+		fmt.Sprintf("webhook_events_failed:%d", atomic.LoadInt64(&webhookFailed)),
+		fmt.Sprintf("webhook_events_dropped:%d", atomic.LoadInt64(&webhookDropped)),
+	}
+}
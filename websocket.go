@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketPort is the port of the WebSocket pub/sub bridge, disabled when empty.
+var WebSocketPort = ""
+
+// WebSocketAllowedOrigins is a space-separated list of glob patterns that
+// the Origin header of browser clients must match. It is empty by default,
+// refusing every browser: any page the user visits could otherwise reach a
+// local server, which protected mode can't tell from a local client.
+var WebSocketAllowedOrigins = ""
+
+const (
+	// webSocketPath is the URL path clients upgrade on.
+	webSocketPath = "/pubsub"
+	// webSocketMaxMessage bounds the size of a message sent by a client.
+	webSocketMaxMessage = 1024 * 1024
+	// webSocketGUID is appended to the client's key to compute the handshake
+	// accept value, as required by RFC 6455.
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocket frame opcodes.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// webSocketRequest is a JSON message sent by a WebSocket client, e.g.
+// {"action": "subscribe", "channels": ["news"]} or
+// {"action": "publish", "channel": "news", "message": "hello"}.
+type webSocketRequest struct {
+	Action   string   `json:"action"`
+	Channels []string `json:"channels"`
+	Patterns []string `json:"patterns"`
+	Channel  string   `json:"channel"`
+	Message  string   `json:"message"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// webSocketCommand translates a client message into the command it stands
+// for. Only the pub/sub commands, AUTH and PING are reachable this way.
+func webSocketCommand(req webSocketRequest) ([]string, error) {
+	switch strings.ToLower(req.Action) {
+	case "subscribe", "unsubscribe":
+		return append([]string{req.Action}, req.Channels...), nil
+	case "psubscribe", "punsubscribe":
+		return append([]string{req.Action}, req.Patterns...), nil
+	case "publish":
+		return []string{"publish", req.Channel, req.Message}, nil
+	case "auth":
+		if req.Username == "" {
+			return []string{"auth", req.Password}, nil
+		}
+		return []string{"auth", req.Username, req.Password}, nil
+	case "ping":
+		return []string{"ping"}, nil
+	default:
+		return nil, fmt.Errorf("unknown action '%s'", req.Action)
+	}
+}
+
+// wsConn adapts a WebSocket connection to the RESP pipeline: reads return
+// the commands that incoming JSON messages translate to, RESP encoded, and
+// writes carry frames already encoded by marshalWebSocket.
+type wsConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	pending []byte
+
+	closeOnce sync.Once
+}
+
+// Read returns the next translated commands, reading messages as needed.
+// Messages that don't translate are answered with an error right away.
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		message, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		var req webSocketRequest
+		var command []string
+		if err = json.Unmarshal(message, &req); err == nil {
+			command, err = webSocketCommand(req)
+		}
+		if err != nil {
+			frame, _ := marshalWebSocket(Value{typ: "error", str: "ERR " + err.Error()})
+			if _, err := ws.Write(frame); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		args := make([]Value, 0, len(command))
+		for _, arg := range command {
+			args = append(args, Value{typ: "bulk", bulk: arg})
+		}
+		ws.pending, err = Value{typ: "array", array: args}.Marshal()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// readMessage reads the next text or binary message, reassembling
+// fragments and answering control frames on the way.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	message := []byte{}
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if _, err := ws.Write(webSocketFrame(wsOpPong, payload)); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+
+		message = append(message, payload...)
+		if len(message) > webSocketMaxMessage {
+			return nil, errors.New("websocket message too large")
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads one frame. Client frames must be masked.
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := header[0]&0x80 != 0, header[0]&0x0F
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked websocket frame from client")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > webSocketMaxMessage {
+		return false, 0, nil, errors.New("websocket message too large")
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Write sends whole frames. Frames from different goroutines never interleave.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	return ws.Conn.Write(p)
+}
+
+// Close sends a close frame, when the connection still takes one, and closes it.
+func (ws *wsConn) Close() error {
+	err := net.ErrClosed
+	ws.closeOnce.Do(func() {
+		ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		ws.Write(webSocketFrame(wsOpClose, nil))
+		err = ws.Conn.Close()
+	})
+	return err
+}
+
+// webSocketFrame encodes a single unmasked frame, as sent by servers.
+func webSocketFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+// marshalWebSocket encodes a reply or push as a JSON text frame. Pub/sub
+// messages and confirmations become objects named after their kind, e.g.
+// {"type": "message", "channel": "news", "message": "hello"}; errors become
+// {"type": "error", "error": ...} and other replies {"type": "reply", "value": ...}.
+func marshalWebSocket(v Value) ([]byte, error) {
+	message := map[string]interface{}{"type": "reply", "value": jsonValue(v)}
+
+	if v.typ == "error" {
+		message = map[string]interface{}{"type": "error", "error": v.str}
+	}
+	if v.typ == "push" && len(v.array) > 0 {
+		parts := v.array
+		switch kind := parts[0].bulk; kind {
+		case "message", "smessage":
+			message = map[string]interface{}{"type": kind, "channel": parts[1].bulk, "message": parts[2].bulk}
+		case "pmessage":
+			message = map[string]interface{}{"type": kind, "pattern": parts[1].bulk, "channel": parts[2].bulk, "message": parts[3].bulk}
+		case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe":
+			message = map[string]interface{}{"type": kind, "channel": jsonValue(parts[1]), "count": parts[2].num}
+		}
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return webSocketFrame(wsOpText, payload), nil
+}
+
+// jsonValue converts a reply to the closest JSON value.
+func jsonValue(v Value) interface{} {
+	switch v.typ {
+	case "string", "error":
+		return v.str
+	case "bulk":
+		return v.bulk
+	case "integer":
+		return v.num
+	case "double":
+		return v.double
+	case "array", "push", "map":
+		values := make([]interface{}, 0, len(v.array))
+		for _, item := range v.array {
+			values = append(values, jsonValue(item))
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// webSocketListener accepts WebSocket connections, upgraded from HTTP
+// requests on webSocketPath, so that they can be served like any other.
+type webSocketListener struct {
+	net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// listenWebSocket opens the WebSocket bridge on every bind address.
+func listenWebSocket() ([]net.Listener, error) {
+	return listenAll(WebSocketPort, func(addr string) (net.Listener, error) {
+		tcp, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		l := &webSocketListener{Listener: tcp, conns: make(chan net.Conn), done: make(chan struct{})}
+		mux := http.NewServeMux()
+		mux.HandleFunc(webSocketPath, l.upgrade)
+		go http.Serve(tcp, mux)
+
+		return l, nil
+	})
+}
+
+// Accept waits for the next upgraded connection.
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+func (l *webSocketListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// upgrade completes the WebSocket handshake of a request and hands the
+// connection to Accept.
+func (l *webSocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade request", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !webSocketOriginAllowed(r.Header.Get("Origin")) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		fmt.Println("Error upgrading WebSocket connection:", err)
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws := &wsConn{Conn: conn, reader: rw.Reader}
+	select {
+	case l.conns <- ws:
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+// webSocketOriginAllowed reports whether a browser from origin may connect.
+// Non-browser clients, which send no Origin, aren't restricted.
+func webSocketOriginAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	for _, pattern := range strings.Fields(WebSocketAllowedOrigins) {
+		if matchGlob(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}